@@ -0,0 +1,116 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// appendLocks serializes appending to files, one *sync.Mutex per path.
+var appendLocks sync.Map
+
+// isAppending is true if uploads to existing files are appended to them.
+func (h *Handler) isAppending() bool {
+	return h.AppendToExisting && h.localDirectory != "" && !h.isEncrypting() && !h.Quarantine && len(h.Transformers) == 0
+}
+
+// receiveForAppending receives the body into a temporary file next to the one it's for,
+// which commit then appends to that. Hence aborted uploads leave nothing behind.
+func (h *Handler) receiveForAppending(ctx context.Context, key string, expectBytes, writeQuota int64,
+	r io.Reader, verdict func() (int, error)) (int64, func() (int, error), int, error) {
+	target := filepath.Join(h.localDirectory, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return 0, nil, http.StatusConflict, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(target), ".append-*")
+	if err != nil {
+		return 0, nil, http.StatusInternalServerError, err
+	}
+	discard := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	if writeQuota > 0 {
+		r = io.LimitReader(r, writeQuota+1)
+	}
+	buf := getCopyBuffer(h.copyBufferSize())
+	defer putCopyBuffer(buf)
+	bytesWritten, err := io.CopyBuffer(tmp, r, *buf)
+	if err != nil && err != io.EOF {
+		discard()
+		if isOutOfSpace(err) {
+			return bytesWritten, nil, http.StatusInsufficientStorage, errInsufficientStorage
+		}
+		return bytesWritten, nil, http.StatusInternalServerError, err
+	}
+	if writeQuota > 0 && bytesWritten > writeQuota {
+		discard()
+		return bytesWritten, nil, http.StatusRequestEntityTooLarge, nil
+	}
+	if expectBytes > 0 && bytesWritten != expectBytes {
+		discard()
+		return bytesWritten, nil, http.StatusUnprocessableEntity, errSizeMismatch
+	}
+	if h.isTooSmall(bytesWritten) {
+		discard()
+		return bytesWritten, nil, http.StatusUnprocessableEntity, errFileTooSmall
+	}
+	if retval, err := verdict(); err != nil {
+		discard()
+		return bytesWritten, nil, retval, err
+	}
+
+	commit := func() (int, error) {
+		defer discard()
+		retval, err := h.appendTo(target, tmp, bytesWritten)
+		if err == nil {
+			h.updateChecksums(ctx, key)
+		}
+		return retval, err
+	}
+	return bytesWritten, commit, http.StatusCreated, nil
+}
+
+// appendTo appends what's been received to the file, up to MaxFilesize in total.
+// Returns 201 if the file has been created thereby, else 204.
+func (h *Handler) appendTo(target string, received *os.File, size int64) (int, error) {
+	mu, _ := appendLocks.LoadOrStore(target, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return http.StatusConflict, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if h.MaxFilesize > 0 && fi.Size()+size > h.MaxFilesize {
+		return http.StatusRequestEntityTooLarge, errFileTooLarge
+	}
+
+	if _, err = received.Seek(0, io.SeekStart); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if _, err = io.Copy(f, received); err != nil {
+		f.Truncate(fi.Size()) // Nothing of a failed append is to remain.
+		if isOutOfSpace(err) {
+			return http.StatusInsufficientStorage, errInsufficientStorage
+		}
+		return http.StatusInternalServerError, err
+	}
+	if fi.Size() == 0 {
+		return http.StatusCreated, nil
+	}
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,58 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAppendToExisting(t *testing.T) {
+	Convey("With AppendToExisting uploads", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.AppendToExisting = true
+		h.MaxFilesize = 16
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		put := func(body string) int {
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("create files that don't exist yet", func() {
+			So(put("REMOVE"), ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("REMOVE"))
+		})
+
+		Convey("are appended to existing files", func() {
+			So(put("REMOVE"), ShouldEqual, 201)
+			So(put("DELME"), ShouldEqual, 204)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("REMOVEDELME"))
+		})
+
+		Convey("don't grow files beyond MaxFilesize", func() {
+			So(put("REMOVEME"), ShouldEqual, 201)
+			So(put("REMOVEME"), ShouldEqual, 204)
+			So(put("X"), ShouldEqual, 413)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("REMOVEMEREMOVEME"))
+		})
+
+		Convey("leave no temporary files behind", func() {
+			So(put("REMOVE"), ShouldEqual, 201)
+			So(put(strings.Repeat("x", 17)), ShouldEqual, 413)
+			entries, _ := ioutil.ReadDir(scratchDir)
+			for _, fi := range entries {
+				So(fi.Name(), ShouldNotStartWith, ".append-")
+			}
+		})
+	})
+}
@@ -0,0 +1,113 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// asyncStatusPath is where, below Scope, the outcome of persisting in the background can be polled.
+const asyncStatusPath = "/.upload-status/"
+
+// asyncJobsRetention is how long outcomes are kept after persisting has finished.
+const asyncJobsRetention = 15 * time.Minute
+
+// asyncJob is one file being persisted in the background.
+type asyncJob struct {
+	key      string
+	done     bool
+	finished time.Time
+	retval   int
+	err      error
+}
+
+// asyncJobs is a registry of asyncJob, by their randomized ID.
+type asyncJobs struct {
+	sync.Mutex
+	m map[string]*asyncJob
+}
+
+var persistJobs = asyncJobs{m: make(map[string]*asyncJob)}
+
+// add registers a new job by its ID. Expired ones are removed on the occasion.
+func (j *asyncJobs) add(id, key string) {
+	j.Lock()
+	defer j.Unlock()
+	for oldID, job := range j.m {
+		if job.done && time.Since(job.finished) > asyncJobsRetention {
+			delete(j.m, oldID)
+		}
+	}
+	j.m[id] = &asyncJob{key: key}
+}
+
+func (j *asyncJobs) finish(id string, retval int, err error) {
+	j.Lock()
+	defer j.Unlock()
+	if job, ok := j.m[id]; ok {
+		job.done, job.finished = true, time.Now()
+		job.retval, job.err = retval, err
+	}
+}
+
+// get returns a copy of the job, if there is any by that ID.
+func (j *asyncJobs) get(id string) (asyncJob, bool) {
+	j.Lock()
+	defer j.Unlock()
+	job, ok := j.m[id]
+	if !ok {
+		return asyncJob{}, false
+	}
+	return *job, true
+}
+
+// statusURL is the path (for Location) at which the outcome of the job can be polled.
+func (h *Handler) statusURL(id string) string {
+	return strings.TrimSuffix(h.Scope, "/") + asyncStatusPath + id
+}
+
+// persistInBackground calls commit in a goroutine, and responds with 202
+// and a Location at which the outcome can be polled by the job's id.
+func (h *Handler) persistInBackground(w http.ResponseWriter, r *http.Request, id, key string,
+	commit func() (int, error)) (int, error) {
+	persistJobs.add(id, key)
+	go func() {
+		retval, err := commit()
+		persistJobs.finish(id, retval, err)
+	}()
+
+	w.Header().Set("Location", h.publicURL(r, h.statusURL(id)))
+	return http.StatusAccepted, nil
+}
+
+// serveAsyncStatus answers polls for the outcome of persisting in the background:
+// 202 while still in progress, 201 with the file's Location once it is done,
+// or the error that has occurred.
+func (h *Handler) serveAsyncStatus(w http.ResponseWriter, r *http.Request) (int, error) {
+	id := r.URL.Path[len(h.statusURL("")):]
+	job, ok := persistJobs.get(id)
+	switch {
+	case !ok || !h.isTenantsKey(job.key):
+		return http.StatusNotFound, nil
+	case !job.done:
+		w.Header().Set("Retry-After", "1")
+		return http.StatusAccepted, nil
+	case job.err != nil:
+		return job.retval, job.err
+	}
+	h.addLocation(w, r, job.key)
+	return job.retval, nil
+}
+
+// isAsyncStatusRequest is true for polls of persisting in the background.
+func (h *Handler) isAsyncStatusRequest(r *http.Request) bool {
+	if !h.AsyncPersist || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	prefix := h.statusURL("")
+	return strings.HasPrefix(r.URL.Path, prefix) && len(r.URL.Path) > len(prefix)
+}
@@ -0,0 +1,92 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"sync"
+
+	"gocloud.dev/blob"
+)
+
+// defaultCopyBufferSize applies if Handler.CopyBufferSize is not set.
+const defaultCopyBufferSize = 1 << 20
+
+// defaultWriterBufferSize is the smallest chunk size of Bucket drivers, that of S3.
+const defaultWriterBufferSize = 5 << 20
+
+// copyBufferPools holds one *sync.Pool per buffer size in use.
+var copyBufferPools sync.Map
+
+// getCopyBuffer returns a buffer of the given size,
+// which is to be returned by putCopyBuffer after use.
+func getCopyBuffer(size int) *[]byte {
+	pool, ok := copyBufferPools.Load(size)
+	if !ok {
+		pool, _ = copyBufferPools.LoadOrStore(size, &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		})
+	}
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+func putCopyBuffer(buf *[]byte) {
+	if pool, ok := copyBufferPools.Load(len(*buf)); ok {
+		pool.(*sync.Pool).Put(buf)
+	}
+}
+
+// copyBufferSize returns the size of buffers used in copying request bodies.
+func (h *Handler) copyBufferSize() int {
+	if h.CopyBufferSize <= 0 {
+		return defaultCopyBufferSize
+	}
+	return h.CopyBufferSize
+}
+
+// maxWriterParts is how many parts a Bucket can upload one file in, at most.
+// That's the limit of S3 multipart uploads.
+const maxWriterParts = 10000
+
+// writerOptions returns what is passed to the Bucket for writing uploads.
+//
+// sizeHint is the expected size of the file, or 0 if unknown. For large files it raises the
+// size of the chunks they're uploaded in, which else could exceed maxWriterParts.
+func (h *Handler) writerOptions(metadata map[string]string, sizeHint int64) *blob.WriterOptions {
+	bufferSize := h.WriterBufferSize
+	if bufferSize <= 0 && sizeHint > maxWriterParts*defaultWriterBufferSize {
+		bufferSize = defaultWriterBufferSize
+	}
+	if bufferSize > 0 && sizeHint/int64(bufferSize) >= maxWriterParts-100 {
+		// Leaves room for what gets added, such as by encryption.
+		bufferSize = int(sizeHint/(maxWriterParts-100)) + 1
+	}
+	if bufferSize <= 0 && len(metadata) == 0 {
+		return nil
+	}
+	opts := &blob.WriterOptions{
+		BufferSize:      bufferSize,
+		ContentType:     metadata[metadataContentType],
+		ContentLanguage: metadata[metadataContentLanguage],
+		Metadata:        metadata,
+	}
+	class := metadata[metadataStorageClass]
+	tags := tagsOf(metadata)
+	if (class != "" && h.SetStorageClass != nil) || (len(tags) > 0 && h.SetTags != nil) {
+		opts.BeforeWrite = func(asFunc func(interface{}) bool) error {
+			if class != "" && h.SetStorageClass != nil {
+				if err := h.SetStorageClass(asFunc, class); err != nil {
+					return err
+				}
+			}
+			if len(tags) > 0 && h.SetTags != nil {
+				return h.SetTags(asFunc, tags)
+			}
+			return nil
+		}
+	}
+	return opts
+}
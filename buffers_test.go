@@ -0,0 +1,53 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCopyBuffers(t *testing.T) {
+	Convey("Buffers for copying", t, func() {
+		Convey("default to 1 MiB", func() {
+			h := Handler{}
+			buf := getCopyBuffer(h.copyBufferSize())
+			So(len(*buf), ShouldEqual, 1<<20)
+			putCopyBuffer(buf)
+		})
+
+		Convey("have the configured size", func() {
+			h := Handler{CopyBufferSize: 4096}
+			buf := getCopyBuffer(h.copyBufferSize())
+			So(len(*buf), ShouldEqual, 4096)
+			putCopyBuffer(buf)
+
+			other := getCopyBuffer(8192)
+			So(len(*other), ShouldEqual, 8192)
+			putCopyBuffer(other)
+		})
+	})
+
+	Convey("Writers for buckets", t, func() {
+		Convey("use the driver's default chunk size unless configured", func() {
+			h := Handler{}
+			So(h.writerOptions(nil, 0), ShouldBeNil)
+			So(h.writerOptions(nil, 1<<30), ShouldBeNil)
+
+			h.WriterBufferSize = 5 << 20
+			So(h.writerOptions(nil, 0).BufferSize, ShouldEqual, 5<<20)
+		})
+
+		Convey("use larger chunks for files that else would need too many", func() {
+			h := Handler{}
+			size := int64(maxWriterParts) * 8 << 20
+			So(h.writerOptions(nil, size).BufferSize*maxWriterParts, ShouldBeGreaterThanOrEqualTo, size)
+
+			h.WriterBufferSize = 5 << 20
+			So(h.writerOptions(nil, size).BufferSize*maxWriterParts, ShouldBeGreaterThanOrEqualTo, size)
+			So(h.writerOptions(nil, 1<<30).BufferSize, ShouldEqual, 5<<20)
+		})
+	})
+}
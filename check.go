@@ -0,0 +1,55 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// filenameCheckPath is where, below Scope, names of files can be checked before uploading them.
+const filenameCheckPath = "/.upload-check/"
+
+// CheckFilename returns why a file could not be uploaded by that name, a path below Scope
+// such as "reports/2021.pdf", or nil if it could. All rules for names apply, such as
+// RestrictFilenamesTo, UnicodeForm, FilenameProfile, and ReadOnlyPaths.
+// Errors for violated rules are ErrInvalidFileName, and wrap a *filename.Error with the rule.
+func (h *Handler) CheckFilename(name string) error {
+	_, err := h.checkedKey(path.Join(h.Scope, name))
+	return err
+}
+
+// checkedKey is translateToKey that also rejects keys that are read-only.
+func (h *Handler) checkedKey(urlPath string) (string, error) {
+	key, err := h.translateToKey(urlPath)
+	if err != nil {
+		return "", err
+	}
+	if h.isReadOnly(key) {
+		return "", errReadOnly
+	}
+	return key, nil
+}
+
+// isFilenameCheckRequest is true for GET or HEAD below filenameCheckPath.
+func (h *Handler) isFilenameCheckRequest(r *http.Request) bool {
+	if !h.EnableFilenameCheck || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	prefix := strings.TrimSuffix(h.Scope, "/") + filenameCheckPath
+	return strings.HasPrefix(r.URL.Path, prefix) && len(r.URL.Path) > len(prefix)
+}
+
+// serveFilenameCheck answers with 204 (No Content) and header "Upload-Key" if the name is acceptable,
+// else with 422 and why not. Any randomized suffix is not part of the key.
+func (h *Handler) serveFilenameCheck(w http.ResponseWriter, r *http.Request) (int, error) {
+	name := r.URL.Path[len(strings.TrimSuffix(h.Scope, "/")+filenameCheckPath):]
+	key, err := h.checkedKey(path.Join(h.Scope, name))
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	w.Header().Set("Upload-Key", key)
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,57 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"blitznote.com/src/http.upload/v5/filename"
+)
+
+func TestFilenameCheck(t *testing.T) {
+	Convey("Names of files", t, func() {
+		h, _ := NewHandler("/uploads", scratchDir, next)
+		h.EnableFilenameCheck = true
+
+		Convey("can be checked by CheckFilename", func() {
+			So(h.CheckFilename("reports/2021.pdf"), ShouldBeNil)
+
+			err := h.CheckFilename("reports/CON.pdf")
+			So(errors.Cause(err), ShouldEqual, errInvalidFileName)
+			So(err.Error(), ShouldContainSubstring, string(filename.RuleReservedOnWindows))
+
+			So(h.CheckFilename("../etc/passwd"), ShouldNotBeNil)
+		})
+
+		Convey("can be checked by GET", func() {
+			check := func(name string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", "/uploads/.upload-check/"+name, nil)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				return w
+			}
+
+			w := check("reports/2021.pdf")
+			So(w.Code, ShouldEqual, 204)
+			So(w.Header().Get("Upload-Key"), ShouldEqual, "reports/2021.pdf")
+
+			h.FilenameProfile = filename.PosixPortable
+			w = check("reports/caf%C3%A9.pdf")
+			So(w.Code, ShouldEqual, 422)
+			So(w.Body.String(), ShouldContainSubstring, string(filename.RuleAlphabet))
+		})
+
+		Convey("cannot be checked by GET if not enabled", func() {
+			h.EnableFilenameCheck = false
+			req := httptest.NewRequest("GET", "/uploads/.upload-check/a", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 418)
+		})
+	})
+}
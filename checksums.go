@@ -0,0 +1,165 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// checksumsLocks serializes updates to checksums files if there's no Locker, one *sync.Mutex per Bucket and key.
+var checksumsLocks sync.Map
+
+// checksumsName is that of the file in every directory listing the digests of the files in it,
+// as written by "sha256sum" and read by "sha256sum -c".
+const checksumsName = "SHA256SUMS"
+
+// isChecksumsFile is true for the files which the Handler maintains, and clients must not change.
+func (h *Handler) isChecksumsFile(key string) bool {
+	return h.MaintainChecksums && path.Base(key) == checksumsName
+}
+
+// updateChecksums brings the entries for the files in the checksums files of their directories up to date,
+// removing those of files that don't exist (anymore). Checksums files without any entries are removed.
+// Errors are ignored, because the files have been changed already.
+func (h *Handler) updateChecksums(ctx context.Context, keys ...string) {
+	if !h.MaintainChecksums {
+		return
+	}
+	byDirectory := make(map[string][]string)
+	for _, key := range keys {
+		if key == "" || strings.HasSuffix(key, "/") || h.isChecksumsFile(key) {
+			continue
+		}
+		dir := path.Dir(key) + "/"
+		if dir == "./" {
+			dir = ""
+		}
+		byDirectory[dir] = append(byDirectory[dir], key)
+	}
+	for dir, keys := range byDirectory {
+		h.updateChecksumsIn(ctx, dir+checksumsName, keys)
+	}
+}
+
+// updateChecksumsIn updates the checksums file at sumsKey with the files in the same directory.
+func (h *Handler) updateChecksumsIn(ctx context.Context, sumsKey string, keys []string) error {
+	// Concurrent updates could lose entries. Across processes only the Locker prevents that.
+	if h.Locker != nil {
+		unlock, _, err := h.Locker.Lock(ctx, sumsKey, true)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	} else {
+		mu, _ := checksumsLocks.LoadOrStore(checksumsLock{h.Bucket, sumsKey}, new(sync.Mutex))
+		mu.(*sync.Mutex).Lock()
+		defer mu.(*sync.Mutex).Unlock()
+	}
+
+	previous, err := h.readAll(ctx, sumsKey)
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return err
+	}
+	digests := parseChecksums(previous)
+
+	for _, key := range keys {
+		name := path.Base(key)
+		if strings.ContainsAny(name, "\n\\") { // Would need escaping, which not all tools understand.
+			continue
+		}
+		digest, err := h.sha256Of(ctx, key)
+		switch {
+		case gcerrors.Code(err) == gcerrors.NotFound:
+			delete(digests, name)
+		case err != nil:
+			return err
+		default:
+			digests[name] = digest
+		}
+	}
+
+	if len(digests) == 0 {
+		if err := h.Bucket.Delete(ctx, sumsKey); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return err
+		}
+		return nil
+	}
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(digests[name] + "  " + name + "\n")
+	}
+	// Readers see either the previous or the new version, because Buckets replace files as a whole.
+	// Like any other file it's encrypted if isEncrypting, hence can be served as such.
+	w, discard, persist, err := h.newStoredSink(ctx, sumsKey,
+		map[string]string{metadataContentType: "text/plain; charset=utf-8"}, int64(buf.Len()))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		discard()
+		return err
+	}
+	return persist()
+}
+
+// checksumsLock identifies a checksums file across Handlers that share a Bucket.
+type checksumsLock struct {
+	bucket *blob.Bucket
+	key    string
+}
+
+// readAll returns the plaintext of a file.
+func (h *Handler) readAll(ctx context.Context, key string) ([]byte, error) {
+	r, err := h.newBlobReader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// parseChecksums returns the digests in a checksums file by the name of their file.
+func parseChecksums(contents []byte) map[string]string {
+	digests := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for s.Scan() {
+		// Such as: <hex>  <name>, or with '*' instead of the second space.
+		if line := s.Text(); len(line) > sha256.Size*2+2 {
+			digests[line[sha256.Size*2+2:]] = line[:sha256.Size*2]
+		}
+	}
+	return digests
+}
+
+// sha256Of returns the SHA-256 digest of the file's plaintext in hex, which is what clients get to see.
+func (h *Handler) sha256Of(ctx context.Context, key string) (string, error) {
+	r, err := h.newBlobReader(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,106 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChecksums(t *testing.T) {
+	Convey("SHA256SUMS", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.EnableWebdav = true
+		h.MaintainChecksums = true
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+
+		serve := func(method, target, destination, body string) int {
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			if destination != "" {
+				req.Header.Set("Destination", destination)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+		sums := func(subdir string) string {
+			b, err := ioutil.ReadFile(filepath.Join(scratchDir, dir, subdir, checksumsName))
+			if os.IsNotExist(err) {
+				return ""
+			}
+			So(err, ShouldBeNil)
+			return string(b)
+		}
+
+		So(serve("PUT", "/"+dir+"/b", "", "DELME"), ShouldEqual, 201)
+		So(serve("PUT", "/"+dir+"/a", "", ""), ShouldEqual, 201)
+
+		Convey("lists the files of its directory, sorted by name", func() {
+			So(sums(""), ShouldEqual,
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  a\n"+
+					"1415a371e26489bf47586bc33e6e4fe6e4511259b9760b601909940ffb02f534  b\n")
+		})
+
+		Convey("gets updated on changes", func() {
+			So(serve("MOVE", "/"+dir+"/b", "/"+dir+"/sub/c", ""), ShouldEqual, 201)
+			So(sums(""), ShouldNotContainSubstring, "  b\n")
+			So(sums("sub"), ShouldEndWith, "  c\n")
+
+			So(serve("DELETE", "/"+dir+"/a", "", ""), ShouldEqual, 204)
+			So(sums(""), ShouldEqual, "")
+		})
+
+		Convey("has the digests of the plaintext, and is encrypted as well", func() {
+			h.EncryptionKey = make([]byte, 32)
+			h.ServeDecrypted = true
+			So(serve("PUT", "/"+dir+"/sub/b", "", "DELME"), ShouldEqual, 201)
+			So(serve("PUT", "/"+dir+"/sub/a", "", ""), ShouldEqual, 201)
+			So(sums("sub"), ShouldNotContainSubstring, "  b\n")
+
+			req := httptest.NewRequest("GET", "/"+dir+"/sub/"+checksumsName, nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 200)
+			So(w.Body.String(), ShouldEqual,
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  a\n"+
+					"1415a371e26489bf47586bc33e6e4fe6e4511259b9760b601909940ffb02f534  b\n")
+		})
+
+		Convey("keeps the entries of concurrent uploads", func() {
+			var names []string
+			for i := 0; i < 64; i++ {
+				names = append(names, fmt.Sprintf("c%02d", i))
+			}
+			var wg sync.WaitGroup
+			for _, name := range names {
+				wg.Add(1)
+				go func(name string) {
+					defer wg.Done()
+					req := httptest.NewRequest("PUT", "/"+dir+"/"+name, strings.NewReader(name))
+					h.ServeHTTP(httptest.NewRecorder(), req)
+				}(name)
+			}
+			wg.Wait()
+
+			listed := sums("")
+			for _, name := range append(names, "a", "b") {
+				So(listed, ShouldContainSubstring, "  "+name+"\n")
+			}
+		})
+
+		Convey("cannot be changed by clients", func() {
+			So(serve("PUT", "/"+dir+"/"+checksumsName, "", "DELME"), ShouldEqual, 403)
+			So(serve("DELETE", "/"+dir+"/"+checksumsName, "", ""), ShouldEqual, 403)
+		})
+	})
+}
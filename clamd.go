@@ -0,0 +1,196 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clamdChunkSize is how much is sent to clamd at once. Its default StreamMaxLength is far larger.
+const clamdChunkSize = 64 << 10
+
+// ClamdScanner is a Scanner that streams uploads to a running clamd, of ClamAV.
+// Connections are kept open in sessions and re-used.
+type ClamdScanner struct {
+	Network string // "unix" or "tcp"
+	Address string // Such as "/run/clamav/clamd.ctl" or "127.0.0.1:3310".
+	// Idle connections to keep. Defaults to 4.
+	MaxIdle int
+	// For establishing the connection and any scan. Defaults to one minute.
+	Timeout time.Duration
+	// Idle connections are not used after this long, as clamd will have closed them.
+	// Defaults to 25 seconds, which is less than clamd's default IdleTimeout.
+	IdleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle []*clamdConn
+}
+
+type clamdConn struct {
+	net.Conn
+	r         *bufio.Reader
+	nextID    int // clamd numbers commands in a session, starting with 1.
+	idleSince time.Time
+}
+
+// ParseClamdScanner returns a ClamdScanner for an address such as "unix:/run/clamav/clamd.ctl"
+// or "tcp:127.0.0.1:3310".
+func ParseClamdScanner(address string) (*ClamdScanner, error) {
+	idx := strings.IndexByte(address, ':')
+	if idx < 1 || (address[:idx] != "unix" && address[:idx] != "tcp") {
+		return nil, errors.New("Address of clamd must start with 'unix:' or 'tcp:'")
+	}
+	return &ClamdScanner{Network: address[:idx], Address: address[idx+1:]}, nil
+}
+
+func (c *ClamdScanner) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return time.Minute
+	}
+	return c.Timeout
+}
+
+func (c *ClamdScanner) idleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return 25 * time.Second
+	}
+	return c.IdleTimeout
+}
+
+// get returns an idle connection that is still open, or a new one.
+func (c *ClamdScanner) get(ctx context.Context) (*clamdConn, error) {
+	for {
+		c.mu.Lock()
+		n := len(c.idle)
+		if n == 0 {
+			c.mu.Unlock()
+			break
+		}
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		if time.Since(conn.idleSince) < c.idleTimeout() && conn.isOpen() {
+			return conn, nil
+		}
+		conn.Close()
+	}
+
+	d := net.Dialer{Timeout: c.timeout()}
+	nc, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(nc, "zIDSESSION\x00"); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &clamdConn{Conn: nc, r: bufio.NewReader(nc), nextID: 1}, nil
+}
+
+// put keeps the connection for re-use, or closes it.
+func (c *ClamdScanner) put(conn *clamdConn) {
+	maxIdle := c.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 4
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdle {
+		conn.Close()
+		return
+	}
+	conn.idleSince = time.Now()
+	c.idle = append(c.idle, conn)
+}
+
+// isOpen is false if clamd has closed the connection, or sent anything unasked.
+func (conn *clamdConn) isOpen() bool {
+	conn.SetReadDeadline(time.Now())
+	_, err := conn.r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Scan implements the Scanner interface.
+func (c *ClamdScanner) Scan(ctx context.Context, r io.Reader) error {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Connecting to clamd failed")
+	}
+	deadline := time.Now().Add(c.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	finding, err := conn.scan(r)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "Scanning with clamd failed")
+	}
+	conn.SetDeadline(time.Time{})
+	c.put(conn)
+	if finding != "" {
+		return &MalwareFoundError{Name: finding}
+	}
+	return nil
+}
+
+// scan sends r with command INSTREAM, and returns the name of any finding.
+func (conn *clamdConn) scan(r io.Reader) (string, error) {
+	id := conn.nextID
+	conn.nextID++
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return "", werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	// Such as: "1: stream: OK", or "1: stream: Eicar-Signature FOUND"
+	reply, err := conn.r.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+	prefix := strconv.Itoa(id) + ": stream: "
+	if !strings.HasPrefix(reply, prefix) {
+		return "", errors.New("Unexpected reply from clamd: " + reply)
+	}
+	reply = reply[len(prefix):]
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", errors.New("clamd: " + reply)
+}
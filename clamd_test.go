@@ -0,0 +1,150 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeClamd answers INSTREAM in sessions, and finds "EICAR" in anything that contains it.
+func fakeClamd(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			if cmd, err := r.ReadString(0); err != nil || cmd != "zIDSESSION\x00" {
+				return
+			}
+			for id := 1; ; id++ {
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					return
+				}
+				var contents bytes.Buffer
+				for {
+					var length [4]byte
+					if _, err := io.ReadFull(r, length[:]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(length[:])
+					if n == 0 {
+						break
+					}
+					io.CopyN(&contents, r, int64(n))
+				}
+				reply := strconv.Itoa(id) + ": stream: OK\x00"
+				if strings.Contains(contents.String(), "EICAR") {
+					reply = strconv.Itoa(id) + ": stream: Eicar-Signature FOUND\x00"
+				}
+				io.WriteString(conn, reply)
+			}
+		}(conn)
+	}
+}
+
+func TestClamdScanning(t *testing.T) {
+	Convey("Scanning with clamd", t, func() {
+		socketDir, err := ioutil.TempDir("", "http-upload-clamd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(socketDir)
+		socket := filepath.Join(socketDir, "clamd.ctl")
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go fakeClamd(l)
+
+		scanner, err := ParseClamdScanner("unix:" + socket)
+		So(err, ShouldBeNil)
+		h, _ := NewHandler("/", scratchDir, next)
+		h.Scanner = scanner
+		var found []string
+		h.OnMalwareFound = func(key string, finding *MalwareFoundError) {
+			found = append(found, finding.Name)
+		}
+
+		put := func(name, contents string) int {
+			req := httptest.NewRequest("PUT", "/"+name, strings.NewReader(contents))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("persists clean files, re-using the connection", func() {
+			for i := 0; i < 3; i++ {
+				tempFName := tempFileName()
+				defer os.Remove(filepath.Join(scratchDir, tempFName))
+				So(put(tempFName, "DELME"), ShouldEqual, 201)
+				compareContents(filepath.Join(scratchDir, tempFName), []byte("DELME"))
+			}
+			So(scanner.idle, ShouldHaveLength, 1)
+		})
+
+		Convey("does not re-use connections that have been idle too long, or closed", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			So(put(tempFName, "DELME"), ShouldEqual, 201)
+			So(scanner.idle, ShouldHaveLength, 1)
+			stale := scanner.idle[0]
+
+			scanner.IdleTimeout = time.Nanosecond
+			So(put(tempFName, "DELME"), ShouldEqual, 201)
+			So(scanner.idle, ShouldHaveLength, 1)
+			So(scanner.idle[0], ShouldNotEqual, stale)
+
+			scanner.IdleTimeout = 0
+			scanner.idle[0].Close() // Reads fail as they would were it closed by clamd.
+			stale = scanner.idle[0]
+			So(put(tempFName, "DELME"), ShouldEqual, 201)
+			So(scanner.idle[0], ShouldNotEqual, stale)
+		})
+
+		Convey("rejects files with malware", func() {
+			tempFName := tempFileName()
+			So(put(tempFName, "DELME EICAR"), ShouldEqual, 422)
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(found, ShouldResemble, []string{"Eicar-Signature"})
+		})
+
+		Convey("rejects files if scanning fails, unless configured to fail open", func() {
+			h.Scanner = &ClamdScanner{Network: "unix", Address: socket + ".missing"}
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			So(put(tempFName, "DELME"), ShouldEqual, 503)
+
+			h.ScanFailOpen = true
+			So(put(tempFName, "DELME"), ShouldEqual, 201)
+		})
+	})
+
+	Convey("Addresses of clamd", t, func() {
+		_, err := ParseClamdScanner("127.0.0.1:3310")
+		So(err, ShouldNotBeNil)
+		s, err := ParseClamdScanner("tcp:127.0.0.1:3310")
+		So(err, ShouldBeNil)
+		So(s.Network, ShouldEqual, "tcp")
+		So(s.Address, ShouldEqual, "127.0.0.1:3310")
+	})
+}
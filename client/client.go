@@ -0,0 +1,340 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package client uploads files to servers that run the upload handler.
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResponseError is returned for any response the server indicated a failure with.
+type ResponseError struct {
+	StatusCode int
+	Message    string
+
+	// From servers that report errors in format "application/problem+json".
+	Code  string // Such as "file_too_large".
+	Limit int64  // In bytes, of the limit that has been exceeded.
+	Part  int    // Of a batch, counting from 1.
+}
+
+// Error implements the error interface.
+func (e *ResponseError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.StatusCode)
+	}
+	return http.StatusText(e.StatusCode) + ": " + e.Message
+}
+
+// Temporary is true for failures that might not happen again if the request were to be retried.
+func (e *ResponseError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Client uploads files to one destination.
+//
+// The zero value is not usable, set at least BaseURL.
+type Client struct {
+	// The URL all names are relative to, such as "https://example.com/web/path".
+	BaseURL string
+
+	// If nil, http.DefaultClient will be used.
+	HTTPClient *http.Client
+
+	// Number of attempts after the first one failed for a temporary reason.
+	Retries int
+	// Waiting time before the first retry, which gets doubled for every next one.
+	RetryDelay time.Duration
+
+	// Where the server manages upload sessions, such as "https://example.com/web/path/.upload-session/".
+	// If set, retries of Put continue from where an aborted attempt has been cut off,
+	// given the server keeps those (with "partial_uploads session"). Else they start over.
+	SessionsURL string
+}
+
+// File is one file to be uploaded in a batch.
+type File struct {
+	// Relative to the Client's BaseURL, and can include sub-directories.
+	Name string
+	Body io.Reader
+}
+
+// New returns a Client for the given destination with sensible defaults.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		Retries:    3,
+		RetryDelay: 500 * time.Millisecond,
+	}
+}
+
+// Put streams one file using HTTP PUT, and returns where it can be downloaded from.
+// The latter is empty if the server does not tell.
+//
+// The file's SHA-256 digest is sent along in header "Digest", for the server to verify it.
+// Therefore the body is read twice, and again for every retry: from its beginning,
+// or with SessionsURL from where an aborted attempt has been cut off.
+func (c *Client) Put(ctx context.Context, name string, body io.ReadSeeker, size int64) (string, error) {
+	digest, err := digestOf(body)
+	if err != nil {
+		return "", err
+	}
+	var (
+		location string
+		attempt  int
+	)
+	err = c.retry(ctx, func() error {
+		var err error
+		if attempt++; attempt > 1 && c.SessionsURL != "" {
+			location, err = c.resume(ctx, name, body, size, digest)
+			if err != errNotResumable {
+				return err
+			}
+		}
+		location, err = c.put(ctx, name, body, size, digest)
+		return err
+	})
+	return location, err
+}
+
+// put is one attempt of Put.
+func (c *Client) put(ctx context.Context, name string, body io.ReadSeeker, size int64, digest string) (string, error) {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.urlFor(name), io.NopCloser(body))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	req.Header.Set("Digest", digest)
+
+	locations, err := c.do(req)
+	if len(locations) > 0 {
+		return locations[0], err
+	}
+	return "", err
+}
+
+// errNotResumable is returned by resume if the server has not kept what an earlier attempt has sent.
+var errNotResumable = errors.New("Nothing to resume")
+
+// resume completes the upload session that the server has turned an aborted attempt of Put into,
+// by sending what's missing as its next chunk. The server verifies the file it makes up by the digest,
+// and if that doesn't match, the session gets removed and errNotResumable returned for Put to start over.
+func (c *Client) resume(ctx context.Context, name string, body io.ReadSeeker, size int64, digest string) (string, error) {
+	destination, err := url.Parse(c.urlFor(name))
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, c.SessionsURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Destination", destination.Path)
+	resp, err := c.httpClient().Do(req) // Follows the redirect to the session, which lists its chunks.
+	if err != nil {
+		return "", err
+	}
+	listing, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.String() == req.URL.String() {
+		return "", errNotResumable
+	}
+	session := resp.Request.URL.String()
+
+	var offset int64
+	var chunks int
+	for _, line := range strings.Split(strings.TrimSpace(string(listing)), "\n") {
+		var index int
+		var chunkSize int64
+		if _, err := fmt.Sscanf(line, "%d %d", &index, &chunkSize); err != nil || index != chunks {
+			return "", errNotResumable
+		}
+		offset += chunkSize
+		chunks++
+	}
+	if chunks == 0 || offset > size {
+		return "", errNotResumable
+	}
+
+	if offset < size {
+		if _, err := body.Seek(offset, io.SeekStart); err != nil {
+			return "", err
+		}
+		req, err := http.NewRequest(http.MethodPut, session+"/"+strconv.Itoa(chunks), io.NopCloser(body))
+		if err != nil {
+			return "", err
+		}
+		req = req.WithContext(ctx)
+		req.ContentLength = size - offset
+		if _, err := c.do(req); err != nil {
+			return "", err
+		}
+	}
+
+	req, err = http.NewRequest(http.MethodPost, session, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Digest", digest)
+	locations, err := c.do(req)
+	if respErr, ok := err.(*ResponseError); ok && respErr.Code == "digest_mismatch" {
+		req, _ = http.NewRequest(http.MethodDelete, session, nil)
+		c.do(req.WithContext(ctx))
+		return "", errNotResumable
+	}
+	if len(locations) > 0 {
+		return locations[0], err
+	}
+	return "", err
+}
+
+// digestOf returns the SHA-256 digest of the whole body, for header "Digest".
+func digestOf(body io.ReadSeeker) (string, error) {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// PostMultipart uploads several files in one MIME Multipart envelope to the BaseURL,
+// and returns where the server indicated they can be downloaded from.
+//
+// As the files are streamed, this will not retry.
+func (c *Client) PostMultipart(ctx context.Context, files ...File) ([]string, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for i, f := range files {
+			part, err := mw.CreateFormFile("file"+strconv.Itoa(i), f.Name)
+			if err == nil {
+				_, err = io.Copy(part, f.Body)
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, c.urlFor(""), pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	locations, err := c.do(req)
+	pr.Close() // Unblocks the writer in case the server had cut us off.
+	return locations, err
+}
+
+// do sends the request, and translates any unsuccessful response into a *ResponseError.
+func (c *Client) do(req *http.Request) ([]string, error) {
+	req.Header.Set("Accept", "application/problem+json")
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		respErr := &ResponseError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(msg)),
+		}
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/problem+json") {
+			var problem struct {
+				Detail string `json:"detail"`
+				Code   string `json:"code"`
+				Limit  int64  `json:"limit"`
+				Part   int    `json:"part"`
+			}
+			if json.Unmarshal(msg, &problem) == nil {
+				respErr.Message, respErr.Code = problem.Detail, problem.Code
+				respErr.Limit, respErr.Part = problem.Limit, problem.Part
+			}
+		}
+		return nil, respErr
+	}
+	io.Copy(io.Discard, resp.Body) // Enables reuse of the connection.
+	return resp.Header.Values("Location"), nil
+}
+
+// retry calls fn until it succeeds, fails for a reason that will not go away by itself,
+// or the number of retries is exhausted.
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.Retries || !isTemporary(err) {
+			return err
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) urlFor(name string) string {
+	if name == "" {
+		return c.BaseURL
+	}
+	base := strings.TrimSuffix(c.BaseURL, "/")
+	name = (&url.URL{Path: strings.TrimPrefix(name, "/")}).EscapedPath()
+	return base + "/" + name
+}
+
+func isTemporary(err error) bool {
+	if respErr, ok := err.(*ResponseError); ok {
+		return respErr.Temporary()
+	}
+	// Errors on the transport, such as resets, are worth another attempt.
+	// Those are of type *url.Error, whose method Temporary is true only for timeouts and the like.
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,155 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	upload "blitznote.com/src/http.upload/v5"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClient(t *testing.T) {
+	scratchDir, err := ioutil.TempDir("", "http-upload-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	h, _ := upload.NewHandler("/", scratchDir, nil)
+	h.ApparentLocation = "/"
+	h.MaxFilesize = 64
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	Convey("Put", t, func() {
+		c := New(srv.URL)
+
+		Convey("uploads one file and reports its location", func() {
+			location, err := c.Put(context.Background(), "one", strings.NewReader("DELME"), 5)
+			So(err, ShouldBeNil)
+			So(location, ShouldEqual, "/one")
+
+			contents, _ := ioutil.ReadFile(filepath.Join(scratchDir, "one"))
+			So(string(contents), ShouldEqual, "DELME")
+		})
+
+		Convey("does not retry permanent failures", func() {
+			_, err := c.Put(context.Background(), "two", strings.NewReader(strings.Repeat("x", 65)), 65)
+			So(err, ShouldHaveSameTypeAs, &ResponseError{})
+			So(err.(*ResponseError).StatusCode, ShouldEqual, http.StatusRequestEntityTooLarge)
+			So(err.(*ResponseError).Code, ShouldEqual, "file_too_large")
+			So(err.(*ResponseError).Limit, ShouldEqual, 64)
+		})
+	})
+
+	Convey("Put retries temporary failures", t, func() {
+		var attempts int
+		flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}))
+		defer flaky.Close()
+
+		c := New(flaky.URL)
+		c.RetryDelay = 0
+		location, err := c.Put(context.Background(), "three", strings.NewReader("DELME"), 5)
+		So(err, ShouldBeNil)
+		So(location, ShouldEqual, "/three")
+		So(attempts, ShouldEqual, 3)
+	})
+
+	Convey("Put sends the file's digest", t, func() {
+		var digest string
+		recording := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			digest = r.Header.Get("Digest")
+			h.ServeHTTP(w, r)
+		}))
+		defer recording.Close()
+
+		_, err := New(recording.URL).Put(context.Background(), "six", strings.NewReader("DELME"), 5)
+		So(err, ShouldBeNil)
+		So(digest, ShouldEqual, "sha-256=FBWjceJkib9HWGvDPm5P5uRRElm5dgtgGQmUD/sC9TQ=")
+	})
+
+	Convey("Put resumes aborted uploads with SessionsURL", t, func() {
+		resuming, _ := upload.NewHandler("/", scratchDir, nil)
+		resuming.ApparentLocation = "/"
+		resuming.Sessions = upload.NewMemorySessionStore()
+		resuming.PartialUploads = upload.ResumePartialUploads
+		var methods []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			methods = append(methods, r.Method)
+			resuming.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+
+		c := New(srv.URL)
+		c.SessionsURL = srv.URL + "/.upload-session/"
+		c.RetryDelay = 100 * time.Millisecond
+		body := &failingOnce{ReadSeeker: strings.NewReader("DELMEREMOVEME"), failAt: 5}
+		location, err := c.Put(context.Background(), "seven", body, 13)
+		So(err, ShouldBeNil)
+		So(location, ShouldEqual, "/seven")
+		So(methods, ShouldResemble, []string{"PUT", "GET", "GET", "PUT", "POST"}) // The lookup gets redirected.
+
+		contents, _ := ioutil.ReadFile(filepath.Join(scratchDir, "seven"))
+		So(string(contents), ShouldEqual, "DELMEREMOVEME")
+	})
+
+	Convey("PostMultipart uploads several files", t, func() {
+		c := New(srv.URL + "/")
+		locations, err := c.PostMultipart(context.Background(),
+			File{Name: "four", Body: strings.NewReader("DELME")},
+			File{Name: "five", Body: strings.NewReader("REMOVEME")},
+		)
+		So(err, ShouldBeNil)
+		So(locations, ShouldResemble, []string{"/four", "/five"})
+
+		contents, _ := ioutil.ReadFile(filepath.Join(scratchDir, "five"))
+		So(string(contents), ShouldEqual, "REMOVEME")
+	})
+}
+
+// failingOnce fails reading at failAt after having been rewound twice: by Put for its digest, and its first attempt.
+type failingOnce struct {
+	io.ReadSeeker
+	failAt int64
+	passes int
+	n      int64
+}
+
+func (f *failingOnce) Seek(offset int64, whence int) (int64, error) {
+	f.passes++
+	f.n = offset
+	return f.ReadSeeker.Seek(offset, whence)
+}
+
+func (f *failingOnce) Read(p []byte) (int, error) {
+	if f.passes == 2 {
+		if f.n >= f.failAt {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if int64(len(p)) > f.failAt-f.n {
+			p = p[:f.failAt-f.n]
+		}
+	}
+	n, err := f.ReadSeeker.Read(p)
+	f.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,100 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command upload-cli uploads files to a server that runs the upload handler.
+//
+// One file is sent using HTTP PUT, and its name is appended to the URL if that ends in a slash.
+// Several files are sent in one MIME Multipart envelope:
+//  upload-cli https://example.com/web/path/ /etc/os-release
+//  upload-cli https://example.com/web/path/ .gitconfig .ssh/id_ed25519.pub
+//
+// Any locations the files can be downloaded from get printed, one per line.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"blitznote.com/src/http.upload/v5/client"
+)
+
+func main() {
+	retries := flag.Int("retries", 3, "Number of retries for single-file uploads that failed for a temporary reason.")
+	retryDelay := flag.Duration("retry-delay", 500*time.Millisecond, "Waiting time before the first retry, doubled for every next one.")
+	sessionsURL := flag.String("sessions-url", "", "Where the server manages upload sessions, for retries to resume single-file uploads that have been cut off.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <URL> <file> [<file> …]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := client.New(flag.Arg(0))
+	c.Retries, c.RetryDelay = *retries, *retryDelay
+	c.SessionsURL = *sessionsURL
+	ctx := context.Background()
+
+	var (
+		locations []string
+		err       error
+	)
+	if flag.NArg() == 2 {
+		locations, err = putOne(ctx, c, flag.Arg(1))
+	} else {
+		locations, err = postMany(ctx, c, flag.Args()[1:])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, l := range locations {
+		fmt.Println(l)
+	}
+}
+
+func putOne(ctx context.Context, c *client.Client, fileName string) ([]string, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	name := ""
+	if strings.HasSuffix(c.BaseURL, "/") {
+		name = filepath.Base(fileName)
+	}
+	location, err := c.Put(ctx, name, fd, fi.Size())
+	if err != nil || location == "" {
+		return nil, err
+	}
+	return []string{location}, nil
+}
+
+func postMany(ctx context.Context, c *client.Client, fileNames []string) ([]string, error) {
+	files := make([]client.File, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		fd, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		files = append(files, client.File{
+			Name: path.Base(filepath.ToSlash(fileName)),
+			Body: fd,
+		})
+	}
+	return c.PostMultipart(ctx, files...)
+}
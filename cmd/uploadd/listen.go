@@ -0,0 +1,89 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd's socket activation.
+const listenFDsStart = 3
+
+// listenOn returns a listener for the address, which is one of:
+// "<host>:<port>", "unix:<path>" of a Unix domain socket, or "systemd" for the first socket
+// passed by socket activation (LISTEN_FDS). Such a socket is used for any address if one has been passed.
+func listenOn(address string) (net.Listener, error) {
+	if ln, err := activatedListener(); ln != nil || err != nil {
+		return ln, err
+	}
+	switch {
+	case address == "systemd":
+		return nil, errors.New("No socket has been passed by systemd, see LISTEN_FDS")
+	case strings.HasPrefix(address, "unix:"):
+		path := strings.TrimPrefix(address, "unix:")
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path) // Left over from an earlier run.
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
+
+// activatedListener returns the first socket passed by systemd, or nil if there's none.
+func activatedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// Not meant for any children.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(listenFDsStart, "LISTEN_FD_3")
+	defer f.Close() // FileListener has a duplicate.
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "Using the socket passed by systemd failed")
+	}
+	return ln, nil
+}
+
+// notifier tells systemd about the state of the service (sd_notify), if it expects that.
+// Its connection is made early, before any sandbox could prevent it.
+type notifier struct {
+	conn net.Conn
+}
+
+// newNotifier connects to NOTIFY_SOCKET, if set. Else its methods do nothing.
+func newNotifier() *notifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return &notifier{}
+	}
+	if strings.HasPrefix(path, "@") { // In the abstract namespace.
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return &notifier{}
+	}
+	return &notifier{conn: conn}
+}
+
+// notify sends a state, such as "READY=1".
+func (n *notifier) notify(state string) {
+	if n.conn != nil {
+		n.conn.Write([]byte(state))
+	}
+}
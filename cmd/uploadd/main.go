@@ -0,0 +1,279 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command uploadd is a standalone HTTP server that accepts uploads.
+//
+// Every flag can also be set by an environment variable of the same name,
+// upper-cased, prefixed with "UPLOADD_", and with '-' replaced by '_'.
+// For example, this is equivalent to passing `-max-filesize 1048576`:
+//  UPLOADD_MAX_FILESIZE=1048576 uploadd -to /var/tmp
+//
+// Flags take precedence over environment variables,
+// and either over settings from the file given by flag -config.
+// That file will be read again on SIGHUP.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	upload "blitznote.com/src/http.upload/v5"
+)
+
+const envPrefix = "UPLOADD_"
+
+func main() {
+	var (
+		configFile = flag.String("config", "", "Path to a file with settings in JSON, or YAML or TOML by its extension, which flags override.")
+		listen     = flag.String("listen", ":9000", "Address to listen on, as in <host>:<port>, unix:<path> of a socket, or 'systemd' for socket activation.")
+		tlsCert    = flag.String("tls-cert", "", "Path to a PEM encoded certificate (chain). Enables TLS together with -tls-key.")
+		tlsKey     = flag.String("tls-key", "", "Path to the PEM encoded private key belonging to -tls-cert.")
+		sandboxed  = flag.Bool("sandbox", false, "On Linux, restrict writes to the destination and spool directories using Landlock.")
+	)
+	var c upload.Config
+	configFlags(flag.CommandLine, &c)
+
+	if err := flagsFromEnvironment(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
+
+	// Anything that has been set explicitly takes precedence over the config file.
+	explicit := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	if *configFile != "" {
+		fromFile, err := loadConfigFile(*configFile, explicit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c = *fromFile
+	}
+
+	if c.To == "" {
+		fmt.Fprintln(flag.CommandLine.Output(), "A destination is missing, set it using flag -to.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("Flags -tls-cert and -tls-key must be used together")
+	}
+
+	h, err := c.NewHandler(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range h.PostProcessors {
+		if s, ok := p.(*upload.Signer); ok {
+			log.Println("Files are signed, verify them using public key:", s.PublicKey())
+		}
+	}
+	scope := h.Scope
+	r := upload.NewReloadable(h)
+
+	if *configFile != "" {
+		go reloadOnSignal(r, *configFile, explicit)
+	}
+	if c.SessionTTL > 0 {
+		go expireSessionsPeriodically(r, time.Duration(c.SessionTTL))
+	}
+	if c.ScrubInterval > 0 {
+		go scrubPeriodically(r, time.Duration(c.ScrubInterval))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(scope, r)
+	if !strings.HasSuffix(scope, "/") {
+		mux.Handle(scope+"/", r)
+	}
+
+	srv := &http.Server{Handler: mux}
+	ln, err := listenOn(*listen) // Before any sandbox, which would prevent creating a socket file.
+	if err != nil {
+		log.Fatal(err)
+	}
+	systemd := newNotifier()
+	if *tlsCert != "" { // Read once, hence renewed certificates take effect only on restart.
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if *sandboxed {
+		dir, isLocal := localDirectory(c.To)
+		if !isLocal {
+			log.Fatal("Flag -sandbox needs a local destination directory")
+		}
+		writable := []string{dir}
+		switch {
+		case c.SpoolDirectory != "":
+			writable = append(writable, c.SpoolDirectory)
+		case h.PartialUploads != upload.DiscardPartialUploads || c.RejectMacros:
+			writable = append(writable, os.TempDir()) // Where those spool without one.
+		}
+		if err := sandbox(writable...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	systemd.notify("READY=1")
+	if srv.TLSConfig != nil {
+		log.Fatal(srv.ServeTLS(ln, "", ""))
+	}
+	log.Fatal(srv.Serve(ln))
+}
+
+// localDirectory returns the directory a destination refers to,
+// and false if it's not on the local filesystem.
+func localDirectory(to string) (string, bool) {
+	if !strings.Contains(to, "://") {
+		return filepath.Clean(to), true
+	}
+	u, err := url.Parse(to)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+// configFlags defines flags on fs that set fields of c.
+func configFlags(fs *flag.FlagSet, c *upload.Config) {
+	fs.StringVar(&c.Scope, "scope", "/", "Prefix of URL paths that are served, and stripped from filenames.")
+	fs.StringVar(&c.To, "to", "", "Target directory, or a URL with a scheme supported by the Go CDK. Required.")
+	fs.BoolVar(&c.EnableWebdav, "enable-webdav", false, "Enables COPY, MOVE, and DELETE.")
+	fs.StringVar(&c.FilenamesForm, "filenames-form", "none", "Reject filenames not in this Unicode form: none, NFC, or NFD.")
+	fs.StringVar(&c.FilenamesIn, "filenames-in", "", "Space-delimited Unicode ranges filenames must be in, such as 'u0000-u007F'.")
+	fs.Var((*uint32Value)(&c.RandomSuffixLen), "random-suffix-len", "If > 0, append a randomized suffix of this length to filenames.")
+	fs.StringVar(&c.PromiseDownloadFrom, "promise-download-from", "", "If set, responds with header 'Location' pointing to this prefix.")
+	fs.Int64Var(&c.MaxFilesize, "max-filesize", 0, "Limits the size of individual files, in bytes. 0 is unlimited.")
+	fs.Int64Var(&c.MaxTransactionSize, "max-transaction-size", 0, "Limits the size of all files in one request, in bytes. 0 is unlimited.")
+}
+
+// loadConfigFile returns a new Config with the contents of the file,
+// and any flags in 'explicit' applied on top.
+func loadConfigFile(fileName string, explicit map[string]string) (*upload.Config, error) {
+	c := new(upload.Config)
+	fs := flag.NewFlagSet(fileName, flag.ContinueOnError)
+	configFlags(fs, c) // Points the flags to c, which gets overwritten below.
+
+	fromFile, err := readConfig(fileName)
+	if err != nil {
+		return nil, err
+	}
+	*c = *fromFile
+	for name, value := range explicit {
+		if fs.Lookup(name) != nil { // Skips those not in the Config, such as -listen.
+			fs.Set(name, value) // Has been validated before.
+		}
+	}
+	return c, nil
+}
+
+// reloadOnSignal reads the config file again on SIGHUP, and replaces the Handler.
+// Every reload starts from a new Config, which is used only if it results in a Handler.
+// A changed Scope is not applied, because it's used outside of the Handler.
+func reloadOnSignal(r *upload.Reloadable, fileName string, explicit map[string]string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		scope := r.Handler().Scope
+		c, err := loadConfigFile(fileName, explicit)
+		if err != nil {
+			log.Println("Reload failed, keeping the current configuration:", err)
+			continue
+		}
+		h, err := c.NewHandler(nil)
+		if err != nil {
+			log.Println("Reload failed, keeping the current configuration:", err)
+			continue
+		}
+		if h.Scope != scope {
+			log.Println("Reload failed, keeping the current configuration: changing the path requires a restart")
+			continue
+		}
+		r.Update(h)
+		log.Println("Reloaded configuration from", fileName)
+	}
+}
+
+// expireSessionsPeriodically removes abandoned upload sessions using the current Handler, and logs the outcome.
+func expireSessionsPeriodically(r *upload.Reloadable, ttl time.Duration) {
+	for range time.Tick(ttl / 2) {
+		report, err := r.Handler().ExpireSessions(context.Background(), ttl)
+		if err != nil {
+			log.Println("Removing expired sessions failed:", err)
+			continue
+		}
+		if report.Sessions > 0 || report.SpoolFiles > 0 {
+			log.Printf("Removed %d expired sessions with %d chunks, and %d temporary files, reclaiming %d bytes",
+				report.Sessions, report.Chunks, report.SpoolFiles, report.Bytes)
+		}
+	}
+}
+
+// scrubPeriodically re-verifies all files using the current Handler, and logs the outcome.
+func scrubPeriodically(r *upload.Reloadable, interval time.Duration) {
+	for range time.Tick(interval) {
+		report, err := r.Handler().Scrub(context.Background(), "")
+		if err != nil {
+			log.Println("Scrubbing failed:", err)
+			continue
+		}
+		log.Printf("Scrubbed %d files (%d bytes) in %v, %d without a digest, corrupted: %v",
+			report.Checked, report.Bytes, report.Finished.Sub(report.Started), report.Unverifiable, report.Corrupted)
+	}
+}
+
+// flagsFromEnvironment sets flags to the values of their corresponding environment variables.
+// Call this before fs.Parse, so that any flags given on the command line override these.
+func flagsFromEnvironment(fs *flag.FlagSet) (err error) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, present := os.LookupEnv(name); present {
+			if serr := fs.Set(f.Name, value); serr != nil {
+				err = fmt.Errorf("Cannot use environment variable %s: %v", name, serr)
+			}
+		}
+	})
+	return
+}
+
+func readConfig(fileName string) (*upload.Config, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return upload.LoadConfigFormat(fd, upload.ConfigFormatOf(fileName))
+}
+
+// uint32Value implements flag.Value.
+type uint32Value uint32
+
+func (v *uint32Value) String() string { return strconv.FormatUint(uint64(*v), 10) }
+
+func (v *uint32Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v = uint32Value(n)
+	return nil
+}
@@ -0,0 +1,111 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Landlock, see: linux/landlock.h
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	accessFSExecute    = 1 << 0
+	accessFSWriteFile  = 1 << 1
+	accessFSReadFile   = 1 << 2
+	accessFSReadDir    = 1 << 3
+	accessFSRemoveDir  = 1 << 4
+	accessFSRemoveFile = 1 << 5
+	accessFSMakeChar   = 1 << 6
+	accessFSMakeDir    = 1 << 7
+	accessFSMakeReg    = 1 << 8
+	accessFSMakeSock   = 1 << 9
+	accessFSMakeFifo   = 1 << 10
+	accessFSMakeBlock  = 1 << 11
+	accessFSMakeSym    = 1 << 12
+
+	// Everything Landlock ABI version 1 knows of.
+	accessFSAll = accessFSMakeSym<<1 - 1
+
+	prSetNoNewPrivs = 38
+)
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneathAttr is packed in C, hence the byte array.
+type landlockPathBeneathAttr [12]byte
+
+func newLandlockPathBeneathAttr(allowedAccess uint64, parentFd int32) (a landlockPathBeneathAttr) {
+	*(*uint64)(unsafe.Pointer(&a[0])) = allowedAccess
+	*(*int32)(unsafe.Pointer(&a[8])) = parentFd
+	return
+}
+
+// sandbox restricts this process using Landlock (Linux 5.13 and later):
+// anything can be read, but only writable are the given directories and what's below them.
+//
+// This needs a binary built with CGO_ENABLED=0, else not all threads can be restricted.
+func sandbox(writableDirectories ...string) error {
+	abi, _, e := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if e != 0 {
+		return errors.Wrap(e, "Landlock is unavailable")
+	}
+	if abi < 1 {
+		return errors.New("Landlock is unavailable")
+	}
+
+	attr := landlockRulesetAttr{handledAccessFS: accessFSAll}
+	rulesetFd, _, e := syscall.Syscall(sysLandlockCreateRuleset,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if e != 0 {
+		return errors.Wrap(e, "landlock_create_ruleset")
+	}
+	defer syscall.Close(int(rulesetFd))
+
+	if err := landlockAllowBeneath(rulesetFd, "/",
+		accessFSReadFile|accessFSReadDir); err != nil {
+		return err
+	}
+	for _, dir := range writableDirectories {
+		if err := landlockAllowBeneath(rulesetFd, dir,
+			accessFSReadFile|accessFSReadDir|accessFSWriteFile|
+				accessFSRemoveDir|accessFSRemoveFile|accessFSMakeDir|accessFSMakeReg); err != nil {
+			return err
+		}
+	}
+
+	if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); e != 0 {
+		return errors.Wrap(e, "prctl(PR_SET_NO_NEW_PRIVS)")
+	}
+	if _, _, e := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, rulesetFd, 0, 0); e != 0 {
+		return errors.Wrap(e, "landlock_restrict_self")
+	}
+	return nil
+}
+
+func landlockAllowBeneath(rulesetFd uintptr, path string, access uint64) error {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	attr := newLandlockPathBeneathAttr(access, int32(fd))
+	if _, _, e := syscall.Syscall6(sysLandlockAddRule,
+		rulesetFd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); e != 0 {
+		return errors.Wrap(e, "landlock_add_rule for "+path)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+func sandbox(writableDirectories ...string) error {
+	return errors.New("Sandboxing is not supported on this platform")
+}
@@ -0,0 +1,774 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gocloud.dev/secrets"
+	_ "gocloud.dev/secrets/localsecrets" // Registers scheme "base64key://"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
+
+	"blitznote.com/src/http.upload/v5/filename"
+)
+
+const (
+	errConfigNoDestination   configError = "Setting 'to' is missing"
+	errConfigUnknownFormName configError = "Setting 'filenames_form' must be one of: none, NFC, NFD"
+	errConfigFilenamesEnc    configError = "Setting 'filenames_encoding' must be one of: utf-8, latin1, url, auto"
+	errConfigFilenamesProf   configError = "Setting 'filenames_profile' must be one of: posix-portable, windows-safe, url-safe"
+	errConfigEncryptionKey   configError = "Setting 'encryption_key' must be 32 bytes in base64"
+	errConfigKeyKeeper       configError = "Setting 'key_keeper' must name one of 'key_keepers'"
+	errConfigSigningKey      configError = "Setting 'signing_key' must be 32 bytes in base64"
+	errConfigReceiptKey      configError = "Setting 'receipt_key' must be 32 bytes in base64"
+	errConfigUploadSessions  configError = "Setting 'upload_sessions' must be one of: memory, bucket"
+	errConfigWriteLocking    configError = "Setting 'write_locking' must be one of: none, wait, reject"
+	errConfigPartialUploads  configError = "Setting 'partial_uploads' must be one of: discard, keep, session (which needs 'upload_sessions')"
+	errConfigKeyKeepersTo    configError = "Setting 'key_keepers' needs 'to' to be a URL of a bucket that keeps metadata"
+	errConfigSlotKey         configError = "Setting 'slots' needs a 'key' for every slot"
+	errConfigOpenPGPTo       configError = "Setting 'require_openpgp_to' must name a file with OpenPGP public keys, armored"
+	errConfigTrustedProxies  configError = "Setting 'trusted_proxies' must be a list of IP addresses or networks in CIDR notation"
+	errConfigContentLanguage configError = "Setting 'content_language' must be one of: ignore, metadata, suffix"
+	errConfigUploadWindows   configError = "Setting 'upload_windows' must be a list of times of day such as: 22:00-06:00"
+	errConfigProtect         configError = "Setting 'protect' must be a list of patterns such as: *.keep"
+	errConfigRedirect        configError = "Setting 'redirect_after_upload' must be a URL"
+	errConfigSuccessStatus   configError = "Setting 'success_status' must be a status code of success, 200 through 299"
+	errConfigSuccessHeaders  configError = "Setting 'success_headers' has an invalid header name or value"
+	errConfigEnvUnset        configError = "Settings refer to an environment variable that is not set: "
+	errConfigMaxConcurrent   configError = "Setting 'max_concurrent_uploads' must not be negative"
+	errConfigMinFilesize     configError = "Setting 'min_filesize' must not be negative"
+	errConfigPackFilesUpTo   configError = "Setting 'pack_files_up_to' must not be negative"
+	errConfigCopyBufferSize  configError = "Setting 'copy_buffer_size' must not be negative"
+	errConfigWriterBuffer    configError = "Setting 'writer_buffer_size' must not be negative"
+	errConfigKeepVersions    configError = "Setting 'keep_versions' must not be negative"
+	errConfigDrainAllowance  configError = "Setting 'drain_allowance' must not be negative"
+	errConfigFormat          configError = "Configuration files must be in one of: json, yaml, toml"
+)
+
+// configError is returned for configurations that cannot be used to create a Handler.
+type configError string
+
+// Error implements the error interface.
+func (e configError) Error() string { return string(e) }
+
+// Duration is a time.Duration that reads from strings such as "90s" in JSON.
+type Duration time.Duration
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config represents the configuration of one Handler
+// using the names of the directives documented in the README file.
+//
+// It is meant to be read from files, for example by LoadConfig:
+//  {
+//    "path": "/wp-uploads",
+//    "to": "/var/www/senpai/wp-uploads",
+//    "enable_webdav": true,
+//    "max_filesize": 16777216,
+//    "filenames_in": "u0000–u007F u0100–u017F"
+//  }
+type Config struct {
+	Scope string `json:"path,omitempty"`
+	Host  string `json:"host,omitempty"`
+	To    string `json:"to,omitempty"`
+
+	EnableWebdav               bool     `json:"enable_webdav,omitempty"`
+	Protect                    []string `json:"protect,omitempty"`
+	ReadOnly                   []string `json:"read_only,omitempty"`
+	SHA256Sums                 bool     `json:"sha256sums,omitempty"`
+	EnableExistenceChecks      bool     `json:"enable_existence_checks,omitempty"`
+	EnableDeltaUploads         bool     `json:"enable_delta_uploads,omitempty"`
+	EnableListing              bool     `json:"enable_listing,omitempty"`
+	EnableTransactionDownloads bool     `json:"enable_transaction_downloads,omitempty"`
+	UploadSessions             string   `json:"upload_sessions,omitempty"`
+	SessionTTL                 Duration `json:"session_ttl,omitempty"` // Used by uploadd, which removes older sessions.
+	WriteLocking               string   `json:"write_locking,omitempty"`
+	FilenamesForm              string   `json:"filenames_form,omitempty"`
+	FilenamesIn                string   `json:"filenames_in,omitempty"`
+	FilenamesEncoding          string   `json:"filenames_encoding,omitempty"`
+	FilenamesProfile           string   `json:"filenames_profile,omitempty"`
+	FilenamesAntiSpoofing      bool     `json:"filenames_anti_spoofing,omitempty"`
+	FilenameCheck              bool     `json:"filename_check,omitempty"`
+	ContentLanguage            string   `json:"content_language,omitempty"`
+	AssignContentType          bool     `json:"assign_content_type,omitempty"`
+	RandomSuffixLen            uint32   `json:"random_suffix_len,omitempty"`
+	FinalNameInBody            bool     `json:"final_name_in_body,omitempty"`
+	PromiseDownloadFrom        string   `json:"promise_download_from,omitempty"`
+	LocationFromRequest        bool     `json:"location_from_request,omitempty"`
+	LinkHeaders                bool     `json:"link_headers,omitempty"`
+	RedirectAfterUpload        string   `json:"redirect_after_upload,omitempty"`
+	UploadForm                 bool     `json:"upload_form,omitempty"`
+	SuccessStatus              int      `json:"success_status,omitempty"`
+
+	SuccessHeaders map[string]string `json:"success_headers,omitempty"`
+
+	TrustedProxies   []string `json:"trusted_proxies,omitempty"`
+	TenantFromHeader string   `json:"tenant_from_header,omitempty"`
+
+	Tenants map[string]TenantLimits `json:"tenants,omitempty"`
+
+	Slots map[string]Slot `json:"slots,omitempty"`
+
+	ContentTypes []string `json:"content_types,omitempty"`
+
+	MaxFilesize        int64 `json:"max_filesize,omitempty"`
+	MaxTransactionSize int64 `json:"max_transaction_size,omitempty"`
+	MinFilesize        int64 `json:"min_filesize,omitempty"`
+	DenyEmptyFiles     bool  `json:"deny_empty_files,omitempty"`
+	DrainAllowance     int64 `json:"drain_allowance,omitempty"`
+
+	UploadTimeout   Duration `json:"upload_timeout,omitempty"`
+	IdleReadTimeout Duration `json:"idle_read_timeout,omitempty"`
+
+	StorageClasses        []StorageClassRule `json:"storage_classes,omitempty"`
+	StorageClassesAllowed []string           `json:"storage_classes_allowed,omitempty"`
+	TagsAllowed           []string           `json:"tags_allowed,omitempty"`
+
+	CopyBufferSize       int  `json:"copy_buffer_size,omitempty"`
+	WriterBufferSize     int  `json:"writer_buffer_size,omitempty"`
+	MaxConcurrentUploads int  `json:"max_concurrent_uploads,omitempty"`
+	RollbackOnPartError  bool `json:"rollback_on_part_error,omitempty"`
+	ContinueOnPartError  bool `json:"continue_on_part_error,omitempty"`
+	CaptureFormFields    bool `json:"capture_form_fields,omitempty"`
+	KeepVersions         int  `json:"keep_versions,omitempty"`
+
+	AppendToExisting bool `json:"append_to_existing,omitempty"`
+	Quarantine       bool `json:"quarantine,omitempty"`
+
+	PackFilesUpTo int64  `json:"pack_files_up_to,omitempty"`
+	PackName      string `json:"pack_name,omitempty"`
+
+	SpoolDirectory string `json:"spool_directory,omitempty"`
+	PartialUploads string `json:"partial_uploads,omitempty"`
+	EncryptionKey  string `json:"encryption_key,omitempty"`
+
+	KeyKeepers map[string]string `json:"key_keepers,omitempty"`
+	KeyKeeper  string            `json:"key_keeper,omitempty"`
+
+	ServeDecrypted bool `json:"serve_decrypted,omitempty"`
+
+	Clamd        string `json:"clamd,omitempty"`
+	ScanFailOpen bool   `json:"scan_fail_open,omitempty"`
+
+	Scrubbing     bool     `json:"scrubbing,omitempty"`
+	ScrubInterval Duration `json:"scrub_interval,omitempty"` // Used by uploadd, which scrubs the whole Bucket that often.
+
+	RequireOpenPGPTo string `json:"require_openpgp_to,omitempty"`
+	SanitizeHTML     bool   `json:"sanitize_html,omitempty"`
+	RejectMacros     bool   `json:"reject_macros,omitempty"`
+
+	StripMetadata bool              `json:"strip_metadata,omitempty"`
+	Thumbnails    map[string]string `json:"thumbnails,omitempty"`
+	SigningKey    string            `json:"signing_key,omitempty"`
+	ReceiptKey    string            `json:"receipt_key,omitempty"`
+
+	Maintenance   bool     `json:"maintenance,omitempty"`
+	RetryAfter    Duration `json:"retry_after,omitempty"`
+	UploadWindows []string `json:"upload_windows,omitempty"`
+
+	AsyncPersist     bool     `json:"async_persist,omitempty"`
+	ProgressInterval Duration `json:"progress_interval,omitempty"`
+	ProgressEvents   bool     `json:"progress_events,omitempty"`
+}
+
+// ConfigFormat is the format of a file with a Config.
+type ConfigFormat string
+
+// Formats that LoadConfigFormat reads.
+const (
+	ConfigJSON ConfigFormat = "json"
+	ConfigYAML ConfigFormat = "yaml"
+	ConfigTOML ConfigFormat = "toml"
+)
+
+// ConfigFormatOf returns the format of a file by its extension, ConfigJSON if it's none of the others.
+func ConfigFormatOf(fileName string) ConfigFormat {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return ConfigYAML
+	case ".toml":
+		return ConfigTOML
+	}
+	return ConfigJSON
+}
+
+// LoadConfig reads one Config in JSON format from r.
+// Unknown settings are rejected to catch typos early.
+//
+// References to environment variables such as "${BUCKET_URL}" in any string are replaced by their values,
+// so that secrets need not be in the file. Those that are not set are an error.
+func LoadConfig(r io.Reader) (*Config, error) {
+	return LoadConfigFormat(r, ConfigJSON)
+}
+
+// LoadConfigFormat is LoadConfig for files in any ConfigFormat.
+// Keys are the same in every format, such as "max_filesize", and durations are strings such as "5m".
+func LoadConfigFormat(r io.Reader, format ConfigFormat) (*Config, error) {
+	var raw interface{}
+	switch format {
+	case ConfigJSON:
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+	case ConfigYAML:
+		if err := yaml.NewDecoder(r).Decode(&raw); err != nil {
+			return nil, err
+		}
+	case ConfigTOML:
+		var table map[string]interface{}
+		if _, err := toml.NewDecoder(r).Decode(&table); err != nil {
+			return nil, err
+		}
+		raw = table
+	default:
+		return nil, errConfigFormat
+	}
+	raw, err := expandEnv(raw)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(raw)
+	if err != nil { // Such as for maps with keys that are not strings, which YAML allows.
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// envReference matches "${NAME}" in settings.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces envReference in all strings of the decoded JSON.
+func expandEnv(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		var err error
+		expanded := envReference.ReplaceAllStringFunc(v, func(ref string) string {
+			name := ref[2 : len(ref)-1]
+			value, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = configError(errConfigEnvUnset.Error() + name)
+			}
+			return value
+		})
+		return expanded, err
+	case []interface{}:
+		for i := range v {
+			var err error
+			if v[i], err = expandEnv(v[i]); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for k := range v {
+			var err error
+			if v[k], err = expandEnv(v[k]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// NewDefaultConfig returns a Config that has uploads written to 'to', a local directory or URL of a Bucket,
+// with what applies if left empty, such as a Scope of "/".
+func NewDefaultConfig(scope, to string) *Config {
+	if scope == "" {
+		scope = "/"
+	}
+	return &Config{Scope: scope, To: to}
+}
+
+// NewStrictConfig is NewDefaultConfig with names and concurrent writes limited to what's safe everywhere,
+// for uploads from untrusted clients.
+func NewStrictConfig(scope, to string) *Config {
+	c := NewDefaultConfig(scope, to)
+	c.FilenamesForm = "NFC"
+	c.FilenamesProfile = filename.WindowsSafe.Name
+	c.FilenamesAntiSpoofing = true
+	c.WriteLocking = "reject"
+	c.DenyEmptyFiles = true
+	return c
+}
+
+// Merge returns a copy of c with all settings that are set in overrides replaced.
+// Maps, such as Tenants, are merged by their keys. Lists are replaced.
+// As settings that are not set look the same as those set to false, 0, or "", such cannot be overridden.
+func (c *Config) Merge(overrides *Config) *Config {
+	merged := c.clone()
+	dst, src := reflect.ValueOf(merged).Elem(), reflect.ValueOf(overrides).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Field(i)
+		switch {
+		case field.IsZero():
+		case field.Kind() == reflect.Map && !dst.Field(i).IsNil():
+			for _, k := range field.MapKeys() {
+				dst.Field(i).SetMapIndex(k, deepCopy(field.MapIndex(k)))
+			}
+		default:
+			dst.Field(i).Set(deepCopy(field))
+		}
+	}
+	return merged
+}
+
+// clone returns a deep copy of c.
+func (c *Config) clone() *Config {
+	return deepCopy(reflect.ValueOf(c)).Interface().(*Config)
+}
+
+// deepCopy returns a copy of v that shares no maps, slices, or pointers with it.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			c.Field(i).Set(deepCopy(v.Field(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			c.SetMapIndex(k, deepCopy(v.MapIndex(k)))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	}
+	return v
+}
+
+// Equal is true if both Configs have the same settings, ignoring the difference
+// between those that are not set and those that are empty.
+func (c *Config) Equal(other *Config) bool {
+	a, b := reflect.ValueOf(c).Elem(), reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		x, y := a.Field(i), b.Field(i)
+		switch x.Kind() {
+		case reflect.Map, reflect.Slice:
+			if x.Len() == 0 && y.Len() == 0 {
+				continue
+			}
+		}
+		if !reflect.DeepEqual(x.Interface(), y.Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate returns the error NewHandler would for invalid settings, without opening
+// the destination or any KeyKeepers, whose errors hence surface in NewHandler only.
+// Files referred to, such as by RequireOpenPGPTo, must exist.
+func (c *Config) Validate() error {
+	_, err := c.newHandler(nil, false)
+	return err
+}
+
+// NewHandler creates a Handler configured according to c.
+//
+// 'next' is optional and can be nil.
+func (c *Config) NewHandler(next http.Handler) (*Handler, error) {
+	return c.newHandler(next, true)
+}
+
+// newHandler is NewHandler, which opens the destination and any KeyKeepers only if 'open' is true,
+// else returns a Handler without a Bucket. Both are opened last, once all settings have been checked.
+func (c *Config) newHandler(next http.Handler, open bool) (h *Handler, err error) {
+	if c.To == "" {
+		return nil, errConfigNoDestination
+	}
+	scope := c.Scope
+	if scope == "" {
+		scope = "/"
+	}
+
+	var form *struct{ Use norm.Form }
+	switch strings.ToUpper(c.FilenamesForm) {
+	case "", "NONE":
+	case "NFC":
+		form = &struct{ Use norm.Form }{Use: norm.NFC}
+	case "NFD":
+		form = &struct{ Use norm.Form }{Use: norm.NFD}
+	default:
+		return nil, errConfigUnknownFormName
+	}
+
+	filenamesEncoding, ok := ParseFilenameEncoding(c.FilenamesEncoding)
+	if !ok {
+		return nil, errConfigFilenamesEnc
+	}
+	var filenamesProfile *filename.Profile
+	if c.FilenamesProfile != "" {
+		if filenamesProfile, ok = filename.Profiles[c.FilenamesProfile]; !ok {
+			return nil, errConfigFilenamesProf
+		}
+	}
+
+	contentLanguage, ok := ParseContentLanguagePolicy(c.ContentLanguage)
+	if !ok {
+		return nil, errConfigContentLanguage
+	}
+
+	var slots map[string]Slot
+	for name, slot := range c.Slots {
+		if strings.Trim(slot.Key, "/") == "" {
+			return nil, errConfigSlotKey
+		}
+		if slots == nil {
+			slots = make(map[string]Slot, len(c.Slots))
+		}
+		slots[strings.Trim(name, "/")] = slot
+	}
+
+	var proxies []*net.IPNet
+	for _, s := range c.TrustedProxies {
+		n, err := ParseTrustedProxy(s)
+		if err != nil {
+			return nil, errConfigTrustedProxies
+		}
+		proxies = append(proxies, n)
+	}
+
+	var alphabet []*unicode.RangeTable
+	if c.FilenamesIn != "" {
+		rt, err := ParseUnicodeBlockList(c.FilenamesIn)
+		if err != nil {
+			return nil, err
+		}
+		alphabet = []*unicode.RangeTable{rt}
+	}
+
+	presets := make([]string, 0, len(c.Thumbnails))
+	for name := range c.Thumbnails {
+		presets = append(presets, name)
+	}
+	sort.Strings(presets)
+	var processors []PostProcessor
+	if c.StripMetadata {
+		processors = append(processors, MetadataStripper{})
+	}
+	for _, name := range presets {
+		t, err := ParseThumbnailer(name, c.Thumbnails[name])
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, t)
+	}
+	if c.SigningKey != "" { // Last, to sign what the others have left.
+		seed, err := base64.StdEncoding.DecodeString(c.SigningKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errConfigSigningKey
+		}
+		processors = append(processors, NewSigner(ed25519.NewKeyFromSeed(seed)))
+	}
+
+	var scanner Scanner
+	if c.Clamd != "" {
+		s, err := ParseClamdScanner(c.Clamd)
+		if err != nil {
+			return nil, err
+		}
+		scanner = s
+	}
+
+	var openPGPKeyIDs []uint64
+	if c.RequireOpenPGPTo != "" {
+		f, err := os.Open(c.RequireOpenPGPTo)
+		if err != nil {
+			return nil, err
+		}
+		openPGPKeyIDs, err = OpenPGPKeyIDs(f)
+		f.Close()
+		if err != nil || len(openPGPKeyIDs) == 0 {
+			return nil, errConfigOpenPGPTo
+		}
+	}
+
+	if !validProtectionPatterns(c.Protect) {
+		return nil, errConfigProtect
+	}
+	if _, err := url.Parse(c.RedirectAfterUpload); err != nil {
+		return nil, errConfigRedirect
+	}
+	if c.SuccessStatus != 0 && (c.SuccessStatus < 200 || c.SuccessStatus > 299) {
+		return nil, errConfigSuccessStatus
+	}
+	switch {
+	case c.MaxConcurrentUploads < 0:
+		return nil, errConfigMaxConcurrent
+	case c.MinFilesize < 0:
+		return nil, errConfigMinFilesize
+	case c.PackFilesUpTo < 0:
+		return nil, errConfigPackFilesUpTo
+	case c.CopyBufferSize < 0:
+		return nil, errConfigCopyBufferSize
+	case c.WriterBufferSize < 0:
+		return nil, errConfigWriterBuffer
+	case c.KeepVersions < 0:
+		return nil, errConfigKeepVersions
+	case c.DrainAllowance < 0:
+		return nil, errConfigDrainAllowance
+	}
+	var successHeaders http.Header
+	for name, value := range c.SuccessHeaders {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return nil, errConfigSuccessHeaders
+		}
+		if successHeaders == nil {
+			successHeaders = make(http.Header, len(c.SuccessHeaders))
+		}
+		successHeaders.Set(name, value)
+	}
+
+	windows := make([]TimeWindow, 0, len(c.UploadWindows))
+	for _, s := range c.UploadWindows {
+		w, err := ParseTimeWindow(s)
+		if err != nil {
+			return nil, errConfigUploadWindows
+		}
+		windows = append(windows, w)
+	}
+
+	var encryptionKey []byte
+	if c.EncryptionKey != "" {
+		k, err := base64.StdEncoding.DecodeString(c.EncryptionKey)
+		if err != nil || len(k) != 32 {
+			return nil, errConfigEncryptionKey
+		}
+		encryptionKey = k
+	}
+
+	var receiptKey ed25519.PrivateKey
+	if c.ReceiptKey != "" {
+		seed, err := base64.StdEncoding.DecodeString(c.ReceiptKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errConfigReceiptKey
+		}
+		receiptKey = ed25519.NewKeyFromSeed(seed)
+	}
+
+	keeperID := c.KeyKeeper
+	if len(c.KeyKeepers) == 1 && keeperID == "" {
+		for id := range c.KeyKeepers {
+			keeperID = id
+		}
+	}
+	if _, ok := c.KeyKeepers[keeperID]; len(c.KeyKeepers) > 0 && !ok {
+		return nil, errConfigKeyKeeper
+	}
+	if len(c.KeyKeepers) > 0 && !strings.Contains(c.To, "://") { // Local directories are used without metadata.
+		return nil, errConfigKeyKeepersTo
+	}
+
+	sessions := strings.ToLower(c.UploadSessions)
+	switch sessions {
+	case "", "memory", "bucket":
+	default:
+		return nil, errConfigUploadSessions
+	}
+	var partialUploads PartialUploadPolicy
+	switch strings.ToLower(c.PartialUploads) {
+	case "", "discard":
+	case "keep":
+		partialUploads = KeepPartialUploads
+	case "session":
+		if sessions == "" {
+			return nil, errConfigPartialUploads
+		}
+		partialUploads = ResumePartialUploads
+	default:
+		return nil, errConfigPartialUploads
+	}
+	var locker KeyLocker
+	writeLocking := strings.ToLower(c.WriteLocking)
+	switch writeLocking {
+	case "", "none":
+	case "wait", "reject":
+		locker = NewKeyLocker()
+	default:
+		return nil, errConfigWriteLocking
+	}
+
+	if !open {
+		for _, u := range c.KeyKeepers {
+			if _, err := url.Parse(u); err != nil {
+				return nil, err
+			}
+		}
+		return &Handler{Next: next, Scope: scope, Maintenance: NewMaintenanceMode()}, nil
+	}
+	keepers := make(map[string]*secrets.Keeper, len(c.KeyKeepers))
+	defer func() { // Nothing's left open if the Handler cannot be had.
+		if err != nil {
+			for _, k := range keepers {
+				k.Close()
+			}
+		}
+	}()
+	for id, u := range c.KeyKeepers {
+		k, err := secrets.OpenKeeper(context.Background(), u)
+		if err != nil {
+			return nil, err
+		}
+		keepers[id] = k
+	}
+	h, err = NewHandler(scope, c.To, next)
+	if err != nil {
+		return nil, err
+	}
+	switch sessions {
+	case "memory":
+		h.Sessions = NewMemorySessionStore()
+	case "bucket":
+		h.Sessions = BucketSessionStore{Bucket: h.Bucket}
+	}
+	h.PartialUploads = partialUploads
+	h.Locker = locker
+	h.RejectConcurrentWrites = writeLocking == "reject"
+	h.Host = c.Host
+	h.EnableWebdav = c.EnableWebdav
+	h.ProtectFromDeletion = c.Protect
+	h.ReadOnlyPaths = c.ReadOnly
+	h.MaintainChecksums = c.SHA256Sums
+	h.EnableExistenceChecks = c.EnableExistenceChecks
+	h.EnableDeltaUploads = c.EnableDeltaUploads
+	h.EnableListing = c.EnableListing
+	h.EnableTransactionDownloads = c.EnableTransactionDownloads
+	h.UnicodeForm = form
+	h.RestrictFilenamesTo = alphabet
+	h.FilenameEncoding = filenamesEncoding
+	h.FilenameProfile = filenamesProfile
+	h.RejectSpoofedFilenames = c.FilenamesAntiSpoofing
+	h.EnableFilenameCheck = c.FilenameCheck
+	h.ContentLanguage = contentLanguage
+	h.AssignContentType = c.AssignContentType
+	h.RandomizedSuffixLength = c.RandomSuffixLen
+	h.FinalNameInBody = c.FinalNameInBody
+	h.ApparentLocation = c.PromiseDownloadFrom
+	h.LocationFromRequest = c.LocationFromRequest
+	h.RedirectAfterUpload = c.RedirectAfterUpload
+	h.ServeUploadForm = c.UploadForm
+	h.SuccessStatus = c.SuccessStatus
+	h.SuccessHeaders = successHeaders
+	h.SendLinkHeaders = c.LinkHeaders
+	h.TrustedProxies = proxies
+	if c.TenantFromHeader != "" {
+		h.TenantOf = TenantFromHeader(c.TenantFromHeader)
+	}
+	h.Tenants = c.Tenants
+	h.ContentTypes = c.ContentTypes
+	h.Slots = slots
+	h.MaxFilesize = c.MaxFilesize
+	h.MaxTransactionSize = c.MaxTransactionSize
+	h.MinFilesize = c.MinFilesize
+	h.DenyEmptyFiles = c.DenyEmptyFiles
+	h.DrainAllowance = c.DrainAllowance
+	h.UploadTimeout = time.Duration(c.UploadTimeout)
+	h.IdleReadTimeout = time.Duration(c.IdleReadTimeout)
+	h.StorageClasses = c.StorageClasses
+	h.StorageClassesAllowed = c.StorageClassesAllowed
+	h.TagsAllowed = c.TagsAllowed
+	h.CopyBufferSize = c.CopyBufferSize
+	h.WriterBufferSize = c.WriterBufferSize
+	h.MaxConcurrentUploads = c.MaxConcurrentUploads
+	h.RollbackOnPartError = c.RollbackOnPartError
+	h.ContinueOnPartError = c.ContinueOnPartError
+	h.CaptureFormFields = c.CaptureFormFields
+	h.KeepVersions = c.KeepVersions
+	h.AppendToExisting = c.AppendToExisting
+	h.Quarantine = c.Quarantine
+	h.PackFilesUpTo = c.PackFilesUpTo
+	h.PackName = c.PackName
+	h.SpoolDirectory = c.SpoolDirectory
+	h.EncryptionKey = encryptionKey
+	if len(keepers) > 0 {
+		h.KeyKeepers = keepers
+		h.KeyKeeperID = keeperID
+	}
+	h.ServeDecrypted = c.ServeDecrypted
+	h.ReceiptKey = receiptKey
+	h.PostProcessors = processors
+	if c.RejectMacros {
+		h.Transformers = append(h.Transformers, &MacroDetector{TempDir: c.SpoolDirectory})
+	}
+	if c.SanitizeHTML {
+		h.Transformers = append(h.Transformers, NewHTMLSanitizer())
+	}
+	h.Scanner = scanner
+	h.ScanFailOpen = c.ScanFailOpen
+	h.EnableScrubbing = c.Scrubbing
+	h.RequireOpenPGPTo = openPGPKeyIDs
+	if c.Maintenance {
+		h.Maintenance.Enable(time.Duration(c.RetryAfter))
+	}
+	if len(windows) > 0 {
+		h.UploadWindows = windows
+	}
+	h.AsyncPersist = c.AsyncPersist
+	h.ProgressInterval = time.Duration(c.ProgressInterval)
+	h.EnableProgressEvents = c.ProgressEvents
+	return h, nil
+}
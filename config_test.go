@@ -0,0 +1,248 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoadConfig(t *testing.T) {
+	Convey("LoadConfig", t, func() {
+		Convey("reads all settings", func() {
+			c, err := LoadConfig(strings.NewReader(`{
+				"path": "/wp-uploads",
+				"host": "senpai.asia",
+				"to": "` + scratchDir + `",
+				"enable_webdav": true,
+				"filenames_form": "NFC",
+				"filenames_in": "u0000–u007F",
+				"random_suffix_len": 4,
+				"promise_download_from": "/wp-uploads",
+				"slots": {"/firmware/latest": {"key": "firmware.bin", "content_types": ["application/zip"]}},
+				"max_filesize": 16777216,
+				"max_transaction_size": 33554432
+			}`))
+			So(err, ShouldBeNil)
+
+			h, err := c.NewHandler(nil)
+			So(err, ShouldBeNil)
+			So(h.Scope, ShouldEqual, "/wp-uploads")
+			So(h.Host, ShouldEqual, "senpai.asia")
+			So(h.EnableWebdav, ShouldBeTrue)
+			So(h.UnicodeForm, ShouldNotBeNil)
+			So(h.UnicodeForm.Use, ShouldEqual, norm.NFC)
+			So(h.RestrictFilenamesTo, ShouldHaveLength, 1)
+			So(h.RandomizedSuffixLength, ShouldEqual, 4)
+			So(h.ApparentLocation, ShouldEqual, "/wp-uploads")
+			So(h.Slots["firmware/latest"].Key, ShouldEqual, "firmware.bin")
+			So(h.MaxFilesize, ShouldEqual, 16777216)
+			So(h.MaxTransactionSize, ShouldEqual, 33554432)
+		})
+
+		Convey("rejects unknown settings", func() {
+			_, err := LoadConfig(strings.NewReader(`{"to": "/var/tmp", "max_file_size": 1}`))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("results in errors for unusable values", func() {
+			c := Config{}
+			_, err := c.NewHandler(nil)
+			So(err, ShouldEqual, errConfigNoDestination)
+
+			c = Config{To: scratchDir, FilenamesForm: "NFKC"}
+			_, err = c.NewHandler(nil)
+			So(err, ShouldEqual, errConfigUnknownFormName)
+
+			keepers := map[string]string{"a": "base64key://", "b": "base64key://"}
+			c = Config{To: "file://" + scratchDir, KeyKeepers: keepers}
+			_, err = c.NewHandler(nil)
+			So(err, ShouldEqual, errConfigKeyKeeper)
+
+			c = Config{To: scratchDir, KeyKeepers: keepers, KeyKeeper: "a"}
+			_, err = c.NewHandler(nil)
+			So(err, ShouldEqual, errConfigKeyKeepersTo)
+
+			c = Config{To: scratchDir, FilenamesEncoding: "ebcdic"}
+			_, err = c.NewHandler(nil)
+			So(err, ShouldEqual, errConfigFilenamesEnc)
+
+			c = Config{To: scratchDir, Slots: map[string]Slot{"firmware/latest": {}}}
+			_, err = c.NewHandler(nil)
+			So(err, ShouldEqual, errConfigSlotKey)
+
+			c = Config{To: scratchDir, RequireOpenPGPTo: "config_test.go"}
+			_, err = c.NewHandler(nil)
+			So(err, ShouldEqual, errConfigOpenPGPTo)
+
+			c = Config{To: scratchDir, PartialUploads: "session"}
+			_, err = c.NewHandler(nil)
+			So(err, ShouldEqual, errConfigPartialUploads)
+
+			for _, tc := range []struct {
+				c   Config
+				err error
+			}{
+				{Config{To: scratchDir, MaxConcurrentUploads: -1}, errConfigMaxConcurrent},
+				{Config{To: scratchDir, MinFilesize: -1}, errConfigMinFilesize},
+				{Config{To: scratchDir, PackFilesUpTo: -1}, errConfigPackFilesUpTo},
+				{Config{To: scratchDir, CopyBufferSize: -1}, errConfigCopyBufferSize},
+				{Config{To: scratchDir, WriterBufferSize: -1}, errConfigWriterBuffer},
+				{Config{To: scratchDir, KeepVersions: -1}, errConfigKeepVersions},
+				{Config{To: scratchDir, DrainAllowance: -1}, errConfigDrainAllowance},
+			} {
+				_, err = tc.c.NewHandler(nil)
+				So(err, ShouldEqual, tc.err)
+				So(tc.c.Validate(), ShouldEqual, tc.err)
+			}
+		})
+	})
+}
+
+func TestLoadConfigFormat(t *testing.T) {
+	Convey("LoadConfigFormat", t, func() {
+		Convey("reads YAML", func() {
+			c, err := LoadConfigFormat(strings.NewReader(`
+path: /wp-uploads
+to: `+scratchDir+`
+enable_webdav: true
+upload_timeout: 5m
+slots:
+  /firmware/latest:
+    key: firmware.bin
+max_filesize: 16777216
+`), ConfigYAML)
+			So(err, ShouldBeNil)
+			So(c.Scope, ShouldEqual, "/wp-uploads")
+			So(c.EnableWebdav, ShouldBeTrue)
+			So(c.UploadTimeout, ShouldEqual, Duration(5*time.Minute))
+			So(c.Slots["/firmware/latest"].Key, ShouldEqual, "firmware.bin")
+			So(c.MaxFilesize, ShouldEqual, 16777216)
+		})
+
+		Convey("reads TOML", func() {
+			c, err := LoadConfigFormat(strings.NewReader(`
+path = "/wp-uploads"
+to = "`+scratchDir+`"
+content_types = ["image/*"]
+max_filesize = 16777216
+
+[tenants.a]
+max_filesize = 100
+`), ConfigTOML)
+			So(err, ShouldBeNil)
+			So(c.Scope, ShouldEqual, "/wp-uploads")
+			So(c.ContentTypes, ShouldResemble, []string{"image/*"})
+			So(c.Tenants["a"].MaxFilesize, ShouldEqual, 100)
+			So(c.MaxFilesize, ShouldEqual, 16777216)
+		})
+
+		Convey("rejects unknown settings in any format", func() {
+			_, err := LoadConfigFormat(strings.NewReader("max_file_size: 1\n"), ConfigYAML)
+			So(err, ShouldNotBeNil)
+			_, err = LoadConfigFormat(strings.NewReader("max_file_size = 1\n"), ConfigTOML)
+			So(err, ShouldNotBeNil)
+			_, err = LoadConfigFormat(strings.NewReader("{}"), "ini")
+			So(err, ShouldEqual, errConfigFormat)
+		})
+
+		Convey("is picked by file extension", func() {
+			So(ConfigFormatOf("uploadd.yml"), ShouldEqual, ConfigYAML)
+			So(ConfigFormatOf("uploadd.TOML"), ShouldEqual, ConfigTOML)
+			So(ConfigFormatOf("uploadd.conf"), ShouldEqual, ConfigJSON)
+		})
+	})
+}
+
+func TestConfigLayers(t *testing.T) {
+	Convey("Configs", t, func() {
+		base := NewDefaultConfig("", scratchDir)
+		base.MaxFilesize = 1 << 20
+		base.Tenants = map[string]TenantLimits{"a": {MaxFilesize: 100}}
+
+		Convey("have defaults", func() {
+			So(base.Scope, ShouldEqual, "/")
+			So(NewStrictConfig("/", scratchDir).Validate(), ShouldBeNil)
+		})
+
+		Convey("can be merged with overrides", func() {
+			merged := base.Merge(&Config{
+				EnableWebdav: true,
+				ContentTypes: []string{"image/*"},
+				Tenants:      map[string]TenantLimits{"b": {MaxFilesize: 200}},
+			})
+			So(merged.To, ShouldEqual, scratchDir)
+			So(merged.MaxFilesize, ShouldEqual, 1<<20)
+			So(merged.EnableWebdav, ShouldBeTrue)
+			So(merged.ContentTypes, ShouldResemble, []string{"image/*"})
+			So(merged.Tenants, ShouldHaveLength, 2)
+
+			Convey("which leaves the original as it is", func() {
+				So(base.EnableWebdav, ShouldBeFalse)
+				So(base.Tenants, ShouldHaveLength, 1)
+				So(merged.Equal(base), ShouldBeFalse)
+				So(base.Merge(&Config{}).Equal(base), ShouldBeTrue)
+			})
+
+			Convey("without sharing maps or lists with either", func() {
+				overrides := &Config{ContentTypes: []string{"image/*"}}
+				merged := base.Merge(overrides)
+				merged.Tenants["a"] = TenantLimits{MaxFilesize: 1}
+				merged.ContentTypes[0] = "text/*"
+				So(base.Tenants["a"].MaxFilesize, ShouldEqual, 100)
+				So(overrides.ContentTypes[0], ShouldEqual, "image/*")
+			})
+		})
+
+		Convey("are validated", func() {
+			So(base.Validate(), ShouldBeNil)
+			So(base.Merge(&Config{FilenamesForm: "NFKC"}).Validate(), ShouldEqual, errConfigUnknownFormName)
+			So(base.Merge(&Config{WriteLocking: "eventually"}).Validate(), ShouldEqual, errConfigWriteLocking)
+			So(base.Merge(&Config{PartialUploads: "session"}).Validate(), ShouldEqual, errConfigPartialUploads)
+		})
+
+		Convey("are validated without opening their destination", func() {
+			elsewhere := base.Merge(&Config{To: "nosuchscheme://bucket"})
+			So(elsewhere.Validate(), ShouldBeNil)
+			_, err := elsewhere.NewHandler(nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	Convey("LoadConfig replaces references to environment variables", t, func() {
+		os.Setenv("UPLOAD_TEST_TO", scratchDir)
+		defer os.Unsetenv("UPLOAD_TEST_TO")
+
+		c, err := LoadConfig(strings.NewReader(`{
+			"to": "${UPLOAD_TEST_TO}",
+			"promise_download_from": "https://${UPLOAD_TEST_TO}/$HOME",
+			"key_keepers": {"a": "base64key://${UPLOAD_TEST_TO}"},
+			"max_filesize": 16777216
+		}`))
+		So(err, ShouldBeNil)
+		So(c.To, ShouldEqual, scratchDir)
+		So(c.PromiseDownloadFrom, ShouldEqual, "https://"+scratchDir+"/$HOME")
+		So(c.KeyKeepers["a"], ShouldEqual, "base64key://"+scratchDir)
+		So(c.MaxFilesize, ShouldEqual, 16777216)
+
+		Convey("and rejects those that are not set", func() {
+			_, err := LoadConfig(strings.NewReader(`{"to": "${UPLOAD_TEST_UNSET}"}`))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEndWith, "UPLOAD_TEST_UNSET")
+		})
+
+		Convey("and still rejects unknown settings", func() {
+			_, err := LoadConfig(strings.NewReader(`{"to": "${UPLOAD_TEST_TO}", "max_file_size": 1}`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,31 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"mime"
+	"path"
+)
+
+// metadataContentType is the metadata of files with the type they've been stored with, see AssignContentType.
+// It's passed on to the Bucket as its ContentType as well.
+const metadataContentType = "upload-content-type"
+
+// contentTypeMetadata returns the metadata with the type a file is to be stored with, with AssignContentType:
+// the one that's been declared, unless that's generic, or else the one of its extension.
+// If neither is known, the Bucket gets to sniff it from the file's first bytes.
+func (h *Handler) contentTypeMetadata(urlPath, declared string) map[string]string {
+	if !h.AssignContentType || h.isEncrypting() { // The Bucket will only ever see ciphertext.
+		return nil
+	}
+	ctype := mime.TypeByExtension(path.Ext(urlPath))
+	if mediatype, params, err := mime.ParseMediaType(declared); err == nil &&
+		mediatype != "application/octet-stream" && mediatype != "multipart/form-data" {
+		ctype = mime.FormatMediaType(mediatype, params)
+	}
+	if ctype == "" {
+		return nil
+	}
+	return map[string]string{metadataContentType: ctype}
+}
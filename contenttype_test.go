@@ -0,0 +1,60 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAssignContentType(t *testing.T) {
+	Convey("contentTypeMetadata", t, func() {
+		h := &Handler{AssignContentType: true}
+
+		Convey("prefers the declared type", func() {
+			So(h.contentTypeMetadata("/a.txt", "text/markdown; charset=utf-8"), ShouldResemble,
+				map[string]string{metadataContentType: "text/markdown; charset=utf-8"})
+		})
+
+		Convey("falls back to the extension's if the declared one is generic or missing", func() {
+			So(h.contentTypeMetadata("/a.png", "application/octet-stream"), ShouldResemble,
+				map[string]string{metadataContentType: "image/png"})
+			So(h.contentTypeMetadata("/a.png", ""), ShouldResemble,
+				map[string]string{metadataContentType: "image/png"})
+		})
+
+		Convey("leaves it to the Bucket if neither is known", func() {
+			So(h.contentTypeMetadata("/a", ""), ShouldBeNil)
+		})
+
+		Convey("does nothing if disabled, or for encrypted files", func() {
+			So((&Handler{}).contentTypeMetadata("/a.png", "image/png"), ShouldBeNil)
+			h.EncryptionKey = make([]byte, 32)
+			So(h.contentTypeMetadata("/a.png", "image/png"), ShouldBeNil)
+		})
+	})
+
+	Convey("With AssignContentType files are stored with their type", t, func() {
+		h, _ := NewHandler("/", "file://"+filepath.ToSlash(scratchDir), nil) // Keeps metadata.
+		h.AssignContentType = true
+		tempFName := tempFileName() + ".json"
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		defer os.Remove(filepath.Join(scratchDir, tempFName+".attrs"))
+
+		req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, 201)
+
+		attrs, err := h.Bucket.Attributes(context.Background(), tempFName)
+		So(err, ShouldBeNil)
+		So(attrs.ContentType, ShouldEqual, "application/json")
+	})
+}
@@ -0,0 +1,77 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Metadata of files with the dates from parameters "creation-date" and "modification-date"
+// of header "Content-Disposition" (RFC 2183), in the format of RFC 3339.
+const (
+	metadataCreationDate     = "upload-creation-date"
+	metadataModificationDate = "upload-modification-date"
+)
+
+// dispositionDates returns the metadata for parameters "creation-date" and "modification-date"
+// of a header "Content-Disposition", if there are any. Dates that cannot be parsed are ignored.
+func dispositionDates(header string) map[string]string {
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return nil
+	}
+	var metadata map[string]string
+	for param, key := range map[string]string{
+		"creation-date":     metadataCreationDate,
+		"modification-date": metadataModificationDate,
+	} {
+		if params[param] == "" {
+			continue
+		}
+		t, err := mail.ParseDate(params[param]) // RFC 822 and its successors.
+		if err != nil {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string, 2)
+		}
+		metadata[key] = t.UTC().Format(time.RFC3339)
+	}
+	return metadata
+}
+
+// mergeMetadata returns a map with all of a's and b's entries.
+func mergeMetadata(a, b map[string]string) map[string]string {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	merged := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+// applyModificationDate sets the modification time of files in local directories,
+// which else would not retain it, from their metadata.
+func (h *Handler) applyModificationDate(key string, metadata map[string]string) {
+	if h.localDirectory == "" || metadata[metadataModificationDate] == "" {
+		return
+	}
+	t, err := time.Parse(time.RFC3339, metadata[metadataModificationDate])
+	if err != nil {
+		return
+	}
+	os.Chtimes(filepath.Join(h.localDirectory, filepath.FromSlash(key)), t, t)
+}
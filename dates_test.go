@@ -0,0 +1,80 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDispositionDates(t *testing.T) {
+	Convey("dispositionDates", t, func() {
+		Convey("reads both dates", func() {
+			metadata := dispositionDates(`attachment; filename="a.txt"; ` +
+				`creation-date="Wed, 12 Feb 1997 16:29:51 -0500"; modification-date="Thu, 13 Feb 1997 08:00:00 +0000"`)
+			So(metadata, ShouldResemble, map[string]string{
+				metadataCreationDate:     "1997-02-12T21:29:51Z",
+				metadataModificationDate: "1997-02-13T08:00:00Z",
+			})
+		})
+
+		Convey("ignores dates that cannot be parsed", func() {
+			So(dispositionDates(`attachment; modification-date="yesterday"`), ShouldBeNil)
+			So(dispositionDates(`attachment; filename="a.txt"`), ShouldBeNil)
+		})
+	})
+}
+
+func TestPreservedDates(t *testing.T) {
+	postWithDates := func(h *Handler, fileName string) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="A"; filename="`+fileName+`"; `+
+			`creation-date="Wed, 12 Feb 1997 16:29:51 -0500"; modification-date="Thu, 13 Feb 1997 08:00:00 +0000"`)
+		p, _ := writer.CreatePart(header)
+		p.Write([]byte("DELME"))
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	Convey("Dates of parts of MIME Multipart uploads", t, func() {
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		defer os.Remove(filepath.Join(scratchDir, tempFName+".attrs"))
+
+		Convey("are kept as modification time in local directories", func() {
+			h, _ := NewHandler("/", scratchDir, next)
+			So(postWithDates(h, tempFName), ShouldEqual, 201)
+
+			fi, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(err, ShouldBeNil)
+			So(fi.ModTime().UTC(), ShouldEqual, time.Date(1997, 2, 13, 8, 0, 0, 0, time.UTC))
+		})
+
+		Convey("are kept as metadata by Buckets that support it", func() {
+			h, _ := NewHandler("/", "file://"+filepath.ToSlash(scratchDir), next) // Keeps metadata.
+			So(postWithDates(h, tempFName), ShouldEqual, 201)
+
+			attrs, err := h.Bucket.Attributes(context.Background(), tempFName)
+			So(err, ShouldBeNil)
+			So(attrs.Metadata[metadataCreationDate], ShouldEqual, "1997-02-12T21:29:51Z")
+			So(attrs.Metadata[metadataModificationDate], ShouldEqual, "1997-02-13T08:00:00Z")
+		})
+	})
+}
@@ -0,0 +1,186 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// Errors of DELETE with a manifest.
+const (
+	errManifestMalformed coreUploadError = "The list of files to delete is malformed"
+	errManifestTooLarge  coreUploadError = "The list of files to delete is too long"
+	errNotRecursive      coreUploadError = "Deleting directories needs query 'recursive'"
+)
+
+// maxManifestSize caps the body of DELETE with a manifest, in bytes.
+const maxManifestSize = 1 << 20
+
+// DeleteManifest is the body of DELETE with a manifest in format "application/json".
+type DeleteManifest struct {
+	Paths []string `json:"paths"` // Relative to the request's path. Those ending in '/' are directories.
+}
+
+// PathStatus is the outcome of deleting one path of a DeleteManifest,
+// as reported in responses with status 207 (Multi-Status).
+type PathStatus struct {
+	Path    string `json:"path"`
+	Status  int    `json:"status"`
+	Deleted int    `json:"deleted,omitempty"` // Files, for directories.
+	Detail  string `json:"detail,omitempty"`
+}
+
+// isBatchDelete is true for DELETE with a body to a directory, or the Scope.
+func (h *Handler) isBatchDelete(r *http.Request) bool {
+	return r.Method == http.MethodDelete && r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 &&
+		(strings.HasSuffix(r.URL.Path, "/") || r.URL.Path == h.Scope)
+}
+
+// serveBatchDelete deletes all files listed in the body, either as JSON (see DeleteManifest) or plain text
+// with one path per line, and answers with the outcome of each as 207 (Multi-Status).
+//
+// All paths are checked before anything gets deleted, and if any is invalid none is.
+// Directories, with everything below, are deleted only if the request has query "recursive".
+func (h *Handler) serveBatchDelete(w http.ResponseWriter, r *http.Request) (int, error) {
+	paths, retval, err := readDeleteManifest(r)
+	if err != nil {
+		return retval, err
+	}
+	_, recursive := r.URL.Query()["recursive"]
+	base := strings.TrimSuffix(r.URL.Path, "/") + "/"
+
+	keys := make([]string, len(paths))
+	for i, p := range paths {
+		isDir := strings.HasSuffix(p, "/")
+		if isDir && !recursive {
+			return http.StatusBadRequest, errNotRecursive
+		}
+		key, err := h.translateToKey(base + strings.TrimPrefix(p, "/"))
+		if err != nil || key == "" {
+			return http.StatusUnprocessableEntity, errInvalidFileName
+		}
+		if isDir {
+			key += "/"
+		}
+		keys[i] = key
+	}
+
+	report := MultiStatus{Paths: make([]PathStatus, 0, len(paths))}
+	for i, key := range keys {
+		status := PathStatus{Path: paths[i], Status: http.StatusNoContent}
+		var (
+			err       error
+			protected int
+		)
+		switch {
+		case strings.HasSuffix(key, "/"):
+			status.Deleted, protected, err = h.deleteBelow(r.Context(), key)
+		case h.isProtected(key) || h.isReadOnly(key):
+			protected = 1
+		default:
+			err = h.Bucket.Delete(r.Context(), key)
+			h.updateChecksums(r.Context(), key)
+		}
+		switch {
+		case err == nil && protected > 0:
+			status.Status, status.Detail = http.StatusForbidden, errProtected.Error()
+		case gcerrors.Code(err) == gcerrors.NotFound || (err == nil && strings.HasSuffix(key, "/") && status.Deleted == 0):
+			status.Status = http.StatusNotFound
+		case err != nil:
+			status.Status, status.Detail = http.StatusInternalServerError, err.Error()
+		}
+		report.Paths = append(report.Paths, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusMultiStatus)
+	json.NewEncoder(w).Encode(report)
+	return statusSent, nil
+}
+
+// readDeleteManifest returns the paths listed in the request's body.
+func readDeleteManifest(r *http.Request) ([]string, int, error) {
+	if r.ContentLength > maxManifestSize {
+		return nil, http.StatusRequestEntityTooLarge, errManifestTooLarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, errManifestMalformed
+	}
+	if len(body) > maxManifestSize {
+		return nil, http.StatusRequestEntityTooLarge, errManifestTooLarge
+	}
+
+	var paths []string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var m DeleteManifest
+		if err := json.Unmarshal(body, &m); err != nil {
+			return nil, http.StatusBadRequest, errManifestMalformed
+		}
+		paths = m.Paths
+	case "", "text/plain":
+		s := bufio.NewScanner(bytes.NewReader(body))
+		s.Buffer(make([]byte, 0, 4096), maxManifestSize)
+		for s.Scan() {
+			if line := strings.TrimSpace(s.Text()); line != "" {
+				paths = append(paths, line)
+			}
+		}
+	default:
+		return nil, http.StatusUnsupportedMediaType, errUnknownEnvelopeFormat
+	}
+	for _, p := range paths {
+		if path.Clean("/"+p) == "/" {
+			return nil, http.StatusUnprocessableEntity, errInvalidFileName
+		}
+	}
+	if len(paths) == 0 {
+		return nil, http.StatusBadRequest, errManifestMalformed
+	}
+	return paths, 0, nil
+}
+
+// deleteBelow deletes all files whose keys start with prefix, except those that are protected or read-only,
+// and returns how many have been deleted and how many not for that.
+func (h *Handler) deleteBelow(ctx context.Context, prefix string) (n, protected int, err error) {
+	var deleted []string
+	defer func() { h.updateChecksums(ctx, deleted...) }()
+	iter := h.Bucket.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF || (err != nil && gcerrors.Code(err) == gcerrors.NotFound) {
+			return n, protected, nil
+		}
+		if err != nil {
+			return n, protected, err
+		}
+		if obj.IsDir || h.isChecksumsFile(obj.Key) { // The latter goes once it lists no files.
+			continue
+		}
+		if h.isProtected(obj.Key) || h.isReadOnly(obj.Key) {
+			protected++
+			continue
+		}
+		if err := h.Bucket.Delete(ctx, obj.Key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return n, protected, err
+		}
+		deleted = append(deleted, obj.Key)
+		n++
+	}
+}
@@ -0,0 +1,80 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBatchDelete(t *testing.T) {
+	Convey("DELETE with a manifest", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.EnableWebdav = true
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+		for _, name := range []string{"a", "b", "logs/1", "logs/2"} {
+			os.MkdirAll(filepath.Dir(filepath.Join(scratchDir, dir, name)), 0755)
+			ioutil.WriteFile(filepath.Join(scratchDir, dir, name), []byte("DELME"), 0644)
+		}
+
+		del := func(target, ctype, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("DELETE", target, strings.NewReader(body))
+			req.Header.Set("Content-Type", ctype)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+		exists := func(name string) bool {
+			_, err := os.Stat(filepath.Join(scratchDir, dir, name))
+			return err == nil
+		}
+
+		Convey("in plain text removes the files listed, and reports on each", func() {
+			w := del("/"+dir+"/", "text/plain", "a\n\nmissing\n")
+			So(w.Code, ShouldEqual, 207)
+			var report MultiStatus
+			So(json.Unmarshal(w.Body.Bytes(), &report), ShouldBeNil)
+			So(report.Paths, ShouldResemble, []PathStatus{
+				{Path: "a", Status: 204},
+				{Path: "missing", Status: 404},
+			})
+			So(exists("a"), ShouldBeFalse)
+			So(exists("b"), ShouldBeTrue)
+		})
+
+		Convey("in JSON, relative to the Scope", func() {
+			w := del("/", "application/json", `{"paths": ["`+dir+`/a", "/`+dir+`/b"]}`)
+			So(w.Code, ShouldEqual, 207)
+			So(exists("a"), ShouldBeFalse)
+			So(exists("b"), ShouldBeFalse)
+		})
+
+		Convey("removes directories only with query 'recursive'", func() {
+			So(del("/"+dir+"/", "text/plain", "a\nlogs/").Code, ShouldEqual, 400)
+			So(exists("a"), ShouldBeTrue)
+
+			w := del("/"+dir+"/?recursive", "text/plain", "logs/")
+			So(w.Code, ShouldEqual, 207)
+			var report MultiStatus
+			json.Unmarshal(w.Body.Bytes(), &report)
+			So(report.Paths, ShouldResemble, []PathStatus{{Path: "logs/", Status: 204, Deleted: 2}})
+			So(exists("logs/1"), ShouldBeFalse)
+		})
+
+		Convey("removes nothing if any path is invalid", func() {
+			So(del("/"+dir+"/", "text/plain", "a\n../../etc/passwd").Code, ShouldEqual, 422)
+			So(del("/"+dir+"/?recursive", "text/plain", "a\n/").Code, ShouldEqual, 422)
+			So(del("/"+dir+"/", "application/json", `{"paths": "a"}`).Code, ShouldEqual, 400)
+			So(exists("a"), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,183 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/gcerrors"
+)
+
+// deltaBlockSize is the granularity of block checksums and "copy" instructions.
+const deltaBlockSize = 64 << 10
+
+// deltaContentType is expected of PATCH requests that carry delta instructions.
+const deltaContentType = "application/vnd.blitznote.delta"
+
+const errDeltaMalformed coreUploadError = "Delta instructions are malformed, or refer to blocks that do not exist"
+
+// isBlockChecksumsRequest is true for GET with query "block-checksums".
+func (h *Handler) isBlockChecksumsRequest(r *http.Request) bool {
+	if !h.EnableDeltaUploads || h.isEncrypting() || r.Method != http.MethodGet {
+		return false
+	}
+	_, ok := r.URL.Query()["block-checksums"]
+	return ok
+}
+
+// serveBlockChecksums responds with the SHA-256 sum of every block of the file, one per line in hex,
+// so that clients can tell which blocks they need to send in a delta upload.
+// The last block can be shorter. Header "Block-Size" has the size of the others.
+func (h *Handler) serveBlockChecksums(w http.ResponseWriter, r *http.Request) (int, error) {
+	key, err := h.translateToKey(r.URL.Path)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	blob, err := h.Bucket.NewReader(r.Context(), key, nil)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return http.StatusNotFound, nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Block checksums failed")
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Block-Size", strconv.Itoa(deltaBlockSize))
+	w.WriteHeader(http.StatusOK)
+	block := make([]byte, deltaBlockSize)
+	for {
+		n, err := io.ReadFull(blob, block)
+		if n > 0 {
+			sum := sha256.Sum256(block[:n])
+			io.WriteString(w, hex.EncodeToString(sum[:])+"\n")
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			break // Too late for a different status code. The client will notice that lines are missing.
+		}
+	}
+	return statusSent, nil
+}
+
+// serveDeltaUpload handles PATCH, which replaces a file by one reconstructed from
+// blocks of it and new data. The body is a sequence of these instructions:
+//  copy <index>\n           appends block <index> of the existing file
+//  data <length>\n<bytes>   appends the <length> bytes that follow
+func (h *Handler) serveDeltaUpload(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), deltaContentType) {
+		return http.StatusUnsupportedMediaType, errUnknownEnvelopeFormat
+	}
+	key, err := h.translateToKey(r.URL.Path)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	unlock, retval, err := h.lockKey(r.Context(), key)
+	if err != nil {
+		return retval, err
+	}
+	defer unlock()
+	attrs, err := h.Bucket.Attributes(r.Context(), key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return http.StatusNotFound, nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Delta upload failed")
+	}
+	h.updateChecksums(r.Context(), key)
+
+	// The file is written under the same key, which is fine as it's replaced only on persist.
+	var (
+		sink             io.Writer
+		discard, persist func() error
+	)
+	if h.SpoolDirectory != "" {
+		sink, discard, persist, err = h.newSpoolSink(r.Context(), key, nil)
+	} else {
+		sink, discard, persist, err = h.newBlobSink(r.Context(), key, nil, attrs.Size) // Likely about the same.
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	bytesWritten, retval, err := h.applyDelta(r.Context(), key, attrs.Size, sink, bufio.NewReader(r.Body))
+	if err == nil && h.MaxFilesize > 0 && bytesWritten > h.MaxFilesize {
+		retval, err = http.StatusRequestEntityTooLarge, errFileTooLarge
+	}
+	if err != nil {
+		discard()
+		return retval, err
+	}
+	if err := h.keepVersion(r.Context(), key); err != nil {
+		discard()
+		return http.StatusInternalServerError, err
+	}
+	if err := persist(); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Delta upload failed")
+	}
+	h.addLocation(w, r, key)
+	return http.StatusCreated, nil
+}
+
+// applyDelta writes to w what the instructions from r describe.
+func (h *Handler) applyDelta(ctx context.Context, key string, oldSize int64,
+	w io.Writer, r *bufio.Reader) (int64, int, error) {
+	var bytesWritten int64
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return bytesWritten, http.StatusCreated, nil
+		}
+		if err != nil {
+			return bytesWritten, http.StatusBadRequest, errDeltaMalformed
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return bytesWritten, http.StatusBadRequest, errDeltaMalformed
+		}
+		arg, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || arg < 0 {
+			return bytesWritten, http.StatusBadRequest, errDeltaMalformed
+		}
+
+		var n int64
+		switch fields[0] {
+		case "copy":
+			offset := arg * deltaBlockSize
+			if offset >= oldSize {
+				return bytesWritten, http.StatusUnprocessableEntity, errDeltaMalformed
+			}
+			block, err := h.Bucket.NewRangeReader(ctx, key, offset, deltaBlockSize, nil)
+			if err != nil {
+				return bytesWritten, http.StatusInternalServerError, err
+			}
+			n, err = io.Copy(w, block)
+			block.Close()
+			if err != nil {
+				return bytesWritten + n, http.StatusInternalServerError, err
+			}
+		case "data":
+			if h.MaxFilesize > 0 && bytesWritten+arg > h.MaxFilesize {
+				return bytesWritten, http.StatusRequestEntityTooLarge, errFileTooLarge
+			}
+			n, err = io.CopyN(w, r, arg)
+			if err != nil {
+				return bytesWritten + n, http.StatusBadRequest, errDeltaMalformed
+			}
+		default:
+			return bytesWritten, http.StatusBadRequest, errDeltaMalformed
+		}
+		bytesWritten += n
+	}
+}
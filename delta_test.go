@@ -0,0 +1,74 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeltaUploads(t *testing.T) {
+	Convey("Delta uploads", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.EnableDeltaUploads = true
+
+		tempFName := tempFileName()
+		fullPath := filepath.Join(scratchDir, tempFName)
+		defer os.Remove(fullPath)
+		original := append(bytes.Repeat([]byte{'a'}, deltaBlockSize), bytes.Repeat([]byte{'b'}, 10)...)
+		ioutil.WriteFile(fullPath, original, 0644)
+
+		Convey("start with checksums of all blocks", func() {
+			req := httptest.NewRequest("GET", "/"+tempFName+"?block-checksums", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+			first, last := sha256.Sum256(original[:deltaBlockSize]), sha256.Sum256(original[deltaBlockSize:])
+			So(w.Body.String(), ShouldEqual, hex.EncodeToString(first[:])+"\n"+hex.EncodeToString(last[:])+"\n")
+		})
+
+		Convey("reconstruct the file from old blocks and new data", func() {
+			body := "data 3\nxyzcopy 1\ncopy 0\n"
+			req := httptest.NewRequest("PATCH", "/"+tempFName, strings.NewReader(body))
+			req.Header.Set("Content-Type", deltaContentType)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 201)
+			expected := append([]byte("xyz"), original[deltaBlockSize:]...)
+			expected = append(expected, original[:deltaBlockSize]...)
+			compareContents(fullPath, expected)
+		})
+
+		Convey("keep the file if instructions are malformed", func() {
+			for _, body := range []string{"copy 2\n", "data 10\nxyz", "move 0\n"} {
+				req := httptest.NewRequest("PATCH", "/"+tempFName, strings.NewReader(body))
+				req.Header.Set("Content-Type", deltaContentType)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+
+				So(w.Code, ShouldBeIn, 400, 422)
+				compareContents(fullPath, original)
+			}
+		})
+
+		Convey("are passed on if not enabled", func() {
+			h.EnableDeltaUploads = false
+			req := httptest.NewRequest("PATCH", "/"+tempFName, strings.NewReader("copy 0\n"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 418)
+		})
+	})
+}
@@ -0,0 +1,186 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Errors of uploads whose contents don't match what has been declared.
+const (
+	errDigestMismatch coreUploadError = "Header or trailer 'Digest' does not match the contents"
+	errLengthMismatch coreUploadError = "Trailer 'Content-Length' does not match the contents"
+)
+
+// digestAlgorithms are the ones from RFC 3230 and RFC 5843 that will be verified.
+// Those of the standard library use CPU extensions where available: SSE 4.2 for CRC32C, and SHA-NI.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+	"crc32c":  func() hash.Hash { return crc32.New(castagnoli) },
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// hashPipelineDepth is how many buffers can be in flight to the hashing goroutine,
+// which lets the next read overlap with hashing the previous ones.
+const hashPipelineDepth = 4
+
+// parseDigests splits the value of a header "Digest" into algorithm (in lowercase) and value.
+func parseDigests(value string) map[string]string {
+	digests := make(map[string]string)
+	for _, field := range strings.Split(value, ",") {
+		idx := strings.IndexByte(field, '=')
+		if idx < 1 {
+			continue
+		}
+		alg := strings.ToLower(strings.TrimSpace(field[:idx]))
+		digests[alg] = strings.TrimSpace(field[idx+1:])
+	}
+	return digests
+}
+
+// digestVerifier reads the request body, and once it's been read entirely
+// compares its length and digests to what the client has declared in trailers, or header "Digest".
+//
+// Streaming clients often know those only at the end, and send them as trailers with chunked transfer encoding.
+// On any mismatch the read returns err instead of io.EOF, which makes the upload get discarded.
+//
+// Hashing is done in a goroutine of its own, so that it doesn't hold up writing what's been read.
+// Call stop once done with the body, in case it's not been read to its end.
+type digestVerifier struct {
+	io.ReadCloser
+	r *http.Request
+
+	hashes map[string]hash.Hash
+	n      int64
+	err    error
+
+	chunks chan []byte   // To be hashed, in order.
+	free   chan []byte   // Buffers that have been hashed and can be reused.
+	done   chan struct{} // Closed after all chunks have been hashed.
+}
+
+// withDigestVerification returns r with a body that gets verified,
+// if the client has declared any digest, or a length in a trailer.
+// The returned *digestVerifier is nil if not.
+func withDigestVerification(r *http.Request) (*http.Request, *digestVerifier) {
+	_, digestInTrailer := r.Trailer["Digest"]
+	_, lengthInTrailer := r.Trailer["Content-Length"]
+	declared := r.Header.Get("Digest")
+	if (declared == "" && !digestInTrailer && !lengthInTrailer) || r.Body == nil || r.Body == http.NoBody {
+		return r, nil
+	}
+
+	d := &digestVerifier{
+		ReadCloser: r.Body,
+		r:          r,
+		hashes:     make(map[string]hash.Hash),
+	}
+	switch {
+	case digestInTrailer: // Which algorithms is unknown until the end.
+		for alg, newHash := range digestAlgorithms {
+			d.hashes[alg] = newHash()
+		}
+	case declared != "":
+		for alg := range parseDigests(declared) {
+			if newHash, ok := digestAlgorithms[alg]; ok {
+				d.hashes[alg] = newHash()
+			}
+		}
+	}
+
+	if len(d.hashes) > 0 {
+		d.chunks = make(chan []byte, hashPipelineDepth)
+		d.free = make(chan []byte, hashPipelineDepth)
+		d.done = make(chan struct{})
+		for i := 0; i < hashPipelineDepth; i++ {
+			d.free <- nil // Allocated on first use, in the size of the reads.
+		}
+		go d.hash(d.chunks)
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Body = d
+	return r2, d
+}
+
+// hash feeds all chunks to the hashes.
+func (d *digestVerifier) hash(chunks <-chan []byte) {
+	defer close(d.done)
+	for chunk := range chunks {
+		for _, h := range d.hashes {
+			h.Write(chunk)
+		}
+		d.free <- chunk
+	}
+}
+
+// stop ends hashing, and waits until everything that's been read has been hashed.
+// It's safe to call this more than once.
+func (d *digestVerifier) stop() {
+	if d == nil || d.chunks == nil {
+		return
+	}
+	close(d.chunks)
+	d.chunks = nil
+	<-d.done
+}
+
+func (d *digestVerifier) Read(b []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.ReadCloser.Read(b)
+	d.n += int64(n)
+	if n > 0 && d.chunks != nil {
+		chunk := <-d.free
+		if cap(chunk) < n {
+			chunk = make([]byte, len(b))
+		}
+		d.chunks <- append(chunk[:0], b[:n]...)
+	}
+	if err == io.EOF {
+		d.stop()
+		if d.err = d.verify(); d.err != nil {
+			return n, d.err
+		}
+	}
+	return n, err
+}
+
+// verify is called after the body has been read and hashed, when trailers are available.
+func (d *digestVerifier) verify() error {
+	if v := d.r.Trailer.Get("Content-Length"); v != "" {
+		if expected, err := strconv.ParseInt(v, 10, 64); err != nil || expected != d.n {
+			return errLengthMismatch
+		}
+	}
+
+	declared := d.r.Header.Get("Digest")
+	if v := d.r.Trailer.Get("Digest"); v != "" {
+		declared = v
+	}
+	for alg, expected := range parseDigests(declared) {
+		h, ok := d.hashes[alg]
+		if !ok {
+			continue // Unsupported, which RFC 3230 permits to ignore.
+		}
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != expected {
+			return errDigestMismatch
+		}
+	}
+	return nil
+}
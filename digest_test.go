@@ -0,0 +1,86 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDigestVerification(t *testing.T) {
+	Convey("Uploads with a declared digest", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		sum := sha256.Sum256([]byte("DELME"))
+		digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+		put := func(tempFName string, header, trailer http.Header) int {
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			req.ContentLength = -1
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			req.Trailer = trailer
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("are accepted if it matches", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			So(put(tempFName, http.Header{"Digest": {digest + ", unknown=abc"}}, nil), ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("DELME"))
+		})
+
+		Convey("are accepted if it matches, if sent as trailer", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			trailer := http.Header{"Digest": {digest}, "Content-Length": {"5"}}
+			So(put(tempFName, nil, trailer), ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("DELME"))
+		})
+
+		Convey("are accepted if it matches, for CRC32C", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			crc := make([]byte, 4)
+			binary.BigEndian.PutUint32(crc, crc32.Checksum([]byte("DELME"), crc32.MakeTable(crc32.Castagnoli)))
+			header := http.Header{"Digest": {"crc32c=" + base64.StdEncoding.EncodeToString(crc)}}
+			So(put(tempFName, header, nil), ShouldEqual, 201)
+
+			header = http.Header{"Digest": {"crc32c=AAAAAA=="}}
+			So(put(tempFileName(), header, nil), ShouldEqual, 422)
+		})
+
+		Convey("stop being hashed if the body is not read to its end", func() {
+			h.MaxFilesize = 2
+			before := runtime.NumGoroutine()
+			So(put(tempFileName(), http.Header{"Digest": {digest}}, nil), ShouldEqual, 413)
+			So(runtime.NumGoroutine(), ShouldBeLessThanOrEqualTo, before)
+		})
+
+		Convey("are rejected and discarded on any mismatch", func() {
+			for _, trailer := range []http.Header{
+				{"Digest": {"sha-256=" + base64.StdEncoding.EncodeToString(make([]byte, 32))}},
+				{"Content-Length": {"4"}},
+			} {
+				tempFName := tempFileName()
+				So(put(tempFName, nil, trailer), ShouldEqual, 422)
+				_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			}
+		})
+	})
+}
@@ -0,0 +1,456 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/gcerrors"
+)
+
+// Files get encrypted in chunks of this size, each with its own authentication tag,
+// so that they can be decrypted while they're streamed.
+const encryptionChunkSize = 64 << 10
+
+// encryptionMagic starts every encrypted file, and is followed by a random nonce prefix.
+const encryptionMagic = "upl\x01"
+
+const encryptionNoncePrefixSize = 7
+
+// Metadata of files with their own key, which has been wrapped by one of Handler.KeyKeepers.
+const (
+	metadataKeyID      = "upload-key-id"
+	metadataWrappedKey = "upload-wrapped-key"
+)
+
+const (
+	errDecryptionFailed coreUploadError = "File could not be decrypted, or has been tampered with"
+	errUnknownKeyKeeper coreUploadError = "No such KeyKeeper"
+)
+
+// newAEAD returns AES-GCM for a key of 32 bytes (AES-256).
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("Encryption keys must be 32 bytes long")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce is the nonce prefix, the chunk's number, and a flag for the last chunk.
+// With the latter, truncating files at a chunk boundary will be noticed.
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptingWriter encrypts everything written to it in chunks, and passes those on to w.
+// Close writes the last chunk, and does not close w.
+type encryptingWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newEncryptingWriter(key []byte, w io.Writer) (*encryptingWriter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, encryptionNoncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, encryptionMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is written only once more follows, because the last one is marked as such.
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	sealed := e.aead.Seal(e.buf[:0], chunkNonce(e.prefix, e.counter, last), e.buf, nil)
+	e.counter++
+	_, err := e.w.Write(sealed)
+	e.buf = e.buf[:0]
+	return err
+}
+
+// Close writes the last chunk, which is empty for empty files.
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptingReader is the counterpart to encryptingWriter.
+type decryptingReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	chunk   []byte // The plaintext not yet read, in buf.
+	done    bool
+}
+
+// NewDecryptingReader returns a reader of the plaintext of a file that has been stored
+// with Handler.EncryptionKey set to the same key.
+// Reads return an error once anything has been found to be tampered with.
+func NewDecryptingReader(key []byte, r io.Reader) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := readEncryptionHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptingReader(aead, prefix, r, 0), nil
+}
+
+// encryptionHeaderSize is that of encryptionMagic and the nonce prefix that follows it.
+const encryptionHeaderSize = len(encryptionMagic) + encryptionNoncePrefixSize
+
+// readEncryptionHeader returns the nonce prefix of an encrypted file.
+func readEncryptionHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errDecryptionFailed
+	}
+	return header[len(encryptionMagic):], nil
+}
+
+// newDecryptingReader decrypts r, which starts with the chunk of the given number.
+func newDecryptingReader(aead cipher.AEAD, prefix []byte, r io.Reader, counter uint32) *decryptingReader {
+	return &decryptingReader{
+		r:       bufio.NewReaderSize(r, encryptionChunkSize+aead.Overhead()),
+		aead:    aead,
+		prefix:  prefix,
+		counter: counter,
+		buf:     make([]byte, encryptionChunkSize+aead.Overhead()),
+	}
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (d *decryptingReader) open() error {
+	sealed := d.buf
+	n, err := io.ReadFull(d.r, sealed)
+	switch err {
+	case nil:
+		// The last chunk can be a full one, which is known only once nothing follows.
+		if _, perr := d.r.Peek(1); perr == io.EOF {
+			d.done = true
+		}
+	case io.ErrUnexpectedEOF:
+		d.done = true
+	default:
+		return errDecryptionFailed
+	}
+	plaintext, err := d.aead.Open(sealed[:0], chunkNonce(d.prefix, d.counter, d.done), sealed[:n], nil)
+	if err != nil {
+		return errDecryptionFailed
+	}
+	d.counter++
+	d.chunk = plaintext
+	return nil
+}
+
+// plaintextSize derives the size of the plaintext from that of an encrypted file.
+func plaintextSize(encryptedSize int64) int64 {
+	const overhead = 16 // of AES-GCM
+	size := encryptedSize - int64(len(encryptionMagic)) - encryptionNoncePrefixSize
+	chunks := (size + encryptionChunkSize + overhead - 1) / (encryptionChunkSize + overhead)
+	if chunks < 1 {
+		chunks = 1
+	}
+	return size - chunks*overhead
+}
+
+// isEncrypting is true if files are encrypted at rest.
+func (h *Handler) isEncrypting() bool {
+	return len(h.EncryptionKey) > 0 || len(h.KeyKeepers) > 0
+}
+
+// newFileKey returns the key to encrypt a new file with, and the metadata to store along with the file.
+// With KeyKeepers that's a random key for this file alone, which is stored wrapped by the current KeyKeeper.
+func (h *Handler) newFileKey(ctx context.Context) ([]byte, map[string]string, error) {
+	if len(h.KeyKeepers) == 0 {
+		return h.EncryptionKey, nil, nil
+	}
+	keeper, ok := h.KeyKeepers[h.KeyKeeperID]
+	if !ok {
+		return nil, nil, errUnknownKeyKeeper
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := keeper.Encrypt(ctx, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Wrapping the file's key failed")
+	}
+	return key, map[string]string{
+		metadataKeyID:      h.KeyKeeperID,
+		metadataWrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+	}, nil
+}
+
+// fileKey returns the key a file has been encrypted with, given its metadata.
+// Files without a wrapped key are from before KeyKeepers had been set, and use EncryptionKey.
+func (h *Handler) fileKey(ctx context.Context, metadata map[string]string) ([]byte, error) {
+	encoded, ok := metadata[metadataWrappedKey]
+	if !ok {
+		if len(h.EncryptionKey) == 0 {
+			return nil, errDecryptionFailed
+		}
+		return h.EncryptionKey, nil
+	}
+	keeper, ok := h.KeyKeepers[metadata[metadataKeyID]]
+	if !ok {
+		return nil, errUnknownKeyKeeper
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errDecryptionFailed
+	}
+	key, err := keeper.Decrypt(ctx, wrapped)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unwrapping the file's key failed")
+	}
+	return key, nil
+}
+
+// encryptSink wraps a sink so that what is written to it gets encrypted with the given key.
+func (h *Handler) encryptSink(key []byte, sink io.Writer, discard, persist func() error) (io.Writer, func() error, error) {
+	ew, err := newEncryptingWriter(key, sink)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ew, func() error {
+		if err := ew.Close(); err != nil {
+			discard()
+			return err
+		}
+		return persist()
+	}, nil
+}
+
+// blobReader is a reader of the contents of a file, decrypted if need be.
+type blobReader struct {
+	io.Reader
+	io.Closer
+}
+
+// newBlobReader returns the file's plaintext.
+func (h *Handler) newBlobReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return h.newBlobReaderFrom(ctx, key, 0)
+}
+
+// newBlobReaderFrom returns the file's plaintext from offset on.
+// Of encrypted files, only the chunks from that with the offset on get read and decrypted.
+func (h *Handler) newBlobReaderFrom(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	if !h.isEncrypting() {
+		return h.Bucket.NewRangeReader(ctx, key, offset, -1, nil)
+	}
+	var metadata map[string]string
+	if len(h.KeyKeepers) > 0 {
+		attrs, err := h.Bucket.Attributes(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		metadata = attrs.Metadata
+	}
+	header, err := h.Bucket.NewRangeReader(ctx, key, 0, int64(encryptionHeaderSize), nil)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := readEncryptionHeader(header)
+	header.Close()
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := h.fileKey(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := offset / encryptionChunkSize
+	start := int64(encryptionHeaderSize) + chunk*int64(encryptionChunkSize+aead.Overhead())
+	blob, err := h.Bucket.NewRangeReader(ctx, key, start, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	r := newDecryptingReader(aead, prefix, blob, uint32(chunk))
+	if _, err := io.CopyN(ioutil.Discard, r, offset-chunk*encryptionChunkSize); err != nil {
+		blob.Close()
+		return nil, errDecryptionFailed
+	}
+	return blobReader{r, blob}, nil
+}
+
+// serveDecrypted answers GET and HEAD with the plaintext of encrypted files if ServeDecrypted is set
+// and AuthorizeDecryption, if any, allows it. Anything else is passed on to Next.
+// A single range of bytes can be requested, for which just the chunks it spans get decrypted.
+func (h *Handler) serveDecrypted(w http.ResponseWriter, r *http.Request) (int, error) {
+	key, err := h.translateToKey(r.URL.Path)
+	if err != nil {
+		return http.StatusMethodNotAllowed, nil
+	}
+	attrs, err := h.Bucket.Attributes(r.Context(), key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return http.StatusMethodNotAllowed, nil // Could be a directory.
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if h.AuthorizeDecryption != nil && !h.AuthorizeDecryption(r, key) {
+		return http.StatusForbidden, nil
+	}
+
+	size := plaintextSize(attrs.Size)
+	ctype := mime.TypeByExtension(path.Ext(key))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff") // Else browsers could run what they think is HTML.
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Last-Modified", attrs.ModTime.UTC().Format(http.TimeFormat))
+
+	offset, length, status := int64(0), size, http.StatusOK
+	if spec := r.Header.Get("Range"); spec != "" {
+		var ok bool
+		if offset, length, ok = parseByteRange(spec, size); !ok {
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+			return http.StatusRequestedRangeNotSatisfiable, nil
+		}
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(offset, 10)+"-"+
+			strconv.FormatInt(offset+length-1, 10)+"/"+strconv.FormatInt(size, 10))
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if r.Method == http.MethodHead {
+		return status, nil
+	}
+
+	blob, err := h.newBlobReaderFrom(r.Context(), key, offset)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer blob.Close()
+	w.WriteHeader(status)
+	buf := getCopyBuffer(h.copyBufferSize())
+	defer putCopyBuffer(buf)
+	if _, err := io.CopyBuffer(w, io.LimitReader(blob, length), *buf); err != nil {
+		// Signals to the client that the response is incomplete.
+		panic(http.ErrAbortHandler)
+	}
+	return statusSent, nil
+}
+
+// parseByteRange returns the offset and length of the one range in a header "Range" (RFC 7233),
+// such as "bytes=0-499", "bytes=500-", or "bytes=-500" for the last 500 bytes.
+// It's false for several ranges, and for those that are malformed or not within the size.
+func parseByteRange(spec string, size int64) (offset, length int64, ok bool) {
+	spec = strings.TrimSpace(spec)
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last := spec[len("bytes="):], ""
+	idx := strings.IndexByte(first, '-')
+	if idx < 0 {
+		return 0, 0, false
+	}
+	first, last = strings.TrimSpace(first[:idx]), strings.TrimSpace(first[idx+1:])
+
+	if first == "" { // A suffix.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	offset, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 || offset >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < offset {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return offset, end - offset + 1, true
+}
@@ -0,0 +1,234 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gocloud.dev/secrets"
+	"gocloud.dev/secrets/localsecrets"
+)
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	encrypt := func(plaintext []byte) []byte {
+		var buf bytes.Buffer
+		ew, err := newEncryptingWriter(key, &buf)
+		So(err, ShouldBeNil)
+		// Odd sizes, to cross chunk boundaries within writes.
+		for len(plaintext) > 0 {
+			n := 1000
+			if n > len(plaintext) {
+				n = len(plaintext)
+			}
+			ew.Write(plaintext[:n])
+			plaintext = plaintext[n:]
+		}
+		So(ew.Close(), ShouldBeNil)
+		return buf.Bytes()
+	}
+	decrypt := func(ciphertext []byte) ([]byte, error) {
+		r, err := NewDecryptingReader(key, bytes.NewReader(ciphertext))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	Convey("Encrypted files", t, func() {
+		Convey("can be decrypted, and their size be told", func() {
+			for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+				plaintext := bytes.Repeat([]byte{'x'}, size)
+				ciphertext := encrypt(plaintext)
+				So(plaintextSize(int64(len(ciphertext))), ShouldEqual, size)
+
+				decrypted, err := decrypt(ciphertext)
+				So(err, ShouldBeNil)
+				So(decrypted, ShouldResemble, plaintext)
+			}
+		})
+
+		Convey("are not decrypted if tampered with", func() {
+			ciphertext := encrypt(bytes.Repeat([]byte{'x'}, 2*encryptionChunkSize+10))
+			flipped := append([]byte{}, ciphertext...)
+			flipped[len(flipped)/2] ^= 1
+			_, err := decrypt(flipped)
+			So(err, ShouldEqual, errDecryptionFailed)
+
+			// Truncated after the second chunk.
+			truncated := ciphertext[:len(encryptionMagic)+encryptionNoncePrefixSize+2*(encryptionChunkSize+16)]
+			_, err = decrypt(truncated)
+			So(err, ShouldEqual, errDecryptionFailed)
+		})
+	})
+
+	Convey("A handler with an encryption key", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.EncryptionKey = key
+		h.ServeDecrypted = true
+
+		Convey("stores files encrypted, and serves their plaintext", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+
+			stored, _ := ioutil.ReadFile(filepath.Join(scratchDir, tempFName))
+			So(string(stored), ShouldNotContainSubstring, "DELME")
+
+			req = httptest.NewRequest("GET", "/"+tempFName, nil)
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 200)
+			So(w.Body.String(), ShouldEqual, "DELME")
+			So(w.Result().Header.Get("Content-Length"), ShouldEqual, strconv.Itoa(len("DELME")))
+			So(w.Result().Header.Get("X-Content-Type-Options"), ShouldEqual, "nosniff")
+
+			Convey("only if enabled", func() {
+				h.ServeDecrypted = false
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 418)
+			})
+
+			Convey("only to requests that are authorized", func() {
+				h.AuthorizeDecryption = func(r *http.Request, key string) bool {
+					return r.Header.Get("Authorization") == "Bearer "+key
+				}
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 403)
+
+				req.Header.Set("Authorization", "Bearer "+tempFName)
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 200)
+			})
+		})
+
+		Convey("serves ranges of the plaintext, across chunks", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			plaintext := make([]byte, 3*encryptionChunkSize+100)
+			for i := range plaintext {
+				plaintext[i] = byte(i % 251)
+			}
+			req := httptest.NewRequest("PUT", "/"+tempFName, bytes.NewReader(plaintext))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+
+			get := func(spec string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", "/"+tempFName, nil)
+				req.Header.Set("Range", spec)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				return w
+			}
+			start := encryptionChunkSize - 10
+			w = get("bytes=" + strconv.Itoa(start) + "-" + strconv.Itoa(start+encryptionChunkSize))
+			So(w.Code, ShouldEqual, 206)
+			So(w.Body.Bytes(), ShouldResemble, plaintext[start:start+encryptionChunkSize+1])
+			So(w.Result().Header.Get("Content-Range"), ShouldEqual,
+				"bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(start+encryptionChunkSize)+"/"+strconv.Itoa(len(plaintext)))
+
+			w = get("bytes=-5")
+			So(w.Code, ShouldEqual, 206)
+			So(w.Body.Bytes(), ShouldResemble, plaintext[len(plaintext)-5:])
+
+			So(get("bytes=0-1,5-6").Code, ShouldEqual, 416)
+			So(get("bytes="+strconv.Itoa(len(plaintext))+"-").Code, ShouldEqual, 416)
+		})
+
+		Convey("passes GET for anything else on", func() {
+			req := httptest.NewRequest("GET", "/"+tempFileName(), nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 418)
+		})
+	})
+
+	Convey("A handler with KeyKeepers", t, func() {
+		h, _ := NewHandler("/", "file://"+filepath.ToSlash(scratchDir), next) // Keeps metadata.
+		oldKeeper := localsecrets.NewKeeper([32]byte{1})
+		newKeeper := localsecrets.NewKeeper([32]byte{2})
+		h.KeyKeepers = map[string]*secrets.Keeper{"old": oldKeeper}
+		h.KeyKeeperID = "old"
+		h.ServeDecrypted = true
+
+		put := func(name string) {
+			req := httptest.NewRequest("PUT", "/"+name, strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+		}
+		get := func(name string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/"+name, nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("stores the wrapped key of every file in its metadata", func() {
+			tempFName := tempFileName()
+			defer h.Bucket.Delete(context.Background(), tempFName)
+			put(tempFName)
+
+			attrs, err := h.Bucket.Attributes(context.Background(), tempFName)
+			So(err, ShouldBeNil)
+			So(attrs.Metadata[metadataKeyID], ShouldEqual, "old")
+			So(attrs.Metadata[metadataWrappedKey], ShouldNotBeEmpty)
+			So(get(tempFName).Body.String(), ShouldEqual, "DELME")
+		})
+
+		Convey("decrypts files with the KeyKeeper that has wrapped their key", func() {
+			oldFName, newFName := tempFileName(), tempFileName()
+			defer h.Bucket.Delete(context.Background(), oldFName)
+			defer h.Bucket.Delete(context.Background(), newFName)
+			put(oldFName)
+
+			h.KeyKeepers["new"] = newKeeper
+			h.KeyKeeperID = "new"
+			put(newFName)
+			So(get(oldFName).Body.String(), ShouldEqual, "DELME")
+			So(get(newFName).Body.String(), ShouldEqual, "DELME")
+
+			delete(h.KeyKeepers, "old")
+			So(get(oldFName).Code, ShouldEqual, 500)
+		})
+	})
+}
+
+func TestParseByteRange(t *testing.T) {
+	Convey("Ranges of bytes", t, func() {
+		for spec, expected := range map[string][2]int64{
+			"bytes=0-499":    {0, 500},
+			"bytes=500-":     {500, 500},
+			"bytes=-100":     {900, 100},
+			"bytes=-2000":    {0, 1000},
+			"bytes=990-1200": {990, 10},
+		} {
+			offset, length, ok := parseByteRange(spec, 1000)
+			So(ok, ShouldBeTrue)
+			So([2]int64{offset, length}, ShouldResemble, expected)
+		}
+		for _, spec := range []string{"bytes=1000-", "bytes=5-4", "bytes=0-1,4-5", "items=0-1", "bytes=-0", "bytes=x-"} {
+			_, _, ok := parseByteRange(spec, 1000)
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
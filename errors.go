@@ -0,0 +1,62 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+// Errors uploads and the Handler's methods fail with, to be told apart by errors.Is.
+// Any error returned or passed to hooks wraps at most one of these. Responses carry them as Problem.Code.
+var (
+	ErrCannotReadMIMEMultipart error = errCannotReadMIMEMultipart
+	ErrFileNameConflict        error = errFileNameConflict
+	ErrInvalidFileName         error = errInvalidFileName
+	ErrNoDestination           error = errNoDestination
+	ErrUnknownEnvelopeFormat   error = errUnknownEnvelopeFormat
+	ErrLengthInvalid           error = errLengthInvalid
+	ErrFileTooLarge            error = errFileTooLarge
+	ErrTransactionTooLarge     error = errTransactionTooLarge
+	ErrSymlinkInPath           error = errSymlinkInPath
+	ErrUploadTimedOut          error = errUploadTimedOut
+	ErrInsufficientStorage     error = errInsufficientStorage
+	ErrUploadToDirectory       error = errUploadToDirectory
+	ErrFileTooSmall            error = errFileTooSmall
+	ErrSizeMismatch            error = errSizeMismatch
+	ErrContentTypeRejected     error = errContentTypeRejected
+	ErrManifestMalformed       error = errManifestMalformed
+	ErrManifestTooLarge        error = errManifestTooLarge
+	ErrNotRecursive            error = errNotRecursive
+	ErrDeltaMalformed          error = errDeltaMalformed
+	ErrDigestMismatch          error = errDigestMismatch
+	ErrLengthMismatch          error = errLengthMismatch
+	ErrDecryptionFailed        error = errDecryptionFailed
+	ErrUnknownKeyKeeper        error = errUnknownKeyKeeper
+	ErrDigestUnsupported       error = errDigestUnsupported
+	ErrFormFieldsTooLarge      error = errFormFieldsTooLarge
+	ErrFilenameEncoding        error = errFilenameEncoding
+	ErrContentLanguage         error = errContentLanguage
+	ErrListingPage             error = errListingPage
+	ErrListingFilter           error = errListingFilter
+	ErrKeyLocked               error = errKeyLocked
+	ErrMacrosFound             error = errMacrosFound
+	ErrMaintenance             error = errMaintenance
+	ErrOutsideUploadWindow     error = errOutsideUploadWindow
+	ErrNotEncrypted            error = errNotEncrypted
+	ErrUnknownRecipient        error = errUnknownRecipient
+	ErrUploadAborted           error = errUploadAborted
+	ErrProtected               error = errProtected
+	ErrReadOnly                error = errReadOnly
+	ErrReceiptInvalid          error = errReceiptInvalid
+	ErrScanAborted             error = errScanAborted
+	ErrSessionIncomplete       error = errSessionIncomplete
+	ErrChunkIndexInvalid       error = errChunkIndexInvalid
+	ErrTooManyChunks           error = errTooManyChunks
+	ErrSlotContentType         error = errSlotContentType
+	ErrStorageClass            error = errStorageClass
+	ErrTagInvalid              error = errTagInvalid
+	ErrNoTenant                error = errNoTenant
+	ErrTenantInvalid           error = errTenantInvalid
+)
+
+// ErrorCode returns the value of Problem.Code for err, such as "file_too_large", or "" if there is none.
+func ErrorCode(err error) string {
+	return problemCode(err)
+}
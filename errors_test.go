@@ -0,0 +1,83 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"blitznote.com/src/http.upload/v5/filename"
+)
+
+func TestExportedErrors(t *testing.T) {
+	Convey("Exported errors", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+
+		Convey("match what they wrap with errors.Is", func() {
+			So(errors.Is(pkgerrors.Wrap(errFileTooLarge, "part 2"), ErrFileTooLarge), ShouldBeTrue)
+			So(errors.Is(&partError{partNum: 2, err: errFileTooLarge}, ErrFileTooLarge), ShouldBeTrue)
+			So(errors.Is(errFileTooSmall, ErrFileTooLarge), ShouldBeFalse)
+		})
+
+		Convey("are what violations of filename rules are, which keep the rule", func() {
+			err := h.CheckFilename("CON")
+			So(errors.Is(err, ErrInvalidFileName), ShouldBeTrue)
+			var ruleErr *filename.Error
+			So(errors.As(err, &ruleErr), ShouldBeTrue)
+			So(ruleErr.Rule, ShouldEqual, filename.RuleReservedOnWindows)
+			So(ErrorCode(err), ShouldEqual, "invalid_filename")
+		})
+
+		Convey("have codes", func() {
+			So(ErrorCode(pkgerrors.Wrap(ErrFileTooLarge, "part 2")), ShouldEqual, "file_too_large")
+			So(ErrorCode(errors.New("unknown")), ShouldBeBlank)
+		})
+
+		Convey("all have codes", func() {
+			// Collects the Err… variables and the constants they are, from the package's source.
+			fset := token.NewFileSet()
+			notTests := func(fi os.FileInfo) bool { return !strings.HasSuffix(fi.Name(), "_test.go") }
+			pkgs, err := parser.ParseDir(fset, ".", notTests, 0)
+			So(err, ShouldBeNil)
+			consts := make(map[string]coreUploadError)
+			exported := make(map[string]string)
+			for _, file := range pkgs["upload"].Files {
+				ast.Inspect(file, func(n ast.Node) bool {
+					spec, ok := n.(*ast.ValueSpec)
+					if !ok || len(spec.Names) != 1 || len(spec.Values) != 1 {
+						return true
+					}
+					name := spec.Names[0].Name
+					switch v := spec.Values[0].(type) {
+					case *ast.BasicLit:
+						if t, ok := spec.Type.(*ast.Ident); ok && t.Name == "coreUploadError" {
+							s, _ := strconv.Unquote(v.Value)
+							consts[name] = coreUploadError(s)
+						}
+					case *ast.Ident:
+						if ast.IsExported(name) && strings.HasPrefix(name, "Err") {
+							exported[name] = v.Name
+						}
+					}
+					return true
+				})
+			}
+			So(exported, ShouldNotBeEmpty)
+			for name, constName := range exported {
+				e, found := consts[constName]
+				So(name+" is "+constName+": "+strconv.FormatBool(found), ShouldEndWith, "true")
+				So(name+": "+ErrorCode(e), ShouldNotEndWith, ": ")
+			}
+		})
+	})
+}
@@ -0,0 +1,170 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressIDHeader carries the ID a client has chosen for an upload, for which it wants progress events.
+// Can be a query parameter of that name instead, for forms.
+const progressIDHeader = "X-Progress-ID"
+
+const (
+	progressRetention    = time.Minute      // How long the outcome of an upload can be gotten after it has ended.
+	progressWaitForStart = 10 * time.Second // How long to wait for an upload to start that's not known yet.
+)
+
+// ProgressEvent is the data of Server-Sent Events about an upload, in format "application/json".
+// Events named "progress" are sent while it is being received, and one named "done" after it has ended.
+type ProgressEvent struct {
+	Received   int64   `json:"received"`
+	Expected   int64   `json:"expected,omitempty"`    // If the client has declared it.
+	ETASeconds float64 `json:"eta_seconds,omitempty"` // Estimated from the average rate so far.
+	Status     int     `json:"status,omitempty"`      // That of the response to the upload, once it's done.
+}
+
+// uploadProgress is what has been received so far of one upload.
+type uploadProgress struct {
+	received int64 // Accessed atomically.
+	expected int64
+	started  time.Time
+	done     chan struct{} // Closed once status has been set.
+	status   int
+}
+
+func (p *uploadProgress) event() ProgressEvent {
+	e := ProgressEvent{Received: atomic.LoadInt64(&p.received), Expected: p.expected}
+	if elapsed := time.Since(p.started).Seconds(); e.Expected > e.Received && e.Received > 0 && elapsed > 0 {
+		e.ETASeconds = float64(e.Expected-e.Received) / (float64(e.Received) / elapsed)
+	}
+	return e
+}
+
+// progressCounter counts what is read from the request body.
+type progressCounter struct {
+	io.ReadCloser
+	p *uploadProgress
+}
+
+func (c *progressCounter) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	atomic.AddInt64(&c.p.received, int64(n))
+	return n, err
+}
+
+// progressRegistry has the uploads that are tracked, by tenant and their ID.
+type progressRegistry struct {
+	sync.Mutex
+	m map[string]*uploadProgress
+}
+
+var trackedUploads = progressRegistry{m: make(map[string]*uploadProgress)}
+
+func (t *progressRegistry) get(id string) *uploadProgress {
+	t.Lock()
+	defer t.Unlock()
+	return t.m[id]
+}
+
+// trackProgress returns r with a body that counts what's read from it, if the client has asked for
+// progress events with header "X-Progress-ID". Call finish with the status of the response.
+func (h *Handler) trackProgress(r *http.Request) (tracked *http.Request, finish func(status int)) {
+	id := r.Header.Get(progressIDHeader)
+	if id == "" {
+		id = r.URL.Query().Get(progressIDHeader)
+	}
+	if !h.EnableProgressEvents || id == "" || len(id) > 128 || r.Body == nil || r.Body == http.NoBody {
+		return r, func(int) {}
+	}
+	id = h.tenant + "/" + id
+	p := &uploadProgress{expected: r.ContentLength, started: time.Now(), done: make(chan struct{})}
+	if p.expected < 0 {
+		p.expected = 0
+	}
+	trackedUploads.Lock()
+	trackedUploads.m[id] = p
+	trackedUploads.Unlock()
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Body = &progressCounter{ReadCloser: r.Body, p: p}
+	return r2, func(status int) {
+		p.status = status
+		close(p.done)
+		time.AfterFunc(progressRetention, func() {
+			trackedUploads.Lock()
+			defer trackedUploads.Unlock()
+			if trackedUploads.m[id] == p { // Else the ID has been re-used.
+				delete(trackedUploads.m, id)
+			}
+		})
+	}
+}
+
+// isProgressEventsRequest is true for GET with query "progress".
+func (h *Handler) isProgressEventsRequest(r *http.Request) bool {
+	return h.EnableProgressEvents && r.Method == http.MethodGet && r.URL.Query().Get("progress") != ""
+}
+
+// serveProgressEvents streams ProgressEvent of the upload with the ID in query "progress",
+// every ProgressInterval or second, until it has ended.
+// The upload can start a little later, so that clients can subscribe before.
+func (h *Handler) serveProgressEvents(w http.ResponseWriter, r *http.Request) (int, error) {
+	id := h.tenant + "/" + r.URL.Query().Get("progress")
+	p := trackedUploads.get(id)
+	for waited := time.Duration(0); p == nil; waited += 100 * time.Millisecond {
+		if waited >= progressWaitForStart {
+			return http.StatusNotFound, nil
+		}
+		select {
+		case <-r.Context().Done():
+			return http.StatusNotFound, nil
+		case <-time.After(100 * time.Millisecond):
+		}
+		p = trackedUploads.get(id)
+	}
+
+	interval := h.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Else nginx would hold events back.
+	w.WriteHeader(http.StatusOK)
+	send := func(name string, e ProgressEvent) {
+		data, _ := json.Marshal(e)
+		io.WriteString(w, "event: "+name+"\ndata: "+string(data)+"\n\n")
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	for {
+		select {
+		case <-p.done:
+			e := p.event()
+			e.Status = p.status
+			send("done", e)
+			return statusSent, nil
+		case <-r.Context().Done():
+			return statusSent, nil
+		default:
+		}
+		send("progress", p.event())
+		select {
+		case <-ticker.C:
+		case <-p.done:
+		case <-r.Context().Done():
+		}
+	}
+}
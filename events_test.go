@@ -0,0 +1,82 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProgressEvents(t *testing.T) {
+	Convey("Progress events", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.EnableProgressEvents = true
+		h.ProgressInterval = 10 * time.Millisecond
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+		name := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, name))
+
+		Convey("stream what has been received, and the outcome", func() {
+			body, feed := io.Pipe()
+			req, _ := http.NewRequest("PUT", srv.URL+"/"+name, body)
+			req.Header.Set(progressIDHeader, "DELME")
+			uploaded := make(chan int)
+			go func() {
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					uploaded <- 0
+					return
+				}
+				resp.Body.Close()
+				uploaded <- resp.StatusCode
+			}()
+			feed.Write([]byte("12345"))
+
+			resp, err := http.Get(srv.URL + "/?progress=DELME")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+
+			events := bufio.NewReader(resp.Body)
+			next := func() (string, ProgressEvent) {
+				name, _ := events.ReadString('\n')
+				data, _ := events.ReadString('\n')
+				events.ReadString('\n')
+				var e ProgressEvent
+				json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &e)
+				return strings.TrimSpace(strings.TrimPrefix(name, "event: ")), e
+			}
+			kind, e := next()
+			So(kind, ShouldEqual, "progress")
+			So(e.Received, ShouldBeLessThanOrEqualTo, 5)
+
+			feed.Close()
+			So(<-uploaded, ShouldEqual, 201)
+			for kind != "done" {
+				kind, e = next()
+			}
+			So(e.Received, ShouldEqual, 5)
+			So(e.Status, ShouldEqual, 201)
+		})
+
+		Convey("are left to the next handler if not enabled", func() {
+			h.EnableProgressEvents = false
+			resp, err := http.Get(srv.URL + "/?progress=unknown")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, 418)
+		})
+	})
+}
@@ -1,5 +1,6 @@
 // This file is released into the public domain.
 
+//go:build ignore
 // +build ignore
 
 // Package main implements a minimal http server that accepts uploads.
@@ -0,0 +1,75 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/gcerrors"
+)
+
+const errDigestUnsupported coreUploadError = "None of the algorithms in 'Digest' is supported"
+
+// serveExistenceCheck answers HEAD with a header "Digest" by whether the file at that path
+// has the same contents. Sync clients use this to skip uploading unchanged files:
+//  200 if it does, and the file need not be uploaded again,
+//  404 if there is no such file,
+//  412 (Precondition Failed) if it's different.
+func (h *Handler) serveExistenceCheck(w http.ResponseWriter, r *http.Request) (int, error) {
+	key, err := h.translateToKey(r.URL.Path)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	declared := parseDigests(r.Header.Get("Digest"))
+	hashes := make(map[string]hash.Hash)
+	for alg := range declared {
+		if newHash, ok := digestAlgorithms[alg]; ok {
+			hashes[alg] = newHash()
+		}
+	}
+	if len(hashes) == 0 {
+		return http.StatusBadRequest, errDigestUnsupported
+	}
+
+	attrs, err := h.Bucket.Attributes(r.Context(), key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return http.StatusNotFound, nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Existence check failed")
+	}
+
+	// Some drivers know the MD5 sum already, and then reading the file can be skipped.
+	if _, wantsMD5 := hashes["md5"]; wantsMD5 && len(hashes) == 1 && len(attrs.MD5) > 0 && !h.isEncrypting() {
+		if base64.StdEncoding.EncodeToString(attrs.MD5) != declared["md5"] {
+			return http.StatusPreconditionFailed, nil
+		}
+		return http.StatusOK, nil
+	}
+
+	blob, err := h.newBlobReader(r.Context(), key)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Existence check failed")
+	}
+	defer blob.Close()
+	writers := make([]io.Writer, 0, len(hashes))
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+	buf := getCopyBuffer(h.copyBufferSize())
+	defer putCopyBuffer(buf)
+	if _, err := io.CopyBuffer(io.MultiWriter(writers...), struct{ io.Reader }{blob}, *buf); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Existence check failed")
+	}
+	for alg, h := range hashes {
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != declared[alg] {
+			return http.StatusPreconditionFailed, nil
+		}
+	}
+	return http.StatusOK, nil
+}
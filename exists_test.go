@@ -0,0 +1,74 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExistenceChecks(t *testing.T) {
+	Convey("HEAD with a digest", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.EnableExistenceChecks = true
+
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		// Written through the handler, so the MD5 sum gets recorded.
+		req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, 201)
+
+		otherFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, otherFName))
+		ioutil.WriteFile(filepath.Join(scratchDir, otherFName), []byte("DELME"), 0644)
+
+		head := func(name, digest string) int {
+			req := httptest.NewRequest("HEAD", "/"+name, nil)
+			req.Header.Set("Digest", digest)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+		sha := sha256.Sum256([]byte("DELME"))
+		md := md5.Sum([]byte("DELME"))
+		shaDigest := "sha-256=" + base64.StdEncoding.EncodeToString(sha[:])
+		mdDigest := "MD5=" + base64.StdEncoding.EncodeToString(md[:])
+
+		Convey("is answered with 200 for files with the same contents", func() {
+			So(head(tempFName, shaDigest), ShouldEqual, 200)
+			So(head(tempFName, mdDigest), ShouldEqual, 200)
+			So(head(otherFName, mdDigest), ShouldEqual, 200)
+		})
+
+		Convey("is answered with 412 for files with other contents", func() {
+			zero := "sha-256=" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+			So(head(tempFName, zero), ShouldEqual, 412)
+			So(head(tempFName, mdDigest+", "+zero), ShouldEqual, 412)
+		})
+
+		Convey("is answered with 404 for missing files", func() {
+			So(head(tempFileName(), shaDigest), ShouldEqual, 404)
+		})
+
+		Convey("needs a supported algorithm", func() {
+			So(head(tempFName, "unknown=abc"), ShouldEqual, 400)
+		})
+
+		Convey("is passed on if not enabled", func() {
+			h.EnableExistenceChecks = false
+			So(head(tempFName, shaDigest), ShouldEqual, 418)
+		})
+	})
+}
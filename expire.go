@@ -0,0 +1,158 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// SessionLister is implemented by SessionStores that can enumerate their sessions,
+// which lets ExpireSessions find those without any chunks.
+type SessionLister interface {
+	List(ctx context.Context) ([]*Session, error)
+}
+
+// List implements the SessionLister interface.
+func (s *MemorySessionStore) List(_ context.Context) ([]*Session, error) {
+	s.Lock()
+	defer s.Unlock()
+	sessions := make([]*Session, 0, len(s.m))
+	for _, session := range s.m {
+		session := session
+		sessions = append(sessions, &session)
+	}
+	return sessions, nil
+}
+
+// List implements the SessionLister interface.
+func (s BucketSessionStore) List(ctx context.Context) ([]*Session, error) {
+	var sessions []*Session
+	iter := s.Bucket.List(&blob.ListOptions{Prefix: sessionPath[1:], Delimiter: "/"})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF || (err != nil && gcerrors.Code(err) == gcerrors.NotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if obj.IsDir || !strings.HasSuffix(obj.Key, ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(obj.Key[len(sessionPath)-1:], ".json")
+		session, err := s.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if session != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+// ExpiryReport is what ExpireSessions has removed.
+type ExpiryReport struct {
+	Sessions   int   `json:"sessions"`
+	Chunks     int   `json:"chunks"`
+	SpoolFiles int   `json:"spool_files"`
+	Bytes      int64 `json:"bytes"` // Reclaimed in total.
+}
+
+// ExpireSessions removes upload sessions that have seen no new chunk for longer than ttl, along with their chunks,
+// and any chunks left behind without a session. Temporary files in SpoolDirectory of the same age,
+// such as of a crashed process, are removed as well.
+//
+// Sessions without chunks are found only if Sessions implements SessionLister.
+func (h *Handler) ExpireSessions(ctx context.Context, ttl time.Duration) (*ExpiryReport, error) {
+	report := new(ExpiryReport)
+	expiry := time.Now().Add(-ttl)
+	if h.Sessions == nil {
+		return report, h.expireSpoolFiles(expiry, report)
+	}
+	lastActive := make(map[string]time.Time)
+	sizes := make(map[string]int64)
+	chunks := make(map[string]int)
+
+	iter := h.Bucket.List(&blob.ListOptions{Prefix: sessionPath[1:]})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF || (err != nil && gcerrors.Code(err) == gcerrors.NotFound) {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		rest := obj.Key[len(sessionPath)-1:]
+		idx := strings.IndexByte(rest, '/')
+		if obj.IsDir || idx < 0 { // Only chunks; sessions kept in the Bucket are listed below.
+			continue
+		}
+		id := rest[:idx]
+		if obj.ModTime.After(lastActive[id]) {
+			lastActive[id] = obj.ModTime
+		}
+		sizes[id] += obj.Size
+		chunks[id]++
+	}
+	if lister, ok := h.Sessions.(SessionLister); ok {
+		sessions, err := lister.List(ctx)
+		if err != nil {
+			return report, err
+		}
+		for _, s := range sessions {
+			if s.Created.After(lastActive[s.ID]) {
+				lastActive[s.ID] = s.Created
+			}
+		}
+	}
+
+	for id, t := range lastActive {
+		if t.After(expiry) {
+			continue
+		}
+		if err := h.removeSession(ctx, &Session{ID: id}); err != nil {
+			return report, err
+		}
+		report.Sessions++
+		report.Chunks += chunks[id]
+		report.Bytes += sizes[id]
+	}
+
+	return report, h.expireSpoolFiles(expiry, report)
+}
+
+// expireSpoolFiles removes temporary files written by newSpoolSink that have not been modified since expiry.
+// Only SpoolDirectory is cleaned, not that of the OS which is used without one:
+// there, files of the same name pattern could be of other processes.
+func (h *Handler) expireSpoolFiles(expiry time.Time, report *ExpiryReport) error {
+	dir := h.SpoolDirectory
+	if dir == "" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(fi.Name(), ".upload-") || fi.ModTime().After(expiry) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		report.SpoolFiles++
+		report.Bytes += fi.Size()
+	}
+	return nil
+}
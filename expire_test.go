@@ -0,0 +1,101 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExpireSessions(t *testing.T) {
+	h, _ := NewHandler("/", scratchDir, nil)
+	stores := []struct {
+		name  string
+		store SessionStore
+	}{
+		{"memory", NewMemorySessionStore()},
+		{"the bucket", BucketSessionStore{Bucket: h.Bucket}},
+	}
+
+	for _, s := range stores {
+		Convey("ExpireSessions with sessions kept in "+s.name, t, func() {
+			h.Sessions = s.store
+			spool, _ := ioutil.TempDir(scratchDir, "spool")
+			defer os.RemoveAll(spool)
+			h.SpoolDirectory = spool
+
+			req := httptest.NewRequest("POST", "/.upload-session/", nil)
+			req.Header.Set("Destination", "/"+tempFileName())
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			sessionURL := w.Header().Get("Location")
+			id := sessionURL[len("/.upload-session/"):]
+			defer h.removeSession(context.Background(), &Session{ID: id})
+
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("PUT", sessionURL+"/0", strings.NewReader("DELME")))
+			So(w.Code, ShouldEqual, 201)
+
+			Convey("keeps those that are active", func() {
+				report, err := h.ExpireSessions(context.Background(), time.Hour)
+				So(err, ShouldBeNil)
+				So(report.Sessions, ShouldEqual, 0)
+				session, _ := h.Sessions.Get(context.Background(), id)
+				So(session, ShouldNotBeNil)
+			})
+
+			Convey("removes those that have been abandoned, and stale temporary files", func() {
+				past := time.Now().Add(-2 * time.Hour)
+				session, _ := h.Sessions.Get(context.Background(), id)
+				session.Created = past
+				h.Sessions.Put(context.Background(), session)
+				chunk := filepath.Join(scratchDir, ".upload-session", id, "0")
+				So(os.Chtimes(chunk, past, past), ShouldBeNil)
+				stale := filepath.Join(spool, ".upload-123")
+				ioutil.WriteFile(stale, []byte("DELME"), 0644)
+				So(os.Chtimes(stale, past, past), ShouldBeNil)
+
+				report, err := h.ExpireSessions(context.Background(), time.Hour)
+				So(err, ShouldBeNil)
+				So(*report, ShouldResemble, ExpiryReport{Sessions: 1, Chunks: 1, SpoolFiles: 1, Bytes: 10})
+				session, _ = h.Sessions.Get(context.Background(), id)
+				So(session, ShouldBeNil)
+				_, err = os.Stat(chunk)
+				So(os.IsNotExist(err), ShouldBeTrue)
+				_, err = os.Stat(stale)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	}
+
+	Convey("ExpireSessions leaves the temporary directory of the OS alone", t, func() {
+		h.Sessions = NewMemorySessionStore()
+		h.SpoolDirectory = ""
+		h.PartialUploads = KeepPartialUploads // Which spools to the temporary directory then.
+		tmp, _ := ioutil.TempDir(scratchDir, "tmp")
+		defer os.RemoveAll(tmp)
+		defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+		os.Setenv("TMPDIR", tmp)
+
+		past := time.Now().Add(-2 * time.Hour)
+		foreign := filepath.Join(tmp, ".upload-123")
+		ioutil.WriteFile(foreign, []byte("DELME"), 0644)
+		So(os.Chtimes(foreign, past, past), ShouldBeNil)
+
+		report, err := h.ExpireSessions(context.Background(), time.Hour)
+		So(err, ShouldBeNil)
+		So(report.SpoolFiles, ShouldEqual, 0)
+		_, err = os.Stat(foreign)
+		So(err, ShouldBeNil)
+	})
+}
@@ -0,0 +1,72 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+
+	"gocloud.dev/blob"
+)
+
+// fieldsSuffix is that of the files next to uploaded ones with the form fields that came with them.
+const fieldsSuffix = ".fields.json"
+
+// Form fields of one upload can be up to this large in total, names included.
+const maxFormFieldsSize = 64 << 10
+
+const errFormFieldsTooLarge coreUploadError = "Form fields are too large"
+
+// isCapturingFormFields is true if fields of MIME Multipart uploads are to be read.
+func (h *Handler) isCapturingFormFields() bool {
+	return h.CaptureFormFields || h.OnFormFields != nil
+}
+
+// readFormField adds the value of the part to fields, or fails if they get too large.
+func readFormField(fields url.Values, part *multipart.Part) error {
+	size := 0
+	for name, values := range fields {
+		for _, v := range values {
+			size += len(name) + len(v)
+		}
+	}
+	allowance := maxFormFieldsSize - size - len(part.FormName())
+	if allowance < 0 {
+		return errFormFieldsTooLarge
+	}
+	value, err := ioutil.ReadAll(io.LimitReader(part, int64(allowance)+1))
+	if err != nil {
+		return err
+	}
+	if len(value) > allowance {
+		return errFormFieldsTooLarge
+	}
+	fields.Add(part.FormName(), string(value))
+	return nil
+}
+
+// captureFormFields writes the fields next to every file as JSON, with CaptureFormFields,
+// and hands them to OnFormFields. Files that fail to get written are ignored, as the upload has succeeded.
+func (h *Handler) captureFormFields(ctx context.Context, keys []string, fields url.Values) {
+	if len(fields) == 0 || len(keys) == 0 {
+		return
+	}
+	if h.OnFormFields != nil {
+		h.OnFormFields(keys, fields)
+	}
+	if !h.CaptureFormFields || h.isEncrypting() { // Would be stored in plaintext.
+		return
+	}
+	contents, _ := json.Marshal(fields)
+	opts := &blob.WriterOptions{ContentType: "application/json"}
+	for _, key := range keys {
+		if err := h.Bucket.WriteAll(ctx, key+fieldsSuffix, contents, opts); err == nil {
+			h.updateChecksums(ctx, key+fieldsSuffix)
+		}
+	}
+}
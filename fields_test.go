@@ -0,0 +1,65 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFormFields(t *testing.T) {
+	Convey("Form fields of MIME Multipart uploads", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.CaptureFormFields = true
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+
+		post := func(title string) int {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			writer.WriteField("title", title)
+			p, _ := writer.CreateFormFile("A", "a")
+			p.Write([]byte("DELME"))
+			writer.WriteField("tags", "x")
+			writer.WriteField("tags", "y")
+			writer.Close()
+
+			req := httptest.NewRequest("POST", "/"+dir+"/", body)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("are written next to the files", func() {
+			So(post("Holidays"), ShouldEqual, 201)
+			b, err := ioutil.ReadFile(filepath.Join(scratchDir, dir, "a"+fieldsSuffix))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"tags":["x","y"],"title":["Holidays"]}`)
+		})
+
+		Convey("are handed to OnFormFields", func() {
+			var got url.Values
+			h.CaptureFormFields = false
+			h.OnFormFields = func(keys []string, fields url.Values) { got = fields }
+			So(post("Holidays"), ShouldEqual, 201)
+			So(got.Get("title"), ShouldEqual, "Holidays")
+			_, err := os.Stat(filepath.Join(scratchDir, dir, "a"+fieldsSuffix))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("are limited in size", func() {
+			So(post(strings.Repeat("x", maxFormFieldsSize)), ShouldEqual, 413)
+		})
+	})
+}
@@ -7,194 +7,190 @@ package upload
 
 import (
 	"crypto/rand"
-	"math"
-	"sort"
-	"strconv"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
 	"strings"
-	"text/scanner"
 	"unicode"
+	"unicode/utf8"
 
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/charmap"
 	"golang.org/x/text/unicode/norm"
+
+	"blitznote.com/src/http.upload/v5/filename"
 )
 
 const (
 	// AlwaysRejectedRunes contains which that are not safe to use with network shares.
 	// If a file name contains any, it will be rejected.
-	AlwaysRejectedRunes = `"*:<>?|\`
-
-	runeSpatium = '\u2009'
+	AlwaysRejectedRunes = filename.AlwaysRejectedRunes
 
-	errStrUnexpectedRange unicodeBlocklistParsingError = "Unexpected Unicode range: "
-	errOutOfBounds        unicodeBlocklistParsingError = "Value out of bounds"
+	errFilenameEncoding coreUploadError = "Header 'X-Filename-Encoding' must be one of: utf-8, latin1, url, auto"
 )
 
-// unicodeBlocklistParsingError happens translating a string to a unicode.RangeTable
-// and is not recoverable.
-type unicodeBlocklistParsingError string
+// FilenameEncoding is how clients encode filenames, which get decoded to UTF-8 before any checks.
+type FilenameEncoding string
 
-// Error implements the error interface.
-func (e unicodeBlocklistParsingError) Error() string { return string(e) }
-
-// Collection of runes from unicode.PrintRanges not suitable for filenames.
-var excludedRunes = &unicode.RangeTable{
-	R16: []unicode.Range16{
-		{0x2028, 0x202f, 1}, // new line, paragraph etc.
-		{0xfff0, 0xffff, 1}, // specials, and invalid (includes the obsolete (invalid) terminal boxes)
-	},
-	LatinOffset: 0,
-}
+// Encodings of filenames. Any not in UTF-8 stem from legacy clients.
+const (
+	FilenamesInUTF8       FilenameEncoding = ""
+	FilenamesInLatin1     FilenameEncoding = "latin1"
+	FilenamesURLEncoded   FilenameEncoding = "url"
+	FilenamesAutoDetected FilenameEncoding = "auto" // Percent-decoded if that works, then Latin-1 if not UTF-8.
+)
 
-// InAlphabet is true for strings exclusively in the given alphabet and form.
-//
-// Runes representing whitespace – other than U+0020 (space) and U+2009 (spatium) –
-// as well as any non-printable will always be rejected.
-//
-// Use this to filter file names.
-func InAlphabet(s string, alphabet []*unicode.RangeTable, enforceForm *norm.Form) bool {
-	if enforceForm != nil && !enforceForm.IsNormalString(s) {
-		return false
+// ParseFilenameEncoding returns the FilenameEncoding of the given name, such as "latin1".
+func ParseFilenameEncoding(name string) (FilenameEncoding, bool) {
+	switch enc := FilenameEncoding(strings.ToLower(name)); enc {
+	case "utf-8", "utf8":
+		return FilenamesInUTF8, true
+	case FilenamesInUTF8, FilenamesInLatin1, FilenamesURLEncoded, FilenamesAutoDetected:
+		return enc, true
+	case "iso-8859-1":
+		return FilenamesInLatin1, true
 	}
+	return FilenamesInUTF8, false
+}
 
-	if alphabet != nil {
-		for _, r := range s {
-			if !unicode.In(r, alphabet...) {
-				return false
-			}
-		}
+// filenameEncoding is that of header "X-Filename-Encoding", else the configured one.
+func (h *Handler) filenameEncoding(r *http.Request) (FilenameEncoding, error) {
+	v := r.Header.Get("X-Filename-Encoding")
+	if v == "" {
+		return h.FilenameEncoding, nil
+	}
+	enc, ok := ParseFilenameEncoding(v)
+	if !ok {
+		return FilenamesInUTF8, errFilenameEncoding
 	}
+	return enc, nil
+}
 
-	for _, r := range s {
-		if uint32(r) <= unicode.MaxLatin1 && strings.ContainsRune(AlwaysRejectedRunes, r) {
-			return false
+// decodeFileName converts a filename, such as from header "Content-Disposition", to UTF-8.
+func decodeFileName(name string, enc FilenameEncoding) (string, error) {
+	switch enc {
+	case FilenamesInLatin1:
+		return charmap.ISO8859_1.NewDecoder().String(name)
+	case FilenamesURLEncoded:
+		decoded, err := url.PathUnescape(name)
+		if err != nil {
+			return "", errInvalidFileName
 		}
-		if r == runeSpatium {
-			continue
+		return decoded, nil
+	case FilenamesAutoDetected:
+		if decoded, err := url.PathUnescape(name); err == nil {
+			name = decoded
 		}
-		if unicode.Is(excludedRunes, r) ||
-			!unicode.IsPrint(r) { // this takes care of the "spaces" as well
-			return false
+		if !utf8.ValidString(name) {
+			return charmap.ISO8859_1.NewDecoder().String(name)
 		}
 	}
-
-	return true
+	return name, nil
 }
 
-type tupleForRangeSlice [][3]uint64
-
-func (a tupleForRangeSlice) Len() int      { return len(a) }
-func (a tupleForRangeSlice) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a tupleForRangeSlice) Less(i, j int) bool {
-	for n := range a[i] {
-		if a[i][n] < a[j][n] {
-			return true
-		}
-		if a[i][n] > a[j][n] {
-			return false
-		}
+// dispositionFileName returns the parameter "filename" of a header "Content-Disposition",
+// decoded from its extended form "filename*" (RFC 5987) if that's given, else "".
+// As with multipart.Part.FileName any directories are stripped.
+func dispositionFileName(header string) string {
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil || params["filename"] == "" {
+		return ""
 	}
-	return false
+	return filepath.Base(params["filename"])
+}
+
+// InAlphabet is true for strings exclusively in the given alphabet and form.
+// See filename.InAlphabet.
+func InAlphabet(s string, alphabet []*unicode.RangeTable, enforceForm *norm.Form) bool {
+	return filename.InAlphabet(s, alphabet, enforceForm)
 }
 
-// ParseUnicodeBlockList naïvely translates a string with space-delimited
-// Unicode ranges to Go's unicode.RangeTable.
-//
-// All elements must fit into uint32.
-// A Range must begin with its lower bound, and ranges must not overlap.
-//
-// The format of one range is as follows, with 'stride' being set to '1' if left empty.
-//  <low>-<high>[:<stride>]
+// ParseUnicodeBlockList translates a string with space-delimited Unicode ranges to Go's unicode.RangeTable.
+// See filename.ParseUnicodeBlockList.
 func ParseUnicodeBlockList(str string) (*unicode.RangeTable, error) {
-	haveRanges := make(tupleForRangeSlice, 0, strings.Count(str, " "))
-
-	// read
-	var s scanner.Scanner
-	s.Init(strings.NewReader(str))
-	tok := s.Scan()
-	for tok != scanner.EOF {
-		var (
-			low, high, stride uint64
-			err               error
-		)
-
-		if tok != scanner.Ident {
-			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
-		}
-		if low, err = strconv.ParseUint(strings.TrimLeft(s.TokenText(), "uU+x"), 16, 32); err != nil {
-			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
-		}
+	return filename.ParseUnicodeBlockList(str)
+}
 
-		tok = s.Scan()
-		if !(tok == '-' || tok == '–') {
-			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+// checkFilenameRules returns errInvalidFileName with the rule that the key, a path below Scope, violates.
+func (h *Handler) checkFilenameRules(key string) error {
+	segments := strings.Split(key, "/")
+	if h.RejectSpoofedFilenames {
+		for _, segment := range segments {
+			if filename.IsSpoofed(segment) {
+				return ruleViolation(filename.RuleSpoofing, segment)
+			}
 		}
-
-		tok = s.Scan()
-		if tok != scanner.Ident {
-			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+	}
+	switch {
+	case !InAlphabet(key, nil, nil):
+		return ruleViolation(filename.RuleUnsafeRune, key)
+	case h.UnicodeForm != nil && !h.UnicodeForm.Use.IsNormalString(key):
+		return ruleViolation(filename.RuleForm, key)
+	case h.RestrictFilenamesTo != nil && !InAlphabet(key, h.RestrictFilenamesTo, nil):
+		return ruleViolation(filename.RuleAlphabet, key)
+	}
+	for _, segment := range segments {
+		if isReservedOnWindows(segment) {
+			return ruleViolation(filename.RuleReservedOnWindows, segment)
 		}
-		if high, err = strconv.ParseUint(strings.TrimLeft(s.TokenText(), "uU+x"), 16, 32); err != nil {
-			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+	}
+	if h.FilenameProfile != nil {
+		if err := h.FilenameProfile.Validate(key); err != nil {
+			return &ruleError{err.(*filename.Error)}
 		}
+	}
+	return nil
+}
 
-		tok = s.Scan()
-		if tok != ':' {
-			haveRanges = append(haveRanges, [3]uint64{low, high, 1})
-			continue
-		}
+func ruleViolation(rule filename.Rule, segment string) error {
+	return &ruleError{&filename.Error{Rule: rule, Segment: segment}}
+}
 
-		tok = s.Scan()
-		if tok != scanner.Int {
-			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
-		}
-		if stride, err = strconv.ParseUint(s.TokenText(), 10, 32); err != nil {
-			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
-		}
+// ruleError is errInvalidFileName, and unwraps to the *filename.Error with the rule that has been violated.
+type ruleError struct {
+	err *filename.Error
+}
+
+// Error implements the error interface.
+func (e *ruleError) Error() string { return e.err.Error() + ": " + string(errInvalidFileName) }
 
-		haveRanges = append(haveRanges, [3]uint64{low, high, stride})
+// Cause is for errors.Cause.
+func (e *ruleError) Cause() error { return errInvalidFileName }
 
-		tok = s.Scan()
-	}
+// Is is for errors.Is.
+func (e *ruleError) Is(target error) bool { return target == errInvalidFileName }
 
-	sort.Sort(haveRanges)
-
-	// fold
-	rt := unicode.RangeTable{}
-	for i := range haveRanges {
-		switch {
-		case haveRanges[i][1] <= unicode.MaxLatin1:
-			rt.LatinOffset++
-			fallthrough
-		case haveRanges[i][1] <= math.MaxUint16:
-			if rt.R16 == nil {
-				rt.R16 = []unicode.Range16{}
-			}
-			rt.R16 = append(rt.R16, unicode.Range16{
-				Lo:     uint16(haveRanges[i][0]),
-				Hi:     uint16(haveRanges[i][1]),
-				Stride: uint16(haveRanges[i][2]),
-			})
-		case haveRanges[i][1] <= math.MaxUint32:
-			if rt.R32 == nil {
-				rt.R32 = []unicode.Range32{}
-			}
-			rt.R32 = append(rt.R32, unicode.Range32{
-				Lo:     uint32(haveRanges[i][0]),
-				Hi:     uint32(haveRanges[i][1]),
-				Stride: uint32(haveRanges[i][2]),
-			})
-		default:
-			return nil, errOutOfBounds
-		}
-	}
+// Unwrap is for errors.As.
+func (e *ruleError) Unwrap() error { return e.err }
 
-	return &rt, nil
+// isReservedOnWindows is filename.IsReservedOnWindows.
+func isReservedOnWindows(segment string) bool {
+	return filename.IsReservedOnWindows(segment)
 }
 
 // printableSuffix returns printable chars meant to be used as randomized suffix
 // in file names.
 func printableSuffix(wantedLength uint32) string {
+	suffix, _ := printableSuffixFrom(rand.Reader, wantedLength) // Doesn't run dry.
+	return suffix
+}
+
+// randomSuffix is printableSuffix with randomness from Handler.Rand, if set,
+// which unlike crypto/rand can fail.
+func (h *Handler) randomSuffix(wantedLength uint32) (string, error) {
+	if h.Rand != nil {
+		return printableSuffixFrom(h.Rand, wantedLength)
+	}
+	return printableSuffix(wantedLength), nil
+}
+
+func printableSuffixFrom(source io.Reader, wantedLength uint32) (string, error) {
 	suffix := make([]byte, wantedLength, wantedLength)
-	rand.Read(suffix)
+	if _, err := io.ReadFull(source, suffix); err != nil {
+		return "", errors.Wrap(err, "Reading randomness failed")
+	}
 
 	for idx, c := range suffix {
 		c = (c % 36)
@@ -206,5 +202,5 @@ func printableSuffix(wantedLength uint32) string {
 		suffix[idx] = c
 	}
 
-	return string(suffix)
+	return string(suffix), nil
 }
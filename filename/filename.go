@@ -0,0 +1,265 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package filename validates names of files and paths, for uploads to be safe on common filesystems.
+package filename
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/scanner"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// AlwaysRejectedRunes contains which that are not safe to use with network shares.
+	// If a file name contains any, it will be rejected.
+	AlwaysRejectedRunes = `"*:<>?|\`
+
+	runeSpatium = '\u2009'
+
+	errStrUnexpectedRange unicodeBlocklistParsingError = "Unexpected Unicode range: "
+	errOutOfBounds        unicodeBlocklistParsingError = "Value out of bounds"
+)
+
+// unicodeBlocklistParsingError happens translating a string to a unicode.RangeTable
+// and is not recoverable.
+type unicodeBlocklistParsingError string
+
+// Error implements the error interface.
+func (e unicodeBlocklistParsingError) Error() string { return string(e) }
+
+// Collection of runes from unicode.PrintRanges not suitable for filenames.
+var excludedRunes = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x2028, 0x202f, 1}, // new line, paragraph etc.
+		{0xfff0, 0xffff, 1}, // specials, and invalid (includes the obsolete (invalid) terminal boxes)
+	},
+	LatinOffset: 0,
+}
+
+// InAlphabet is true for strings exclusively in the given alphabet and form.
+//
+// Runes representing whitespace – other than U+0020 (space) and U+2009 (spatium) –
+// as well as any non-printable will always be rejected.
+//
+// Use this to filter file names.
+func InAlphabet(s string, alphabet []*unicode.RangeTable, enforceForm *norm.Form) bool {
+	if enforceForm != nil && !enforceForm.IsNormalString(s) {
+		return false
+	}
+
+	if alphabet != nil {
+		for _, r := range s {
+			if !unicode.In(r, alphabet...) {
+				return false
+			}
+		}
+	}
+
+	for _, r := range s {
+		if uint32(r) <= unicode.MaxLatin1 && strings.ContainsRune(AlwaysRejectedRunes, r) {
+			return false
+		}
+		if r == runeSpatium {
+			continue
+		}
+		if unicode.Is(excludedRunes, r) ||
+			!unicode.IsPrint(r) { // this takes care of the "spaces" as well
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsReservedOnWindows is true for path segments that Windows will not accept as filename,
+// such as device names ("CON", "lpt1.txt"), or which it would silently alter by stripping trailing dots and spaces.
+//
+// Check these to be safe with SMB shares as destinations.
+func IsReservedOnWindows(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	if strings.HasSuffix(segment, ".") || strings.HasSuffix(segment, " ") {
+		return segment != "." && segment != ".."
+	}
+
+	// The device names are reserved with any extension.
+	basename := segment
+	if idx := strings.IndexByte(segment, '.'); idx >= 0 {
+		basename = segment[:idx]
+	}
+	basename = strings.TrimRight(basename, " ")
+	switch len(basename) {
+	case 3:
+		switch strings.ToUpper(basename) {
+		case "CON", "PRN", "AUX", "NUL":
+			return true
+		}
+	case 4:
+		prefix, digit := strings.ToUpper(basename[:3]), basename[3]
+		return (prefix == "COM" || prefix == "LPT") && '1' <= digit && digit <= '9'
+	}
+	return false
+}
+
+type tupleForRangeSlice [][3]uint64
+
+func (a tupleForRangeSlice) Len() int      { return len(a) }
+func (a tupleForRangeSlice) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a tupleForRangeSlice) Less(i, j int) bool {
+	for n := range a[i] {
+		if a[i][n] < a[j][n] {
+			return true
+		}
+		if a[i][n] > a[j][n] {
+			return false
+		}
+	}
+	return false
+}
+
+// without returns the ranges minus the runes from low through high.
+func (a tupleForRangeSlice) without(low, high uint64) tupleForRangeSlice {
+	remaining := make(tupleForRangeSlice, 0, len(a)+1)
+	for _, r := range a {
+		if high < r[0] || low > r[1] {
+			remaining = append(remaining, r)
+			continue
+		}
+		if low > r[0] {
+			last := low - 1
+			last -= (last - r[0]) % r[2]
+			remaining = append(remaining, [3]uint64{r[0], last, r[2]})
+		}
+		if high < r[1] {
+			first := high + 1
+			if rem := (first - r[0]) % r[2]; rem != 0 {
+				first += r[2] - rem
+			}
+			if first <= r[1] {
+				remaining = append(remaining, [3]uint64{first, r[1], r[2]})
+			}
+		}
+	}
+	return remaining
+}
+
+// ParseUnicodeBlockList naïvely translates a string with space-delimited
+// Unicode ranges to Go's unicode.RangeTable.
+//
+// All elements must fit into uint32.
+// A Range must begin with its lower bound, and ranges must not overlap.
+//
+// The format of one range is as follows, with 'stride' being set to '1' if left empty.
+//  <low>-<high>[:<stride>]
+//
+// Ranges prefixed by '!' are excluded from all others, or from all of Unicode if there are none,
+// and can overlap. They have no stride. For example, anything but bidi controls and emoji:
+//  !u202a-u202e !u2066-u2069 !u1f300-u1faff
+func ParseUnicodeBlockList(str string) (*unicode.RangeTable, error) {
+	haveRanges := make(tupleForRangeSlice, 0, strings.Count(str, " "))
+	var excludedRanges tupleForRangeSlice
+
+	// read
+	var s scanner.Scanner
+	s.Init(strings.NewReader(str))
+	tok := s.Scan()
+	for tok != scanner.EOF {
+		var (
+			low, high, stride uint64
+			err               error
+		)
+
+		exclude := tok == '!'
+		if exclude {
+			tok = s.Scan()
+		}
+		if tok != scanner.Ident {
+			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+		}
+		if low, err = strconv.ParseUint(strings.TrimLeft(s.TokenText(), "uU+x"), 16, 32); err != nil {
+			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+		}
+
+		tok = s.Scan()
+		if !(tok == '-' || tok == '–') {
+			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+		}
+
+		tok = s.Scan()
+		if tok != scanner.Ident {
+			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+		}
+		if high, err = strconv.ParseUint(strings.TrimLeft(s.TokenText(), "uU+x"), 16, 32); err != nil {
+			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+		}
+
+		tok = s.Scan()
+		if tok != ':' {
+			if exclude {
+				excludedRanges = append(excludedRanges, [3]uint64{low, high, 1})
+			} else {
+				haveRanges = append(haveRanges, [3]uint64{low, high, 1})
+			}
+			continue
+		}
+
+		tok = s.Scan()
+		if tok != scanner.Int || exclude { // Exclusions have no stride.
+			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+		}
+		if stride, err = strconv.ParseUint(s.TokenText(), 10, 32); err != nil {
+			return nil, unicodeBlocklistParsingError(errStrUnexpectedRange.Error() + s.Pos().String())
+		}
+
+		haveRanges = append(haveRanges, [3]uint64{low, high, stride})
+
+		tok = s.Scan()
+	}
+
+	if len(haveRanges) == 0 && len(excludedRanges) > 0 {
+		haveRanges = append(haveRanges, [3]uint64{0, math.MaxUint16, 1}, [3]uint64{math.MaxUint16 + 1, unicode.MaxRune, 1})
+	}
+	for _, excluded := range excludedRanges {
+		haveRanges = haveRanges.without(excluded[0], excluded[1])
+	}
+	sort.Sort(haveRanges)
+
+	// fold
+	rt := unicode.RangeTable{}
+	for i := range haveRanges {
+		switch {
+		case haveRanges[i][1] <= unicode.MaxLatin1:
+			rt.LatinOffset++
+			fallthrough
+		case haveRanges[i][1] <= math.MaxUint16:
+			if rt.R16 == nil {
+				rt.R16 = []unicode.Range16{}
+			}
+			rt.R16 = append(rt.R16, unicode.Range16{
+				Lo:     uint16(haveRanges[i][0]),
+				Hi:     uint16(haveRanges[i][1]),
+				Stride: uint16(haveRanges[i][2]),
+			})
+		case haveRanges[i][1] <= math.MaxUint32:
+			if rt.R32 == nil {
+				rt.R32 = []unicode.Range32{}
+			}
+			rt.R32 = append(rt.R32, unicode.Range32{
+				Lo:     uint32(haveRanges[i][0]),
+				Hi:     uint32(haveRanges[i][1]),
+				Stride: uint32(haveRanges[i][2]),
+			})
+		default:
+			return nil, errOutOfBounds
+		}
+	}
+
+	return &rt, nil
+}
@@ -0,0 +1,44 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filename
+
+import (
+	"testing"
+	"unicode"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseUnicodeBlockListExclusions(t *testing.T) {
+	Convey("ParseUnicodeBlockList with exclusions", t, func() {
+		Convey("cuts them out of the other ranges", func() {
+			rt, err := ParseUnicodeBlockList(`u0020-u007e u0100-u0110:2 !u0041-u005a !u0104-u0106`)
+			So(err, ShouldBeNil)
+			So(rt, ShouldResemble, &unicode.RangeTable{
+				R16: []unicode.Range16{
+					{0x0020, 0x0040, 1},
+					{0x005b, 0x007e, 1},
+					{0x0100, 0x0102, 2},
+					{0x0108, 0x0110, 2},
+				},
+				LatinOffset: 2,
+			})
+		})
+
+		Convey("apply to all of Unicode without any other ranges", func() {
+			rt, err := ParseUnicodeBlockList(`!u202a-u202e !u1f300-u1faff`)
+			So(err, ShouldBeNil)
+			So(unicode.Is(rt, 'a'), ShouldBeTrue)
+			So(unicode.Is(rt, '\u00e4'), ShouldBeTrue)
+			So(unicode.Is(rt, '\u202e'), ShouldBeFalse)
+			So(unicode.Is(rt, '\U0001f600'), ShouldBeFalse)
+			So(unicode.Is(rt, '\U0001fb00'), ShouldBeTrue)
+		})
+
+		Convey("cannot have a stride", func() {
+			_, err := ParseUnicodeBlockList(`!u0041-u005a:2`)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,146 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filename
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Rule is one of a Profile that a key can violate.
+type Rule string
+
+// Rules that Profile.Validate reports.
+const (
+	RuleEmpty             Rule = "empty"      // Empty keys, or segments thereof as in "a//b".
+	RuleMaxLength         Rule = "max_length" // Of the whole key.
+	RuleMaxSegmentLength  Rule = "max_segment_length"
+	RuleUnsafeRune        Rule = "unsafe_rune" // Any of AlwaysRejectedRunes, whitespace, or non-printable.
+	RuleAlphabet          Rule = "alphabet"
+	RuleForm              Rule = "form"
+	RuleReservedOnWindows Rule = "reserved_on_windows"
+	RuleLeadingHyphen     Rule = "leading_hyphen"
+	RuleSpoofing          Rule = "spoofing" // See IsSpoofed.
+)
+
+// Error is returned by Profile.Validate with the rule that has been violated.
+type Error struct {
+	Rule    Rule
+	Segment string // The offending one, or the whole key for rules that apply to it.
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return "Filename violates rule '" + string(e.Rule) + "': " + strconv.Quote(e.Segment)
+}
+
+// Profile is a set of rules for keys, which are paths with segments separated by '/'.
+// Lengths are in bytes of UTF-8, which is never less than in UTF-16 code units; 0 means no limit.
+type Profile struct {
+	Name string
+
+	MaxLength        int
+	MaxSegmentLength int
+	// If set, segments are limited to these runes. The '/' between segments needs not be included.
+	Alphabet []*unicode.RangeTable
+	// If set, segments must be in this Unicode normalization form.
+	Form *norm.Form
+
+	RejectReservedOnWindows bool
+	RejectLeadingHyphen     bool // Such names get mistaken for options by command-line tools.
+	RejectSpoofing          bool
+}
+
+var (
+	// PosixPortable is the portable filename character set of POSIX, without a leading '-'.
+	PosixPortable = &Profile{
+		Name:             "posix-portable",
+		MaxLength:        4095,
+		MaxSegmentLength: 255,
+		Alphabet: []*unicode.RangeTable{{
+			R16: []unicode.Range16{
+				{0x2d, 0x2e, 1}, // - .
+				{0x30, 0x39, 1}, // 0–9
+				{0x41, 0x5a, 1}, // A–Z
+				{0x5f, 0x5f, 1}, // _
+				{0x61, 0x7a, 1}, // a–z
+			},
+			LatinOffset: 5,
+		}},
+		RejectLeadingHyphen: true,
+	}
+
+	// WindowsSafe rejects what Windows and SMB shares won't accept, such as "CON" or "a.", within MAX_PATH.
+	WindowsSafe = &Profile{
+		Name:                    "windows-safe",
+		MaxLength:               259,
+		MaxSegmentLength:        255,
+		RejectReservedOnWindows: true,
+	}
+
+	// URLSafe has segments only of the unreserved characters of URLs (RFC 3986),
+	// which never need to be percent-encoded.
+	URLSafe = &Profile{
+		Name: "url-safe",
+		Alphabet: []*unicode.RangeTable{{
+			R16: []unicode.Range16{
+				{0x2d, 0x2e, 1}, // - .
+				{0x30, 0x39, 1}, // 0–9
+				{0x41, 0x5a, 1}, // A–Z
+				{0x5f, 0x5f, 1}, // _
+				{0x61, 0x7a, 1}, // a–z
+				{0x7e, 0x7e, 1}, // ~
+			},
+			LatinOffset: 6,
+		}},
+	}
+)
+
+// Profiles are the standard ones by their Name.
+var Profiles = map[string]*Profile{
+	PosixPortable.Name: PosixPortable,
+	WindowsSafe.Name:   WindowsSafe,
+	URLSafe.Name:       URLSafe,
+}
+
+// Validate returns nil if the key abides by all rules, else an *Error with the first it violates.
+func (p *Profile) Validate(key string) error {
+	if key == "" {
+		return &Error{Rule: RuleEmpty, Segment: key}
+	}
+	if p.MaxLength > 0 && len(key) > p.MaxLength {
+		return &Error{Rule: RuleMaxLength, Segment: key}
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if err := p.validateSegment(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Profile) validateSegment(segment string) error {
+	switch {
+	case segment == "":
+		return &Error{Rule: RuleEmpty, Segment: segment}
+	case p.MaxSegmentLength > 0 && len(segment) > p.MaxSegmentLength:
+		return &Error{Rule: RuleMaxSegmentLength, Segment: segment}
+	case p.RejectSpoofing && IsSpoofed(segment):
+		return &Error{Rule: RuleSpoofing, Segment: segment}
+	case !InAlphabet(segment, nil, nil):
+		return &Error{Rule: RuleUnsafeRune, Segment: segment}
+	case p.Alphabet != nil && !InAlphabet(segment, p.Alphabet, nil):
+		return &Error{Rule: RuleAlphabet, Segment: segment}
+	case p.Form != nil && !p.Form.IsNormalString(segment):
+		return &Error{Rule: RuleForm, Segment: segment}
+	case p.RejectReservedOnWindows && IsReservedOnWindows(segment):
+		return &Error{Rule: RuleReservedOnWindows, Segment: segment}
+	case p.RejectLeadingHyphen && strings.HasPrefix(segment, "-"):
+		return &Error{Rule: RuleLeadingHyphen, Segment: segment}
+	}
+	return nil
+}
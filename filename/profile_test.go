@@ -0,0 +1,52 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filename
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestProfiles(t *testing.T) {
+	Convey("Profile.Validate", t, FailureContinues, func() {
+		nfd := norm.NFD
+		samples := []struct {
+			profile *Profile
+			key     string
+			rule    Rule
+		}{
+			{PosixPortable, "reports/2021-05_final.pdf", ""},
+			{PosixPortable, "reports/-rf", RuleLeadingHyphen},
+			{PosixPortable, "reports/café.pdf", RuleAlphabet},
+			{PosixPortable, "reports//a", RuleEmpty},
+			{PosixPortable, "a/" + strings.Repeat("x", 256), RuleMaxSegmentLength},
+			{PosixPortable, "a\tb", RuleUnsafeRune},
+			{WindowsSafe, "café/CON.txt", RuleReservedOnWindows},
+			{WindowsSafe, "café/note.", RuleReservedOnWindows},
+			{WindowsSafe, "a?", RuleUnsafeRune},
+			{WindowsSafe, strings.Repeat("x/", 130), RuleMaxLength},
+			{WindowsSafe, "-café", ""},
+			{URLSafe, "a~b/c.d", ""},
+			{URLSafe, "a b", RuleAlphabet},
+			{&Profile{Form: &nfd}, "caf\u00e9", RuleForm},
+		}
+
+		for _, sample := range samples {
+			err := sample.profile.Validate(sample.key)
+			if sample.rule == "" {
+				So(err, ShouldBeNil)
+				continue
+			}
+			So(err, ShouldHaveSameTypeAs, &Error{})
+			So(err.(*Error).Rule, ShouldEqual, sample.rule)
+		}
+	})
+
+	Convey("Profiles are found by their name", t, func() {
+		So(Profiles["url-safe"], ShouldEqual, URLSafe)
+	})
+}
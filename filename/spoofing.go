@@ -0,0 +1,92 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filename
+
+import (
+	"unicode"
+)
+
+// Runes that change how text around them is displayed, without being visible themselves,
+// such as to have "invoice\u202efdp.exe" shown as "invoiceexe.pdf".
+var invisibleControls = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x061c, 0x061c, 1}, // arabic letter mark
+		{0x200b, 0x200f, 1}, // zero-width space, (non-)joiner, LTR and RTL marks
+		{0x202a, 0x202e, 1}, // bidi embeddings and overrides
+		{0x2060, 0x2064, 1}, // word joiner, invisible operators
+		{0x2066, 0x2069, 1}, // bidi isolates
+		{0xfeff, 0xfeff, 1}, // zero-width no-break space
+	},
+}
+
+// Scripts that are looked up first, as they're the most common ones, or those that get mixed up.
+var commonScripts = []*unicode.RangeTable{
+	unicode.Latin, unicode.Greek, unicode.Cyrillic, unicode.Armenian,
+	unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Bopomofo,
+	unicode.Arabic, unicode.Hebrew,
+}
+
+// IsSpoofed is true for names with invisible controls, such as bidi overrides and zero-width joiners,
+// or with words in letters of scripts that are not commonly used together, such as a Cyrillic 'а' amid Latin ones.
+// Words are what's between anything else, such as '.', '-', or digits, hence "счёт.pdf" is fine.
+//
+// Scripts can be mixed as in "Highly Restrictive" of Unicode TR 39:
+// Latin with Han, Hiragana, and Katakana; with Han and Bopomofo; or with Han and Hangul.
+func IsSpoofed(name string) bool {
+	scripts := make(map[*unicode.RangeTable]bool, 2)
+	for _, r := range name {
+		if unicode.Is(invisibleControls, r) {
+			return true
+		}
+		if !unicode.IsLetter(r) && !unicode.IsMark(r) {
+			if isMixingScripts(scripts) {
+				return true
+			}
+			scripts = make(map[*unicode.RangeTable]bool, 2)
+			continue
+		}
+		if script := scriptOf(r); script != nil {
+			scripts[script] = true
+		}
+	}
+	return isMixingScripts(scripts)
+}
+
+// isMixingScripts is true for scripts that are not commonly used together.
+func isMixingScripts(scripts map[*unicode.RangeTable]bool) bool {
+	if len(scripts) <= 1 {
+		return false
+	}
+
+	delete(scripts, unicode.Latin)
+	delete(scripts, unicode.Han)
+	switch {
+	case len(scripts) == 0:
+		return false
+	case len(scripts) == 1:
+		return !(scripts[unicode.Hiragana] || scripts[unicode.Katakana] ||
+			scripts[unicode.Bopomofo] || scripts[unicode.Hangul])
+	case len(scripts) == 2:
+		return !(scripts[unicode.Hiragana] && scripts[unicode.Katakana])
+	}
+	return true
+}
+
+// scriptOf returns the script of the rune, or nil for those in common use, such as combining marks.
+func scriptOf(r rune) *unicode.RangeTable {
+	if unicode.Is(unicode.Common, r) || unicode.Is(unicode.Inherited, r) {
+		return nil
+	}
+	for _, script := range commonScripts {
+		if unicode.Is(script, r) {
+			return script
+		}
+	}
+	for _, script := range unicode.Scripts {
+		if unicode.Is(script, r) {
+			return script
+		}
+	}
+	return nil
+}
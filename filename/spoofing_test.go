@@ -0,0 +1,36 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filename
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIsSpoofed(t *testing.T) {
+	Convey("IsSpoofed", t, FailureContinues, func() {
+		samples := []struct {
+			input    string
+			returned bool
+		}{
+			{"invoice.pdf", false},
+			{"invoice\u202efdp.exe", true}, // RTL override
+			{"pay\u200bpal.html", true},    // zero-width space
+			{"pаypal.html", true},          // Cyrillic а
+			{"счёт.pdf", false},            // Cyrillic, and Latin in another word
+			{"Καλημέρα 2021.txt", false},
+			{"report-漢字.txt", false},  // Latin and Han
+			{"ひらがなカタ漢.txt", false},    // Japanese
+			{"한국어-notes.txt", false},  // Latin and Hangul
+			{"Αlpha-с.txt", true},     // Greek, Latin, and Cyrillic
+			{"café\u0301.txt", false}, // combining marks are of any script
+		}
+
+		for i, tuple := range samples {
+			tuple.returned = IsSpoofed(samples[i].input)
+			So(tuple, ShouldResemble, samples[i])
+		}
+	})
+}
@@ -114,6 +114,46 @@ func TestInAlphabet(t *testing.T) {
 	})
 }
 
+func TestIsReservedOnWindows(t *testing.T) {
+	Convey("isReservedOnWindows", t, func() {
+		samples := []struct {
+			input    string
+			returned bool
+		}{
+			{"file.txt", false}, {"console", false}, {"com0", false}, {"COM10", false},
+			{"CON", true}, {"con.txt", true}, {"nul.tar.gz", true}, {"Lpt1", true}, {"aux .txt", true},
+			{"trailing.", true}, {"trailing ", true},
+		}
+
+		for i, tuple := range samples {
+			tuple.returned = isReservedOnWindows(samples[i].input)
+			So(tuple, ShouldResemble, samples[i])
+		}
+	})
+}
+
+func TestDispositionFileName(t *testing.T) {
+	Convey("dispositionFileName", t, func() {
+		samples := []struct {
+			input    string
+			returned string
+		}{
+			{`attachment; filename="a.txt"`, "a.txt"},
+			{`form-data; name="A"; filename="foo/a.txt"`, "a.txt"},
+			{`attachment; filename="../../etc/a.txt"`, "a.txt"},
+			{`attachment; filename*=UTF-8''..%2F..%2F%E2%82%AC.txt`, "€.txt"},
+			{`attachment; filename*=UTF-8''%E2%82%AC%20rates.txt`, "€ rates.txt"},
+			{`attachment; filename="EUR rates.txt"; filename*=utf-8''%E2%82%AC%20rates.txt`, "€ rates.txt"},
+			{`form-data; name="A"`, ""}, {`attachment; filename=`, ""}, {"", ""},
+		}
+
+		for i, tuple := range samples {
+			tuple.returned = dispositionFileName(samples[i].input)
+			So(tuple, ShouldResemble, samples[i])
+		}
+	})
+}
+
 func TestParseUnicodeBlockList(t *testing.T) {
 	Convey("ParseUnicodeBlockList works", t, FailureContinues, func() {
 		samples := []struct {
@@ -140,3 +180,31 @@ func TestParseUnicodeBlockList(t *testing.T) {
 		}
 	})
 }
+
+func TestDecodeFileName(t *testing.T) {
+	Convey("decodeFileName", t, func() {
+		samples := []struct {
+			input    string
+			enc      FilenameEncoding
+			returned string
+		}{
+			{"caf\xe9.txt", FilenamesInLatin1, "café.txt"},
+			{"caf%C3%A9.txt", FilenamesURLEncoded, "café.txt"},
+			{"caf%C3%A9.txt", FilenamesInUTF8, "caf%C3%A9.txt"},
+			{"caf%C3%A9.txt", FilenamesAutoDetected, "café.txt"},
+			{"caf%E9.txt", FilenamesAutoDetected, "café.txt"},
+			{"café.txt", FilenamesAutoDetected, "café.txt"},
+			{"100%.txt", FilenamesAutoDetected, "100%.txt"},
+		}
+
+		for i, tuple := range samples {
+			tuple.returned, _ = decodeFileName(samples[i].input, samples[i].enc)
+			So(tuple, ShouldResemble, samples[i])
+		}
+
+		Convey("rejects malformed percent-encoding", func() {
+			_, err := decodeFileName("100%.txt", FilenamesURLEncoded)
+			So(err, ShouldEqual, errInvalidFileName)
+		})
+	})
+}
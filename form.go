@@ -0,0 +1,46 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	_ "embed" // For the form.
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+//go:embed form.html
+var formHTML string
+
+// uploadForm is the page with which files can be uploaded using a browser, also by drag and drop.
+// It posts them in a MIME Multipart envelope, so RedirectAfterUpload applies if scripts are disabled.
+var uploadForm = template.Must(template.New("form").Parse(formHTML))
+
+// isUploadFormRequest is true for GET or HEAD on the Scope itself if ServeUploadForm is set.
+func (h *Handler) isUploadFormRequest(r *http.Request) bool {
+	if !h.ServeUploadForm || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	return strings.TrimSuffix(r.URL.Path, "/") == strings.TrimSuffix(h.Scope, "/")
+}
+
+// serveUploadForm answers with the upload form.
+func (h *Handler) serveUploadForm(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return statusSent, nil
+	}
+	uploadForm.Execute(w, struct {
+		Accept      string
+		MaxFilesize int64
+	}{
+		Accept:      strings.Join(h.ContentTypes, ","),
+		MaxFilesize: h.MaxFilesize,
+	})
+	return statusSent, nil
+}
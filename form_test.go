@@ -0,0 +1,39 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUploadForm(t *testing.T) {
+	Convey("The upload form", t, func() {
+		h, _ := NewHandler("/upload", scratchDir, next)
+		h.ServeUploadForm = true
+		h.ContentTypes = []string{"image/*", "application/pdf"}
+		get := func(target string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+			return w
+		}
+
+		Convey("is served on the Scope itself", func() {
+			w := get("/upload/")
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("Content-Type"), ShouldStartWith, "text/html")
+			So(w.Body.String(), ShouldContainSubstring, `enctype="multipart/form-data"`)
+			So(w.Body.String(), ShouldContainSubstring, `accept="image/*,application/pdf"`)
+			So(get("/upload").Code, ShouldEqual, 200)
+		})
+
+		Convey("is not served below the Scope, or if not enabled", func() {
+			So(get("/upload/file").Body.String(), ShouldNotContainSubstring, "<form")
+			h.ServeUploadForm = false
+			So(get("/upload/").Body.String(), ShouldNotContainSubstring, "<form")
+		})
+	})
+}
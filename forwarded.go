@@ -0,0 +1,91 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxy reads an address, such as "10.0.0.1", or a network in CIDR notation,
+// such as "10.0.0.0/8", for Handler.TrustedProxies.
+func ParseTrustedProxy(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// isFromTrustedProxy is true if the request has been sent by any of TrustedProxies.
+func (h *Handler) isFromTrustedProxy(r *http.Request) bool {
+	if len(h.TrustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstForwarded returns the first value of a header "X-Forwarded-*", which is the one
+// set by the proxy closest to the client if there are several.
+func firstForwarded(r *http.Request, name string) string {
+	v := r.Header.Get(name)
+	if idx := strings.IndexByte(v, ','); idx >= 0 {
+		v = v[:idx]
+	}
+	return strings.TrimSpace(v)
+}
+
+// requestOrigin returns the scheme, host, and path prefix the client has used to get to the Handler,
+// such as "https://example.com/files", if LocationFromRequest is set. Else it's "".
+func (h *Handler) requestOrigin(r *http.Request) string {
+	if !h.LocationFromRequest {
+		return ""
+	}
+	scheme, host, prefix := "http", r.Host, ""
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if h.isFromTrustedProxy(r) {
+		switch proto := strings.ToLower(firstForwarded(r, "X-Forwarded-Proto")); proto {
+		case "http", "https":
+			scheme = proto
+		}
+		if fwdHost := firstForwarded(r, "X-Forwarded-Host"); fwdHost != "" && !strings.ContainsAny(fwdHost, "/\\@ ") {
+			host = fwdHost
+		}
+		if fwdPrefix := firstForwarded(r, "X-Forwarded-Prefix"); strings.HasPrefix(fwdPrefix, "/") {
+			prefix = strings.TrimRight(fwdPrefix, "/")
+		}
+	}
+	return scheme + "://" + host + prefix
+}
+
+// publicURL returns the URL for a path below the Handler, as seen by the client if LocationFromRequest is set.
+func (h *Handler) publicURL(r *http.Request, urlPath string) string {
+	if strings.Contains(urlPath, "://") {
+		return urlPath
+	}
+	return h.requestOrigin(r) + urlPath
+}
@@ -0,0 +1,96 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseTrustedProxy(t *testing.T) {
+	Convey("ParseTrustedProxy", t, func() {
+		n, err := ParseTrustedProxy("10.0.0.0/8")
+		So(err, ShouldBeNil)
+		So(n.Contains(net.ParseIP("10.1.2.3")), ShouldBeTrue)
+
+		n, err = ParseTrustedProxy("192.0.2.1")
+		So(err, ShouldBeNil)
+		So(n.Contains(net.ParseIP("192.0.2.1")), ShouldBeTrue)
+		So(n.Contains(net.ParseIP("192.0.2.2")), ShouldBeFalse)
+
+		n, err = ParseTrustedProxy("::1")
+		So(err, ShouldBeNil)
+		So(n.Contains(net.ParseIP("::1")), ShouldBeTrue)
+
+		_, err = ParseTrustedProxy("proxy.example.com")
+		So(err, ShouldNotBeNil)
+		_, err = (&Config{To: scratchDir, TrustedProxies: []string{"10.0.0.0/33"}}).NewHandler(nil)
+		So(err, ShouldEqual, errConfigTrustedProxies)
+	})
+}
+
+func TestLocationFromRequest(t *testing.T) {
+	Convey("With LocationFromRequest", t, func() {
+		h, _ := NewHandler("/upload", scratchDir, nil)
+		h.LocationFromRequest = true
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+		put := func(remoteAddr string, headers map[string]string) string {
+			req := httptest.NewRequest("PUT", "http://files.example.com/upload/"+tempFName, strings.NewReader("DELME"))
+			req.RemoteAddr = remoteAddr
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			return w.Header().Get("Location")
+		}
+		forwarded := map[string]string{
+			"X-Forwarded-Proto":  "https",
+			"X-Forwarded-Host":   "www.example.com, proxy.internal",
+			"X-Forwarded-Prefix": "/files/",
+		}
+
+		Convey("Location is absolute, below Scope", func() {
+			So(put("192.0.2.1:1234", nil), ShouldEqual, "http://files.example.com/upload/"+tempFName)
+		})
+
+		Convey("Location is below ApparentLocation if that is set", func() {
+			h.ApparentLocation = "/download"
+			So(put("192.0.2.1:1234", nil), ShouldEqual, "http://files.example.com/download/"+tempFName)
+		})
+
+		Convey("headers X-Forwarded-* are ignored from anyone but TrustedProxies", func() {
+			So(put("192.0.2.1:1234", forwarded), ShouldEqual, "http://files.example.com/upload/"+tempFName)
+		})
+
+		Convey("headers X-Forwarded-* of TrustedProxies are honored", func() {
+			n, _ := ParseTrustedProxy("192.0.2.0/24")
+			h.TrustedProxies = []*net.IPNet{n}
+			So(put("192.0.2.1:1234", forwarded), ShouldEqual, "https://www.example.com/files/upload/"+tempFName)
+
+			Convey("but not if malformed", func() {
+				malformed := map[string]string{
+					"X-Forwarded-Proto":  "javascript",
+					"X-Forwarded-Host":   "evil.example.com/",
+					"X-Forwarded-Prefix": "files",
+				}
+				So(put("192.0.2.1:1234", malformed), ShouldEqual, "http://files.example.com/upload/"+tempFName)
+			})
+		})
+
+		Convey("an absolute ApparentLocation is kept as it is", func() {
+			h.ApparentLocation = "https://cdn.example.com/upload"
+			So(put("192.0.2.1:1234", nil), ShouldEqual, "https://cdn.example.com/upload/"+tempFName)
+		})
+	})
+}
@@ -0,0 +1,40 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"path"
+	"strings"
+)
+
+// KeyMapper derives keys from paths in custom ways, such as by slug rules or hashing.
+type KeyMapper interface {
+	// Translate gets the path below Scope, such as "mine/my.blob", after it has been cleaned
+	// and checked against traversal and RestrictFilenamesTo, and returns the key to use instead.
+	// Paths of directories are passed as well, for listings and deletions.
+	// Any tenant is prefixed to the result. Errors are passed on as they are.
+	Translate(urlPath string) (key string, err error)
+}
+
+// KeyMapperFunc adapts a function to a KeyMapper.
+type KeyMapperFunc func(urlPath string) (string, error)
+
+// Translate implements the KeyMapper interface.
+func (f KeyMapperFunc) Translate(urlPath string) (string, error) {
+	return f(urlPath)
+}
+
+// mapKey runs the key through KeyMapper, and rejects results that would escape
+// the Bucket's part of the Scope, or aren't clean.
+func (h *Handler) mapKey(key string) (string, error) {
+	mapped, err := h.KeyMapper.Translate(key)
+	if err != nil {
+		return "", err
+	}
+	if mapped == "" || path.Clean(mapped) != mapped || mapped == ".." ||
+		strings.HasPrefix(mapped, "/") || strings.HasPrefix(mapped, "../") {
+		return "", errInvalidFileName
+	}
+	return mapped, nil
+}
@@ -0,0 +1,53 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyMapper(t *testing.T) {
+	Convey("KeyMapper", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+		var got string
+		h.KeyMapper = KeyMapperFunc(func(urlPath string) (string, error) {
+			got = urlPath
+			return strings.ToLower(strings.ReplaceAll(urlPath, " ", "-")), nil
+		})
+
+		put := func(urlPath string) int {
+			req := httptest.NewRequest("PUT", urlPath, strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("decides what keys become of paths", func() {
+			So(put("/"+dir+"/My%20File.TXT"), ShouldEqual, 201)
+			So(got, ShouldEqual, dir+"/My File.TXT")
+			b, err := ioutil.ReadFile(filepath.Join(scratchDir, dir, "my-file.txt"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "DELME")
+		})
+
+		Convey("gets cleaned paths only", func() {
+			So(put("/"+dir+"/../../etc/passwd"), ShouldEqual, 422)
+			So(got, ShouldBeBlank)
+		})
+
+		Convey("cannot escape the Scope", func() {
+			h.KeyMapper = KeyMapperFunc(func(string) (string, error) { return "../" + dir, nil })
+			So(put("/"+dir+"/a"), ShouldEqual, 422)
+		})
+	})
+}
@@ -0,0 +1,80 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+const errContentLanguage coreUploadError = "Header Content-Language must name exactly one valid language"
+
+// metadataContentLanguage is the metadata of files with the language from header "Content-Language".
+// It's passed on to the Bucket as its ContentLanguage as well.
+const metadataContentLanguage = "upload-content-language"
+
+// ContentLanguagePolicy is what becomes of header "Content-Language" of uploads.
+type ContentLanguagePolicy string
+
+// Policies for header "Content-Language".
+const (
+	IgnoreContentLanguage     ContentLanguagePolicy = ""
+	ContentLanguageAsMetadata ContentLanguagePolicy = "metadata" // Needs a Bucket that keeps metadata.
+	ContentLanguageAsSuffix   ContentLanguagePolicy = "suffix"   // Such as "file.de.txt" for "file.txt".
+)
+
+// ParseContentLanguagePolicy reads a ContentLanguagePolicy, or returns false if it's unknown.
+func ParseContentLanguagePolicy(s string) (ContentLanguagePolicy, bool) {
+	switch p := ContentLanguagePolicy(strings.ToLower(s)); p {
+	case IgnoreContentLanguage, ContentLanguageAsMetadata, ContentLanguageAsSuffix:
+		return p, true
+	case "ignore":
+		return IgnoreContentLanguage, true
+	}
+	return IgnoreContentLanguage, false
+}
+
+// contentLanguage returns the tag in a header "Content-Language" in its canonical form, such as "pt-BR",
+// or "" if the header is empty.
+func contentLanguage(header string) (string, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return "", nil
+	}
+	if strings.Contains(header, ",") {
+		return "", errContentLanguage
+	}
+	tag, err := language.Parse(header)
+	if err != nil {
+		return "", errContentLanguage
+	}
+	return tag.String(), nil
+}
+
+// withLanguage applies ContentLanguage: returns the path with the language as suffix,
+// or the metadata to store it with.
+func (h *Handler) withLanguage(urlPath, header string) (string, map[string]string, error) {
+	if h.ContentLanguage == IgnoreContentLanguage {
+		return urlPath, nil, nil
+	}
+	lang, err := contentLanguage(header)
+	if err != nil || lang == "" {
+		return urlPath, nil, err
+	}
+	if h.ContentLanguage == ContentLanguageAsMetadata {
+		return urlPath, map[string]string{metadataContentLanguage: lang}, nil
+	}
+
+	ext := path.Ext(urlPath)
+	if strings.HasSuffix(urlPath, "/") || ext == path.Base(urlPath) { // Such as ".profile".
+		ext = ""
+	}
+	stem := urlPath[:len(urlPath)-len(ext)]
+	if strings.HasSuffix(strings.ToLower(stem), "."+strings.ToLower(lang)) { // Has it already.
+		return urlPath, nil, nil
+	}
+	return stem + "." + lang + ext, nil, nil
+}
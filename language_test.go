@@ -0,0 +1,100 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestContentLanguage(t *testing.T) {
+	Convey("contentLanguage", t, func() {
+		lang, err := contentLanguage("de")
+		So(err, ShouldBeNil)
+		So(lang, ShouldEqual, "de")
+		lang, _ = contentLanguage(" pt-br ")
+		So(lang, ShouldEqual, "pt-BR")
+		lang, err = contentLanguage("")
+		So(err, ShouldBeNil)
+		So(lang, ShouldEqual, "")
+
+		_, err = contentLanguage("de, en")
+		So(err, ShouldEqual, errContentLanguage)
+		_, err = contentLanguage("../etc")
+		So(err, ShouldEqual, errContentLanguage)
+	})
+
+	Convey("With ContentLanguageAsSuffix", t, func() {
+		h := &Handler{ContentLanguage: ContentLanguageAsSuffix}
+		for given, expected := range map[string]string{
+			"/docs/file.txt":    "/docs/file.de.txt",
+			"/docs/file.de.txt": "/docs/file.de.txt",
+			"/docs/README":      "/docs/README.de",
+			"/docs/.profile":    "/docs/.profile.de",
+			"/docs/a.tar.gz":    "/docs/a.tar.de.gz",
+		} {
+			p, metadata, err := h.withLanguage(given, "de")
+			So(err, ShouldBeNil)
+			So(p, ShouldEqual, expected)
+			So(metadata, ShouldBeNil)
+		}
+
+		Convey("uploads are written next to each other", func() {
+			h, _ := NewHandler("/", scratchDir, nil)
+			h.ContentLanguage = ContentLanguageAsSuffix
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName+".de.txt"))
+			defer os.Remove(filepath.Join(scratchDir, tempFName+".en.txt"))
+
+			for _, lang := range []string{"de", "en"} {
+				req := httptest.NewRequest("PUT", "/"+tempFName+".txt", strings.NewReader("DELME"))
+				req.Header.Set("Content-Language", lang)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 201)
+				_, err := os.Stat(filepath.Join(scratchDir, tempFName+"."+lang+".txt"))
+				So(err, ShouldBeNil)
+			}
+
+			req := httptest.NewRequest("PUT", "/"+tempFName+".txt", strings.NewReader("DELME"))
+			req.Header.Set("Content-Language", "xx-invalid-tag-1234567890")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 400)
+		})
+	})
+
+	Convey("With ContentLanguageAsMetadata", t, func() {
+		h, _ := NewHandler("/", "file://"+filepath.ToSlash(scratchDir), nil) // Keeps metadata.
+		h.ContentLanguage = ContentLanguageAsMetadata
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		defer os.Remove(filepath.Join(scratchDir, tempFName+".attrs"))
+
+		req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+		req.Header.Set("Content-Language", "de-AT")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, 201)
+
+		attrs, err := h.Bucket.Attributes(context.Background(), tempFName)
+		So(err, ShouldBeNil)
+		So(attrs.ContentLanguage, ShouldEqual, "de-AT")
+		So(attrs.Metadata[metadataContentLanguage], ShouldEqual, "de-AT")
+	})
+
+	Convey("Config 'content_language'", t, func() {
+		_, err := (&Config{To: scratchDir, ContentLanguage: "header"}).NewHandler(nil)
+		So(err, ShouldEqual, errConfigContentLanguage)
+		h, err := (&Config{To: scratchDir, ContentLanguage: "suffix"}).NewHandler(nil)
+		So(err, ShouldBeNil)
+		So(h.ContentLanguage, ShouldEqual, ContentLanguageAsSuffix)
+	})
+}
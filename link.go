@@ -0,0 +1,97 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/gcerrors"
+)
+
+// methodLink makes the file at the request's path reachable at header "Destination" as well.
+const methodLink = "LINK"
+
+// attrsSuffix is that of the files in which fileblob keeps metadata, next to the file.
+const attrsSuffix = ".attrs"
+
+// link makes the file at oldPath reachable at newPath, replacing anything there, without copying its contents:
+// in local directories as hard link, else by a copy the Bucket makes by itself.
+// The link is like a copy thereafter: replacing either file leaves the other as it is.
+func (h *Handler) link(ctx context.Context, newPath, oldPath string) (int, error) {
+	srcKey, err := h.translateToKey(oldPath)
+	if err != nil {
+		return http.StatusUnprocessableEntity, errors.Wrap(err, "Invalid source filepath")
+	}
+	dstKey, err := h.translateToKey(newPath)
+	if err != nil {
+		return http.StatusUnprocessableEntity, errors.Wrap(err, "Invalid destination filepath")
+	}
+	if srcKey == dstKey {
+		return http.StatusForbidden, nil
+	}
+	if h.isProtected(dstKey) {
+		return http.StatusForbidden, errProtected
+	}
+	if _, err := h.Bucket.Attributes(ctx, srcKey); gcerrors.Code(err) == gcerrors.NotFound {
+		return http.StatusNotFound, nil
+	}
+
+	unlock, retval, err := h.lockKey(ctx, dstKey)
+	if err != nil {
+		return retval, err
+	}
+	defer unlock()
+	if err := h.keepVersion(ctx, dstKey); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// Appending modifies files in place, which would show through any hard link.
+	if h.localDirectory == "" || h.isAppending() || h.hardLink(srcKey, dstKey) != nil {
+		if err := h.Bucket.Copy(ctx, dstKey, srcKey, nil); err != nil {
+			// A directory is at dstKey, or a file where one would have to be created, as with COPY.
+			if gcerr, ok := err.(interface{ Unwrap() error }); ok {
+				switch e := gcerr.Unwrap().(type) {
+				case *os.LinkError, *os.PathError:
+					return http.StatusConflict, e
+				}
+			}
+			return http.StatusInternalServerError, errors.Wrap(err, "LINK failed")
+		}
+	}
+	h.updateChecksums(ctx, dstKey)
+	return http.StatusCreated, nil
+}
+
+// hardLink links the local files, and any of their metadata, atomically replacing whatever is at dstKey.
+func (h *Handler) hardLink(srcKey, dstKey string) error {
+	src := filepath.Join(h.localDirectory, filepath.FromSlash(srcKey))
+	dst := filepath.Join(h.localDirectory, filepath.FromSlash(dstKey))
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	if err := linkReplacing(src, dst); err != nil {
+		return err
+	}
+	if _, err := os.Stat(src + attrsSuffix); os.IsNotExist(err) {
+		os.Remove(dst + attrsSuffix)
+		return nil
+	}
+	return linkReplacing(src+attrsSuffix, dst+attrsSuffix)
+}
+
+// linkReplacing is os.Link that replaces dst if it exists.
+func linkReplacing(src, dst string) error {
+	tmp := dst + ".link-" + printableSuffix(8)
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLink(t *testing.T) {
+	Convey("LINK", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.EnableWebdav = true
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+
+		serve := func(method, target, destination, body string) int {
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			if destination != "" {
+				req.Header.Set("Destination", destination)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+		So(serve("PUT", "/"+dir+"/v1", "", "DELME"), ShouldEqual, 201)
+		So(serve("PUT", "/"+dir+"/v2", "", "DELME, TOO"), ShouldEqual, 201)
+
+		Convey("makes a file reachable under another name without copying it", func() {
+			So(serve("LINK", "/"+dir+"/v1", "/"+dir+"/latest/file", ""), ShouldEqual, 201)
+			src, _ := os.Stat(filepath.Join(scratchDir, dir, "v1"))
+			dst, err := os.Stat(filepath.Join(scratchDir, dir, "latest", "file"))
+			So(err, ShouldBeNil)
+			So(os.SameFile(src, dst), ShouldBeTrue)
+
+			Convey("and replaces any earlier link", func() {
+				So(serve("LINK", "/"+dir+"/v2", "/"+dir+"/latest/file", ""), ShouldEqual, 201)
+				b, _ := ioutil.ReadFile(filepath.Join(scratchDir, dir, "latest", "file"))
+				So(string(b), ShouldEqual, "DELME, TOO")
+				b, _ = ioutil.ReadFile(filepath.Join(scratchDir, dir, "v1"))
+				So(string(b), ShouldEqual, "DELME")
+			})
+		})
+
+		Convey("copies with Buckets other than local directories", func() {
+			h.localDirectory = ""
+			So(serve("LINK", "/"+dir+"/v1", "/"+dir+"/latest", ""), ShouldEqual, 201)
+			src, _ := os.Stat(filepath.Join(scratchDir, dir, "v1"))
+			dst, _ := os.Stat(filepath.Join(scratchDir, dir, "latest"))
+			So(os.SameFile(src, dst), ShouldBeFalse)
+			compareContents(filepath.Join(scratchDir, dir, "latest"), []byte("DELME"))
+		})
+
+		Convey("conflicts with directories in the way", func() {
+			So(os.MkdirAll(filepath.Join(scratchDir, dir, "latest", "file"), 0777), ShouldBeNil)
+			So(serve("LINK", "/"+dir+"/v1", "/"+dir+"/latest/file", ""), ShouldEqual, 409)
+			So(serve("LINK", "/"+dir+"/v1", "/"+dir+"/v2/file", ""), ShouldEqual, 409)
+		})
+
+		Convey("needs an existing file, and a destination", func() {
+			So(serve("LINK", "/"+dir+"/missing", "/"+dir+"/latest", ""), ShouldEqual, 404)
+			So(serve("LINK", "/"+dir+"/v1", "", ""), ShouldEqual, 400)
+		})
+	})
+}
@@ -0,0 +1,99 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"gocloud.dev/gcerrors"
+)
+
+// FileMetadata is what GET with query "metadata" answers with, in format "application/json".
+// Responses to uploads point to it with a header "Link" that has rel="describedby", see SendLinkHeaders.
+type FileMetadata struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Modified    time.Time `json:"modified"`
+	MD5         []byte    `json:"md5,omitempty"` // Only if the Bucket knows it. Not of encrypted files.
+
+	Tags map[string]string `json:"tags,omitempty"` // See Handler.TagsAllowed.
+
+	Derived map[string]string `json:"derived,omitempty"` // Keys of files such as thumbnails, by name. See Deriver.
+}
+
+// linkTargetEscaper escapes what would end the target of a header "Link" early.
+var linkTargetEscaper = strings.NewReplacer("<", "%3C", ">", "%3E", " ", "%20", `"`, "%22")
+
+// metadataURL is where the FileMetadata of the file can be gotten.
+func (h *Handler) metadataURL(r *http.Request, key string) string {
+	u := url.URL{Path: h.urlPath(key), RawQuery: "metadata"}
+	return h.publicURL(r, u.String())
+}
+
+// addLinks sends headers "Link" (RFC 8288) for the file: rel="self" with its location if that's known,
+// and rel="describedby" with where its FileMetadata can be gotten.
+func (h *Handler) addLinks(w http.ResponseWriter, r *http.Request, key, location string) {
+	if location != "" {
+		w.Header().Add("Link", "<"+linkTargetEscaper.Replace(location)+`>; rel="self"`)
+	}
+	w.Header().Add("Link", "<"+h.metadataURL(r, key)+`>; rel="describedby"`)
+}
+
+// isMetadataRequest is true for GET and HEAD with query "metadata".
+func (h *Handler) isMetadataRequest(r *http.Request) bool {
+	if !h.SendLinkHeaders || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	_, ok := r.URL.Query()["metadata"]
+	return ok
+}
+
+// serveMetadata answers with the FileMetadata of a file.
+func (h *Handler) serveMetadata(w http.ResponseWriter, r *http.Request) (int, error) {
+	key, err := h.translateToKey(r.URL.Path)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	if strings.HasPrefix(key, versionsPrefix) || strings.HasPrefix("/"+key, sessionPath) {
+		return http.StatusNotFound, nil
+	}
+	attrs, err := h.Bucket.Attributes(r.Context(), key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return http.StatusNotFound, nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	m := FileMetadata{Key: h.tenantRelative(key), Size: attrs.Size, ContentType: attrs.ContentType, Modified: attrs.ModTime.UTC()}
+	if h.isEncrypting() {
+		m.Size = plaintextSize(attrs.Size)
+		m.ContentType = "" // Is that of the ciphertext.
+	} else {
+		m.MD5 = attrs.MD5
+	}
+	if m.ContentType == "" {
+		m.ContentType = mime.TypeByExtension(path.Ext(key))
+	}
+	if m.ContentType == "" {
+		m.ContentType = "application/octet-stream"
+	}
+	m.Derived = h.tenantRelativeKeys(h.derivedFiles(r.Context(), key))
+	m.Tags = tagsOf(attrs.Metadata)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(m)
+	}
+	return statusSent, nil
+}
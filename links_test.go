@@ -0,0 +1,81 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLinkHeaders(t *testing.T) {
+	Convey("With SendLinkHeaders", t, func() {
+		h, _ := NewHandler("/upload", scratchDir, nil)
+		h.SendLinkHeaders = true
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+		put := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest("PUT", "http://files.example.com/upload/"+tempFName, strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			return w
+		}
+
+		Convey("uploads get a link to the file's metadata", func() {
+			w := put()
+			So(w.Header()["Link"], ShouldResemble, []string{
+				"</upload/" + tempFName + `?metadata>; rel="describedby"`,
+			})
+		})
+
+		Convey("and with a Location also one to the file itself, both absolute with LocationFromRequest", func() {
+			h.LocationFromRequest = true
+			w := put()
+			So(w.Header()["Link"], ShouldResemble, []string{
+				"<http://files.example.com/upload/" + tempFName + `>; rel="self"`,
+				"<http://files.example.com/upload/" + tempFName + `?metadata>; rel="describedby"`,
+			})
+		})
+
+		Convey("GET with query 'metadata' answers with the file's metadata", func() {
+			put()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/upload/"+tempFName+"?metadata", nil))
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+			var m FileMetadata
+			So(json.NewDecoder(w.Body).Decode(&m), ShouldBeNil)
+			So(m.Key, ShouldEqual, tempFName)
+			So(m.Size, ShouldEqual, 5)
+			So(m.ContentType, ShouldNotBeEmpty)
+			So(m.Modified.IsZero(), ShouldBeFalse)
+
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/upload/"+tempFName+"-nonexistent?metadata", nil))
+			So(w.Code, ShouldEqual, 404)
+		})
+	})
+
+	Convey("Without SendLinkHeaders", t, func() {
+		h, _ := NewHandler("/upload", scratchDir, nil)
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/upload/"+tempFName, strings.NewReader("DELME")))
+		So(w.Header().Get("Link"), ShouldBeEmpty)
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/upload/"+tempFName+"?metadata", nil))
+		So(w.Code, ShouldEqual, 405) // Passed on to Next.
+	})
+}
@@ -0,0 +1,159 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// Pages of Listing have up to this many entries, or less if the client asks for that.
+const maxListingPageSize = 1000
+
+// Errors of listings.
+const (
+	errListingPage   coreUploadError = "Query 'page' is not one of a previous listing"
+	errListingFilter coreUploadError = "Query 'glob' must be a pattern, and 'since' a time in RFC 3339 format"
+)
+
+// Listing is what GET with query "list" answers with, in format "application/json".
+type Listing struct {
+	Entries []ListingEntry `json:"entries"`
+	// If set, there are more entries, which GET with this as query "page" lists.
+	NextPage string `json:"next_page,omitempty"`
+}
+
+// ListingEntry is a file or directory in a Listing.
+type ListingEntry struct {
+	Name     string     `json:"name"` // Ends in a '/' for directories. A path below the directory if recursive.
+	Size     int64      `json:"size,omitempty"`
+	Modified *time.Time `json:"modified,omitempty"`
+	MD5      []byte     `json:"md5,omitempty"`    // Only if the Bucket knows it. Not of encrypted files.
+	SHA256   string     `json:"sha256,omitempty"` // In hex, with MaintainChecksums.
+}
+
+// isListingRequest is true for GET with query "list".
+func (h *Handler) isListingRequest(r *http.Request) bool {
+	if !h.EnableListing || r.Method != http.MethodGet {
+		return false
+	}
+	_, ok := r.URL.Query()["list"]
+	return ok
+}
+
+// serveListing answers with the files and directories in the directory at the request's path,
+// a page at a time. Query "limit" reduces how many entries a page has. These narrow down what's listed:
+//  prefix     Names start with this.
+//  glob       Names match this pattern, as in path.Match. Without a '/', applies to the last element.
+//  since      Files have been modified at or after this time, in RFC 3339 format.
+//  recursive  Files in subdirectories are listed instead of those.
+// Pages can have fewer entries than the limit if any are filtered, even none, and still have a next one.
+func (h *Handler) serveListing(w http.ResponseWriter, r *http.Request) (int, error) {
+	dir, err := h.keyPrefix(r.URL.Path)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	query := r.URL.Query()
+	glob := query.Get("glob")
+	if _, err := path.Match(glob, ""); err != nil {
+		return http.StatusBadRequest, errListingFilter
+	}
+	var since time.Time
+	if query.Get("since") != "" {
+		if since, err = time.Parse(time.RFC3339, query.Get("since")); err != nil {
+			return http.StatusBadRequest, errListingFilter
+		}
+	}
+	opts := &blob.ListOptions{Prefix: dir + strings.TrimPrefix(query.Get("prefix"), "/"), Delimiter: "/"}
+	if _, recursive := query["recursive"]; recursive {
+		opts.Delimiter = ""
+	}
+	pageSize := maxListingPageSize
+	if n, err := strconv.Atoi(query.Get("limit")); err == nil && n > 0 && n < pageSize {
+		pageSize = n
+	}
+	token := blob.FirstPageToken
+	if query.Get("page") != "" {
+		if token, err = base64.RawURLEncoding.DecodeString(query.Get("page")); err != nil || len(token) == 0 {
+			return http.StatusBadRequest, errListingPage
+		}
+	}
+
+	objs, nextToken, err := h.Bucket.ListPage(r.Context(), token, pageSize, opts)
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return http.StatusInternalServerError, err
+	}
+	isScope := dir == "" || dir == h.tenant+"/"
+	if len(objs) == 0 && query.Get("page") == "" && opts.Prefix == dir && !isScope {
+		return http.StatusNotFound, nil
+	}
+
+	sums := make(map[string]map[string]string) // By directory.
+	listing := Listing{Entries: make([]ListingEntry, 0, len(objs))}
+	for _, obj := range objs {
+		name := obj.Key[len(dir):]
+		if strings.Contains("/"+name, "/.upload-") { // Internal, such as versions or sessions.
+			continue
+		}
+		if glob != "" && !matchesGlob(glob, strings.TrimSuffix(name, "/")) {
+			continue
+		}
+		if !obj.IsDir && obj.ModTime.Before(since) {
+			continue
+		}
+		e := ListingEntry{Name: name}
+		if !obj.IsDir {
+			subdir, base := path.Split(obj.Key)
+			if _, ok := sums[subdir]; !ok {
+				sums[subdir] = h.readChecksums(r, subdir)
+			}
+			modified := obj.ModTime.UTC()
+			e.Size, e.Modified, e.SHA256 = obj.Size, &modified, sums[subdir][base]
+			if h.isEncrypting() {
+				e.Size = plaintextSize(obj.Size)
+			} else {
+				e.MD5 = obj.MD5
+			}
+		}
+		listing.Entries = append(listing.Entries, e)
+	}
+	if len(nextToken) > 0 {
+		listing.NextPage = base64.RawURLEncoding.EncodeToString(nextToken)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(listing)
+	return statusSent, nil
+}
+
+// matchesGlob is true if the pattern matches the name, or its last element if the pattern has no '/'.
+func matchesGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// readChecksums returns the digests in the checksums file of the directory, by name, if there is one.
+func (h *Handler) readChecksums(r *http.Request, prefix string) map[string]string {
+	if !h.MaintainChecksums {
+		return nil
+	}
+	contents, err := h.readAll(r.Context(), prefix+checksumsName)
+	if err != nil {
+		return nil
+	}
+	return parseChecksums(contents)
+}
@@ -0,0 +1,94 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestListing(t *testing.T) {
+	Convey("GET with query 'list'", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.EnableListing = true
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+		for _, name := range []string{"a", "b", "sub/c"} {
+			os.MkdirAll(filepath.Dir(filepath.Join(scratchDir, dir, name)), 0755)
+			ioutil.WriteFile(filepath.Join(scratchDir, dir, name), []byte("DELME"), 0644)
+		}
+		list := func(target string) (int, Listing) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+			var listing Listing
+			json.Unmarshal(w.Body.Bytes(), &listing)
+			return w.Code, listing
+		}
+		names := func(listing Listing) []string {
+			var names []string
+			for _, e := range listing.Entries {
+				names = append(names, e.Name)
+			}
+			return names
+		}
+
+		Convey("lists the files and subdirectories of a directory", func() {
+			code, listing := list("/" + dir + "/?list")
+			So(code, ShouldEqual, 200)
+			So(names(listing), ShouldResemble, []string{"a", "b", "sub/"})
+			So(listing.Entries[0].Size, ShouldEqual, 5)
+			So(listing.Entries[0].Modified, ShouldNotBeNil)
+			So(listing.Entries[2].Modified, ShouldBeNil)
+			So(listing.NextPage, ShouldEqual, "")
+		})
+
+		Convey("a page at a time", func() {
+			_, listing := list("/" + dir + "?list&limit=2")
+			So(names(listing), ShouldResemble, []string{"a", "b"})
+			So(listing.NextPage, ShouldNotEqual, "")
+			_, listing = list("/" + dir + "?list&limit=2&page=" + listing.NextPage)
+			So(names(listing), ShouldResemble, []string{"sub/"})
+		})
+
+		Convey("with digests if SHA256SUMS are maintained", func() {
+			h.MaintainChecksums = true
+			h.updateChecksums(context.Background(), dir+"/a")
+			_, listing := list("/" + dir + "/?list")
+			So(listing.Entries[0].Name, ShouldEqual, "SHA256SUMS")
+			So(listing.Entries[1].SHA256, ShouldEqual, "1415a371e26489bf47586bc33e6e4fe6e4511259b9760b601909940ffb02f534")
+		})
+
+		Convey("filtered", func() {
+			_, listing := list("/" + dir + "/?list&prefix=s")
+			So(names(listing), ShouldResemble, []string{"sub/"})
+			_, listing = list("/" + dir + "/?list&recursive&glob=c")
+			So(names(listing), ShouldResemble, []string{"sub/c"})
+			_, listing = list("/" + dir + "/?list&since=2999-01-01T00:00:00Z")
+			So(names(listing), ShouldResemble, []string{"sub/"})
+
+			code, _ := list("/" + dir + "/?list&glob=[")
+			So(code, ShouldEqual, 400)
+			code, _ = list("/" + dir + "/?list&since=yesterday")
+			So(code, ShouldEqual, 400)
+		})
+
+		Convey("answers 404 for what's not a directory", func() {
+			code, _ := list("/" + dir + "/a?list")
+			So(code, ShouldEqual, 404)
+		})
+
+		Convey("is left to the next handler if not enabled", func() {
+			h.EnableListing = false
+			code, _ := list("/" + dir + "/?list")
+			So(code, ShouldEqual, 418)
+		})
+	})
+}
@@ -0,0 +1,77 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+const errKeyLocked coreUploadError = "Another upload to this file is in progress"
+
+// KeyLocker serializes writes to the same key.
+// Implementations that span several instances, such as with Redis or etcd, can be used
+// if those serve the same Bucket.
+type KeyLocker interface {
+	// Lock returns once the key has been locked, or with ok = false if it is locked already
+	// and wait is false. Then unlock is nil.
+	Lock(ctx context.Context, key string, wait bool) (unlock func(), ok bool, err error)
+}
+
+// keyLocker is a KeyLocker for writes within this process.
+type keyLocker struct {
+	mu   sync.Mutex
+	held map[string]chan struct{} // Gets closed on unlock.
+}
+
+// NewKeyLocker returns a KeyLocker for writes within this process.
+func NewKeyLocker() KeyLocker {
+	return &keyLocker{held: make(map[string]chan struct{})}
+}
+
+// Lock implements the KeyLocker interface.
+func (l *keyLocker) Lock(ctx context.Context, key string, wait bool) (func(), bool, error) {
+	for {
+		l.mu.Lock()
+		released, isHeld := l.held[key]
+		if !isHeld {
+			released = make(chan struct{})
+			l.held[key] = released
+			l.mu.Unlock()
+			return func() {
+				l.mu.Lock()
+				delete(l.held, key)
+				l.mu.Unlock()
+				close(released)
+			}, true, nil
+		}
+		l.mu.Unlock()
+
+		if !wait {
+			return nil, false, nil
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// lockKey locks the key against concurrent writes, if a Locker has been set.
+// unlock must be called once the file has been written or discarded.
+func (h *Handler) lockKey(ctx context.Context, key string) (unlock func(), retval int, err error) {
+	if h.Locker == nil {
+		return func() {}, 0, nil
+	}
+	unlock, ok, err := h.Locker.Lock(ctx, key, !h.RejectConcurrentWrites)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	if !ok {
+		return nil, http.StatusConflict, errKeyLocked
+	}
+	return unlock, 0, nil
+}
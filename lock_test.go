@@ -0,0 +1,110 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyLocker(t *testing.T) {
+	ctx := context.Background()
+
+	Convey("KeyLocker", t, func() {
+		l := NewKeyLocker()
+		unlock, ok, err := l.Lock(ctx, "a", false)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		Convey("does not lock a key twice", func() {
+			_, ok, _ := l.Lock(ctx, "a", false)
+			So(ok, ShouldBeFalse)
+			_, ok, _ = l.Lock(ctx, "b", false)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("lets waiters proceed once unlocked", func() {
+			locked := make(chan struct{})
+			go func() {
+				unlock, _, _ := l.Lock(ctx, "a", true)
+				close(locked)
+				unlock()
+			}()
+			select {
+			case <-locked:
+				t.Fatal("Key has been locked twice")
+			case <-time.After(20 * time.Millisecond):
+			}
+			unlock()
+			<-locked
+		})
+
+		Convey("stops waiting once the context is done", func() {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			_, ok, err := l.Lock(ctx, "a", true)
+			So(ok, ShouldBeFalse)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	Convey("A second upload to the same file", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.Locker = NewKeyLocker()
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+		// The first upload stalls after its first bytes.
+		pr, pw := io.Pipe()
+		first := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			req := httptest.NewRequest("PUT", "/"+tempFName, pr)
+			h.ServeHTTP(first, req)
+			close(done)
+		}()
+		pw.Write([]byte("DEL"))
+
+		Convey("is rejected if so configured", func() {
+			h.RejectConcurrentWrites = true
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("OTHER"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 409)
+
+			pw.Write([]byte("ME"))
+			pw.Close()
+			<-done
+			So(first.Code, ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("DELME"))
+		})
+
+		Convey("else waits for the first one", func() {
+			second := make(chan int)
+			go func() {
+				req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("OTHER"))
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				second <- w.Code
+			}()
+
+			pw.Write([]byte("ME"))
+			pw.Close()
+			<-done
+			So(first.Code, ShouldEqual, 201)
+			So(<-second, ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("OTHER"))
+		})
+	})
+}
@@ -0,0 +1,134 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const errMacrosFound coreUploadError = "The document contains macros"
+
+// Signatures of containers of Office documents.
+var (
+	oleSignature = []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1") // .doc, .xls, .ppt, and the like.
+	zipSignature = []byte("PK\x03\x04")                       // OOXML: .docx, .xlsm, .pptm, and the like.
+)
+
+// oleVBAProject is the name of the stream with the macros in OLE files, which names its entries in UTF-16LE.
+var oleVBAProject = []byte("_\x00V\x00B\x00A\x00_\x00P\x00R\x00O\x00J\x00E\x00C\x00T\x00")
+
+// MacroDetector is a Transformer that rejects Office documents with macros,
+// or flags them if OnMacrosFound is set and KeepDocuments is true.
+// Documents are recognized by their contents, not their names, and are passed on unchanged.
+//
+// OLE files, used by the formats before Office 2007, are searched for a VBA project.
+// OOXML files, which are ZIP archives, have a "vbaProject.bin", Excel 4.0 macro sheets,
+// or embedded OLE files with a VBA project if they contain macros. They get buffered
+// in a temporary file, because ZIP archives are read starting at their end.
+type MacroDetector struct {
+	// If true, documents with macros are persisted nevertheless.
+	KeepDocuments bool
+	// Is called with the key of every document with macros.
+	OnMacrosFound func(key string)
+	// Where to buffer OOXML documents. Defaults to that of the OS.
+	TempDir string
+}
+
+// Transform implements the Transformer interface.
+func (d *MacroDetector) Transform(key string, dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
+	head, _ := br.Peek(len(oleSignature))
+	var (
+		found bool
+		err   error
+	)
+	switch {
+	case bytes.HasPrefix(head, oleSignature):
+		found, err = containsStreaming(io.TeeReader(br, dst), oleVBAProject)
+	case bytes.HasPrefix(head, zipSignature):
+		found, err = d.inspectOOXML(io.TeeReader(br, dst))
+	default:
+		_, err = io.Copy(dst, br)
+	}
+	if err != nil || !found {
+		return err
+	}
+	if d.OnMacrosFound != nil {
+		d.OnMacrosFound(key)
+	}
+	if d.KeepDocuments {
+		return nil
+	}
+	return errMacrosFound
+}
+
+// inspectOOXML is true if the ZIP archive in r has parts with macros.
+// Archives that cannot be read are no Office documents, and let through.
+func (d *MacroDetector) inspectOOXML(r io.Reader) (bool, error) {
+	f, err := ioutil.TempFile(d.TempDir, ".upload-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return false, err
+	}
+
+	archive, err := zip.NewReader(f, size)
+	if err != nil {
+		return false, nil
+	}
+	for _, entry := range archive.File {
+		name := strings.ToLower(entry.Name)
+		switch {
+		case strings.HasSuffix(name, "vbaproject.bin"), strings.Contains(name, "/macrosheets/"):
+			return true, nil
+		case strings.Contains(name, "/embeddings/"):
+			rc, err := entry.Open()
+			if err != nil {
+				continue
+			}
+			found, _ := containsStreaming(rc, oleVBAProject)
+			rc.Close()
+			if found {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// containsStreaming is true if needle is in what's read from r, which is read to its end regardless.
+func containsStreaming(r io.Reader, needle []byte) (bool, error) {
+	var (
+		found bool
+		tail  []byte // Of what's been read so far, in case needle spans reads.
+	)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 && !found {
+			window := append(tail, buf[:n]...)
+			found = bytes.Contains(window, needle)
+			if len(window) >= len(needle) {
+				window = window[len(window)-len(needle)+1:]
+			}
+			tail = append(tail[:0], window...)
+		}
+		if err == io.EOF {
+			return found, nil
+		}
+		if err != nil {
+			return found, err
+		}
+	}
+}
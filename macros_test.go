@@ -0,0 +1,82 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func ooxml(names ...string) []byte {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for _, name := range append([]string{"[Content_Types].xml", "word/document.xml"}, names...) {
+		w, _ := z.Create(name)
+		w.Write([]byte("DELME"))
+	}
+	z.Close()
+	return buf.Bytes()
+}
+
+func TestMacroDetector(t *testing.T) {
+	Convey("Detecting macros", t, func() {
+		d := &MacroDetector{}
+		inspect := func(contents []byte) error {
+			var out bytes.Buffer
+			err := d.Transform("file", &out, iotest.HalfReader(bytes.NewReader(contents)))
+			So(out.Bytes(), ShouldResemble, contents)
+			return err
+		}
+
+		Convey("rejects OOXML documents with a VBA project", func() {
+			So(inspect(ooxml()), ShouldBeNil)
+			So(inspect(ooxml("word/vbaProject.bin")), ShouldEqual, errMacrosFound)
+			So(inspect(ooxml("xl/macrosheets/sheet1.xml")), ShouldEqual, errMacrosFound)
+		})
+
+		Convey("rejects OLE documents with a VBA project", func() {
+			doc := append(append([]byte{}, oleSignature...), bytes.Repeat([]byte{0}, 40000)...)
+			So(inspect(doc), ShouldBeNil)
+			doc = append(doc[:32*1024-5], oleVBAProject...) // Spans reads.
+			So(inspect(doc), ShouldEqual, errMacrosFound)
+		})
+
+		Convey("lets anything else through", func() {
+			So(inspect([]byte("DELME")), ShouldBeNil)
+			So(inspect([]byte("PK\x03\x04 not a ZIP archive")), ShouldBeNil)
+		})
+
+		Convey("flags documents if they are to be kept", func() {
+			var flagged []string
+			d.KeepDocuments = true
+			d.OnMacrosFound = func(key string) { flagged = append(flagged, key) }
+			So(inspect(ooxml("ppt/vbaProject.bin")), ShouldBeNil)
+			So(flagged, ShouldResemble, []string{"file"})
+		})
+	})
+
+	Convey("Uploads of documents with macros", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.Transformers = []Transformer{&MacroDetector{}}
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+
+		req := httptest.NewRequest("PUT", "/"+dir+"/report.docx", bytes.NewReader(ooxml("word/vbaProject.bin")))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, 422)
+		b, _ := ioutil.ReadAll(w.Body)
+		So(string(b), ShouldContainSubstring, string(errMacrosFound))
+		_, err := os.Stat(filepath.Join(scratchDir, dir, "report.docx"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,138 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	errMaintenance         coreUploadError = "Uploads are suspended for maintenance"
+	errOutsideUploadWindow coreUploadError = "Uploads are not accepted at this time"
+)
+
+// MaintenanceMode puts a Handler into read-only mode, and can be switched while it's serving.
+// Methods that write, such as PUT and DELETE, are then answered with 503 (Service Unavailable).
+type MaintenanceMode struct {
+	retryAfter int64 // In seconds, if enabled. Else -1.
+}
+
+// NewMaintenanceMode returns a MaintenanceMode that's disabled.
+func NewMaintenanceMode() *MaintenanceMode {
+	return &MaintenanceMode{retryAfter: -1}
+}
+
+// Enable suspends uploads. Clients are told to retry after the given duration, if > 0.
+func (m *MaintenanceMode) Enable(retryAfter time.Duration) {
+	seconds := int64(retryAfter / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	atomic.StoreInt64(&m.retryAfter, seconds)
+}
+
+// Disable resumes accepting uploads.
+func (m *MaintenanceMode) Disable() {
+	atomic.StoreInt64(&m.retryAfter, -1)
+}
+
+// IsEnabled is true while uploads are suspended.
+func (m *MaintenanceMode) IsEnabled() bool {
+	_, on := m.state()
+	return on
+}
+
+func (m *MaintenanceMode) state() (retryAfter time.Duration, on bool) {
+	if m == nil {
+		return 0, false
+	}
+	seconds := atomic.LoadInt64(&m.retryAfter)
+	return time.Duration(seconds) * time.Second, seconds >= 0
+}
+
+// TimeWindow is a daily span of time, in local time of the server, such as 22:00 to 06:00.
+// If To is before From it spans midnight.
+type TimeWindow struct {
+	From, To time.Duration // Since midnight.
+}
+
+// ParseTimeWindow reads a TimeWindow in format "HH:MM-HH:MM".
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	from, to := s, ""
+	if idx := strings.IndexAny(s, "-–"); idx > 0 {
+		from, to = s[:idx], strings.TrimLeft(s[idx:], "-–")
+	}
+	var w TimeWindow
+	var err error
+	if w.From, err = parseTimeOfDay(from); err != nil {
+		return w, err
+	}
+	w.To, err = parseTimeOfDay(to)
+	return w, err
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// opensIn returns how long until the window opens, which is 0 if it's open at t.
+func (w TimeWindow) opensIn(t time.Time) time.Duration {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	switch {
+	case w.From <= w.To && now >= w.From && now < w.To,
+		w.From > w.To && (now >= w.From || now < w.To):
+		return 0
+	case now < w.From:
+		return w.From - now
+	}
+	return 24*time.Hour - now + w.From
+}
+
+// isWriting is true for the methods that change files. Any others are passed on to Next anyway.
+func isWriting(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, "COPY", "MOVE", "DELETE", methodLink, methodApprove:
+		return true
+	}
+	return false
+}
+
+// checkUploadsAllowed rejects requests that write while in MaintenanceMode or outside of all UploadWindows,
+// with header "Retry-After" if it's known when that could succeed.
+func (h *Handler) checkUploadsAllowed(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !isWriting(r.Method) {
+		return 0, nil
+	}
+	if retryAfter, on := h.Maintenance.state(); on {
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter/time.Second), 10))
+		}
+		return http.StatusServiceUnavailable, errMaintenance
+	}
+	if len(h.UploadWindows) == 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	next := 24 * time.Hour
+	for _, window := range h.UploadWindows {
+		opensIn := window.opensIn(now)
+		if opensIn == 0 {
+			return 0, nil
+		}
+		if opensIn < next {
+			next = opensIn
+		}
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((next+time.Second-1)/time.Second), 10))
+	return http.StatusServiceUnavailable, errOutsideUploadWindow
+}
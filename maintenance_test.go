@@ -0,0 +1,133 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	Convey("In MaintenanceMode", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		put := func(h *Handler) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME")))
+			return w
+		}
+
+		Convey("uploads are rejected with 503 and Retry-After", func() {
+			h.Maintenance.Enable(10 * time.Minute)
+			So(h.Maintenance.IsEnabled(), ShouldBeTrue)
+			w := put(h)
+			So(w.Code, ShouldEqual, 503)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "600")
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("reads are passed on", func() {
+			h.Maintenance.Enable(0)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/"+tempFName, nil))
+			So(w.Code, ShouldEqual, 405)
+		})
+
+		Convey("the switch applies to copies of the Handler", func() {
+			copied := *h
+			h.Maintenance.Enable(0)
+			w := put(&copied)
+			So(w.Code, ShouldEqual, 503)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "")
+
+			h.Maintenance.Disable()
+			So(put(&copied).Code, ShouldEqual, 201)
+		})
+
+		Convey("is off by default, also for Handlers not made by NewHandler", func() {
+			So((&Handler{}).Maintenance.IsEnabled(), ShouldBeFalse)
+			So(put(h).Code, ShouldEqual, 201)
+		})
+	})
+
+	Convey("Config 'maintenance' starts a Handler in MaintenanceMode", t, func() {
+		c := Config{To: scratchDir, Maintenance: true, RetryAfter: Duration(time.Hour)}
+		h, err := c.NewHandler(nil)
+		So(err, ShouldBeNil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/"+tempFileName(), strings.NewReader("DELME")))
+		So(w.Code, ShouldEqual, 503)
+		So(w.Header().Get("Retry-After"), ShouldEqual, "3600")
+	})
+}
+
+func TestUploadWindows(t *testing.T) {
+	Convey("ParseTimeWindow", t, func() {
+		w, err := ParseTimeWindow("22:00-06:30")
+		So(err, ShouldBeNil)
+		So(w, ShouldResemble, TimeWindow{From: 22 * time.Hour, To: 6*time.Hour + 30*time.Minute})
+
+		_, err = ParseTimeWindow("22:00")
+		So(err, ShouldNotBeNil)
+		_, err = ParseTimeWindow("25:00-26:00")
+		So(err, ShouldNotBeNil)
+
+		_, err = (&Config{To: scratchDir, UploadWindows: []string{"night"}}).NewHandler(nil)
+		So(err, ShouldEqual, errConfigUploadWindows)
+	})
+
+	Convey("A TimeWindow", t, func() {
+		at := func(hour, minute int) time.Time { return time.Date(2020, 1, 1, hour, minute, 0, 0, time.UTC) }
+
+		Convey("within a day", func() {
+			w := TimeWindow{From: 9 * time.Hour, To: 17 * time.Hour}
+			So(w.opensIn(at(12, 0)), ShouldEqual, 0)
+			So(w.opensIn(at(8, 30)), ShouldEqual, 30*time.Minute)
+			So(w.opensIn(at(17, 0)), ShouldEqual, 16*time.Hour)
+		})
+
+		Convey("spanning midnight", func() {
+			w := TimeWindow{From: 22 * time.Hour, To: 6 * time.Hour}
+			So(w.opensIn(at(23, 0)), ShouldEqual, 0)
+			So(w.opensIn(at(1, 0)), ShouldEqual, 0)
+			So(w.opensIn(at(6, 0)), ShouldEqual, 16*time.Hour)
+		})
+	})
+
+	Convey("Outside of all UploadWindows", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		sinceMidnight := now.Sub(midnight)
+
+		Convey("uploads are rejected with 503 and Retry-After", func() {
+			opens := (sinceMidnight + 2*time.Hour) % (24 * time.Hour)
+			h.UploadWindows = []TimeWindow{{From: opens, To: (opens + time.Hour) % (24 * time.Hour)}}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("PUT", "/"+tempFileName(), strings.NewReader("DELME")))
+			So(w.Code, ShouldEqual, 503)
+			So(w.Header().Get("Retry-After"), ShouldBeIn, []string{"7199", "7200"})
+		})
+
+		Convey("but not within one", func() {
+			h.UploadWindows = []TimeWindow{{From: sinceMidnight - time.Minute, To: sinceMidnight + time.Hour}}
+			if sinceMidnight < time.Minute {
+				h.UploadWindows[0].From += 24 * time.Hour
+			}
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME")))
+			So(w.Code, ShouldEqual, 201)
+		})
+	})
+}
@@ -0,0 +1,84 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	errNotEncrypted     coreUploadError = "The upload is not encrypted with OpenPGP"
+	errUnknownRecipient coreUploadError = "The upload is not encrypted to any accepted recipient"
+)
+
+// openPGPPeekSize is how much of an upload is read to find the recipients it's been encrypted to.
+// Every recipient takes about 600 bytes with RSA-4096 keys.
+const openPGPPeekSize = 64 << 10
+
+// OpenPGPKeyIDs returns the IDs of all keys in a keyring in the armored format,
+// including those of subkeys, for Handler.RequireOpenPGPTo.
+func OpenPGPKeyIDs(armoredKeyRing io.Reader) ([]uint64, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(armoredKeyRing)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entities {
+		ids = append(ids, e.PrimaryKey.KeyId)
+		for _, sub := range e.Subkeys {
+			ids = append(ids, sub.PublicKey.KeyId)
+		}
+	}
+	return ids, nil
+}
+
+// requireOpenPGP reads the start of an upload to check that it's an OpenPGP message,
+// encrypted to at least one of RequireOpenPGPTo. Only its packet headers are parsed, nothing is decrypted.
+//
+// Returns a reader that yields all of the upload again.
+func (h *Handler) requireOpenPGP(r io.Reader) (io.Reader, int, error) {
+	var peeked bytes.Buffer
+	if _, err := io.Copy(&peeked, io.LimitReader(r, openPGPPeekSize)); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	var packets io.Reader = bytes.NewReader(peeked.Bytes())
+	if bytes.HasPrefix(peeked.Bytes(), []byte("-----BEGIN PGP MESSAGE-----")) {
+		block, err := armor.Decode(packets)
+		if err != nil {
+			return nil, http.StatusUnprocessableEntity, errNotEncrypted
+		}
+		packets = block.Body
+	}
+
+	var isToRecipient bool
+	for {
+		p, err := packet.Read(packets)
+		if err != nil {
+			return nil, http.StatusUnprocessableEntity, errNotEncrypted
+		}
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			for _, id := range h.RequireOpenPGPTo {
+				if p.KeyId == id { // Anonymous recipients have ID 0, and are not accepted.
+					isToRecipient = true
+				}
+			}
+			continue
+		case *packet.SymmetricallyEncrypted:
+			if !isToRecipient {
+				return nil, http.StatusUnprocessableEntity, errUnknownRecipient
+			}
+			return io.MultiReader(&peeked, r), 0, nil
+		}
+		// Anything else, such as literal data, is plaintext.
+		return nil, http.StatusUnprocessableEntity, errNotEncrypted
+	}
+}
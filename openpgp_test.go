@@ -0,0 +1,86 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// encryptTo returns "DELME" encrypted to the recipient, armored if so desired.
+func encryptTo(recipient *openpgp.Entity, armored bool) []byte {
+	var buf bytes.Buffer
+	var sink io.Writer = &buf
+	var closeArmor func() error
+	if armored {
+		a, _ := armor.Encode(&buf, "PGP MESSAGE", nil)
+		sink, closeArmor = a, a.Close
+	}
+	for _, id := range recipient.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8} // SHA-256. Else RIPEMD-160 were assumed.
+	}
+	w, err := openpgp.Encrypt(sink, []*openpgp.Entity{recipient}, nil, nil, nil)
+	So(err, ShouldBeNil)
+	w.Write([]byte("DELME"))
+	w.Close()
+	if closeArmor != nil {
+		closeArmor()
+	}
+	return buf.Bytes()
+}
+
+func TestRequireOpenPGP(t *testing.T) {
+	Convey("With RequireOpenPGPTo uploads", t, func() {
+		recipient, _ := openpgp.NewEntity("Recipient", "", "recipient@example.com", nil)
+		stranger, _ := openpgp.NewEntity("Stranger", "", "stranger@example.com", nil)
+
+		var pubring bytes.Buffer
+		a, _ := armor.Encode(&pubring, openpgp.PublicKeyType, nil)
+		recipient.Serialize(a)
+		a.Close()
+		ids, err := OpenPGPKeyIDs(&pubring)
+		So(err, ShouldBeNil)
+		So(ids, ShouldHaveLength, 2) // The primary key, and one for encryption.
+
+		h, _ := NewHandler("/", scratchDir, next)
+		h.RequireOpenPGPTo = ids
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		put := func(body []byte) int {
+			req := httptest.NewRequest("PUT", "/"+tempFName, bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("are accepted if encrypted to the recipient", func() {
+			encrypted := encryptTo(recipient, false)
+			So(put(encrypted), ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), encrypted)
+
+			So(put(encryptTo(recipient, true)), ShouldEqual, 201)
+		})
+
+		Convey("are rejected if in plaintext", func() {
+			So(put([]byte("DELME")), ShouldEqual, 422)
+			So(put([]byte(strings.Repeat("x", openPGPPeekSize+1))), ShouldEqual, 422)
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("are rejected if encrypted to anyone else", func() {
+			So(put(encryptTo(stranger, false)), ShouldEqual, 422)
+		})
+	})
+}
@@ -0,0 +1,106 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultPackName is the archive small files get appended to, if Handler.PackName is not set.
+const defaultPackName = "packed.tar"
+
+// packLocks serializes appending to archives, one *sync.Mutex per path.
+var packLocks sync.Map
+
+func (h *Handler) packName() string {
+	name := h.PackName
+	if name == "" {
+		name = defaultPackName
+	}
+	if h.tenant != "" {
+		return h.tenant + "/" + name
+	}
+	return name
+}
+
+// isPackingEnabled is true if small files are to be appended to an archive.
+func (h *Handler) isPackingEnabled() bool {
+	return h.PackFilesUpTo > 0 && h.localDirectory != "" && !h.isEncrypting() && !h.Quarantine && len(h.Transformers) == 0
+}
+
+// peekSmall reads up to PackFilesUpTo bytes from r. If that has been everything, it returns those.
+// Else, and only then, a reader is returned that yields what has been read so far, and then the rest of r.
+func (h *Handler) peekSmall(r io.Reader) ([]byte, io.Reader, error) {
+	limit := h.PackFilesUpTo
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if n <= limit {
+		return buf.Bytes(), nil, nil
+	}
+	return nil, io.MultiReader(&buf, r), nil
+}
+
+// appendToPack appends one file to the archive, as entry in the tar format,
+// and records in a second file ending in ".idx" where its contents start:
+//  <offset> <size> <key>
+//
+// No end-of-archive marker is written, so the next file can simply be appended.
+// Tools such as GNU tar are fine with that.
+func (h *Handler) appendToPack(key string, contents []byte) (int, error) {
+	archiveName := filepath.Join(h.localDirectory, filepath.FromSlash(h.packName()))
+	mu, _ := packLocks.LoadOrStore(archiveName, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	archive, err := os.OpenFile(archiveName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer archive.Close()
+	index, err := os.OpenFile(archiveName+".idx", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer index.Close()
+
+	tw := tar.NewWriter(archive)
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     key,
+		Size:     int64(len(contents)),
+		Mode:     0644,
+		ModTime:  time.Now(),
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	offset, err := archive.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if _, err = tw.Write(contents); err != nil {
+		return http.StatusInsufficientStorage, err
+	}
+	if err = tw.Flush(); err != nil { // Pads to full blocks. Unlike Close, this writes no trailer.
+		return http.StatusInsufficientStorage, err
+	}
+
+	line := strconv.FormatInt(offset, 10) + " " + strconv.Itoa(len(contents)) + " " + key + "\n"
+	if _, err = index.WriteString(line); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusCreated, nil
+}
@@ -0,0 +1,79 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPackSmallFiles(t *testing.T) {
+	Convey("Small files", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.PackFilesUpTo = 8
+		h.PackName = tempFileName() + ".tar"
+		archiveName := filepath.Join(scratchDir, h.PackName)
+		defer os.Remove(archiveName)
+		defer os.Remove(archiveName + ".idx")
+
+		put := func(name, contents string) int {
+			req := httptest.NewRequest("PUT", "/"+name, strings.NewReader(contents))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+			ioutil.ReadAll(resp.Body)
+			return resp.StatusCode
+		}
+
+		Convey("get appended to the archive, and larger ones are written as usual", func() {
+			small1, small2, large := tempFileName(), tempFileName(), tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, large))
+			So(put(small1, "DELME"), ShouldEqual, 201)
+			So(put(small2, ""), ShouldEqual, 201)
+			So(put(large, "REMOVEME!"), ShouldEqual, 201)
+
+			_, err := os.Stat(filepath.Join(scratchDir, small1))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			compareContents(filepath.Join(scratchDir, large), []byte("REMOVEME!"))
+
+			fd, err := os.Open(archiveName)
+			So(err, ShouldBeNil)
+			defer fd.Close()
+			tr := tar.NewReader(fd)
+			hdr, err := tr.Next()
+			So(err, ShouldBeNil)
+			So(hdr.Name, ShouldEqual, small1)
+			contents, _ := ioutil.ReadAll(tr)
+			So(string(contents), ShouldEqual, "DELME")
+			hdr, err = tr.Next()
+			So(err, ShouldBeNil)
+			So(hdr.Name, ShouldEqual, small2)
+			_, err = tr.Next()
+			So(err, ShouldEqual, io.EOF)
+
+			index, _ := ioutil.ReadFile(archiveName + ".idx")
+			lines := strings.Split(strings.TrimSpace(string(index)), "\n")
+			So(lines, ShouldHaveLength, 2)
+			So(lines[0], ShouldEndWith, " 5 "+small1)
+			offset, _ := strconv.ParseInt(strings.Fields(lines[0])[0], 10, 64)
+			contents = make([]byte, 5)
+			fd.ReadAt(contents, offset)
+			So(string(contents), ShouldEqual, "DELME")
+		})
+
+		Convey("cannot overwrite the archive", func() {
+			So(put(h.PackName, "DELME"), ShouldEqual, http.StatusUnprocessableEntity)
+		})
+	})
+}
@@ -0,0 +1,121 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const errUploadAborted coreUploadError = "The upload has been aborted before it's been received in full"
+
+// PartialUploadPolicy is what becomes of uploads that clients abort.
+type PartialUploadPolicy string
+
+// Policies for aborted uploads.
+const (
+	DiscardPartialUploads PartialUploadPolicy = ""
+	KeepPartialUploads    PartialUploadPolicy = "keep"    // As file with suffix ".partial".
+	ResumePartialUploads  PartialUploadPolicy = "session" // As first chunk of an upload session.
+)
+
+// partialSuffix is appended to the keys of files kept by KeepPartialUploads.
+const partialSuffix = ".partial"
+
+// abortDetector remembers any error reading the request body.
+type abortDetector struct {
+	r   io.Reader
+	err error
+}
+
+func (a *abortDetector) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if err != nil && err != io.EOF {
+		a.err = err
+	}
+	return n, err
+}
+
+// isAborted is true if reading has failed, but not for any checks such as of a digest.
+func (a *abortDetector) isAborted() bool {
+	if a.err == nil {
+		return false
+	}
+	_, isCheck := errors.Cause(a.err).(coreUploadError)
+	return !isCheck
+}
+
+// partialSessionID is the ID of the session an aborted upload to the key is handed off to.
+// It's derived from the key so that clients can look it up, see serveSession.
+func partialSessionID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:12]) // Is of the same length and alphabet as printableSuffix(24).
+}
+
+// isKeepingPartialUploads is true if aborted uploads are to be kept.
+// Not so if files are encrypted, because they would be kept in plaintext.
+func (h *Handler) isKeepingPartialUploads() bool {
+	return h.PartialUploads != DiscardPartialUploads && !h.isEncrypting()
+}
+
+// newPartialSink returns a writer for a copy of what's being received into the key.
+// That copy is kept in a temporary file in SpoolDirectory, or else that of the OS,
+// and is written to the Bucket according to PartialUploads by keep.
+//
+// Sessions are of requestedKey, the key without any randomized suffix, by which clients look them up,
+// and which gets a new suffix once they are completed.
+func (h *Handler) newPartialSink(requestedKey, key string) (w io.Writer, discard, keep func() error, err error) {
+	spooler := *h
+	if spooler.SpoolDirectory == "" {
+		spooler.SpoolDirectory = os.TempDir()
+	}
+	// The request's context will have ended once the client has aborted.
+	ctx := context.Background()
+
+	if h.PartialUploads == KeepPartialUploads {
+		return spooler.newSpoolSink(ctx, key+partialSuffix, nil)
+	}
+	id := partialSessionID(requestedKey)
+	w, discard, persist, err := spooler.newSpoolSink(ctx, chunkKey(id, 0), nil)
+	keep = func() error {
+		if stale, _ := h.Sessions.Get(ctx, id); stale != nil {
+			h.removeSession(ctx, stale) // Else chunks of an earlier attempt were mixed in.
+		}
+		if err := persist(); err != nil {
+			return err
+		}
+		return h.Sessions.Put(ctx, &Session{ID: id, Path: h.urlPath(requestedKey), Tenant: h.tenant, Created: time.Now()})
+	}
+	return w, discard, keep, err
+}
+
+// lookupPartialSession answers GET to the sessionURL with header "Destination" with a redirect
+// to the session an aborted upload to that destination has been handed off to, if there is any.
+func (h *Handler) lookupPartialSession(w http.ResponseWriter, r *http.Request) (int, error) {
+	destName := r.Header.Get("Destination")
+	if destName == "" {
+		return http.StatusBadRequest, errNoDestination
+	}
+	key, err := h.translateToKey(destName)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	id := partialSessionID(key)
+	session, err := h.Sessions.Get(r.Context(), id)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Session lookup failed")
+	}
+	if session == nil {
+		return http.StatusNotFound, nil
+	}
+	w.Header().Set("Location", h.publicURL(r, h.sessionURL(id)))
+	return http.StatusSeeOther, nil
+}
@@ -0,0 +1,117 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// abortingBody yields its contents, then fails as if the client had gone away.
+type abortingBody struct {
+	r io.Reader
+}
+
+func (b *abortingBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestPartialUploads(t *testing.T) {
+	Convey("Uploads that the client aborts", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		defer os.Remove(filepath.Join(scratchDir, tempFName+partialSuffix))
+		put := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest("PUT", "/"+tempFName, &abortingBody{strings.NewReader("DELME")})
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("fail with 400, and are discarded by default", func() {
+			So(put().Code, ShouldEqual, 400)
+			for _, name := range []string{tempFName, tempFName + partialSuffix} {
+				_, err := os.Stat(filepath.Join(scratchDir, name))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			}
+		})
+
+		Convey("are kept with suffix '.partial' with KeepPartialUploads", func() {
+			h.PartialUploads = KeepPartialUploads
+			So(put().Code, ShouldEqual, 400)
+			compareContents(filepath.Join(scratchDir, tempFName+partialSuffix), []byte("DELME"))
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("can be resumed in a session with ResumePartialUploads", func() {
+			h.Sessions = NewMemorySessionStore()
+			h.PartialUploads = ResumePartialUploads
+			So(put().Code, ShouldEqual, 400)
+
+			req := httptest.NewRequest("GET", sessionPath, nil)
+			req.Header.Set("Destination", "/"+tempFName)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 303)
+			session := w.Result().Header.Get("Location")
+			So(session, ShouldStartWith, sessionPath)
+
+			req = httptest.NewRequest("PUT", session+"/1", strings.NewReader("REMOVEME"))
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+
+			req = httptest.NewRequest("POST", session, nil)
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("DELMEREMOVEME"))
+		})
+
+		Convey("can be resumed with a randomized suffix, which the file gets once complete", func() {
+			h.Sessions = NewMemorySessionStore()
+			h.PartialUploads = ResumePartialUploads
+			h.RandomizedSuffixLength = 4
+			So(put().Code, ShouldEqual, 400)
+
+			req := httptest.NewRequest("GET", sessionPath, nil)
+			req.Header.Set("Destination", "/"+tempFName)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 303)
+			session := w.Result().Header.Get("Location")
+
+			req = httptest.NewRequest("POST", session, nil)
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			written, _ := filepath.Glob(filepath.Join(scratchDir, tempFName+"_????"))
+			So(written, ShouldHaveLength, 1)
+			defer os.Remove(written[0])
+			compareContents(written[0], []byte("DELME"))
+		})
+
+		Convey("are kept entirely if successful after all", func() {
+			h.PartialUploads = KeepPartialUploads
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName+partialSuffix))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
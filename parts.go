@@ -0,0 +1,154 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"encoding/json"
+	"hash"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// partOutcome is the result of persisting one part of a MIME Multipart envelope.
+type partOutcome struct {
+	partNum int
+	key     string
+	size    int64
+	sum     hash.Hash // For the receipt.
+	retval  int
+	err     error
+}
+
+// PartStatus is the outcome of one part of a MIME Multipart upload,
+// as reported in responses with status 207 (Multi-Status).
+type PartStatus struct {
+	Part   int    `json:"part"` // Counting from 1.
+	Key    string `json:"key,omitempty"`
+	Status int    `json:"status"`
+	Code   string `json:"code,omitempty"` // As in Problem.Code.
+	Detail string `json:"detail,omitempty"`
+
+	Derived map[string]string `json:"derived,omitempty"` // As in FileMetadata.
+}
+
+// MultiStatus is the body of responses with status 207 (Multi-Status),
+// sent in format "application/json".
+type MultiStatus struct {
+	Parts []PartStatus `json:"parts,omitempty"`
+	Paths []PathStatus `json:"paths,omitempty"` // Of DELETE with a manifest.
+}
+
+// settleParts responds to a MIME Multipart upload once all of its parts have been persisted, or have failed.
+//
+// If parts have failed after others have been persisted, those are removed again with RollbackOnPartError.
+// Else clients that accept JSON, or any with ContinueOnPartError, get 207 (Multi-Status)
+// with the outcome of every part, and any others the error of the first failed part.
+// Any form fields are captured for the files that have been persisted.
+func (h *Handler) settleParts(w http.ResponseWriter, r *http.Request, outcomes []*partOutcome, fields url.Values) (int, error) {
+	var (
+		failed *partOutcome
+		keys   []string // Of the files that have been persisted.
+	)
+	for _, o := range outcomes {
+		if o.err == nil {
+			keys = append(keys, o.key)
+		} else if failed == nil {
+			failed = o
+		}
+	}
+	if failed != nil && h.RollbackOnPartError && !h.isAppending() {
+		for _, o := range outcomes {
+			if key := h.writtenTo(o); o.err == nil && key != "" {
+				h.Bucket.Delete(r.Context(), key)
+			}
+		}
+		return failed.retval, &partError{failed.partNum, failed.err}
+	}
+	h.captureFormFields(r.Context(), keys, fields)
+
+	for _, o := range outcomes {
+		if o.err == nil {
+			// Yes, we send this even though another part might have failed.
+			h.addLocation(w, r, o.key)
+			h.addReceipt(w, o.key, o.size, o.sum)
+		}
+	}
+	if h.EnableTransactionDownloads && len(keys) > 0 {
+		id, err := h.randomSuffix(24)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		recentTransactions.add(id, keys)
+		w.Header().Set("Transaction", h.publicURL(r, h.transactionURL(id)))
+	}
+	switch {
+	case failed == nil && h.RedirectAfterUpload != "":
+		return h.redirectAfterUpload(w, keys)
+	case failed == nil && h.Quarantine:
+		return http.StatusAccepted, nil
+	case failed == nil:
+		return http.StatusCreated, nil
+	case len(keys) == 0 || !(acceptsProblems(r) || h.ContinueOnPartError):
+		return failed.retval, &partError{failed.partNum, failed.err}
+	}
+
+	report := MultiStatus{Parts: make([]PartStatus, 0, len(outcomes))}
+	for _, o := range outcomes {
+		if o.err == nil {
+			report.Parts = append(report.Parts, PartStatus{Part: o.partNum, Key: h.tenantRelative(o.key), Status: http.StatusCreated,
+				Derived: h.tenantRelativeKeys(h.derivedFiles(r.Context(), o.key))})
+			continue
+		}
+		report.Parts = append(report.Parts, PartStatus{Part: o.partNum, Status: o.retval,
+			Code: problemCode(o.err), Detail: o.err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusMultiStatus)
+	json.NewEncoder(w).Encode(report)
+	return statusSent, nil
+}
+
+// writtenTo is the key the part's file has actually been written to, which with Quarantine is not its own,
+// or "" if it has been packed: then it's an entry of the archive, and no file by itself.
+func (h *Handler) writtenTo(o *partOutcome) string {
+	switch {
+	case h.isPackingEnabled() && o.size <= h.PackFilesUpTo:
+		return ""
+	case h.Quarantine:
+		return quarantineKey(o.key)
+	}
+	return o.key
+}
+
+// redirectAfterUpload sends the client on to RedirectAfterUpload, with the keys of the files it has uploaded.
+func (h *Handler) redirectAfterUpload(w http.ResponseWriter, keys []string) (int, error) {
+	u, err := url.Parse(h.RedirectAfterUpload)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	query := u.Query()
+	for _, key := range keys {
+		query.Add("key", h.tenantRelative(key))
+	}
+	u.RawQuery = query.Encode()
+	w.Header().Del("Location") // Those of the files.
+	w.Header().Set("Location", u.String())
+	return http.StatusSeeOther, nil
+}
+
+// skipsFailedPart is true if with ContinueOnPartError the remaining parts are to be processed
+// after one has failed like this. Not so for errors of the server, timeouts, or limits of the whole upload.
+func (h *Handler) skipsFailedPart(retval int, err error) bool {
+	if !h.ContinueOnPartError || h.RollbackOnPartError {
+		return false
+	}
+	switch errors.Cause(err) {
+	case errTransactionTooLarge, errUploadTimedOut:
+		return false
+	}
+	return retval >= 400 && retval < 500 && retval != http.StatusRequestTimeout
+}
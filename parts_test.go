@@ -0,0 +1,166 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPartialSuccess(t *testing.T) {
+	Convey("MIME Multipart uploads with a failed part", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.MaxFilesize = 10
+		first, second := tempFileName(), tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, first))
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		p, _ := writer.CreateFormFile("A", first)
+		p.Write([]byte("DELME"))
+		p, _ = writer.CreateFormFile("B", second)
+		p.Write([]byte("REMOVEME-TOO"))
+		writer.Close()
+		post := func(accept string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(body.Bytes()))
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			req.Header.Set("Accept", accept)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("get 207 (Multi-Status) with every part's outcome if the client accepts JSON", func() {
+			w := post("application/json")
+			So(w.Code, ShouldEqual, 207)
+
+			var report MultiStatus
+			So(json.Unmarshal(w.Body.Bytes(), &report), ShouldBeNil)
+			So(report.Parts, ShouldHaveLength, 2)
+			So(report.Parts[0], ShouldResemble, PartStatus{Part: 1, Key: first, Status: 201})
+			So(report.Parts[1].Part, ShouldEqual, 2)
+			So(report.Parts[1].Status, ShouldEqual, 413)
+			So(report.Parts[1].Code, ShouldEqual, "file_too_large")
+			compareContents(filepath.Join(scratchDir, first), []byte("DELME"))
+		})
+
+		Convey("get the first error else", func() {
+			So(post("").Code, ShouldEqual, 413)
+			compareContents(filepath.Join(scratchDir, first), []byte("DELME"))
+		})
+
+		Convey("have the other files removed with RollbackOnPartError", func() {
+			h.RollbackOnPartError = true
+			So(post("application/json").Code, ShouldEqual, 413)
+			_, err := os.Stat(filepath.Join(scratchDir, first))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("have those in quarantine removed, leaving approved ones alone", func() {
+			h.RollbackOnPartError = true
+			h.Quarantine = true
+			So(ioutil.WriteFile(filepath.Join(scratchDir, first), []byte("APPROVED"), 0644), ShouldBeNil)
+			defer os.RemoveAll(filepath.Join(scratchDir, quarantinePrefix))
+
+			So(post("").Code, ShouldEqual, 413)
+			compareContents(filepath.Join(scratchDir, first), []byte("APPROVED"))
+			_, err := os.Stat(filepath.Join(scratchDir, filepath.FromSlash(quarantineKey(first))))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("leave files alone that have the name of packed ones", func() {
+			h.RollbackOnPartError = true
+			h.PackFilesUpTo = 8
+			h.PackName = tempFileName() + ".tar"
+			defer os.Remove(filepath.Join(scratchDir, h.PackName))
+			defer os.Remove(filepath.Join(scratchDir, h.PackName+".idx"))
+			So(ioutil.WriteFile(filepath.Join(scratchDir, first), []byte("STANDALONE"), 0644), ShouldBeNil)
+
+			So(post("").Code, ShouldEqual, 413)
+			compareContents(filepath.Join(scratchDir, first), []byte("STANDALONE"))
+		})
+	})
+
+	Convey("MIME Multipart uploads with ContinueOnPartError", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.MaxFilesize = 10
+		h.ContinueOnPartError = true
+		first, last := tempFileName(), tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, first))
+		defer os.Remove(filepath.Join(scratchDir, last))
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for _, part := range []struct{ name, contents string }{
+			{first, "DELME"},
+			{tempFileName(), "REMOVEME-TOO"},
+			{"CON", "DELME"}, // Reserved on Windows.
+			{last, "REMOVEME"},
+		} {
+			p, _ := writer.CreateFormFile("A", part.name)
+			p.Write([]byte(part.contents))
+		}
+		writer.Close()
+		req := httptest.NewRequest("POST", "/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		Convey("skip parts that fail, and report them", func() {
+			So(w.Code, ShouldEqual, 207)
+			var report MultiStatus
+			So(json.Unmarshal(w.Body.Bytes(), &report), ShouldBeNil)
+			So(report.Parts, ShouldHaveLength, 4)
+			So(report.Parts[1].Status, ShouldEqual, 413)
+			So(report.Parts[2].Status, ShouldEqual, 422)
+			So(report.Parts[3], ShouldResemble, PartStatus{Part: 4, Key: last, Status: 201})
+		})
+
+		Convey("process the remaining parts", func() {
+			compareContents(filepath.Join(scratchDir, first), []byte("DELME"))
+			compareContents(filepath.Join(scratchDir, last), []byte("REMOVEME"))
+		})
+	})
+}
+
+func TestRedirectAfterUpload(t *testing.T) {
+	Convey("Successful uploads", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.ApparentLocation = "/"
+		name := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, name))
+
+		Convey("by HTML forms redirect to RedirectAfterUpload, with the keys", func() {
+			h.RedirectAfterUpload = "/thanks.html?lang=en"
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			p, _ := writer.CreateFormFile("A", name)
+			p.Write([]byte("DELME"))
+			writer.Close()
+
+			req := httptest.NewRequest("POST", "/", body)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 303)
+			So(w.Header()["Location"], ShouldResemble, []string{"/thanks.html?key=" + name + "&lang=en"})
+		})
+
+		Convey("get SuccessStatus", func() {
+			h.SuccessStatus = 200
+			req := httptest.NewRequest("PUT", "/"+name, bytes.NewReader([]byte("DELME")))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 200)
+		})
+	})
+}
@@ -0,0 +1,147 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// problemContentType is that of error responses in the format of RFC 7807,
+// which are sent to clients that accept it or JSON.
+const problemContentType = "application/problem+json"
+
+// Problem is the body of error responses in format "application/problem+json".
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	Code  string `json:"code,omitempty"`  // Such as "file_too_large", for clients to tell errors apart.
+	Limit int64  `json:"limit,omitempty"` // In bytes, of the limit that has been exceeded.
+	Part  int    `json:"part,omitempty"`  // Of a MIME Multipart envelope, counting from 1.
+}
+
+// errorCodes are the values of Problem.Code.
+var errorCodes = map[coreUploadError]string{
+	errCannotReadMIMEMultipart: "multipart_unreadable",
+	errFileNameConflict:        "name_conflict",
+	errInvalidFileName:         "invalid_filename",
+	errNoDestination:           "no_destination",
+	errUnknownEnvelopeFormat:   "unknown_envelope_format",
+	errLengthInvalid:           "length_invalid",
+	errFileTooLarge:            "file_too_large",
+	errTransactionTooLarge:     "transaction_too_large",
+	errSymlinkInPath:           "symlink_in_path",
+	errUploadTimedOut:          "timed_out",
+	errInsufficientStorage:     "insufficient_storage",
+	errUploadToDirectory:       "is_directory",
+	errFileTooSmall:            "file_too_small",
+	errSizeMismatch:            "size_mismatch",
+	errDigestMismatch:          "digest_mismatch",
+	errLengthMismatch:          "length_mismatch",
+	errDigestUnsupported:       "digest_unsupported",
+	errDeltaMalformed:          "delta_malformed",
+	errKeyLocked:               "locked",
+	errScanAborted:             "scan_aborted",
+	errSessionIncomplete:       "session_incomplete",
+	errChunkIndexInvalid:       "chunk_index_invalid",
+	errTooManyChunks:           "too_many_chunks",
+	errFilenameEncoding:        "filename_encoding_unknown",
+	errSlotContentType:         "content_type_rejected",
+	errContentTypeRejected:     "content_type_rejected",
+	errContentLanguage:         "content_language_invalid",
+	errStorageClass:            "storage_class_unavailable",
+	errNotEncrypted:            "not_encrypted",
+	errDecryptionFailed:        "decryption_failed",
+	errUnknownKeyKeeper:        "unknown_key_keeper",
+	errReceiptInvalid:          "receipt_invalid",
+	errNoTenant:                "no_tenant",
+	errTenantInvalid:           "tenant_invalid",
+	errUploadAborted:           "aborted",
+	errUnknownRecipient:        "unknown_recipient",
+	errMaintenance:             "maintenance",
+	errOutsideUploadWindow:     "outside_upload_window",
+	errManifestMalformed:       "manifest_malformed",
+	errManifestTooLarge:        "manifest_too_large",
+	errNotRecursive:            "not_recursive",
+	errProtected:               "protected",
+	errReadOnly:                "read_only",
+	errMacrosFound:             "macros_found",
+	errListingPage:             "listing_page_invalid",
+	errListingFilter:           "listing_filter_invalid",
+	errFormFieldsTooLarge:      "form_fields_too_large",
+	errTagInvalid:              "tag_invalid",
+}
+
+// partError is an error with one part of a MIME Multipart envelope.
+type partError struct {
+	partNum int // Counting from 1.
+	err     error
+}
+
+// Error implements the error interface.
+func (e *partError) Error() string {
+	return "MIME Multipart exploding failed on part " + strconv.Itoa(e.partNum) + ": " + e.err.Error()
+}
+
+// Cause is for errors.Cause.
+func (e *partError) Cause() error { return e.err }
+
+// Unwrap is for errors.As.
+func (e *partError) Unwrap() error { return e.err }
+
+// problemCode returns the value of Problem.Code for err, if any.
+func problemCode(err error) string {
+	switch cause := errors.Cause(err).(type) {
+	case coreUploadError:
+		return errorCodes[cause]
+	case *MalwareFoundError:
+		return "malware_found"
+	}
+	return ""
+}
+
+// isOutOfSpace is true for errors writing to storage that has no space left.
+func isOutOfSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// acceptsProblems is true for clients that accept "application/problem+json" or JSON.
+func acceptsProblems(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, problemContentType) || strings.Contains(accept, "application/json")
+}
+
+// writeProblem sends the error in format "application/problem+json".
+func (h *Handler) writeProblem(w http.ResponseWriter, httpCode int, err error) {
+	p := Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(httpCode),
+		Status: httpCode,
+		Detail: err.Error(),
+	}
+	var pe *partError
+	if errors.As(err, &pe) {
+		p.Part = pe.partNum
+	}
+	p.Code = problemCode(err)
+	switch errors.Cause(err) {
+	case errFileTooLarge:
+		p.Limit = h.MaxFilesize
+	case errTransactionTooLarge:
+		p.Limit = h.MaxTransactionSize
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(httpCode)
+	json.NewEncoder(w).Encode(p)
+}
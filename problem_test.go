@@ -0,0 +1,79 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProblemDetails(t *testing.T) {
+	Convey("Errors", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.MaxFilesize = 10
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+		Convey("are sent in format application/problem+json to clients that accept it", func() {
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader(strings.Repeat("x", 11)))
+			req.Header.Set("Accept", "application/problem+json")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 413)
+			So(w.Result().Header.Get("Content-Type"), ShouldEqual, problemContentType)
+			var p Problem
+			So(json.Unmarshal(w.Body.Bytes(), &p), ShouldBeNil)
+			So(p.Status, ShouldEqual, 413)
+			So(p.Code, ShouldEqual, "file_too_large")
+			So(p.Limit, ShouldEqual, 10)
+			So(p.Part, ShouldEqual, 0)
+		})
+
+		Convey("tell uploads that are not of their declared length apart", func() {
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			req.Header.Set("Content-Length", "6")
+			req.Header.Set("Accept", "application/problem+json")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 422)
+			var p Problem
+			So(json.Unmarshal(w.Body.Bytes(), &p), ShouldBeNil)
+			So(p.Code, ShouldEqual, "size_mismatch")
+			So(p.Detail, ShouldNotBeEmpty)
+		})
+
+		Convey("name the part of an envelope that has been rejected", func() {
+			h.RollbackOnPartError = true // Else this were a 207 (Multi-Status).
+			body, ctype := payloadWithAttachments(tempFName, 5, 11)
+			req := httptest.NewRequest("POST", "/", body)
+			req.Header.Set("Content-Type", ctype)
+			req.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 413)
+			var p Problem
+			So(json.Unmarshal(w.Body.Bytes(), &p), ShouldBeNil)
+			So(p.Code, ShouldEqual, "file_too_large")
+			So(p.Part, ShouldEqual, 2)
+		})
+
+		Convey("are sent as plain text to any other clients", func() {
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader(strings.Repeat("x", 11)))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 413)
+			So(w.Result().Header.Get("Content-Type"), ShouldStartWith, "text/plain")
+		})
+	})
+}
@@ -0,0 +1,82 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+
+	"gocloud.dev/blob"
+)
+
+// PostProcessor derives something from files that have just been persisted,
+// for example thumbnails of images, which it would write next to the original.
+//
+// The upload has succeeded once the file has been persisted, hence any errors
+// are not sent to the client and are for implementations to log if need be.
+// Use Handler.AsyncPersist if processing takes long.
+type PostProcessor interface {
+	Process(ctx context.Context, bucket *blob.Bucket, key string) error
+}
+
+// PostProcessorFunc adapts a function to a PostProcessor.
+type PostProcessorFunc func(ctx context.Context, bucket *blob.Bucket, key string) error
+
+// Process implements the PostProcessor interface.
+func (f PostProcessorFunc) Process(ctx context.Context, bucket *blob.Bucket, key string) error {
+	return f(ctx, bucket, key)
+}
+
+// Deriver is implemented by PostProcessors that write files derived from the original,
+// so that clients can be told where to find them.
+type Deriver interface {
+	// DerivedKey returns the key of the file derived from the one at key, and a name for it,
+	// or empty strings if there will be none.
+	DerivedKey(key string) (name, derivedKey string)
+}
+
+// derivedFiles returns by their name the keys of files that PostProcessors have derived from the file.
+// Only those that exist are included.
+func (h *Handler) derivedFiles(ctx context.Context, key string) map[string]string {
+	if h.isEncrypting() {
+		return nil
+	}
+	var derived map[string]string
+	for _, p := range h.PostProcessors {
+		d, ok := p.(Deriver)
+		if !ok {
+			continue
+		}
+		name, derivedKey := d.DerivedKey(key)
+		if derivedKey == "" {
+			continue
+		}
+		if exists, _ := h.Bucket.Exists(ctx, derivedKey); !exists {
+			continue
+		}
+		if derived == nil {
+			derived = make(map[string]string)
+		}
+		derived[name] = derivedKey
+	}
+	return derived
+}
+
+// withDerivedFiles returns the key, followed by those of files derived from it.
+func (h *Handler) withDerivedFiles(ctx context.Context, key string) []string {
+	keys := []string{key}
+	for _, derivedKey := range h.derivedFiles(ctx, key) {
+		keys = append(keys, derivedKey)
+	}
+	return keys
+}
+
+// postProcess runs all PostProcessors on the file, in order.
+func (h *Handler) postProcess(ctx context.Context, key string) {
+	if h.isEncrypting() { // They would see, and write, only encrypted files.
+		return
+	}
+	for _, p := range h.PostProcessors {
+		p.Process(ctx, h.Bucket, key)
+	}
+}
@@ -0,0 +1,55 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// progressHeader carries the number of bytes received so far in informational responses.
+const progressHeader = "Received-Bytes"
+
+// progressReporter counts what is read from the request body,
+// and sends that count as "102 Processing" at most every interval.
+//
+// Sending happens in Read, on the handler's goroutine, as ResponseWriter is not safe for concurrent use.
+type progressReporter struct {
+	io.ReadCloser
+	w        http.ResponseWriter
+	interval time.Duration
+
+	received   int64
+	lastReport time.Time
+}
+
+func (p *progressReporter) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.received += int64(n)
+	if n > 0 && time.Since(p.lastReport) >= p.interval {
+		p.lastReport = time.Now()
+		p.w.Header().Set(progressHeader, strconv.FormatInt(p.received, 10))
+		p.w.WriteHeader(http.StatusProcessing)
+		p.w.Header().Del(progressHeader)
+	}
+	return n, err
+}
+
+// withProgressReports returns r with a body that reports progress, if ProgressInterval is set.
+func (h *Handler) withProgressReports(w http.ResponseWriter, r *http.Request) *http.Request {
+	if h.ProgressInterval <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Body = &progressReporter{
+		ReadCloser: r.Body,
+		w:          w,
+		interval:   h.ProgressInterval,
+		lastReport: time.Now(),
+	}
+	return r2
+}
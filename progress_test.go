@@ -0,0 +1,70 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProgressReports(t *testing.T) {
+	Convey("Progress reports", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.ProgressInterval = 10 * time.Millisecond
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		Convey("are sent as 102 with the bytes received so far", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+			pr, pw := io.Pipe()
+			go func() {
+				for i := 0; i < 4; i++ {
+					pw.Write([]byte("DELME"))
+					time.Sleep(25 * time.Millisecond)
+				}
+				pw.Close()
+			}()
+
+			var (
+				mu       sync.Mutex
+				reported []string
+			)
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					if code == http.StatusProcessing {
+						mu.Lock()
+						reported = append(reported, header.Get("Received-Bytes"))
+						mu.Unlock()
+					}
+					return nil
+				},
+			}
+			req, _ := http.NewRequest("PUT", srv.URL+"/"+tempFName, pr)
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(resp.StatusCode, ShouldEqual, 201)
+			So(resp.Header.Get("Received-Bytes"), ShouldEqual, "")
+			mu.Lock()
+			defer mu.Unlock()
+			So(len(reported), ShouldBeGreaterThan, 0)
+			So(reported[0], ShouldNotBeEmpty)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("DELMEDELMEDELMEDELME"))
+		})
+	})
+}
@@ -0,0 +1,79 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Errors of files that must not be changed.
+const (
+	errProtected coreUploadError = "The file is protected from deletion"
+	errReadOnly  coreUploadError = "The path is read-only"
+)
+
+// isProtected is true if the key matches any pattern of ProtectFromDeletion.
+// Patterns without a '/' are matched against the name of the file, else against its path below the Scope.
+func (h *Handler) isProtected(key string) bool {
+	key = h.tenantRelative(key)
+	for _, pattern := range h.ProtectFromDeletion {
+		subject := key
+		if !strings.Contains(pattern, "/") {
+			subject = path.Base(key)
+		}
+		if matched, _ := path.Match(strings.TrimPrefix(pattern, "/"), subject); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validProtectionPatterns is false if any pattern is malformed.
+func validProtectionPatterns(patterns []string) bool {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isReadOnly is true if the key is at or below any of ReadOnlyPaths, or a checksums file.
+func (h *Handler) isReadOnly(key string) bool {
+	if h.isChecksumsFile(key) {
+		return true
+	}
+	key = h.tenantRelative(key)
+	for _, p := range h.ReadOnlyPaths {
+		p = strings.Trim(p, "/")
+		if key == p || strings.HasPrefix(key, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWritable rejects requests that would change anything at or below ReadOnlyPaths,
+// as far as that's evident from its path and header "Destination".
+// Files in MIME Multipart envelopes and manifests are checked once their names are known.
+func (h *Handler) checkWritable(r *http.Request) (int, error) {
+	if (len(h.ReadOnlyPaths) == 0 && !h.MaintainChecksums) || !isWriting(r.Method) {
+		return 0, nil
+	}
+	var paths []string
+	if r.Method != "COPY" && r.Method != methodLink { // Only read from there.
+		paths = append(paths, r.URL.Path)
+	}
+	if destName := r.Header.Get("Destination"); destName != "" {
+		paths = append(paths, destName)
+	}
+	for _, p := range paths {
+		if key, err := h.translateToKey(p); err == nil && h.isReadOnly(key) {
+			return http.StatusForbidden, errReadOnly
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,106 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProtectFromDeletion(t *testing.T) {
+	Convey("isProtected", t, func() {
+		h := &Handler{ProtectFromDeletion: []string{"*.keep", "/releases/*/MANIFEST"}}
+		So(h.isProtected("a/b/.keep"), ShouldBeTrue)
+		So(h.isProtected("a/b/file.keep"), ShouldBeTrue)
+		So(h.isProtected("releases/1.0/MANIFEST"), ShouldBeTrue)
+		So(h.isProtected("releases/1.0/MANIFEST.bak"), ShouldBeFalse)
+		So(h.isProtected("mirror/releases/1.0/MANIFEST"), ShouldBeFalse)
+
+		h.tenant = "releases"
+		So(h.isProtected("releases/MANIFEST"), ShouldBeFalse)
+		So(h.isProtected("releases/releases/1.0/MANIFEST"), ShouldBeTrue)
+	})
+
+	Convey("With ProtectFromDeletion", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.EnableWebdav = true
+		h.ProtectFromDeletion = []string{"*.keep"}
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+		os.Mkdir(filepath.Join(scratchDir, dir), 0755)
+		ioutil.WriteFile(filepath.Join(scratchDir, dir, ".keep"), nil, 0644)
+		ioutil.WriteFile(filepath.Join(scratchDir, dir, "file"), []byte("DELME"), 0644)
+
+		serve := func(method, target, destination string) int {
+			req := httptest.NewRequest(method, target, nil)
+			if destination != "" {
+				req.Header.Set("Destination", destination)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		So(serve("DELETE", "/"+dir+"/.keep", ""), ShouldEqual, 403)
+		So(serve("MOVE", "/"+dir+"/.keep", "/"+dir+"/moved"), ShouldEqual, 403)
+		So(serve("COPY", "/"+dir+"/file", "/"+dir+"/.keep"), ShouldEqual, 403)
+		So(serve("COPY", "/"+dir+"/.keep", "/"+dir+"/copied"), ShouldEqual, 201)
+
+		req := httptest.NewRequest("DELETE", "/"+dir+"/?recursive", strings.NewReader("file\n.keep\n"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, 207)
+		So(w.Body.String(), ShouldContainSubstring, `{"path":".keep","status":403`)
+		_, err := os.Stat(filepath.Join(scratchDir, dir, ".keep"))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("With ReadOnlyPaths", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.EnableWebdav = true
+		dir := tempFileName()
+		h.ReadOnlyPaths = []string{"/" + dir + "/vendor/"}
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+		os.MkdirAll(filepath.Join(scratchDir, dir, "vendor"), 0755)
+		ioutil.WriteFile(filepath.Join(scratchDir, dir, "vendor", "lib"), []byte("DELME"), 0644)
+
+		serve := func(method, target, destination, body string) int {
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			if destination != "" {
+				req.Header.Set("Destination", destination)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		So(serve("PUT", "/"+dir+"/vendor/lib", "", "DELME"), ShouldEqual, 403)
+		So(serve("PUT", "/"+dir+"/vendor/new/file", "", "DELME"), ShouldEqual, 403)
+		So(serve("DELETE", "/"+dir+"/vendor/lib", "", ""), ShouldEqual, 403)
+		So(serve("MOVE", "/"+dir+"/vendor/lib", "/"+dir+"/lib", ""), ShouldEqual, 403)
+		So(serve("COPY", "/"+dir+"/vendor/lib", "/"+dir+"/lib", ""), ShouldEqual, 201)
+		So(serve("COPY", "/"+dir+"/lib", "/"+dir+"/vendor/copied", ""), ShouldEqual, 403)
+		So(serve("PUT", "/"+dir+"/vendored", "", "DELME"), ShouldEqual, 201)
+
+		Convey("also for files in MIME Multipart envelopes", func() {
+			body := "--B\r\nContent-Disposition: form-data; name=\"f\"; filename=\"x\"\r\n\r\nDELME\r\n--B--\r\n"
+			req := httptest.NewRequest("POST", "/"+dir+"/vendor/", strings.NewReader(body))
+			req.Header.Set("Content-Type", "multipart/form-data; boundary=B")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 403)
+		})
+	})
+
+	Convey("Config 'protect'", t, func() {
+		_, err := (&Config{To: scratchDir, Protect: []string{"[a-"}}).NewHandler(nil)
+		So(err, ShouldEqual, errConfigProtect)
+	})
+}
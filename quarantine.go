@@ -0,0 +1,110 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// quarantinePrefix is where in the Bucket uploads are kept until they've been approved,
+// as "<quarantinePrefix><key>".
+const quarantinePrefix = ".upload-quarantine/"
+
+// methodApprove is the same as POST with query "approve".
+const methodApprove = "APPROVE"
+
+func quarantineKey(key string) string {
+	return quarantinePrefix + key
+}
+
+// isModerationRequest is true for APPROVE, POST with query "approve" or "reject",
+// and GET with query "quarantine".
+func (h *Handler) isModerationRequest(r *http.Request) bool {
+	if !h.Quarantine {
+		return false
+	}
+	query := r.URL.Query()
+	switch r.Method {
+	case methodApprove:
+		return true
+	case http.MethodPost:
+		_, approve := query["approve"]
+		_, reject := query["reject"]
+		return approve || reject
+	case http.MethodGet:
+		_, ok := query["quarantine"]
+		return ok
+	}
+	return false
+}
+
+// serveModeration lists the uploads awaiting approval below a path, one per line: "<key> <size>",
+// or approves one, which moves it to where it's been uploaded to, or rejects it, which removes it.
+func (h *Handler) serveModeration(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method == http.MethodGet {
+		return h.listQuarantined(w, r)
+	}
+	key, err := h.translateToKey(r.URL.Path)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	if exists, err := h.Bucket.Exists(r.Context(), quarantineKey(key)); err != nil || !exists {
+		return http.StatusNotFound, err
+	}
+	if _, reject := r.URL.Query()["reject"]; reject && r.Method == http.MethodPost {
+		if err := h.Bucket.Delete(r.Context(), quarantineKey(key)); err != nil {
+			return http.StatusInternalServerError, errors.Wrap(err, "Rejecting the upload failed")
+		}
+		return http.StatusNoContent, nil
+	}
+
+	unlock, retval, err := h.lockKey(r.Context(), key)
+	if err != nil {
+		return retval, err
+	}
+	defer unlock()
+	if err := h.keepVersion(r.Context(), key); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := h.Bucket.Copy(r.Context(), key, quarantineKey(key), nil); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Approving the upload failed")
+	}
+	h.Bucket.Delete(r.Context(), quarantineKey(key))
+	h.postProcess(r.Context(), key)
+	h.updateChecksums(r.Context(), h.withDerivedFiles(r.Context(), key)...)
+	h.addLocation(w, r, key)
+	return http.StatusCreated, nil
+}
+
+// listQuarantined writes the keys and sizes of the uploads awaiting approval below the request's path.
+func (h *Handler) listQuarantined(w http.ResponseWriter, r *http.Request) (int, error) {
+	prefix, err := h.keyPrefix(r.URL.Path)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	iter := h.Bucket.List(&blob.ListOptions{Prefix: quarantineKey(prefix)})
+	for {
+		obj, err := iter.Next(r.Context())
+		if err == io.EOF || (err != nil && gcerrors.Code(err) == gcerrors.NotFound) {
+			break
+		}
+		if err != nil {
+			return statusSent, err // The status has been sent already.
+		}
+		if obj.IsDir {
+			continue
+		}
+		io.WriteString(w, h.tenantRelative(obj.Key[len(quarantinePrefix):])+" "+strconv.FormatInt(obj.Size, 10)+"\n")
+	}
+	return statusSent, nil
+}
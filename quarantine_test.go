@@ -0,0 +1,64 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQuarantine(t *testing.T) {
+	Convey("With Quarantine", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.Quarantine = true
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		defer os.RemoveAll(filepath.Join(scratchDir, ".upload-quarantine"))
+
+		serve := func(method, target string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, target, nil)
+			if method == "PUT" {
+				req = httptest.NewRequest(method, target, strings.NewReader("DELME"))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		So(serve("PUT", "/"+tempFName).Code, ShouldEqual, 202)
+
+		Convey("uploads are hidden until they've been approved", func() {
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			w := serve("GET", "/?quarantine")
+			So(w.Code, ShouldEqual, 200)
+			So(w.Body.String(), ShouldEqual, tempFName+" 5\n")
+
+			So(serve("APPROVE", "/"+tempFName).Code, ShouldEqual, 201)
+			b, err := ioutil.ReadFile(filepath.Join(scratchDir, tempFName))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "DELME")
+			So(serve("GET", "/?quarantine").Body.String(), ShouldEqual, "")
+			So(serve("POST", "/"+tempFName+"?approve").Code, ShouldEqual, 404)
+		})
+
+		Convey("rejected uploads are removed", func() {
+			So(serve("POST", "/"+tempFName+"?reject").Code, ShouldEqual, 204)
+			So(serve("POST", "/"+tempFName+"?approve").Code, ShouldEqual, 404)
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("nothing can be written to the quarantine directly", func() {
+			So(serve("PUT", "/.upload-quarantine/"+tempFName).Code, ShouldEqual, 422)
+		})
+	})
+}
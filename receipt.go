@@ -0,0 +1,82 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// receiptHeader is the JWS header of receipts, which are signed using Ed25519 (RFC 8037).
+const receiptHeader = `{"alg":"EdDSA","typ":"JWT"}`
+
+const errReceiptInvalid coreUploadError = "Receipt is malformed, or its signature is invalid"
+
+// Receipt is what has been uploaded when, as attested by the server in header "Upload-Receipt".
+type Receipt struct {
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	Digest   string `json:"digest"` // Such as "sha-256=<base64>", as in header "Digest".
+	IssuedAt int64  `json:"iat"`    // In seconds since the epoch.
+}
+
+// ParseReceipt verifies a receipt, and returns its contents.
+func ParseReceipt(token string, publicKey ed25519.PublicKey) (*Receipt, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errReceiptInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errReceiptInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errReceiptInvalid
+	}
+	var rcpt Receipt
+	if err := json.Unmarshal(payload, &rcpt); err != nil {
+		return nil, errReceiptInvalid
+	}
+	return &rcpt, nil
+}
+
+// hashForReceipt returns a reader that hashes what is read through it, for addReceipt,
+// or r and nil if no receipts are issued.
+func (h *Handler) hashForReceipt(r io.Reader) (io.Reader, hash.Hash) {
+	if h.ReceiptKey == nil {
+		return r, nil
+	}
+	sum := sha256.New()
+	return io.TeeReader(r, sum), sum
+}
+
+// addReceipt sends a header "Upload-Receipt" if receipts are issued.
+func (h *Handler) addReceipt(w http.ResponseWriter, key string, size int64, sum hash.Hash) {
+	if h.ReceiptKey == nil || sum == nil {
+		return
+	}
+	payload, _ := json.Marshal(Receipt{
+		Key:      h.tenantRelative(key),
+		Size:     size,
+		Digest:   "sha-256=" + base64.StdEncoding.EncodeToString(sum.Sum(nil)),
+		IssuedAt: time.Now().Unix(),
+	})
+	var token bytes.Buffer
+	token.WriteString(base64.RawURLEncoding.EncodeToString([]byte(receiptHeader)))
+	token.WriteByte('.')
+	token.WriteString(base64.RawURLEncoding.EncodeToString(payload))
+	signature := ed25519.Sign(h.ReceiptKey, token.Bytes())
+	token.WriteByte('.')
+	token.WriteString(base64.RawURLEncoding.EncodeToString(signature))
+	w.Header().Add("Upload-Receipt", token.String())
+}
@@ -0,0 +1,86 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReceipts(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+
+	Convey("Uploads", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.ReceiptKey = privateKey
+
+		Convey("get a receipt", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+
+			receipts := w.Result().Header["Upload-Receipt"]
+			So(receipts, ShouldHaveLength, 1)
+			rcpt, err := ParseReceipt(receipts[0], publicKey)
+			So(err, ShouldBeNil)
+			So(rcpt.Key, ShouldEqual, tempFName)
+			So(rcpt.Size, ShouldEqual, 5)
+			sum := sha256.Sum256([]byte("DELME"))
+			So(rcpt.Digest, ShouldEqual, "sha-256="+base64.StdEncoding.EncodeToString(sum[:]))
+			So(rcpt.IssuedAt, ShouldAlmostEqual, time.Now().Unix(), 5)
+
+			Convey("which cannot be forged", func() {
+				otherKey := ed25519.NewKeyFromSeed([]byte(strings.Repeat("x", ed25519.SeedSize)))
+				_, err := ParseReceipt(receipts[0], otherKey.Public().(ed25519.PublicKey))
+				So(err, ShouldEqual, errReceiptInvalid)
+
+				parts := strings.Split(receipts[0], ".")
+				forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"key":"other"}`)) + "." + parts[2]
+				_, err = ParseReceipt(forged, publicKey)
+				So(err, ShouldEqual, errReceiptInvalid)
+			})
+		})
+
+		Convey("in MIME Multipart envelopes get one receipt per file", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			body, ctype := payloadWithAttachments(tempFName, 1, 2)
+			req := httptest.NewRequest("POST", "/", body)
+			req.Header.Set("Content-Type", ctype)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+
+			receipts := w.Result().Header["Upload-Receipt"]
+			So(receipts, ShouldHaveLength, 2)
+			for i, token := range receipts {
+				rcpt, err := ParseReceipt(token, publicKey)
+				So(err, ShouldBeNil)
+				So(rcpt.Size, ShouldEqual, i+1)
+			}
+		})
+
+		Convey("that have failed get none", func() {
+			h.MaxFilesize = 2
+			req := httptest.NewRequest("PUT", "/"+tempFileName(), strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 413)
+			So(w.Result().Header.Get("Upload-Receipt"), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,43 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Reloadable serves requests using a Handler that can be replaced at runtime,
+// for example to change limits or allowed alphabets without a restart.
+//
+// Requests in flight finish with the Handler they started with.
+type Reloadable struct {
+	current atomic.Value // *Handler
+}
+
+// NewReloadable returns a Reloadable that starts out serving using h.
+func NewReloadable(h *Handler) *Reloadable {
+	r := new(Reloadable)
+	r.Update(h)
+	return r
+}
+
+// Update makes any new requests use h.
+//
+// The replaced Handler is left as it is, and so is its Bucket, which you can close
+// once you know that it's no longer in use.
+func (r *Reloadable) Update(h *Handler) {
+	r.current.Store(h)
+}
+
+// Handler returns the Handler new requests will be served by.
+func (r *Reloadable) Handler() *Handler {
+	h, _ := r.current.Load().(*Handler)
+	return h
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (r *Reloadable) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Handler().ServeHTTP(w, req)
+}
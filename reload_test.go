@@ -0,0 +1,46 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReloadable(t *testing.T) {
+	Convey("Reloadable applies the latest configuration to new requests", t, func() {
+		h1, _ := NewHandler("/", scratchDir, next)
+		r := NewReloadable(h1)
+		So(r.Handler(), ShouldEqual, h1)
+
+		h2, _ := NewHandler("/", scratchDir, next)
+		h2.MaxFilesize = 4
+		r.Update(h2)
+		So(r.Handler(), ShouldEqual, h2)
+
+		tempFName := tempFileName()
+		req, err := http.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Length", "5")
+		defer func() {
+			os.Remove(filepath.Join(scratchDir, tempFName))
+		}()
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		resp := w.Result()
+		ioutil.ReadAll(resp.Body)
+
+		So(resp.StatusCode, ShouldEqual, 413)
+	})
+}
@@ -0,0 +1,217 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// droppedWithContents are elements that are removed along with everything in them,
+// because what's in them is either code or would be shown out of context.
+var droppedWithContents = map[string]bool{
+	"script": true, "style": true, "template": true, "iframe": true, "object": true,
+	"noembed": true, "noframes": true, "frameset": true, "svg": true, "math": true,
+	"noscript": true, "xmp": true, "plaintext": true,
+}
+
+// markdownLinkTarget matches the start of link targets in Markdown, inline or in reference definitions,
+// up to and including their scheme.
+var markdownLinkTarget = regexp.MustCompile(`(\]\(\s*<?|(?m:^ {0,3}\[[^\]]+\]:[ \t]*<?))([A-Za-z][A-Za-z0-9+.\-]*):`)
+
+// markdownAutolink matches Markdown's autolinks, such as <https://example.com> or <user@example.com>.
+var markdownAutolink = regexp.MustCompile(`^<(([A-Za-z][A-Za-z0-9+.\-]*):[^\s<>]*|[^\s<>@:]+@[^\s<>@:]+)>$`)
+
+// HTMLSanitizer is a Transformer that removes from HTML and Markdown documents all elements
+// and attributes that are not in its allow-list, as well as links to URLs of any other schemes,
+// so that they can be served without scripts of the uploader running in the browsers of others.
+// The text of removed elements is kept, except for those such as "script" or "style".
+//
+// It applies to files with the extensions .html, .htm, .xhtml, .md, and .markdown.
+// Comments are removed. Markdown is left as it is otherwise, including any entities.
+type HTMLSanitizer struct {
+	// Allowed elements by their name in lowercase, with the attributes they can have.
+	Elements map[string][]string
+	// Allowed schemes of URLs in attributes "href", "src", and "cite", and in Markdown links.
+	// URLs without one are always allowed.
+	URLSchemes []string
+}
+
+// NewHTMLSanitizer returns an HTMLSanitizer that allows elements for text, lists, tables, links, and images.
+func NewHTMLSanitizer() *HTMLSanitizer {
+	s := &HTMLSanitizer{
+		Elements: map[string][]string{
+			"a":       {"href", "title"},
+			"img":     {"src", "alt", "title", "width", "height"},
+			"abbr":    {"title"},
+			"q":       {"cite"},
+			"ol":      {"start"},
+			"td":      {"colspan", "rowspan"},
+			"th":      {"colspan", "rowspan", "scope"},
+			"meta":    {"charset"},
+			"details": {"open"},
+		},
+		URLSchemes: []string{"http", "https", "mailto"},
+	}
+	for _, name := range strings.Fields(`html head body title
+		p br hr div span blockquote pre code kbd samp var
+		b i u s em strong small sub sup del ins mark cite dfn
+		h1 h2 h3 h4 h5 h6 ul li dl dt dd
+		table caption thead tbody tfoot tr colgroup col
+		figure figcaption summary`) {
+		s.Elements[name] = nil
+	}
+	return s
+}
+
+// Transform implements the Transformer interface.
+func (s *HTMLSanitizer) Transform(key string, dst io.Writer, src io.Reader) error {
+	var isMarkdown bool
+	switch strings.ToLower(path.Ext(key)) {
+	case ".html", ".htm", ".xhtml":
+	case ".md", ".markdown":
+		isMarkdown = true
+	default:
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	z := html.NewTokenizer(src)
+	var (
+		dropping string // Name of the element whose contents are being dropped.
+		depth    int    // Of nested elements of that name.
+	)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return errors.Wrap(z.Err(), "Sanitizing failed")
+		}
+		tok := z.Token()
+
+		if dropping != "" {
+			switch {
+			case tok.Data != dropping:
+			case tt == html.StartTagToken:
+				depth++
+			case tt == html.EndTagToken:
+				if depth--; depth == 0 {
+					dropping = ""
+				}
+			}
+			continue
+		}
+
+		var out string
+		switch tt {
+		case html.TextToken:
+			// Markdown is left unescaped, unless it could be taken for markup.
+			if raw := string(z.Raw()); isMarkdown && !strings.Contains(raw, "<") {
+				out = s.neutralizeMarkdownLinks(raw)
+			} else {
+				out = html.EscapeString(tok.Data)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedWithContents[tok.Data] {
+				if tt == html.StartTagToken {
+					dropping, depth = tok.Data, 1
+				}
+				continue
+			}
+			if raw := string(z.Raw()); isMarkdown && s.isAutolink(raw) {
+				out = raw
+				break
+			}
+			attrs, ok := s.Elements[tok.Data]
+			if !ok {
+				continue
+			}
+			tok.Attr = s.allowedAttributes(tok.Attr, attrs)
+			out = tok.String()
+		case html.EndTagToken:
+			if _, ok := s.Elements[tok.Data]; !ok {
+				continue
+			}
+			out = tok.String()
+		case html.DoctypeToken:
+			out = tok.String()
+		default: // Comments.
+			continue
+		}
+		if _, err := io.WriteString(dst, out); err != nil {
+			return err
+		}
+	}
+}
+
+// allowedAttributes returns those of attrs that are in allowed, and with URLs of allowed schemes.
+func (s *HTMLSanitizer) allowedAttributes(attrs []html.Attribute, allowed []string) []html.Attribute {
+	kept := attrs[:0]
+	for _, a := range attrs {
+		if a.Namespace != "" || !containsString(allowed, a.Key) {
+			continue
+		}
+		switch a.Key {
+		case "href", "src", "cite":
+			if !s.isAllowedURL(a.Val) {
+				continue
+			}
+		}
+		kept = append(kept, a)
+	}
+	return kept
+}
+
+// isAllowedURL is true for relative URLs, and those of any of URLSchemes.
+func (s *HTMLSanitizer) isAllowedURL(u string) bool {
+	// Browsers ignore whitespace and control characters in schemes, such as in "java\tscript:".
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, u)
+	idx := strings.IndexAny(u, ":/?#")
+	if idx < 0 || u[idx] != ':' {
+		return true
+	}
+	return containsString(s.URLSchemes, strings.ToLower(u[:idx]))
+}
+
+// isAutolink is true for Markdown's autolinks to allowed URLs or to e-mail addresses,
+// which the Tokenizer takes for elements.
+func (s *HTMLSanitizer) isAutolink(raw string) bool {
+	m := markdownAutolink.FindStringSubmatch(raw)
+	if m == nil {
+		return false
+	}
+	return m[2] == "" || containsString(s.URLSchemes, strings.ToLower(m[2]))
+}
+
+// neutralizeMarkdownLinks replaces the scheme of link targets that are not allowed with "#".
+func (s *HTMLSanitizer) neutralizeMarkdownLinks(text string) string {
+	return markdownLinkTarget.ReplaceAllStringFunc(text, func(m string) string {
+		sub := markdownLinkTarget.FindStringSubmatch(m)
+		if containsString(s.URLSchemes, strings.ToLower(sub[2])) {
+			return m
+		}
+		return sub[1] + "#"
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
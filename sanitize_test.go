@@ -0,0 +1,107 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHTMLSanitizer(t *testing.T) {
+	s := NewHTMLSanitizer()
+	sanitize := func(key, input string) string {
+		var out strings.Builder
+		So(s.Transform(key, &out, strings.NewReader(input)), ShouldBeNil)
+		return out.String()
+	}
+
+	Convey("Sanitizing HTML", t, func() {
+		Convey("removes scripts and styles with their contents, and comments", func() {
+			So(sanitize("a.html", `<p>Hi<script>alert(1)</script><style>p{}</style><!-- x --></p>`),
+				ShouldEqual, `<p>Hi</p>`)
+		})
+
+		Convey("removes elements not allowed, but keeps their text", func() {
+			So(sanitize("a.htm", `<form><b>bold</b> <blink>text</blink></form>`),
+				ShouldEqual, `<b>bold</b> text`)
+		})
+
+		Convey("removes attributes not allowed, and links to other schemes", func() {
+			So(sanitize("a.html", `<a href="https://example.com" onclick="x()">1</a><a href="java	script:x()">2</a>`),
+				ShouldEqual, `<a href="https://example.com">1</a><a>2</a>`)
+			So(sanitize("a.html", `<img src="/pic.png" alt="pic"><img src="data:image/png,">`),
+				ShouldEqual, `<img src="/pic.png" alt="pic"><img>`)
+		})
+
+		Convey("escapes text", func() {
+			So(sanitize("a.html", `1 &lt; 2 &amp; <title><b></title>`),
+				ShouldEqual, `1 &lt; 2 &amp; <title>&lt;b&gt;</title>`)
+		})
+
+		Convey("leaves other files as they are", func() {
+			So(sanitize("a.txt", `<script>alert(1)</script>`), ShouldEqual, `<script>alert(1)</script>`)
+		})
+	})
+
+	Convey("Sanitizing Markdown", t, func() {
+		Convey("leaves text and autolinks as they are", func() {
+			input := "# Title\n\n* 1 > 0\n* <https://example.com> and <me@example.com>\n\n> quote\n"
+			So(sanitize("README.md", input), ShouldEqual, input)
+		})
+
+		Convey("removes any markup not allowed", func() {
+			So(sanitize("a.markdown", "Hi <script>alert(1)</script><b onmouseover=x()>there</b>"),
+				ShouldEqual, "Hi <b>there</b>")
+		})
+
+		Convey("neutralizes links to other schemes", func() {
+			So(sanitize("a.md", "[a](https://example.com) [b](javascript:alert(1))\n\n[c]: vbscript:x\n"),
+				ShouldEqual, "[a](https://example.com) [b](#alert(1))\n\n[c]: #x\n")
+			So(sanitize("a.md", "<javascript:alert(1)>"), ShouldEqual, "")
+		})
+	})
+}
+
+func TestTransformers(t *testing.T) {
+	Convey("Transformers", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+
+		put := func(name, body string) int {
+			req := httptest.NewRequest("PUT", "/"+dir+"/"+name, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("get applied in order, before anything is stored", func() {
+			upper := TransformerFunc(func(key string, dst io.Writer, src io.Reader) error {
+				b, _ := ioutil.ReadAll(src)
+				_, err := io.WriteString(dst, strings.ToUpper(string(b)))
+				return err
+			})
+			h.Transformers = []Transformer{NewHTMLSanitizer(), upper}
+			So(put("a.html", "<p>Hi<script>alert(1)</script></p>"), ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, dir, "a.html"), []byte("<P>HI</P>"))
+		})
+
+		Convey("reject files with 422 if any fails", func() {
+			h.Transformers = []Transformer{TransformerFunc(func(key string, dst io.Writer, src io.Reader) error {
+				return errors.New("Not today")
+			})}
+			So(put("a.txt", "DELME"), ShouldEqual, 422)
+			_, err := os.Stat(filepath.Join(scratchDir, dir, "a.txt"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,65 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+const errScanAborted coreUploadError = "Upload has been aborted"
+
+// Scanner inspects uploads for malware before they get persisted.
+type Scanner interface {
+	// Scan reads r, and returns a *MalwareFoundError if it is malicious.
+	// Any other error means the contents could not be scanned.
+	Scan(ctx context.Context, r io.Reader) error
+}
+
+// MalwareFoundError is returned by a Scanner for malicious contents.
+type MalwareFoundError struct {
+	Name string // As reported by the scanner, such as "Eicar-Signature".
+}
+
+// Error implements the error interface.
+func (e *MalwareFoundError) Error() string { return "Malware found: " + e.Name }
+
+// scanAlongside returns a reader that passes what is read from r to the Scanner, too.
+// Once everything has been read, verdict returns how to respond if the upload must not be persisted,
+// else 0 and nil. Call stop in any case to end the scanning, which is a no-op after verdict.
+func (h *Handler) scanAlongside(ctx context.Context, key string, r io.Reader) (io.Reader, func() (int, error), func()) {
+	pr, pw := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		err := h.Scanner.Scan(ctx, pr)
+		io.Copy(ioutil.Discard, pr) // Should the scanner have stopped early, else writes would block.
+		result <- err
+	}()
+
+	verdict := func() (int, error) {
+		pw.Close()
+		err := <-result
+		switch finding := err.(type) {
+		case nil:
+			return 0, nil
+		case *MalwareFoundError:
+			if h.OnMalwareFound != nil {
+				h.OnMalwareFound(key, finding)
+			}
+			return http.StatusUnprocessableEntity, finding
+		}
+		if h.ScanFailOpen {
+			return 0, nil
+		}
+		return http.StatusServiceUnavailable, errors.Wrap(err, "Scanning for malware failed")
+	}
+	stop := func() {
+		pw.CloseWithError(errScanAborted)
+	}
+	return io.TeeReader(r, pw), verdict, stop
+}
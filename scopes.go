@@ -0,0 +1,89 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ScopeMux dispatches requests to the Handler with the longest Scope matching the URL.Path,
+// so that one instance can serve several scopes with different configurations.
+//
+// Handlers with a Host are considered first, and only for requests to that host.
+type ScopeMux struct {
+	handlers []*Handler
+
+	// For requests outside of any Scope. Optional, and if nil the response will be 404.
+	Next http.Handler
+}
+
+// NewScopeMux returns a ScopeMux over the given Handlers.
+//
+// 'next' is optional and can be nil.
+func NewScopeMux(next http.Handler, handlers ...*Handler) *ScopeMux {
+	m := &ScopeMux{
+		handlers: make([]*Handler, len(handlers)),
+		Next:     next,
+	}
+	copy(m.handlers, handlers)
+	sort.SliceStable(m.handlers, func(i, j int) bool {
+		a, b := m.handlers[i], m.handlers[j]
+		if (a.Host == "") != (b.Host == "") {
+			return a.Host != ""
+		}
+		return len(strings.TrimSuffix(a.Scope, "/")) > len(strings.TrimSuffix(b.Scope, "/"))
+	})
+	return m
+}
+
+// Wrap returns a middleware that handles uploads as configured, and passes anything else on to next unchanged:
+// requests outside of the Scope or for another Host, and those with methods it doesn't serve, such as GET.
+// Their ResponseWriter is the original, too, which next can hijack, and which won't add any SuccessHeaders.
+//
+// 'next' is optional and can be nil, which answers those with 404.
+func Wrap(next http.Handler, c *Config) (http.Handler, error) {
+	if next == nil {
+		next = http.NotFoundHandler()
+	}
+	h, err := c.NewHandler(next)
+	if err != nil {
+		return nil, err
+	}
+	return NewScopeMux(next, h), nil
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (m *ScopeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h := m.match(r); h != nil {
+		h.ServeHTTP(w, r)
+		return
+	}
+	if m.Next != nil {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// match returns the first Handler whose Scope is a prefix of the request's path,
+// honoring path segments: "/images" matches "/images/a.png" but not "/imagesque".
+func (m *ScopeMux) match(r *http.Request) *Handler {
+	path, host := r.URL.Path, r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range m.handlers {
+		if h.Host != "" && !strings.EqualFold(h.Host, host) {
+			continue
+		}
+		scope := strings.TrimSuffix(h.Scope, "/")
+		if scope == "" || path == scope || strings.HasPrefix(path, scope+"/") {
+			return h
+		}
+	}
+	return nil
+}
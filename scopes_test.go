@@ -0,0 +1,147 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScopeMux(t *testing.T) {
+	Convey("ScopeMux", t, func() {
+		images, _ := NewHandler("/images", scratchDir, next)
+		images.MaxFilesize = 4
+		root, _ := NewHandler("/", scratchDir, next)
+		docs, _ := NewHandler("/docs/", scratchDir, next)
+		m := NewScopeMux(nil, root, images, docs)
+
+		Convey("picks the longest matching Scope", func() {
+			So(m.match(httptest.NewRequest("PUT", "/images/a", nil)), ShouldEqual, images)
+			So(m.match(httptest.NewRequest("PUT", "/docs/a", nil)), ShouldEqual, docs)
+		})
+
+		Convey("does not match on partial path segments", func() {
+			So(m.match(httptest.NewRequest("PUT", "/imagesque", nil)), ShouldEqual, root)
+		})
+
+		Convey("considers the host first", func() {
+			assets, _ := NewHandler("/", scratchDir, next)
+			assets.Host = "cdn.example.org"
+			m := NewScopeMux(nil, root, images, assets)
+
+			req := httptest.NewRequest("PUT", "/images/a", nil)
+			req.Host = "CDN.example.org:8443"
+			So(m.match(req), ShouldEqual, assets)
+			req.Host = "uploads.example.com"
+			So(m.match(req), ShouldEqual, images)
+		})
+
+		Convey("applies the configuration of the matched Handler", func() {
+			tempFName := tempFileName()
+			req, err := http.NewRequest("PUT", "/images/"+tempFName, strings.NewReader("DELME"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Length", "5")
+			defer func() {
+				os.Remove(filepath.Join(scratchDir, tempFName))
+			}()
+
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, req)
+			resp := w.Result()
+			ioutil.ReadAll(resp.Body)
+			So(resp.StatusCode, ShouldEqual, 413)
+
+			req, _ = http.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			req.Header.Set("Content-Length", "5")
+			w = httptest.NewRecorder()
+			m.ServeHTTP(w, req)
+			resp = w.Result()
+			ioutil.ReadAll(resp.Body)
+			So(resp.StatusCode, ShouldEqual, 201)
+		})
+
+		Convey("responds with 404 to requests outside of any Scope", func() {
+			m := NewScopeMux(nil, images)
+			req, _ := http.NewRequest("PUT", "/elsewhere", strings.NewReader("DELME"))
+
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, req)
+			resp := w.Result()
+			ioutil.ReadAll(resp.Body)
+			So(resp.StatusCode, ShouldEqual, 404)
+		})
+	})
+}
+
+func TestWrap(t *testing.T) {
+	Convey("Wrap", t, func() {
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Inner", r.Method)
+			w.WriteHeader(http.StatusOK)
+		})
+		wrapped, err := Wrap(inner, NewDefaultConfig("/uploads", scratchDir))
+		So(err, ShouldBeNil)
+		name := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, name))
+
+		serve := func(method, path string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			wrapped.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("handles uploads", func() {
+			w := serve("PUT", "/uploads/"+name)
+			So(w.Code, ShouldEqual, 201)
+			So(w.Header().Get("X-Inner"), ShouldBeBlank)
+		})
+
+		Convey("passes anything else on", func() {
+			for _, path := range []string{"/uploads/" + name, "/elsewhere"} {
+				w := serve("GET", path)
+				So(w.Code, ShouldEqual, 200)
+				So(w.Header().Get("X-Inner"), ShouldEqual, "GET")
+			}
+			So(serve("PUT", "/elsewhere").Header().Get("X-Inner"), ShouldEqual, "PUT")
+		})
+
+		Convey("hands next the original ResponseWriter", func() {
+			var got http.ResponseWriter
+			c := NewDefaultConfig("/uploads", scratchDir)
+			c.SuccessHeaders = map[string]string{"Cache-Control": "no-store"}
+			wrapped, _ = Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = w
+				w.WriteHeader(http.StatusOK)
+			}), c)
+
+			for _, method := range []string{"OPTIONS", "PROPFIND", "MOVE"} {
+				got = nil
+				w := serve(method, "/uploads/"+name)
+				So(w.Code, ShouldEqual, 200)
+				So(got, ShouldEqual, w)
+				So(w.Header().Get("Cache-Control"), ShouldBeEmpty)
+			}
+		})
+
+		Convey("answers with 404 without next", func() {
+			wrapped, _ = Wrap(nil, NewDefaultConfig("/uploads", scratchDir))
+			So(serve("GET", "/uploads/"+name).Code, ShouldEqual, 404)
+		})
+
+		Convey("rejects invalid Configs", func() {
+			_, err := Wrap(inner, &Config{})
+			So(err, ShouldEqual, errConfigNoDestination)
+		})
+	})
+}
@@ -0,0 +1,151 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// corruptedPrefix is where in the Bucket files are moved to whose contents don't match their recorded digest,
+// as "<corruptedPrefix><key>".
+const corruptedPrefix = ".upload-corrupted/"
+
+// ScrubReport is the outcome of one pass of Scrub.
+type ScrubReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	Checked      int64    `json:"checked"`      // Files whose contents have been compared to their digest.
+	Bytes        int64    `json:"bytes"`        // Read in total.
+	Unverifiable int64    `json:"unverifiable"` // Files without a recorded digest.
+	Corrupted    []string `json:"corrupted"`    // Keys of files that have been moved below ".upload-corrupted/".
+}
+
+// isScrubRequest is true for POST with query "scrub".
+func (h *Handler) isScrubRequest(r *http.Request) bool {
+	if !h.EnableScrubbing || r.Method != http.MethodPost {
+		return false
+	}
+	_, ok := r.URL.Query()["scrub"]
+	return ok
+}
+
+// serveScrub scrubs all files below the request's path, and answers with the ScrubReport.
+func (h *Handler) serveScrub(w http.ResponseWriter, r *http.Request) (int, error) {
+	prefix, err := h.keyPrefix(r.URL.Path)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	report, err := h.Scrub(r.Context(), prefix)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	b, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return statusSent, nil
+}
+
+// Scrub reads every file in the Bucket whose key starts with prefix, and compares it to the MD5 digest
+// the Bucket has recorded when it's been written. Files that don't match are moved below ".upload-corrupted/",
+// and OnCorruptionFound is called with their keys.
+//
+// Run it periodically for long-lived archives.
+// Buckets that don't keep metadata, such as local directories without "file://", have no digests to check.
+func (h *Handler) Scrub(ctx context.Context, prefix string) (*ScrubReport, error) {
+	report := &ScrubReport{Started: time.Now()}
+	iter := h.Bucket.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF || (err != nil && gcerrors.Code(err) == gcerrors.NotFound) {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		if obj.IsDir || strings.HasPrefix(obj.Key, corruptedPrefix) {
+			continue
+		}
+		corrupted, err := h.scrubOne(ctx, obj.Key, report)
+		if err != nil {
+			return report, err
+		}
+		if !corrupted {
+			continue
+		}
+		if err := h.moveCorrupted(ctx, obj.Key); err != nil {
+			return report, err
+		}
+		report.Corrupted = append(report.Corrupted, obj.Key)
+		if h.OnCorruptionFound != nil {
+			h.OnCorruptionFound(obj.Key)
+		}
+	}
+	report.Finished = time.Now()
+	return report, nil
+}
+
+// scrubOne is true if the file's contents don't match its recorded digest.
+// Files that have been replaced or removed meanwhile are not corrupted.
+func (h *Handler) scrubOne(ctx context.Context, key string, report *ScrubReport) (bool, error) {
+	attrs, err := h.Bucket.Attributes(ctx, key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(attrs.MD5) == 0 {
+		report.Unverifiable++
+		return false, nil
+	}
+
+	rd, err := h.Bucket.NewReader(ctx, key, nil)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	sum := md5.New()
+	n, err := io.Copy(sum, rd)
+	rd.Close()
+	report.Bytes += n
+	if err != nil {
+		return false, errors.Wrapf(err, "Reading '%s' failed", key)
+	}
+	report.Checked++
+	if bytes.Equal(sum.Sum(nil), attrs.MD5) {
+		return false, nil
+	}
+
+	now, err := h.Bucket.Attributes(ctx, key)
+	if err != nil || !now.ModTime.Equal(attrs.ModTime) || !bytes.Equal(now.MD5, attrs.MD5) {
+		return false, nil // Has been replaced.
+	}
+	return true, nil
+}
+
+func (h *Handler) moveCorrupted(ctx context.Context, key string) error {
+	if err := h.Bucket.Copy(ctx, corruptedPrefix+key, key, nil); err != nil {
+		return errors.Wrapf(err, "Moving corrupted '%s' aside failed", key)
+	}
+	if err := h.Bucket.Delete(ctx, key); err != nil {
+		return err
+	}
+	h.updateChecksums(ctx, key)
+	return nil
+}
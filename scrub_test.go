@@ -0,0 +1,79 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScrub(t *testing.T) {
+	Convey("Scrub", t, func() {
+		h, _ := NewHandler("/", "file://"+filepath.ToSlash(scratchDir), nil) // Keeps digests.
+		h.EnableScrubbing = true
+		dir := tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, dir))
+		defer os.RemoveAll(filepath.Join(scratchDir, corruptedPrefix))
+
+		for _, name := range []string{"intact", "rotten"} {
+			req := httptest.NewRequest("PUT", "/"+dir+"/"+name, strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+		}
+
+		Convey("leaves intact files alone", func() {
+			report, err := h.Scrub(context.Background(), dir+"/")
+			So(err, ShouldBeNil)
+			So(report.Checked, ShouldEqual, 2)
+			So(report.Bytes, ShouldEqual, 10)
+			So(report.Corrupted, ShouldBeEmpty)
+		})
+
+		Convey("moves corrupted files aside, and reports them", func() {
+			So(ioutil.WriteFile(filepath.Join(scratchDir, dir, "rotten"), []byte("DELMX"), 0644), ShouldBeNil)
+			var found []string
+			h.OnCorruptionFound = func(key string) { found = append(found, key) }
+
+			req := httptest.NewRequest("POST", "/"+dir+"/?scrub", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 200)
+			var report ScrubReport
+			So(json.Unmarshal(w.Body.Bytes(), &report), ShouldBeNil)
+			So(report.Checked, ShouldEqual, 2)
+			So(report.Corrupted, ShouldResemble, []string{dir + "/rotten"})
+			So(found, ShouldResemble, report.Corrupted)
+
+			_, err := os.Stat(filepath.Join(scratchDir, dir, "rotten"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			b, err := ioutil.ReadFile(filepath.Join(scratchDir, corruptedPrefix, dir, "rotten"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "DELMX")
+		})
+
+		Convey("counts files without a digest", func() {
+			So(ioutil.WriteFile(filepath.Join(scratchDir, dir, "bare"), []byte("DELME"), 0644), ShouldBeNil)
+			report, err := h.Scrub(context.Background(), dir+"/")
+			So(err, ShouldBeNil)
+			So(report.Checked, ShouldEqual, 2)
+			So(report.Unverifiable, ShouldEqual, 1)
+		})
+
+		Convey("the corrupted files cannot be written to", func() {
+			req := httptest.NewRequest("PUT", "/"+corruptedPrefix+dir+"/rotten", strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 422)
+		})
+	})
+}
@@ -0,0 +1,423 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// sessionPath is where, below Scope, upload sessions are created and managed.
+// Their chunks are kept in the Bucket under the same prefix, which is reserved so that no regular upload can write there.
+const sessionPath = "/.upload-session/"
+
+// maxSessionChunks is how many chunks a session can have, as many as parts of an S3 multipart upload.
+const maxSessionChunks = 10000
+
+const (
+	errSessionIncomplete coreUploadError = "Chunks of the upload session are missing"
+	errChunkIndexInvalid coreUploadError = "Chunk index must be a non-negative integer"
+	errTooManyChunks     coreUploadError = "Upload sessions cannot have more than 10000 chunks"
+)
+
+// Session is one upload that's been split into chunks,
+// which can be uploaded in any order, concurrently, and be retried.
+type Session struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`             // Of the file-to-be, in the URL.
+	Tenant  string    `json:"tenant,omitempty"` // See Handler.TenantOf.
+	Created time.Time `json:"created"`
+}
+
+// SessionStore keeps upload sessions. Chunks are not kept in it, but in the Bucket.
+//
+// Sessions survive restarts of the Handler only with a store that persists them,
+// and must be in a store shared by all instances if several serve the same Bucket.
+type SessionStore interface {
+	Put(ctx context.Context, s *Session) error
+	// Get returns nil and no error if there is no such session.
+	Get(ctx context.Context, id string) (*Session, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// MemorySessionStore keeps sessions in memory, and therefore does not persist them.
+type MemorySessionStore struct {
+	sync.Mutex
+	m map[string]Session
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{m: make(map[string]Session)}
+}
+
+// Put implements the SessionStore interface.
+func (s *MemorySessionStore) Put(_ context.Context, session *Session) error {
+	s.Lock()
+	defer s.Unlock()
+	s.m[session.ID] = *session
+	return nil
+}
+
+// Get implements the SessionStore interface.
+func (s *MemorySessionStore) Get(_ context.Context, id string) (*Session, error) {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.m[id]
+	if !ok {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// Delete implements the SessionStore interface.
+func (s *MemorySessionStore) Delete(_ context.Context, id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, id)
+	return nil
+}
+
+// BucketSessionStore keeps sessions in a Bucket as JSON, next to their chunks if it's the Handler's.
+type BucketSessionStore struct {
+	Bucket *blob.Bucket
+}
+
+func (s BucketSessionStore) key(id string) string {
+	return sessionPath[1:] + id + ".json"
+}
+
+// Put implements the SessionStore interface.
+func (s BucketSessionStore) Put(ctx context.Context, session *Session) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return s.Bucket.WriteAll(ctx, s.key(session.ID), b, nil)
+}
+
+// Get implements the SessionStore interface.
+func (s BucketSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	b, err := s.Bucket.ReadAll(ctx, s.key(id))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err := json.Unmarshal(b, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Delete implements the SessionStore interface.
+func (s BucketSessionStore) Delete(ctx context.Context, id string) error {
+	err := s.Bucket.Delete(ctx, s.key(id))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil
+	}
+	return err
+}
+
+// sessionURL is the path at which the session is managed.
+func (h *Handler) sessionURL(id string) string {
+	return strings.TrimSuffix(h.Scope, "/") + sessionPath + id
+}
+
+// chunkKey is where a chunk is kept in the Bucket until the session is completed or aborted.
+func chunkKey(id string, index int) string {
+	return sessionPath[1:] + id + "/" + strconv.Itoa(index)
+}
+
+// isSessionRequest is true for anything below the sessionURL.
+func (h *Handler) isSessionRequest(r *http.Request) bool {
+	return h.Sessions != nil && strings.HasPrefix(r.URL.Path, h.sessionURL(""))
+}
+
+// serveSession handles the lifecycle of upload sessions:
+//
+//	POST   <sessionURL>            with header "Destination" creates a session, found at "Location"
+//	GET    <sessionURL>            with header "Destination" redirects to the session of an aborted upload
+//	PUT    <sessionURL>/<id>/<n>   uploads chunk n, counting from 0
+//	GET    <sessionURL>/<id>       lists the chunks received so far, one per line: "<n> <size>"
+//	POST   <sessionURL>/<id>       writes the file from all chunks, which must be without gaps,
+//	                               verified by header "Digest" if there is one
+//	DELETE <sessionURL>/<id>       aborts the session, and removes its chunks
+func (h *Handler) serveSession(w http.ResponseWriter, r *http.Request) (int, error) {
+	rest := r.URL.Path[len(h.sessionURL("")):]
+	if rest == "" {
+		switch r.Method {
+		case http.MethodPost:
+			return h.createSession(w, r)
+		case http.MethodGet:
+			return h.lookupPartialSession(w, r)
+		}
+		return http.StatusMethodNotAllowed, nil
+	}
+	id, chunk := rest, ""
+	if idx := strings.IndexByte(rest, '/'); idx >= 0 {
+		id, chunk = rest[:idx], rest[idx+1:]
+	}
+	if strings.Trim(id, "0123456789abcdefghijklmnopqrstuvwxyz") != "" { // Not one of printableSuffix.
+		return http.StatusNotFound, nil
+	}
+	session, err := h.Sessions.Get(r.Context(), id)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Session lookup failed")
+	}
+	if session == nil || session.Tenant != h.tenant {
+		return http.StatusNotFound, nil
+	}
+
+	switch {
+	case chunk != "" && r.Method == http.MethodPut:
+		index, err := strconv.Atoi(chunk)
+		if err != nil || index < 0 {
+			return http.StatusBadRequest, errChunkIndexInvalid
+		}
+		if index >= maxSessionChunks {
+			return http.StatusUnprocessableEntity, errTooManyChunks
+		}
+		return h.receiveChunk(r.Context(), session, index, r.Body)
+	case chunk != "":
+		return http.StatusMethodNotAllowed, nil
+	case r.Method == http.MethodGet:
+		chunks, err := h.listChunks(r.Context(), session)
+		if err != nil {
+			return http.StatusInternalServerError, errors.Wrap(err, "Listing chunks failed")
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		for _, c := range chunks {
+			io.WriteString(w, strconv.Itoa(c.index)+" "+strconv.FormatInt(c.size, 10)+"\n")
+		}
+		return statusSent, nil
+	case r.Method == http.MethodPost:
+		return h.completeSession(w, r, session)
+	case r.Method == http.MethodDelete:
+		if err := h.removeSession(r.Context(), session); err != nil {
+			return http.StatusInternalServerError, errors.Wrap(err, "Aborting the session failed")
+		}
+		return http.StatusNoContent, nil
+	}
+	return http.StatusMethodNotAllowed, nil
+}
+
+func (h *Handler) createSession(w http.ResponseWriter, r *http.Request) (int, error) {
+	destName := r.Header.Get("Destination")
+	if destName == "" {
+		return http.StatusBadRequest, errNoDestination
+	}
+	if key, err := h.translateToKey(destName); err != nil || strings.HasPrefix("/"+key, sessionPath) {
+		return http.StatusUnprocessableEntity, errInvalidFileName
+	}
+	id, err := h.randomSuffix(24)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	session := Session{ID: id, Path: destName, Tenant: h.tenant, Created: time.Now()}
+	if err := h.Sessions.Put(r.Context(), &session); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Creating the session failed")
+	}
+	w.Header().Set("Location", h.publicURL(r, h.sessionURL(session.ID)))
+	return http.StatusCreated, nil
+}
+
+// sessionQuota is how many bytes all chunks of a session can have in total, and the error for exceeding that,
+// which is the lower of MaxFilesize and MaxTransactionSize. 0 is for no limit.
+func (h *Handler) sessionQuota() (int64, error) {
+	quota, overQuotaErr := h.MaxTransactionSize, errTransactionTooLarge
+	if quota == 0 || (h.MaxFilesize > 0 && h.MaxFilesize < quota) {
+		quota, overQuotaErr = h.MaxFilesize, errFileTooLarge
+	}
+	return quota, overQuotaErr
+}
+
+// receiveChunk writes one chunk, which replaces any earlier one of the same index.
+// Chunks are spooled and encrypted as files are. Scanning and Transformers see them once they make up the file.
+//
+// A chunk is rejected if, with the others received so far, the session would exceed its sessionQuota.
+func (h *Handler) receiveChunk(ctx context.Context, session *Session, index int, r io.Reader) (int, error) {
+	quota, overQuotaErr := h.sessionQuota()
+	if quota > 0 {
+		chunks, err := h.listChunks(ctx, session)
+		if err != nil {
+			return http.StatusInternalServerError, errors.Wrap(err, "Listing chunks failed")
+		}
+		for _, c := range chunks {
+			if c.index != index { // Else it's being replaced.
+				quota -= c.size
+			}
+		}
+		if quota < 0 {
+			return http.StatusRequestEntityTooLarge, overQuotaErr
+		}
+		r = io.LimitReader(r, quota+1)
+	}
+
+	sink, discard, persist, err := h.newStoredSink(ctx, chunkKey(session.ID, index), nil, 0)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	buf := getCopyBuffer(h.copyBufferSize())
+	defer putCopyBuffer(buf)
+	n, err := io.CopyBuffer(struct{ io.Writer }{sink}, r, *buf)
+	if err != nil {
+		discard()
+		return http.StatusInternalServerError, err
+	}
+	if quota > 0 && n > quota {
+		discard()
+		return http.StatusRequestEntityTooLarge, overQuotaErr
+	}
+	if err := persist(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusCreated, nil
+}
+
+type chunkInfo struct {
+	index int
+	size  int64
+}
+
+// listChunks returns the chunks received so far, ordered by their index.
+func (h *Handler) listChunks(ctx context.Context, session *Session) ([]chunkInfo, error) {
+	prefix := sessionPath[1:] + session.ID + "/"
+	var chunks []chunkInfo
+	iter := h.Bucket.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		index, err := strconv.Atoi(obj.Key[len(prefix):])
+		if err != nil || obj.IsDir {
+			continue
+		}
+		size := obj.Size
+		if h.isEncrypting() {
+			size = plaintextSize(size)
+		}
+		chunks = append(chunks, chunkInfo{index: index, size: size})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].index < chunks[j].index })
+	return chunks, nil
+}
+
+// completeSession writes the file from the chunks, and then removes the session.
+func (h *Handler) completeSession(w http.ResponseWriter, r *http.Request, session *Session) (int, error) {
+	ctx := r.Context()
+	chunks, err := h.listChunks(ctx, session)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Listing chunks failed")
+	}
+	var total int64
+	keys := make([]string, 0, len(chunks))
+	for i, c := range chunks {
+		if c.index != i {
+			return http.StatusConflict, errSessionIncomplete
+		}
+		total += c.size
+		keys = append(keys, chunkKey(session.ID, c.index))
+	}
+	if quota, overQuotaErr := h.sessionQuota(); quota > 0 && total > quota {
+		return http.StatusRequestEntityTooLarge, overQuotaErr
+	}
+
+	chunksBody := &chunksReader{ctx: ctx, h: h, keys: keys}
+	defer chunksBody.Close()
+	// Header "Digest" of the request is that of the whole file.
+	assembled := new(http.Request)
+	*assembled = *r
+	assembled.Body = chunksBody
+	assembled, digests := withDigestVerification(assembled)
+	defer digests.stop()
+
+	body, sum := h.hashForReceipt(assembled.Body)
+	bytesWritten, key, retval, err := h.writeOneHTTPBlob(ctx, session.Path, h.contentTypeMetadata(session.Path, ""), total, h.MaxFilesize, body)
+	if digests != nil && digests.err != nil {
+		return http.StatusUnprocessableEntity, digests.err // Has been discarded, and the session is kept.
+	}
+	if err != nil || retval >= 300 { // Quarantine answers with 202.
+		return retval, err
+	}
+	h.removeSession(ctx, session)
+	h.addLocation(w, r, key)
+	h.addReceipt(w, key, bytesWritten, sum)
+	return retval, nil
+}
+
+// removeSession deletes the session and its chunks.
+func (h *Handler) removeSession(ctx context.Context, session *Session) error {
+	chunks, err := h.listChunks(ctx, session)
+	if err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if err := h.Bucket.Delete(ctx, chunkKey(session.ID, c.index)); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return err
+		}
+	}
+	return h.Sessions.Delete(ctx, session.ID)
+}
+
+// chunksReader reads the chunks one after another, opening only one at a time, decrypted if need be.
+type chunksReader struct {
+	ctx  context.Context
+	h    *Handler
+	keys []string
+	cur  io.ReadCloser
+}
+
+func (c *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+			r, err := c.h.newBlobReader(c.ctx, c.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			c.cur, c.keys = r, c.keys[1:]
+		}
+		n, err := c.cur.Read(p)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close releases the chunk currently being read, if any.
+func (c *chunksReader) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+	err := c.cur.Close()
+	c.cur = nil
+	return err
+}
@@ -0,0 +1,185 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSessions(t *testing.T) {
+	h, _ := NewHandler("/", scratchDir, next)
+	stores := []struct {
+		name  string
+		store SessionStore
+	}{
+		{"memory", NewMemorySessionStore()},
+		{"the bucket", BucketSessionStore{Bucket: h.Bucket}},
+	}
+
+	do := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, s := range stores {
+		Convey("Upload sessions kept in "+s.name, t, func() {
+			h.Sessions = s.store
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+			w := do("POST", "/.upload-session/", "", "Destination", "/"+tempFName)
+			So(w.Code, ShouldEqual, 201)
+			session := w.Result().Header.Get("Location")
+			So(session, ShouldStartWith, "/.upload-session/")
+
+			So(do("PUT", session+"/1", "ME").Code, ShouldEqual, 201)
+			So(do("PUT", session+"/0", "DEL").Code, ShouldEqual, 201)
+
+			Convey("list the chunks received", func() {
+				w := do("GET", session, "")
+				So(w.Code, ShouldEqual, 200)
+				So(w.Body.String(), ShouldEqual, "0 3\n1 2\n")
+			})
+
+			Convey("write the file once complete", func() {
+				So(do("POST", session, "").Code, ShouldEqual, 201)
+				compareContents(filepath.Join(scratchDir, tempFName), []byte("DELME"))
+				So(do("GET", session, "").Code, ShouldEqual, 404)
+			})
+
+			Convey("verify the file once complete by header Digest", func() {
+				w := do("POST", session, "", "Digest", "sha-256=nZP5FfFsU0tLNXWO7NA0jq2SPYu//wjN0lDukPywZAA=")
+				So(w.Code, ShouldEqual, 422)
+				_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+				So(os.IsNotExist(err), ShouldBeTrue)
+				So(do("GET", session, "").Code, ShouldEqual, 200) // Can be completed by another attempt.
+
+				So(do("POST", session, "", "Digest", "sha-256=FBWjceJkib9HWGvDPm5P5uRRElm5dgtgGQmUD/sC9TQ=").Code, ShouldEqual, 201)
+				compareContents(filepath.Join(scratchDir, tempFName), []byte("DELME"))
+			})
+
+			Convey("cannot be completed with chunks missing", func() {
+				So(do("PUT", session+"/3", "!").Code, ShouldEqual, 201)
+				So(do("POST", session, "").Code, ShouldEqual, 409)
+				do("DELETE", session, "")
+			})
+
+			Convey("can be aborted, which removes the chunks", func() {
+				So(do("DELETE", session, "").Code, ShouldEqual, 204)
+				So(do("GET", session, "").Code, ShouldEqual, 404)
+				exists, _ := h.Bucket.Exists(context.Background(), chunkKey(strings.TrimPrefix(session, "/.upload-session/"), 0))
+				So(exists, ShouldBeFalse)
+			})
+		})
+	}
+
+	Convey("Upload sessions", t, func() {
+		h.Sessions = NewMemorySessionStore()
+
+		Convey("need a valid destination", func() {
+			So(do("POST", "/.upload-session/", "").Code, ShouldEqual, 400)
+			So(do("POST", "/.upload-session/", "", "Destination", "/.upload-session/x").Code, ShouldEqual, 422)
+		})
+
+		Convey("are not found if unknown", func() {
+			So(do("GET", "/.upload-session/nonexistent", "").Code, ShouldEqual, 404)
+			So(do("PUT", "/.upload-session/../x/0", "").Code, ShouldEqual, 404)
+		})
+
+		Convey("have no more than maxSessionChunks chunks", func() {
+			session := do("POST", "/.upload-session/", "", "Destination", "/"+tempFileName()).Result().Header.Get("Location")
+			defer do("DELETE", session, "")
+			So(do("PUT", session+"/"+strconv.Itoa(maxSessionChunks-1), "!").Code, ShouldEqual, 201)
+			So(do("PUT", session+"/"+strconv.Itoa(maxSessionChunks), "!").Code, ShouldEqual, 422)
+		})
+
+		Convey("keep chunks encrypted if files are", func() {
+			h.EncryptionKey = bytes.Repeat([]byte{0x42}, 32)
+			defer func() { h.EncryptionKey = nil }()
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+			session := do("POST", "/.upload-session/", "", "Destination", "/"+tempFName).Result().Header.Get("Location")
+			So(do("PUT", session+"/0", "DELME").Code, ShouldEqual, 201)
+			id := strings.TrimPrefix(session, "/.upload-session/")
+			stored, _ := ioutil.ReadFile(filepath.Join(scratchDir, filepath.FromSlash(chunkKey(id, 0))))
+			So(string(stored), ShouldNotContainSubstring, "DELME")
+			So(do("GET", session, "").Body.String(), ShouldEqual, "0 5\n")
+
+			So(do("POST", session, "").Code, ShouldEqual, 201)
+			r, err := h.newBlobReader(context.Background(), tempFName)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			plaintext, _ := ioutil.ReadAll(r)
+			So(string(plaintext), ShouldEqual, "DELME")
+		})
+	})
+
+	Convey("Upload sessions are limited", t, func() {
+		h.Sessions = NewMemorySessionStore()
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		session := do("POST", "/.upload-session/", "", "Destination", "/"+tempFName).Result().Header.Get("Location")
+		defer do("DELETE", session, "")
+
+		Convey("by MaxFilesize, across all chunks", func() {
+			h.MaxFilesize = 5
+			defer func() { h.MaxFilesize = 0 }()
+			So(do("PUT", session+"/0", "DEL").Code, ShouldEqual, 201)
+			So(do("PUT", session+"/1", "ME!").Code, ShouldEqual, 413)
+			So(do("PUT", session+"/1", "ME").Code, ShouldEqual, 201)
+			So(do("PUT", session+"/0", "DELE").Code, ShouldEqual, 413) // Replacing one counts only the new one.
+			So(do("PUT", session+"/0", "ABC").Code, ShouldEqual, 201)
+			So(do("GET", session, "").Body.String(), ShouldEqual, "0 3\n1 2\n")
+		})
+
+		Convey("by MaxTransactionSize, across all chunks", func() {
+			h.MaxTransactionSize = 4
+			defer func() { h.MaxTransactionSize = 0 }()
+			So(do("PUT", session+"/0", "DEL").Code, ShouldEqual, 201)
+			So(do("PUT", session+"/1", "ME").Code, ShouldEqual, 413)
+		})
+	})
+
+	Convey("Upload sessions completed into Quarantine", t, func() {
+		h.Sessions = NewMemorySessionStore()
+		h.Quarantine = true
+		defer func() { h.Quarantine = false }()
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, quarantinePrefix, tempFName))
+
+		session := do("POST", "/.upload-session/", "", "Destination", "/"+tempFName).Result().Header.Get("Location")
+		So(do("PUT", session+"/0", "DELME").Code, ShouldEqual, 201)
+		So(do("POST", session, "").Code, ShouldEqual, 202)
+		compareContents(filepath.Join(scratchDir, quarantinePrefix, tempFName), []byte("DELME"))
+
+		Convey("are removed, with their chunks", func() {
+			So(do("GET", session, "").Code, ShouldEqual, 404)
+			exists, _ := h.Bucket.Exists(context.Background(), chunkKey(strings.TrimPrefix(session, "/.upload-session/"), 0))
+			So(exists, ShouldBeFalse)
+		})
+	})
+
+	Convey("Regular uploads cannot write where the Handler keeps its own files", t, func() {
+		h.Sessions = nil
+		for _, name := range []string{"/.upload-session/x/0", "/.upload-versions/x", "/.upload-corrupted/x"} {
+			So(do("PUT", name, "DELME").Code, ShouldEqual, 422)
+		}
+	})
+}
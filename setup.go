@@ -5,14 +5,22 @@ package upload
 
 import (
 	"context"
+	"crypto/ed25519"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 	"unicode"
 
 	"gocloud.dev/blob"
 	_ "gocloud.dev/blob/fileblob" // Registers scheme "file://"
+	"gocloud.dev/secrets"
 	"golang.org/x/text/unicode/norm"
+
+	"blitznote.com/src/http.upload/v5/filename"
 )
 
 // Handler will deal with anything that manipulates files,
@@ -20,6 +28,20 @@ import (
 type Handler struct {
 	MaxFilesize        int64
 	MaxTransactionSize int64
+	// If not empty, files must be declared to be of one of these types, such as "image/*",
+	// in header "Content-Type" of the request or of their part of a MIME Multipart upload. Else 415.
+	ContentTypes []string
+	// Files smaller than this, or empty ones if DenyEmptyFiles is set, are rejected with 422.
+	MinFilesize    int64
+	DenyEmptyFiles bool
+	// After any limit has been exceeded, read and discard up to this many bytes of the request
+	// so the connection can be re-used. If there's more, or this is 0, the connection gets closed.
+	DrainAllowance int64
+
+	// Uploads that take longer than this, in total or waiting for the next bytes, get aborted with 408.
+	// Anything received until then is discarded. Independent of timeouts of the http.Server.
+	UploadTimeout   time.Duration
+	IdleReadTimeout time.Duration
 
 	// The upload destination.
 	Bucket *blob.Bucket
@@ -27,23 +49,286 @@ type Handler struct {
 	// Uploaded files can be gotten back from here.
 	// If ≠ "" this will trigger sending headers such as "Location".
 	ApparentLocation string
+	// If true, URLs in headers such as "Location" are absolute, on the scheme and host the request has been
+	// sent to, and if ApparentLocation is not set point to the file below Scope. Requests from TrustedProxies
+	// can override that with headers "X-Forwarded-Proto", "X-Forwarded-Host", and "X-Forwarded-Prefix",
+	// the latter being the path a proxy has stripped. For use behind path-rewriting reverse proxies.
+	LocationFromRequest bool
+	// If true, responses to uploads have headers "Link" (RFC 8288) per file, with rel="self" for its location
+	// as in "Location", and rel="describedby" for GET with query "metadata" that answers with its FileMetadata.
+	SendLinkHeaders bool
+	// If set, successful uploads by POST with a MIME Multipart envelope, such as from HTML forms, are answered
+	// with 303 (See Other) to this URL, with the key of every file in query parameter "key", as classic form handlers do.
+	RedirectAfterUpload string
+	// If true, GET on Scope itself is answered with a page to upload files with, by drag and drop or a form.
+	// It shows the progress, and is sent along whatever has authenticated the request for it.
+	ServeUploadForm bool
+	// If not 0, successful uploads are answered with this instead of 201 (Created), such as 200 or 204
+	// for clients that expect those.
+	SuccessStatus int
+	// Headers added to successful responses to anything but GET and HEAD, such as to uploads and deletions.
+	// For example "Cache-Control: no-store", or "Access-Control-Expose-Headers: Location".
+	SuccessHeaders http.Header
+	// Proxies whose headers "X-Forwarded-*" are honored. See ParseTrustedProxy.
+	TrustedProxies []*net.IPNet
 
 	// Enables MOVE, DELETE, and similar. Without this only POST and PUT will be recognized.
 	EnableWebdav bool
+	// Files matching any of these patterns, as in path.Match, cannot be deleted, moved, or replaced
+	// by COPY or MOVE; such requests are rejected with 403. Patterns without a '/' apply to filenames,
+	// else to paths below Scope, such as "*.keep" or "releases/*/MANIFEST".
+	ProtectFromDeletion []string
+	// Paths below Scope, such as "vendor", at and below which nothing can be uploaded, deleted, or moved,
+	// because another system manages them. Such requests are rejected with 403.
+	ReadOnlyPaths []string
+	// If true, every directory gets a file "SHA256SUMS" in the format of "sha256sum", for "sha256sum -c",
+	// with the digests of its files. It's updated whenever one is written or deleted, and clients cannot change it.
+	// Archives of PackFilesUpTo are not listed. Of encrypted files, the digests are of the plaintext.
+	MaintainChecksums bool
+	// Answer HEAD with header "Digest" by whether the file exists with the same contents.
+	// As this reads files, it reveals their contents to anyone who can guess them.
+	EnableExistenceChecks bool
+	// Enables GET with query "list" on directories, which answers with their files and subdirectories,
+	// a page at a time, as Listing in JSON. For file managers.
+	EnableListing bool
+	// Enables delta uploads with PATCH, and GET with query "block-checksums" to prepare them.
+	EnableDeltaUploads bool
+	// After a MIME Multipart upload, header "Transaction" points to where its files
+	// can be downloaded as ZIP archive for 15 minutes.
+	EnableTransactionDownloads bool
+	// If set, uploads can be split into chunks, which are managed in sessions below Scope
+	// at "/.upload-session/". See README.md for their API.
+	Sessions SessionStore
 
 	// Set this to reject any non-conforming filenames.
 	UnicodeForm *struct{ Use norm.Form }
+	// How filenames are encoded, unless a client declares that in header "X-Filename-Encoding".
+	// They're decoded to UTF-8 before they get checked. Only needed for legacy clients.
+	FilenameEncoding FilenameEncoding
+
+	// If true, files are stored with the type declared in header "Content-Type", of the request
+	// or of their part of a MIME Multipart upload, unless that's generic, or else the type of their extension.
+	// Else the Bucket sniffs it from their first bytes. Downloads straight from S3 or GCS serve that type.
+	AssignContentType bool
+	// What becomes of header "Content-Language" of uploads, or of parts of MIME Multipart uploads:
+	// by default it's ignored. Else it's stored as metadata, or as suffix of the filename such as "file.de.txt",
+	// so that language variants of one document can be uploaded to the same path.
+	ContentLanguage ContentLanguagePolicy
 
 	// Limit the acceptable alphabet(s) for filenames by setting this value.
 	RestrictFilenamesTo []*unicode.RangeTable
+	// If set, paths below Scope must abide by its rules as well, such as filename.PosixPortable.
+	FilenameProfile *filename.Profile
+	// If true, names with bidi overrides, zero-width joiners, or letters of scripts that are
+	// not commonly mixed, such as a Cyrillic 'а' amid Latin ones, are rejected. See filename.IsSpoofed.
+	RejectSpoofedFilenames bool
+	// If true, GET on "<Scope>/.upload-check/<path>" tells whether a file could be uploaded to <path>,
+	// with 204 (No Content), or 422 and the rule it would violate. See CheckFilename.
+	EnableFilenameCheck bool
+
+	// If set, keys are what this makes of paths. As locations and listings show keys, not paths,
+	// a KeyMapper should keep them recognizable, else leave ApparentLocation unset.
+	KeyMapper KeyMapper
+
+	// Source of randomness for suffixes and the IDs of sessions, transactions, and the like.
+	// Defaults to crypto/rand. Set this to a seeded source for reproducible tests only;
+	// it must be safe for concurrent use. Uploads fail with 500 once it returns an error, such as io.EOF.
+	Rand io.Reader
 
 	// Append '_' and a randomized suffix of that length.
+	// Responses to single uploads then have the resulting path in header "X-Final-Name".
 	RandomizedSuffixLength uint32
+	// If true, that path is the body of responses as well, as plain text, for clients that can't read headers.
+	FinalNameInBody bool
+
+	// Uploads to these paths below Scope, such as "firmware/latest" (no leading '/'), get written
+	// to the Slot's key instead. Files that get replaced are kept if KeepVersions is set.
+	Slots map[string]Slot
+
+	// If > 1, up to this many parts of a MIME Multipart upload get persisted concurrently
+	// while the next parts are still being received. Speeds up uploads to cloud storage.
+	// The response will be sent once all have been persisted.
+	MaxConcurrentUploads int
+	// If true and a part of a MIME Multipart upload fails, files of the other parts are removed again.
+	// Else clients that accept JSON get status 207 (Multi-Status) with the outcome of every part.
+	// Files that have replaced others are not reverted, although KeepVersions retains what's been replaced.
+	// With Quarantine, the files in quarantine are removed. Those of PackFilesUpTo stay in the archive.
+	RollbackOnPartError bool
+	// If true, parts of a MIME Multipart upload that fail for their name, size, or contents are skipped,
+	// and the remaining parts are processed nevertheless. Responses to uploads with skipped parts
+	// have status 207 (Multi-Status). For bulk imports. Ignored with RollbackOnPartError.
+	ContinueOnPartError bool
+	// If true, fields of MIME Multipart uploads that are not files, such as titles, descriptions, or tags
+	// from forms, are written next to every file of the upload as JSON, in a file with suffix ".fields.json".
+	// Not with EncryptionKey, as they would be stored in plaintext. Up to 64 KiB in total, else 413.
+	CaptureFormFields bool
+	// Is called with the keys of the files and the fields of every MIME Multipart upload that has any.
+	OnFormFields func(keys []string, fields url.Values)
+
+	// If true and the destination is a local directory, uploads to existing files are appended to them,
+	// for log or event ingestion. MaxFilesize then applies to files as a whole, not to each upload.
+	// Takes precedence over PackFilesUpTo, and RollbackOnPartError does not apply.
+	AppendToExisting bool
+
+	// If > 0 and the destination is a local directory, files up to this size
+	// get appended to one archive in the tar format instead of being written individually.
+	// For destinations that receive many tiny files, such as logs.
+	PackFilesUpTo int64
+	// The archive small files are appended to, relative to the destination. Defaults to "packed.tar".
+	PackName string
+
+	// If true, respond to PUT with 202 right after the body has been received,
+	// and persist it in the background. The response's "Location" can be polled for the outcome.
+	// This applies to single files only, not to MIME Multipart.
+	AsyncPersist bool
+
+	// If > 0, while receiving uploads send "102 Processing" at most this often,
+	// with header "Received-Bytes" counting what has been received so far.
+	// Lets clients behind buffering proxies tell a slow upload from a stalled one.
+	ProgressInterval time.Duration
+	// If true, uploads with header "X-Progress-ID", an ID the client has chosen, can be followed
+	// by GET with that ID as query "progress", which streams ProgressEvent as Server-Sent Events,
+	// every ProgressInterval or second. For progress bars where a proxy buffers the upload.
+	EnableProgressEvents bool
+
+	// Files get written to the storage class of the first matching rule, or to the one a client requests
+	// in header "X-Storage-Class" if that's one of StorageClassesAllowed, else 400. Such as to write huge
+	// archives straight to cold storage. Needs SetStorageClass, which applies it using the Bucket's driver.
+	StorageClasses        []StorageClassRule
+	StorageClassesAllowed []string
+	// Is called as BeforeWrite of blob.WriterOptions. With S3, for example:
+	//  func(asFunc func(interface{}) bool, class string) error {
+	//    var input *s3manager.UploadInput
+	//    if asFunc(&input) {
+	//      input.StorageClass = aws.String(class)
+	//    }
+	//    return nil
+	//  }
+	SetStorageClass func(asFunc func(interface{}) bool, class string) error
+
+	// Keys of tags that clients can set in headers "X-Tag-<key>" or "Tagging", such as "project".
+	// Any other is rejected with 400. Tags are kept in the metadata of files, as "tag-<key>".
+	TagsAllowed []string
+	// Is called as BeforeWrite of blob.WriterOptions with the tags of a file, by their key,
+	// to have the Bucket's driver set them as tags, such as for lifecycle policies of S3:
+	//  func(asFunc func(interface{}) bool, tags map[string]string) error {
+	//    var input *s3manager.UploadInput
+	//    if asFunc(&input) {
+	//      input.Tagging = aws.String(url.Values{…}.Encode())
+	//    }
+	//    return nil
+	//  }
+	SetTags func(asFunc func(interface{}) bool, tags map[string]string) error
+
+	// Size of the buffers request bodies are copied through, if > 0. Defaults to 1 MiB.
+	// Buffers are pooled and re-used.
+	CopyBufferSize int
+	// Size of the chunks a Bucket uploads in one request, such as parts of S3 multipart uploads.
+	// Bounds the memory used per upload. If 0, the driver picks its default. Ignored by some drivers.
+	// Raised for files whose declared size would else need more than 10,000 chunks, the limit of S3.
+	WriterBufferSize int
+
+	// If set to 32 bytes, files are encrypted at rest with AES-256-GCM.
+	// Files are not appended to any archive then, nor are PostProcessors run, and delta uploads are disabled.
+	EncryptionKey []byte
+	// If set, every file is encrypted with a key of its own instead, which gets wrapped by
+	// KeyKeepers[KeyKeeperID], such as one of AWS KMS or GCP KMS, and stored in the file's metadata.
+	// Files are decrypted using the KeyKeeper that has wrapped their key. Therefore keys can be rotated
+	// by adding a KeyKeeper and pointing KeyKeeperID to it, without re-encrypting any files.
+	// The Bucket must keep metadata, which it won't if NewHandler has been given a local directory.
+	KeyKeepers  map[string]*secrets.Keeper
+	KeyKeeperID string
+	// With EncryptionKey or KeyKeepers, answer GET and HEAD for files with their plaintext,
+	// instead of passing those requests on to Next, which would serve what's been encrypted.
+	// Anyone who can reach this Handler can read any file then, unless AuthorizeDecryption is set.
+	ServeDecrypted bool
+	// If set, only requests this returns true for get the plaintext of the file by its key. Others get 403.
+	AuthorizeDecryption func(r *http.Request, key string) bool
+
+	// If set, every response to a successful upload has a header "Upload-Receipt" per file, a JWS
+	// signed with this key, which states the file's key, size, SHA-256 digest and when it's been received.
+	// Clients can present it later to prove what they've uploaded. See ParseReceipt.
+	// Not sent with AsyncPersist, because files could still fail to be persisted then.
+	ReceiptKey ed25519.PrivateKey
+
+	// If > 0, this many previous versions of files are kept when they get replaced.
+	// They can be listed with GET and query "versions", and restored with POST and query "restore=<version>".
+	KeepVersions int
+
+	// If set, writes to the same file are serialized: any later one waits until the earlier has been
+	// persisted or discarded, or is rejected with 409 (Conflict) if RejectConcurrentWrites is set.
+	// Use NewKeyLocker for writes within this process.
+	Locker                 KeyLocker
+	RejectConcurrentWrites bool
+
+	// If true, uploads are kept hidden in the Bucket below ".upload-quarantine/", answered with 202,
+	// until they're approved with method APPROVE or POST with query "approve", or removed with "reject".
+	// GET with query "quarantine" lists those awaiting approval. Only then are PostProcessors run.
+	// Restrict who can approve by your authentication. Precedes AppendToExisting and PackFilesUpTo,
+	// and disables delta uploads.
+	Quarantine bool
+
+	// If set, uploads are received into temporary files in this directory,
+	// and written to the Bucket only once they have been accepted.
+	SpoolDirectory string
+	// What becomes of uploads that clients abort. By default they're discarded.
+	// Else a copy of what's being received is kept in a temporary file in SpoolDirectory, or that of the OS,
+	// which gets written next to the file with suffix ".partial", or as first chunk of a session,
+	// which needs Sessions to be set. Doesn't apply to encrypted files.
+	PartialUploads PartialUploadPolicy
+
+	// If set, uploads are scanned for malware while being received, and rejected with 422 if any is found.
+	Scanner Scanner
+	// Persist files nevertheless if the Scanner fails. Else they are rejected with 503.
+	ScanFailOpen bool
+	// Is called with the key a file would have had, for every file in which malware has been found.
+	OnMalwareFound func(key string, finding *MalwareFoundError)
+
+	// Enables POST with query "scrub", which re-reads all files below that path and moves those
+	// that don't match their recorded digest aside. See Handler.Scrub.
+	EnableScrubbing bool
+	// Is called with the key of every file Scrub has found to be corrupted.
+	OnCorruptionFound func(key string)
+
+	// If set, only uploads that are OpenPGP messages encrypted to any of these key IDs are accepted,
+	// binary or armored, else they're rejected with 422. For drop boxes that must never store plaintext.
+	// See OpenPGPKeyIDs.
+	RequireOpenPGPTo []uint64
+
+	// Run in this order on the contents of every file while it's being received, such as to sanitize it.
+	// Files are neither appended to nor packed then, and delta uploads are disabled.
+	Transformers []Transformer
+
+	// Run in this order on every file after it has been persisted, such as to create thumbnails.
+	// Does not apply to files appended to an archive, see PackFilesUpTo.
+	PostProcessors []PostProcessor
+
+	// Switches the Handler into read-only mode while it's serving: writes are answered with 503.
+	// Set by NewHandler, and shared by copies of the Handler.
+	Maintenance *MaintenanceMode
+	// If not empty, writes are accepted only within any of these, else answered with 503
+	// and header "Retry-After" pointing to when the next one opens. Such as for backups at night only.
+	UploadWindows []TimeWindow
 
 	// For methods that are not recognized.
 	Next http.Handler
 	// The path, to be stripped from the full URL and the target path swapped in.
 	Scope string
+	// If set, a ScopeMux will pass only requests for this host (sans port) to the Handler.
+	Host string
+
+	// If set, every tenant gets a directory of its own, "<destination>/<tenant>/", to which all paths
+	// are relative, and requests to write without one are rejected with 401. Tenants are such as
+	// the keyId a request has been authenticated with, see TenantFromContext and TenantFromHeader.
+	// Set ApparentLocation to where the destination can be downloaded from, without tenant.
+	TenantOf func(r *http.Request) string
+	// Limits that replace those above for some tenants, such as for tiers with larger files.
+	Tenants map[string]TenantLimits
+
+	// Set by NewHandler for destinations on the local filesystem.
+	localDirectory string
+	// Set for requests of one tenant, see TenantOf.
+	tenant string
 }
 
 // NewHandler creates a new instance of this plugin's upload handler,
@@ -52,11 +337,17 @@ type Handler struct {
 // 'scope' is the prefix of the upload destination's URL.Path, like `/dir/to/upload/destination`.
 //
 // 'next' is optional and can be nil.
+//
+// If the target is a local directory, symbolic links below it won't be followed.
 func NewHandler(scope string, targetDirectory string, next http.Handler) (*Handler, error) {
+	var localDirectory string
 	if !strings.Contains(targetDirectory, "://") {
+		localDirectory = filepath.Clean(targetDirectory)
 		targetDirectory = "file://" +
-			filepath.Clean(targetDirectory) +
+			localDirectory +
 			"?metadata=skip"
+	} else if u, err := url.Parse(targetDirectory); err == nil && u.Scheme == "file" {
+		localDirectory = filepath.FromSlash(u.Path)
 	}
 	bucket, err := blob.OpenBucket(
 		context.Background(),
@@ -67,9 +358,11 @@ func NewHandler(scope string, targetDirectory string, next http.Handler) (*Handl
 	}
 
 	h := Handler{
-		Bucket: bucket,
-		Next:   next,
-		Scope:  scope,
+		Bucket:         bucket,
+		Maintenance:    NewMaintenanceMode(),
+		Next:           next,
+		Scope:          scope,
+		localDirectory: localDirectory,
 	}
 	return &h, nil
 }
@@ -0,0 +1,90 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"golang.org/x/crypto/blake2b"
+)
+
+// signatureSuffix is appended to a file's key for that of its signature.
+const signatureSuffix = ".sig"
+
+// Signer is a PostProcessor that writes a detached signature in the format of minisign
+// next to every file, with ".sig" appended to its name. Verify files like this:
+//  minisign -V -P <Signer.PublicKey()> -m photo.jpg
+//
+// Signatures are of the BLAKE2b-512 hash of the file, hence files of any size can be signed.
+// Run Signer after anything that modifies files, such as the MetadataStripper.
+type Signer struct {
+	privateKey ed25519.PrivateKey
+	keyID      [8]byte
+}
+
+// NewSigner returns a Signer using the given key.
+// Its key ID is derived from the public key, and the same for the same key.
+func NewSigner(privateKey ed25519.PrivateKey) *Signer {
+	s := Signer{privateKey: privateKey}
+	sum := blake2b.Sum512(privateKey.Public().(ed25519.PublicKey))
+	copy(s.keyID[:], sum[:])
+	return &s
+}
+
+// PublicKey returns the public key in the format of minisign.
+func (s *Signer) PublicKey() string {
+	var buf bytes.Buffer
+	buf.WriteString("Ed")
+	buf.Write(s.keyID[:])
+	buf.Write(s.privateKey.Public().(ed25519.PublicKey))
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// DerivedKey implements the Deriver interface.
+func (s *Signer) DerivedKey(key string) (string, string) {
+	if strings.HasSuffix(key, signatureSuffix) {
+		return "", ""
+	}
+	return "signature", key + signatureSuffix
+}
+
+// Process implements the PostProcessor interface.
+func (s *Signer) Process(ctx context.Context, bucket *blob.Bucket, key string) error {
+	if strings.HasSuffix(key, signatureSuffix) {
+		return nil
+	}
+	src, err := bucket.NewReader(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	hash, _ := blake2b.New512(nil)
+	if _, err := io.Copy(hash, src); err != nil {
+		return err
+	}
+
+	signature := ed25519.Sign(s.privateKey, hash.Sum(nil))
+	var sig bytes.Buffer
+	sig.WriteString("ED") // Of the hash, not the file.
+	sig.Write(s.keyID[:])
+	sig.Write(signature)
+	// The trusted comment is signed as well, along with the signature.
+	trustedComment := "timestamp:" + strconv.FormatInt(time.Now().Unix(), 10) + "\tfile:" + path.Base(key)
+	globalSig := ed25519.Sign(s.privateKey, append(signature, trustedComment...))
+
+	contents := "untrusted comment: signature from http.upload\n" +
+		base64.StdEncoding.EncodeToString(sig.Bytes()) + "\n" +
+		"trusted comment: " + trustedComment + "\n" +
+		base64.StdEncoding.EncodeToString(globalSig) + "\n"
+	return bucket.WriteAll(ctx, key+signatureSuffix, []byte(contents), nil)
+}
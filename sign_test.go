@@ -0,0 +1,58 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestSigner(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	signer := NewSigner(privateKey)
+	publicKey, _ := base64.StdEncoding.DecodeString(signer.PublicKey())
+
+	Convey("Signer", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		ctx := context.Background()
+		tempFName := tempFileName()
+		h.Bucket.WriteAll(ctx, tempFName, []byte("DELME"), nil)
+		defer h.Bucket.Delete(ctx, tempFName)
+		defer h.Bucket.Delete(ctx, tempFName+signatureSuffix)
+
+		Convey("writes signatures in the format of minisign", func() {
+			So(signer.Process(ctx, h.Bucket, tempFName), ShouldBeNil)
+			contents, err := h.Bucket.ReadAll(ctx, tempFName+signatureSuffix)
+			So(err, ShouldBeNil)
+			lines := strings.Split(string(contents), "\n")
+			So(lines, ShouldHaveLength, 5)
+			So(lines[0], ShouldStartWith, "untrusted comment: ")
+			So(lines[2], ShouldStartWith, "trusted comment: ")
+
+			sig, _ := base64.StdEncoding.DecodeString(lines[1])
+			So(sig, ShouldHaveLength, 2+8+ed25519.SignatureSize)
+			So(string(sig[:2]), ShouldEqual, "ED")
+			So(sig[2:10], ShouldResemble, publicKey[2:10]) // The key ID.
+
+			hash := blake2b.Sum512([]byte("DELME"))
+			So(ed25519.Verify(publicKey[10:], hash[:], sig[10:]), ShouldBeTrue)
+			globalSig, _ := base64.StdEncoding.DecodeString(lines[3])
+			trustedComment := strings.TrimPrefix(lines[2], "trusted comment: ")
+			So(ed25519.Verify(publicKey[10:], append(sig[10:], trustedComment...), globalSig), ShouldBeTrue)
+		})
+
+		Convey("does not sign signatures", func() {
+			h.Bucket.WriteAll(ctx, tempFName+signatureSuffix, []byte("DELME"), nil)
+			So(signer.Process(ctx, h.Bucket, tempFName+signatureSuffix), ShouldBeNil)
+			exists, _ := h.Bucket.Exists(ctx, tempFName+signatureSuffix+signatureSuffix)
+			So(exists, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,85 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const errSlotContentType coreUploadError = "The slot does not accept this Content-Type"
+
+// Slot is a fixed destination for uploads to a logical name, such as "firmware/latest".
+// Clients always upload to the same URL, while where the file ends up is up to the server.
+type Slot struct {
+	Key string `json:"key"` // Where the file is written to, relative to the destination.
+
+	// If not empty, header "Content-Type" must match one of these, such as "application/zip" or "image/*".
+	ContentTypes []string `json:"content_types,omitempty"`
+	// If > 0, this replaces Handler.MaxFilesize.
+	MaxFilesize int64 `json:"max_filesize,omitempty"`
+}
+
+// accepts is true for a Content-Type that matches one of ContentTypes.
+func (s Slot) accepts(ctype string) bool {
+	return matchesContentType(s.ContentTypes, ctype)
+}
+
+// matchesContentType is true if the list is empty, or ctype matches one of it,
+// which can be such as "application/zip" or "image/*".
+func matchesContentType(acceptable []string, ctype string) bool {
+	if len(acceptable) == 0 {
+		return true
+	}
+	mediatype, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	for _, accepted := range acceptable {
+		accepted = strings.ToLower(accepted)
+		if accepted == mediatype ||
+			(strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediatype, accepted[:len(accepted)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// slotFor returns the Slot that's been uploaded to, if any.
+// Names are matched by whole path segments: with scope "/avatar" a slot "s" is not "/avatars".
+// Paths that end in '/' are directories, and never a slot.
+func (h *Handler) slotFor(r *http.Request) (Slot, bool) {
+	if len(h.Slots) == 0 || strings.HasSuffix(r.URL.Path, "/") {
+		return Slot{}, false
+	}
+	name := path.Clean(r.URL.Path)
+	if h.Scope != "/" {
+		if !strings.HasPrefix(name, h.Scope+"/") {
+			return Slot{}, false
+		}
+		name = name[len(h.Scope):]
+	}
+	slot, ok := h.Slots[strings.Trim(name, "/")]
+	return slot, ok
+}
+
+// serveSlotUpload writes the body to the Slot's key, as is, no matter whether it's been PUT or POST.
+// No randomized suffix is applied to the key.
+func (h *Handler) serveSlotUpload(w http.ResponseWriter, r *http.Request, slot Slot) (int, error) {
+	if !slot.accepts(r.Header.Get("Content-Type")) {
+		return http.StatusUnsupportedMediaType, errSlotContentType
+	}
+
+	slotted := *h
+	slotted.RandomizedSuffixLength = 0
+	if slot.MaxFilesize > 0 {
+		slotted.MaxFilesize = slot.MaxFilesize
+	}
+	r = r.Clone(r.Context())
+	r.Method = http.MethodPut // Else a POST with header "Content-Type" were taken for an envelope.
+	r.URL.Path = path.Join(h.Scope, slot.Key)
+	return slotted.serveUpload(w, r)
+}
@@ -0,0 +1,62 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSlots(t *testing.T) {
+	Convey("Uploads to slots", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.MaxFilesize = 4
+		h.RandomizedSuffixLength = 6
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName+".bin"))
+		h.Slots = map[string]Slot{
+			"firmware/latest": {Key: tempFName + ".bin", ContentTypes: []string{"application/octet-stream"}, MaxFilesize: 16},
+			"avatar":          {Key: tempFName + ".bin", ContentTypes: []string{"image/*"}},
+		}
+		upload := func(method, path, ctype, body string) int {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", ctype)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("are written to the slot's key, with its max_filesize", func() {
+			So(upload("PUT", "/firmware/latest", "application/octet-stream", "REMOVEME"), ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName+".bin"), []byte("REMOVEME"))
+
+			So(upload("POST", "/firmware/latest", "application/octet-stream", "DELME"), ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName+".bin"), []byte("DELME"))
+
+			So(upload("PUT", "/firmware/latest", "application/octet-stream", strings.Repeat("x", 17)), ShouldEqual, 413)
+		})
+
+		Convey("are rejected for other content types", func() {
+			So(upload("PUT", "/firmware/latest", "text/plain", "DELME"), ShouldEqual, 415)
+			So(upload("PUT", "/avatar", "image/png; name=x", "DEL"), ShouldEqual, 201)
+			So(upload("PUT", "/avatar", "imagery/png", "DEL"), ShouldEqual, 415)
+		})
+
+		Convey("match whole path segments only", func() {
+			So(upload("PUT", "/avatar/", "text/plain", "DEL"), ShouldNotEqual, 415)
+			So(upload("PUT", "/avatars", "imagery/png", "DEL"), ShouldNotEqual, 415)
+			os.Remove(filepath.Join(scratchDir, "avatars"))
+
+			h.Scope = "/av"
+			h.Slots = map[string]Slot{"atar": {Key: tempFName + ".bin", ContentTypes: []string{"image/*"}}}
+			So(upload("PUT", "/av/atar", "imagery/png", "DEL"), ShouldEqual, 415)
+			So(upload("PUT", "/avatar", "imagery/png", "DEL"), ShouldNotEqual, 415)
+		})
+	})
+}
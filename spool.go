@@ -0,0 +1,50 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// newSpoolSink returns a writer into a temporary file in SpoolDirectory.
+// Only on persist its contents get written to the Bucket under the given key, with the given metadata.
+// Either discard or persist must be called exactly once.
+//
+// Nothing reaches the Bucket for uploads that get rejected after their body has been read,
+// which for cloud storage else would have been transmitted in part already.
+func (h *Handler) newSpoolSink(ctx context.Context, key string, metadata map[string]string) (w io.Writer, discard, persist func() error, err error) {
+	f, err := ioutil.TempFile(h.SpoolDirectory, ".upload-*")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	discard = func() error {
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	persist = func() error {
+		defer discard()
+		size, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		blob, discardBlob, persistBlob, err := h.newBlobSink(ctx, key, metadata, size)
+		if err != nil {
+			return err
+		}
+		buf := getCopyBuffer(h.copyBufferSize())
+		defer putCopyBuffer(buf)
+		if _, err := io.CopyBuffer(struct{ io.Writer }{blob}, struct{ io.Reader }{f}, *buf); err != nil {
+			discardBlob()
+			return err
+		}
+		return persistBlob()
+	}
+	return f, discard, persist, nil
+}
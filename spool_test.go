@@ -0,0 +1,56 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSpooling(t *testing.T) {
+	Convey("Spooling uploads", t, func() {
+		spoolDir, err := ioutil.TempDir("", "http-upload-spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(spoolDir)
+
+		h, _ := NewHandler("/", scratchDir, next)
+		h.SpoolDirectory = spoolDir
+
+		Convey("writes accepted files to the destination, and leaves nothing behind", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("DELME"))
+			leftovers, _ := ioutil.ReadDir(spoolDir)
+			So(leftovers, ShouldBeEmpty)
+		})
+
+		Convey("discards rejected files", func() {
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			req.Header.Set("Content-Length", "6")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 422)
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			leftovers, _ := ioutil.ReadDir(spoolDir)
+			So(leftovers, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,67 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"path"
+	"strings"
+)
+
+const errStorageClass coreUploadError = "The storage class in header X-Storage-Class is not available"
+
+// metadataStorageClass is the metadata of files with the storage class they've been written to,
+// which is applied by Handler.SetStorageClass.
+const metadataStorageClass = "upload-storage-class"
+
+// StorageClassRule picks the storage class of files, see Handler.StorageClasses.
+type StorageClassRule struct {
+	MinSize    int64    `json:"min_size,omitempty"`   // Of files that declare their size. If 0, of any.
+	Extensions []string `json:"extensions,omitempty"` // Such as ".tar". If empty, of any.
+	Class      string   `json:"class"`                // Such as "GLACIER" with S3, or "COLDLINE" with GCS.
+}
+
+// matches is true if the rule applies to a file with the key and the declared size.
+func (rule StorageClassRule) matches(key string, size int64) bool {
+	if rule.MinSize > 0 && size < rule.MinSize {
+		return false
+	}
+	if len(rule.Extensions) == 0 {
+		return true
+	}
+	ext := path.Ext(key)
+	for _, e := range rule.Extensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedStorageClass returns the metadata with the storage class from a header "X-Storage-Class",
+// which must be one of StorageClassesAllowed.
+func (h *Handler) requestedStorageClass(header string) (map[string]string, error) {
+	if header == "" {
+		return nil, nil
+	}
+	for _, class := range h.StorageClassesAllowed {
+		if strings.EqualFold(class, header) {
+			return map[string]string{metadataStorageClass: class}, nil
+		}
+	}
+	return nil, errStorageClass
+}
+
+// withStorageClass adds the storage class of the first matching StorageClasses to the metadata,
+// unless the client has requested one.
+func (h *Handler) withStorageClass(key string, metadata map[string]string, size int64) map[string]string {
+	if metadata[metadataStorageClass] != "" {
+		return metadata
+	}
+	for _, rule := range h.StorageClasses {
+		if rule.matches(key, size) {
+			return mergeMetadata(metadata, map[string]string{metadataStorageClass: rule.Class})
+		}
+	}
+	return metadata
+}
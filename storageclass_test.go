@@ -0,0 +1,63 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStorageClasses(t *testing.T) {
+	Convey("StorageClassRule", t, func() {
+		rule := StorageClassRule{MinSize: 1 << 30, Extensions: []string{".tar", ".zip"}, Class: "GLACIER"}
+		So(rule.matches("backup.TAR", 2<<30), ShouldBeTrue)
+		So(rule.matches("backup.tar", 1<<20), ShouldBeFalse)
+		So(rule.matches("backup.tar", 0), ShouldBeFalse) // Size unknown.
+		So(rule.matches("backup.png", 2<<30), ShouldBeFalse)
+		So(StorageClassRule{Class: "STANDARD_IA"}.matches("any", 0), ShouldBeTrue)
+	})
+
+	Convey("With StorageClasses", t, func() {
+		var applied []string
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.StorageClasses = []StorageClassRule{{Extensions: []string{".tar"}, Class: "COLDLINE"}}
+		h.StorageClassesAllowed = []string{"NEARLINE"}
+		h.SetStorageClass = func(asFunc func(interface{}) bool, class string) error {
+			applied = append(applied, class)
+			return nil
+		}
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName+".tar"))
+		defer os.Remove(filepath.Join(scratchDir, tempFName+".txt"))
+
+		put := func(name, class string) int {
+			req := httptest.NewRequest("PUT", "/"+name, strings.NewReader("DELME"))
+			req.Header.Set("X-Storage-Class", class)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("files are written to that of the first matching rule", func() {
+			So(put(tempFName+".tar", ""), ShouldEqual, 201)
+			So(put(tempFName+".txt", ""), ShouldEqual, 201)
+			So(applied, ShouldResemble, []string{"COLDLINE"})
+		})
+
+		Convey("clients can request one of StorageClassesAllowed, which takes precedence", func() {
+			So(put(tempFName+".tar", "nearline"), ShouldEqual, 201)
+			So(applied, ShouldResemble, []string{"NEARLINE"})
+		})
+
+		Convey("any other is rejected", func() {
+			So(put(tempFName+".txt", "GLACIER"), ShouldEqual, 400)
+			So(applied, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,163 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+)
+
+var (
+	errNotJPEG = errors.New("Not a JPEG image")
+	errNotPNG  = errors.New("Not a PNG image")
+
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// MetadataStripper is a PostProcessor that removes metadata, such as EXIF with GPS coordinates,
+// from JPEG and PNG images. The pixels are not touched, nor are color profiles.
+// Cameras record the orientation in EXIF, hence some photos will appear rotated afterwards.
+//
+// HEIC images are left as they are.
+type MetadataStripper struct{}
+
+// Process implements the PostProcessor interface.
+func (MetadataStripper) Process(ctx context.Context, bucket *blob.Bucket, key string) error {
+	var strip func(io.Writer, *bufio.Reader) error
+	switch strings.ToLower(path.Ext(key)) {
+	case ".jpg", ".jpeg":
+		strip = stripJPEG
+	case ".png":
+		strip = stripPNG
+	default:
+		return nil
+	}
+
+	src, err := bucket.NewReader(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	// Replaces the file on Close only, until then the original can be read.
+	ctx, cancelWrite := context.WithCancel(ctx)
+	defer cancelWrite()
+	dst, err := bucket.NewWriter(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	if err := strip(dst, bufio.NewReader(src)); err != nil {
+		cancelWrite() // Keeps the original.
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// stripJPEG copies segments of the image, except for APP1 (EXIF, XMP), APP13 (IPTC), and comments.
+func stripJPEG(dst io.Writer, src *bufio.Reader) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(src, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return errNotJPEG
+	}
+	if _, err := dst.Write(soi[:]); err != nil {
+		return err
+	}
+
+	for {
+		b, err := src.ReadByte()
+		if err != nil {
+			return errNotJPEG
+		}
+		if b != 0xff {
+			return errNotJPEG
+		}
+		marker, err := src.ReadByte()
+		for err == nil && marker == 0xff { // Fill bytes.
+			marker, err = src.ReadByte()
+		}
+		if err != nil {
+			return errNotJPEG
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) { // Without a payload.
+			if _, err := dst.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+		if marker == 0xd9 { // EOI
+			_, err := dst.Write([]byte{0xff, marker})
+			return err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(src, length[:]); err != nil {
+			return errNotJPEG
+		}
+		n := int64(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return errNotJPEG
+		}
+		switch marker {
+		case 0xe1, 0xed, 0xfe: // APP1, APP13, COM
+			if _, err := io.CopyN(ioutil.Discard, src, n); err != nil {
+				return errNotJPEG
+			}
+			continue
+		}
+		if _, err := dst.Write([]byte{0xff, marker, length[0], length[1]}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, n); err != nil {
+			return err
+		}
+		if marker == 0xda { // SOS: what follows is image data, and no more metadata.
+			_, err := io.Copy(dst, src)
+			return err
+		}
+	}
+}
+
+// stripPNG copies all chunks of the image, except for eXIf, tEXt, zTXt, iTXt, and tIME.
+func stripPNG(dst io.Writer, src *bufio.Reader) error {
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(src, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return errNotPNG
+	}
+	if _, err := dst.Write(signature); err != nil {
+		return err
+	}
+
+	var header [8]byte // length, and type
+	for {
+		if _, err := io.ReadFull(src, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errNotPNG
+		}
+		n := int64(binary.BigEndian.Uint32(header[:4])) + 4 // data, and CRC
+		switch string(header[4:]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+			if _, err := io.CopyN(ioutil.Discard, src, n); err != nil {
+				return errNotPNG
+			}
+			continue
+		}
+		if _, err := dst.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, n); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStripMetadata(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+
+	Convey("Stripping metadata", t, func() {
+		Convey("removes EXIF and comments from JPEG images", func() {
+			var original bytes.Buffer
+			jpeg.Encode(&original, img, nil)
+			exif := append([]byte{0xff, 0xe1, 0x00, 0x10}, "Exif\x00\x00GPS:1234"...)
+			comment := append([]byte{0xff, 0xfe, 0x00, 0x06}, "Hi!!"...)
+			withMetadata := append([]byte{}, original.Bytes()[:2]...)
+			withMetadata = append(withMetadata, exif...)
+			withMetadata = append(withMetadata, comment...)
+			withMetadata = append(withMetadata, original.Bytes()[2:]...)
+
+			var stripped bytes.Buffer
+			err := stripJPEG(&stripped, bufio.NewReader(bytes.NewReader(withMetadata)))
+			So(err, ShouldBeNil)
+			So(stripped.Bytes(), ShouldResemble, original.Bytes())
+		})
+
+		Convey("removes text chunks from PNG images", func() {
+			var original bytes.Buffer
+			png.Encode(&original, img)
+			text := []byte("\x00\x00\x00\x08tEXtGPS\x001234\x00\x00\x00\x00")
+			afterIHDR := len(pngSignature) + 8 + 13 + 4
+			withMetadata := append([]byte{}, original.Bytes()[:afterIHDR]...)
+			withMetadata = append(withMetadata, text...)
+			withMetadata = append(withMetadata, original.Bytes()[afterIHDR:]...)
+
+			var stripped bytes.Buffer
+			err := stripPNG(&stripped, bufio.NewReader(bytes.NewReader(withMetadata)))
+			So(err, ShouldBeNil)
+			So(stripped.Bytes(), ShouldResemble, original.Bytes())
+		})
+
+		Convey("rejects anything else", func() {
+			var stripped bytes.Buffer
+			So(stripJPEG(&stripped, bufio.NewReader(bytes.NewReader([]byte("DELME")))), ShouldNotBeNil)
+			So(stripPNG(&stripped, bufio.NewReader(bytes.NewReader([]byte("DELME")))), ShouldNotBeNil)
+		})
+
+		Convey("leaves files as they are that are not images", func() {
+			h, _ := NewHandler("/", scratchDir, next)
+			h.PostProcessors = []PostProcessor{MetadataStripper{}}
+			tempFName := tempFileName() + ".jpg"
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+			req := httptest.NewRequest("PUT", "/"+tempFName, bytes.NewReader([]byte("DELME")))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			contents, _ := ioutil.ReadFile(filepath.Join(scratchDir, tempFName))
+			So(string(contents), ShouldEqual, "DELME")
+		})
+	})
+}
@@ -0,0 +1,57 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http"
+)
+
+// successDecorator adds headers to responses of success,
+// including those that functions returning statusSent have written themselves.
+type successDecorator struct {
+	http.ResponseWriter
+	headers     http.Header
+	wroteHeader bool
+}
+
+func (d *successDecorator) WriteHeader(code int) {
+	if !d.wroteHeader && code >= 200 && code <= 299 {
+		header := d.ResponseWriter.Header()
+		for name, values := range d.headers {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	if code >= 200 { // Not for informational responses, such as "102 Processing".
+		d.wroteHeader = true
+	}
+	d.ResponseWriter.WriteHeader(code)
+}
+
+func (d *successDecorator) Write(b []byte) (int, error) {
+	if !d.wroteHeader {
+		d.WriteHeader(http.StatusOK)
+	}
+	return d.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, if the underlying ResponseWriter does.
+func (d *successDecorator) Flush() {
+	if f, ok := d.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the ResponseWriter, for http.ResponseController and read deadlines.
+func (d *successDecorator) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
+// withSuccessHeaders returns w decorated with SuccessHeaders for requests that write or delete files.
+// Responses to GET and HEAD are left alone, as is anything passed on to Next.
+func (h *Handler) withSuccessHeaders(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if len(h.SuccessHeaders) == 0 || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return w
+	}
+	return &successDecorator{ResponseWriter: w, headers: h.SuccessHeaders}
+}
@@ -0,0 +1,69 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSuccessHeaders(t *testing.T) {
+	Convey("SuccessHeaders", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.EnableWebdav = true
+		h.SuccessHeaders = http.Header{"Cache-Control": {"no-store"}}
+		name := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, name))
+
+		do := func(method string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/"+name, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("are sent with successful uploads and deletions", func() {
+			w := do("PUT", "DELME")
+			So(w.Code, ShouldEqual, 201)
+			So(w.Header().Get("Cache-Control"), ShouldEqual, "no-store")
+
+			w = do("DELETE", "")
+			So(w.Code, ShouldEqual, 204)
+			So(w.Header().Get("Cache-Control"), ShouldEqual, "no-store")
+		})
+
+		Convey("are not sent with errors", func() {
+			w := do("DELETE", "")
+			So(w.Code, ShouldBeGreaterThanOrEqualTo, 400)
+			So(w.Header().Get("Cache-Control"), ShouldBeEmpty)
+		})
+
+		Convey("are not sent by Next, which gets the original ResponseWriter", func() {
+			var got http.ResponseWriter
+			h.Next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = w
+				w.WriteHeader(http.StatusOK)
+			})
+			h.EnableWebdav = false
+			req := httptest.NewRequest("MOVE", "/"+name, nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 200)
+			So(got, ShouldEqual, w)
+			So(w.Header().Get("Cache-Control"), ShouldBeEmpty)
+		})
+
+		Convey("are not sent in answer to GET", func() {
+			w := do("GET", "")
+			So(w.Code, ShouldEqual, 418)
+			So(w.Header().Get("Cache-Control"), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,82 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const errTagInvalid coreUploadError = "Tags in headers X-Tag-* or Tagging must be of TagsAllowed, with values of up to 256 bytes"
+
+// metadataTagPrefix precedes the keys of tags in the metadata of files.
+const metadataTagPrefix = "tag-"
+
+// tagHeaderPrefix precedes the key of a tag in the names of headers, such as "X-Tag-Project: apollo".
+const tagHeaderPrefix = "X-Tag-"
+
+// Values of tags are limited to this many bytes, as they are with S3.
+const maxTagValueLength = 256
+
+// requestedTags returns the metadata with the tags from headers "X-Tag-<key>" and "Tagging",
+// the latter being as with S3, such as "project=apollo&tier=gold". Keys are in lowercase.
+// Without TagsAllowed such headers are ignored.
+func (h *Handler) requestedTags(header http.Header) (map[string]string, error) {
+	if len(h.TagsAllowed) == 0 {
+		return nil, nil
+	}
+	tags := make(url.Values)
+	for name, values := range header {
+		if strings.HasPrefix(name, tagHeaderPrefix) && len(name) > len(tagHeaderPrefix) {
+			tags[name[len(tagHeaderPrefix):]] = values
+		}
+	}
+	if tagging := header.Get("Tagging"); tagging != "" {
+		parsed, err := url.ParseQuery(tagging)
+		if err != nil {
+			return nil, errTagInvalid
+		}
+		for k, values := range parsed {
+			tags[k] = append(tags[k], values...)
+		}
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	metadata := make(map[string]string, len(tags))
+	for k, values := range tags {
+		k = strings.ToLower(k)
+		if !h.isTagAllowed(k) || len(values) != 1 || len(values[0]) > maxTagValueLength {
+			return nil, errTagInvalid
+		}
+		metadata[metadataTagPrefix+k] = values[0]
+	}
+	return metadata, nil
+}
+
+func (h *Handler) isTagAllowed(key string) bool {
+	for _, allowed := range h.TagsAllowed {
+		if strings.EqualFold(allowed, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagsOf returns the tags in the metadata by their key, or nil if there are none.
+func tagsOf(metadata map[string]string) map[string]string {
+	var tags map[string]string
+	for k, v := range metadata {
+		if !strings.HasPrefix(k, metadataTagPrefix) {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[k[len(metadataTagPrefix):]] = v
+	}
+	return tags
+}
@@ -0,0 +1,75 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTags(t *testing.T) {
+	Convey("Tags", t, func() {
+		h, _ := NewHandler("/", "file://"+filepath.ToSlash(scratchDir), next) // Keeps metadata.
+		h.TagsAllowed = []string{"project", "tier"}
+		name := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, name))
+		defer os.Remove(filepath.Join(scratchDir, name+".attrs"))
+
+		put := func(header http.Header) int {
+			req := httptest.NewRequest("PUT", "/"+name, strings.NewReader("DELME"))
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+		tags := func() map[string]string {
+			attrs, err := h.Bucket.Attributes(context.Background(), name)
+			So(err, ShouldBeNil)
+			return tagsOf(attrs.Metadata)
+		}
+
+		Convey("from headers X-Tag-* and Tagging are kept as metadata", func() {
+			So(put(http.Header{"X-Tag-Project": {"apollo"}, "Tagging": {"tier=gold"}}), ShouldEqual, 201)
+			So(tags(), ShouldResemble, map[string]string{"project": "apollo", "tier": "gold"})
+		})
+
+		Convey("apply to every part of MIME Multipart uploads", func() {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			p, _ := writer.CreateFormFile("A", name)
+			p.Write([]byte("DELME"))
+			writer.Close()
+			req := httptest.NewRequest("POST", "/", body)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			req.Header.Set("Tagging", "project=apollo")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			So(tags(), ShouldResemble, map[string]string{"project": "apollo"})
+		})
+
+		Convey("must be allowed", func() {
+			So(put(http.Header{"X-Tag-Owner": {"me"}}), ShouldEqual, 400)
+			So(put(http.Header{"Tagging": {"tier=a&tier=b"}}), ShouldEqual, 400)
+			So(put(http.Header{"X-Tag-Project": {strings.Repeat("x", maxTagValueLength+1)}}), ShouldEqual, 400)
+		})
+
+		Convey("are ignored without TagsAllowed", func() {
+			h.TagsAllowed = nil
+			So(put(http.Header{"X-Tag-Owner": {"me"}}), ShouldEqual, 201)
+			So(tags(), ShouldBeNil)
+		})
+	})
+}
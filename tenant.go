@@ -0,0 +1,135 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	errNoTenant      coreUploadError = "Uploads need an authenticated identity"
+	errTenantInvalid coreUploadError = "The identity cannot be used as name of a directory"
+)
+
+// TenantLimits replace limits of the Handler for one tenant, those that are ≠ 0 or not empty.
+// See ContextWithLimits for other uses.
+type TenantLimits struct {
+	MaxFilesize        int64    `json:"max_filesize,omitempty"`
+	MaxTransactionSize int64    `json:"max_transaction_size,omitempty"`
+	ContentTypes       []string `json:"content_types,omitempty"` // As in Handler.ContentTypes.
+}
+
+// applyTo replaces the Handler's limits.
+func (l TenantLimits) applyTo(h *Handler) {
+	if l.MaxFilesize != 0 {
+		h.MaxFilesize = l.MaxFilesize
+	}
+	if l.MaxTransactionSize != 0 {
+		h.MaxTransactionSize = l.MaxTransactionSize
+	}
+	if len(l.ContentTypes) > 0 {
+		h.ContentTypes = l.ContentTypes
+	}
+}
+
+type tenantContextKey struct{}
+
+type limitsContextKey struct{}
+
+// ContextWithLimits returns a context that carries limits that replace the Handler's, and any tenant's,
+// for one request. Use it in a middleware for dynamic policies, such as larger files for administrators.
+func ContextWithLimits(ctx context.Context, limits TenantLimits) context.Context {
+	return context.WithValue(ctx, limitsContextKey{}, limits)
+}
+
+// applyContextLimits applies the limits of ContextWithLimits, if any.
+func (h *Handler) applyContextLimits(r *http.Request) {
+	if limits, ok := r.Context().Value(limitsContextKey{}).(TenantLimits); ok {
+		limits.applyTo(h)
+	}
+}
+
+// ContextWithTenant returns a context that carries the tenant, such as the keyId a request
+// has been authenticated with, for TenantFromContext.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of ContextWithTenant, if any.
+// Use it as Handler.TenantOf behind any middleware that authenticates requests.
+func TenantFromContext(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// TenantFromHeader returns a Handler.TenantOf that reads the tenant from a header,
+// such as "X-Forwarded-User". Use it only behind a proxy that authenticates requests,
+// and which overwrites that header.
+func TenantFromHeader(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// isValidTenant is true for names that can be used as one directory.
+// Those starting with a dot are reserved, such as for sessions and versions.
+func isValidTenant(tenant string) bool {
+	return tenant != "" && !strings.HasPrefix(tenant, ".") &&
+		!strings.ContainsAny(tenant, "/\\\x00") && !isReservedOnWindows(tenant)
+}
+
+// forTenant returns a copy of the Handler that's confined to the directory of the request's tenant,
+// "<destination>/<tenant>/". Keys are prefixed with that, including those in header "Destination"
+// of COPY and MOVE, hence no tenant can reach any files of another.
+func (h *Handler) forTenant(r *http.Request) (*Handler, int, error) {
+	tenant := h.TenantOf(r)
+	if tenant == "" {
+		if !isWriting(r.Method) {
+			return nil, http.StatusMethodNotAllowed, nil // For Next.
+		}
+		return nil, http.StatusUnauthorized, errNoTenant
+	}
+	if !isValidTenant(tenant) {
+		return nil, http.StatusForbidden, errTenantInvalid
+	}
+	confined := *h
+	confined.tenant = tenant
+	if limits, ok := h.Tenants[tenant]; ok {
+		limits.applyTo(&confined)
+		confined.applyContextLimits(r) // Take precedence.
+	}
+	return &confined, 0, nil
+}
+
+// isTenantsKey is true if the key belongs to the Handler's tenant, or if there are none.
+func (h *Handler) isTenantsKey(key string) bool {
+	return h.tenant == "" || strings.HasPrefix(key, h.tenant+"/")
+}
+
+// tenantRelative strips the tenant's directory off a key, which is how keys are shown to the tenant.
+func (h *Handler) tenantRelative(key string) string {
+	if h.tenant == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, h.tenant+"/")
+}
+
+// tenantRelativeKeys is tenantRelative for the values of the map, as returned by derivedFiles.
+func (h *Handler) tenantRelativeKeys(keys map[string]string) map[string]string {
+	if h.tenant == "" {
+		return keys
+	}
+	for name, key := range keys {
+		keys[name] = h.tenantRelative(key)
+	}
+	return keys
+}
+
+// urlPath is the inverse of translateToKey.
+func (h *Handler) urlPath(key string) string {
+	return path.Join(h.Scope, h.tenantRelative(key))
+}
@@ -0,0 +1,248 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTenants(t *testing.T) {
+	Convey("With TenantOf", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+		h.EnableWebdav = true
+		h.TenantOf = TenantFromContext
+		tenantA, tenantB := "a"+tempFileName(), "b"+tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, tenantA))
+		defer os.RemoveAll(filepath.Join(scratchDir, tenantB))
+
+		serve := func(tenant string, req *http.Request) *httptest.ResponseRecorder {
+			if tenant != "" {
+				req = req.WithContext(ContextWithTenant(req.Context(), tenant))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("files are written to the tenant's directory", func() {
+			w := serve(tenantA, httptest.NewRequest("PUT", "/file.txt", strings.NewReader("DELME")))
+			So(w.Code, ShouldEqual, 201)
+			b, err := ioutil.ReadFile(filepath.Join(scratchDir, tenantA, "file.txt"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "DELME")
+
+			Convey("and no tenant can reach those of another", func() {
+				req := httptest.NewRequest("COPY", "/../"+tenantA+"/file.txt", nil)
+				req.Header.Set("Destination", "/stolen.txt")
+				So(serve(tenantB, req).Code, ShouldEqual, 422)
+				_, err := os.Stat(filepath.Join(scratchDir, tenantB, "stolen.txt"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+
+				req = httptest.NewRequest("MOVE", "/file.txt", nil)
+				req.Header.Set("Destination", "/../"+tenantB+"/file.txt")
+				So(serve(tenantA, req).Code, ShouldEqual, 422)
+
+				req = httptest.NewRequest("MOVE", "/file.txt", nil)
+				req.Header.Set("Destination", "/"+tenantB+"/file.txt")
+				So(serve(tenantA, req).Code, ShouldEqual, 201)
+				_, err = os.Stat(filepath.Join(scratchDir, tenantB, "file.txt"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+				_, err = os.Stat(filepath.Join(scratchDir, tenantA, tenantB, "file.txt"))
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("Location is below the tenant's ApparentLocation, or else where it's been uploaded to", func() {
+			h.LocationFromRequest = true
+			w := serve(tenantA, httptest.NewRequest("PUT", "http://example.com/file.txt", strings.NewReader("DELME")))
+			So(w.Header().Get("Location"), ShouldEqual, "http://example.com/file.txt")
+
+			h.ApparentLocation = "/download"
+			w = serve(tenantA, httptest.NewRequest("PUT", "http://example.com/file.txt", strings.NewReader("DELME")))
+			So(w.Header().Get("Location"), ShouldEqual, "http://example.com/download/"+tenantA+"/file.txt")
+		})
+
+		Convey("keys in responses are relative to the tenant's directory", func() {
+			h.SendLinkHeaders = true
+			So(serve(tenantA, httptest.NewRequest("PUT", "/file.txt", strings.NewReader("DELME"))).Code, ShouldEqual, 201)
+			w := serve(tenantA, httptest.NewRequest("GET", "/file.txt?metadata", nil))
+			So(w.Code, ShouldEqual, 200)
+			var m FileMetadata
+			So(json.NewDecoder(w.Body).Decode(&m), ShouldBeNil)
+			So(m.Key, ShouldEqual, "file.txt")
+		})
+
+		Convey("keys are relative to the tenant's directory in", func() {
+			postForm := func(names ...string) *httptest.ResponseRecorder {
+				body := &bytes.Buffer{}
+				writer := multipart.NewWriter(body)
+				for _, name := range names {
+					p, _ := writer.CreateFormFile("A", name)
+					p.Write([]byte("DELME"))
+				}
+				writer.Close()
+				req := httptest.NewRequest("POST", "/", body)
+				req.Header.Set("Content-Type", writer.FormDataContentType())
+				return serve(tenantA, req)
+			}
+
+			Convey("transaction downloads", func() {
+				h.EnableTransactionDownloads = true
+				w := postForm("file.txt")
+				So(w.Code, ShouldEqual, 201)
+				w = serve(tenantA, httptest.NewRequest("GET", w.Header().Get("Transaction"), nil))
+				So(w.Code, ShouldEqual, 200)
+				zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+				So(err, ShouldBeNil)
+				So(zr.File, ShouldHaveLength, 1)
+				So(zr.File[0].Name, ShouldEqual, "file.txt")
+			})
+
+			Convey("redirects after uploads", func() {
+				h.RedirectAfterUpload = "/thanks.html"
+				w := postForm("file.txt")
+				So(w.Code, ShouldEqual, 303)
+				So(w.Header().Get("Location"), ShouldEqual, "/thanks.html?key=file.txt")
+			})
+
+			Convey("receipts", func() {
+				publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+				h.ReceiptKey = privateKey
+				w := serve(tenantA, httptest.NewRequest("PUT", "/file.txt", strings.NewReader("DELME")))
+				So(w.Code, ShouldEqual, 201)
+				rcpt, err := ParseReceipt(w.Header().Get("Upload-Receipt"), publicKey)
+				So(err, ShouldBeNil)
+				So(rcpt.Key, ShouldEqual, "file.txt")
+			})
+
+			Convey("the listing of quarantined uploads", func() {
+				h.Quarantine = true
+				So(serve(tenantA, httptest.NewRequest("PUT", "/file.txt", strings.NewReader("DELME"))).Code, ShouldEqual, 202)
+				defer os.RemoveAll(filepath.Join(scratchDir, quarantinePrefix, tenantA))
+				w := serve(tenantA, httptest.NewRequest("GET", "/?quarantine", nil))
+				So(w.Code, ShouldEqual, 200)
+				So(w.Body.String(), ShouldEqual, "file.txt 5\n")
+			})
+		})
+
+		Convey("writes without a tenant are rejected, and reads passed on to Next", func() {
+			So(serve("", httptest.NewRequest("PUT", "/file.txt", strings.NewReader("DELME"))).Code, ShouldEqual, 401)
+			So(serve("", httptest.NewRequest("GET", "/file.txt", nil)).Code, ShouldEqual, 405)
+		})
+
+		Convey("tenants that cannot be directories are rejected", func() {
+			for _, tenant := range []string{"..", ".upload-versions", "a/b", "CON"} {
+				So(serve(tenant, httptest.NewRequest("PUT", "/file.txt", strings.NewReader("DELME"))).Code, ShouldEqual, 403)
+			}
+		})
+
+		Convey("upload sessions are of one tenant only", func() {
+			h.Sessions = NewMemorySessionStore()
+			req := httptest.NewRequest("POST", "/.upload-session/", nil)
+			req.Header.Set("Destination", "/file.txt")
+			w := serve(tenantA, req)
+			So(w.Code, ShouldEqual, 201)
+			sessionURL := w.Header().Get("Location")
+
+			So(serve(tenantB, httptest.NewRequest("GET", sessionURL, nil)).Code, ShouldEqual, 404)
+			So(serve(tenantA, httptest.NewRequest("GET", sessionURL, nil)).Code, ShouldEqual, 200)
+		})
+	})
+
+	Convey("TenantLimits replace those of the Handler for their tenant", t, func() {
+		c := Config{
+			To:               scratchDir,
+			TenantFromHeader: "X-Forwarded-User",
+			MaxFilesize:      4,
+			ContentTypes:     []string{"text/plain"},
+			Tenants: map[string]TenantLimits{
+				"premium": {MaxFilesize: 1024, ContentTypes: []string{"text/*", "image/png"}},
+			},
+		}
+		h, err := c.NewHandler(nil)
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(filepath.Join(scratchDir, "free"))
+		defer os.RemoveAll(filepath.Join(scratchDir, "premium"))
+
+		put := func(tenant, ctype string) int {
+			req := httptest.NewRequest("PUT", "/file.txt", strings.NewReader("DELME"))
+			req.Header.Set("X-Forwarded-User", tenant)
+			req.Header.Set("Content-Type", ctype)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+		So(put("free", "text/plain"), ShouldEqual, 413)
+		So(put("premium", "text/plain"), ShouldEqual, 201)
+		So(put("premium", "image/png"), ShouldEqual, 201)
+		So(put("premium", "application/zip"), ShouldEqual, 415)
+		So(h.MaxFilesize, ShouldEqual, 4) // Unchanged.
+	})
+
+	Convey("Config 'tenant_from_header'", t, func() {
+		h, err := (&Config{To: scratchDir, TenantFromHeader: "X-Forwarded-User"}).NewHandler(nil)
+		So(err, ShouldBeNil)
+		tenant := "h" + tempFileName()
+		defer os.RemoveAll(filepath.Join(scratchDir, tenant))
+
+		req := httptest.NewRequest("PUT", "/file.txt", strings.NewReader("DELME"))
+		req.Header.Set("X-Forwarded-User", tenant)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, 201)
+		_, err = os.Stat(filepath.Join(scratchDir, tenant, "file.txt"))
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestContextWithLimits(t *testing.T) {
+	Convey("Limits from the context", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.MaxFilesize = 4
+		name := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, name))
+
+		put := func(limits *TenantLimits) int {
+			req := httptest.NewRequest("PUT", "/"+name, strings.NewReader("DELME"))
+			if limits != nil {
+				req = req.WithContext(ContextWithLimits(req.Context(), *limits))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("replace those of the Handler for one request", func() {
+			So(put(nil), ShouldEqual, 413)
+			So(put(&TenantLimits{MaxFilesize: 5}), ShouldEqual, 201)
+			So(h.MaxFilesize, ShouldEqual, 4)
+			So(put(nil), ShouldEqual, 413)
+		})
+
+		Convey("take precedence over those of tenants", func() {
+			h.TenantOf = TenantFromHeader("X-Tenant")
+			h.Tenants = map[string]TenantLimits{"alice": {MaxFilesize: 3}}
+			defer os.RemoveAll(filepath.Join(scratchDir, "alice"))
+			req := httptest.NewRequest("PUT", "/"+name, strings.NewReader("DELME"))
+			req.Header.Set("X-Tenant", "alice")
+			req = req.WithContext(ContextWithLimits(req.Context(), TenantLimits{MaxFilesize: 5}))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+		})
+	})
+}
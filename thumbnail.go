@@ -0,0 +1,139 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"image"
+	_ "image/gif" // Registers the format with image.Decode.
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+)
+
+// thumbnailMaxPixels guards against images that decompress to huge bitmaps.
+const thumbnailMaxPixels = 64 << 20
+
+// Thumbnailer is a PostProcessor that writes a downscaled copy of every image in the formats
+// JPEG, PNG, or GIF next to it, with the preset's name inserted before the extension:
+//  photo.jpg → photo.thumb.jpg
+//
+// Copies of GIF images are PNG, any others in the format their extension names.
+// Images that fit already are copied nevertheless, so clients can rely on the copy being there.
+type Thumbnailer struct {
+	Name      string // The preset's name, such as "thumb".
+	MaxWidth  int
+	MaxHeight int
+}
+
+// ParseThumbnailer returns a Thumbnailer for a preset such as "200x150".
+func ParseThumbnailer(name, size string) (*Thumbnailer, error) {
+	idx := strings.IndexByte(size, 'x')
+	if idx < 1 || name == "" {
+		return nil, errors.New("Thumbnail preset '" + name + "' is not of format WIDTHxHEIGHT")
+	}
+	width, err1 := strconv.Atoi(size[:idx])
+	height, err2 := strconv.Atoi(size[idx+1:])
+	if err1 != nil || err2 != nil || width < 1 || height < 1 {
+		return nil, errors.New("Thumbnail preset '" + name + "' is not of format WIDTHxHEIGHT")
+	}
+	return &Thumbnailer{Name: name, MaxWidth: width, MaxHeight: height}, nil
+}
+
+// DerivedKey implements the Deriver interface.
+func (t *Thumbnailer) DerivedKey(key string) (string, string) {
+	extension := strings.ToLower(path.Ext(key))
+	switch extension {
+	case ".jpg", ".jpeg":
+	case ".png", ".gif":
+		extension = ".png"
+	default:
+		return "", ""
+	}
+	return t.Name, strings.TrimSuffix(key, path.Ext(key)) + "." + t.Name + extension
+}
+
+// Process implements the PostProcessor interface.
+func (t *Thumbnailer) Process(ctx context.Context, bucket *blob.Bucket, key string) error {
+	_, thumbKey := t.DerivedKey(key)
+	if thumbKey == "" {
+		return nil
+	}
+
+	contents, err := bucket.ReadAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return errors.New("Image is too large to get a thumbnail")
+	}
+	img, _, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	thumb := downscale(img, t.MaxWidth, t.MaxHeight)
+
+	var buf bytes.Buffer
+	if strings.HasSuffix(thumbKey, ".png") {
+		err = png.Encode(&buf, thumb)
+	} else {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return err
+	}
+	return bucket.WriteAll(ctx, thumbKey, buf.Bytes(), nil)
+}
+
+// downscale shrinks img to fit into the given bounds, keeping its aspect ratio,
+// by averaging all pixels that make up one of the result.
+func downscale(img image.Image, maxWidth, maxHeight int) image.Image {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width <= maxWidth && height <= maxHeight {
+		return img
+	}
+	if width*maxHeight > height*maxWidth {
+		width, height = maxWidth, height*maxWidth/width
+	} else {
+		width, height = width*maxHeight/height, maxHeight
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,89 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestThumbnails(t *testing.T) {
+	Convey("Thumbnail presets", t, func() {
+		Convey("are of format WIDTHxHEIGHT", func() {
+			th, err := ParseThumbnailer("thumb", "200x150")
+			So(err, ShouldBeNil)
+			So(th.MaxWidth, ShouldEqual, 200)
+			So(th.MaxHeight, ShouldEqual, 150)
+
+			for _, size := range []string{"", "200", "x150", "200x", "0x1", "axb"} {
+				_, err = ParseThumbnailer("thumb", size)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+
+	Convey("Uploaded images", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		th, _ := ParseThumbnailer("thumb", "4x4")
+		h.PostProcessors = []PostProcessor{th}
+
+		Convey("get a downscaled copy next to them", func() {
+			img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+			for i := range img.Pix {
+				img.Pix[i] = 0xff
+			}
+			var buf bytes.Buffer
+			png.Encode(&buf, img)
+
+			tempFName := tempFileName()
+			defer os.Remove(filepath.Join(scratchDir, tempFName+".png"))
+			defer os.Remove(filepath.Join(scratchDir, tempFName+".thumb.png"))
+			req := httptest.NewRequest("PUT", "/"+tempFName+".png", &buf)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+
+			fd, err := os.Open(filepath.Join(scratchDir, tempFName+".thumb.png"))
+			So(err, ShouldBeNil)
+			defer fd.Close()
+			thumb, err := png.Decode(fd)
+			So(err, ShouldBeNil)
+			So(thumb.Bounds().Dx(), ShouldEqual, 4)
+			So(thumb.Bounds().Dy(), ShouldEqual, 2)
+			So(color.RGBAModel.Convert(thumb.At(1, 1)), ShouldResemble, color.RGBA{0xff, 0xff, 0xff, 0xff})
+
+			Convey("which is listed in the file's metadata", func() {
+				h.SendLinkHeaders = true
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("GET", "/"+tempFName+".png?metadata", nil))
+				So(w.Code, ShouldEqual, 200)
+				var m FileMetadata
+				So(json.NewDecoder(w.Body).Decode(&m), ShouldBeNil)
+				So(m.Derived, ShouldResemble, map[string]string{"thumb": tempFName + ".thumb.png"})
+			})
+		})
+	})
+
+	Convey("Names of thumbnails are known in advance", t, func() {
+		th, _ := ParseThumbnailer("thumb", "4x4")
+		for key, expected := range map[string]string{
+			"a/photo.JPG":  "a/photo.thumb.jpg",
+			"a/photo.jpeg": "a/photo.thumb.jpeg",
+			"a/anim.gif":   "a/anim.thumb.png",
+			"a/README":     "",
+		} {
+			_, derivedKey := th.DerivedKey(key)
+			So(derivedKey, ShouldEqual, expected)
+		}
+	})
+}
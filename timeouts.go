@@ -0,0 +1,98 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// deadlineReader enforces UploadTimeout and IdleReadTimeout on the request body.
+//
+// If the server supports it, Go 1.20 and later do, blocked reads get interrupted
+// by read deadlines on the connection. Else a timeout is noticed once a read returns,
+// which still stops clients that trickle in their uploads.
+type deadlineReader struct {
+	io.ReadCloser
+	setReadDeadline func(time.Time) error // nil if unsupported
+
+	deadline time.Time // zero if there is no UploadTimeout
+	idle     time.Duration
+	timedOut bool
+}
+
+func (d *deadlineReader) Read(b []byte) (int, error) {
+	if d.timedOut {
+		return 0, errUploadTimedOut
+	}
+	now := time.Now()
+	if !d.deadline.IsZero() && now.After(d.deadline) {
+		d.timedOut = true
+		return 0, errUploadTimedOut
+	}
+
+	next := d.deadline
+	if d.idle > 0 && (next.IsZero() || now.Add(d.idle).Before(next)) {
+		next = now.Add(d.idle)
+	}
+	if d.setReadDeadline != nil {
+		d.setReadDeadline(next)
+	}
+
+	n, err := d.ReadCloser.Read(b)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		d.timedOut = true
+		return n, errUploadTimedOut
+	}
+	if err == nil && d.idle > 0 && time.Since(now) > d.idle {
+		d.timedOut = true
+		return n, errUploadTimedOut
+	}
+	return n, err
+}
+
+// reset lifts any deadline, so the connection can be used for the next request.
+func (d *deadlineReader) reset() {
+	if d.setReadDeadline != nil && !d.timedOut {
+		d.setReadDeadline(time.Time{})
+	}
+}
+
+// withDeadlines returns r with a body that times out according to UploadTimeout and IdleReadTimeout.
+// The returned *deadlineReader is nil if neither is set.
+func (h *Handler) withDeadlines(w http.ResponseWriter, r *http.Request) (*http.Request, *deadlineReader) {
+	if (h.UploadTimeout <= 0 && h.IdleReadTimeout <= 0) || r.Body == nil || r.Body == http.NoBody {
+		return r, nil
+	}
+	d := &deadlineReader{
+		ReadCloser: r.Body,
+		idle:       h.IdleReadTimeout,
+	}
+	if h.UploadTimeout > 0 {
+		d.deadline = time.Now().Add(h.UploadTimeout)
+	}
+	d.setReadDeadline = readDeadlineSetter(w)
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Body = d
+	return r2, d
+}
+
+// readDeadlineSetter returns SetReadDeadline of w, or of any ResponseWriter it wraps,
+// as http.ResponseController would, or nil if there is none.
+func readDeadlineSetter(w http.ResponseWriter) func(time.Time) error {
+	for {
+		switch t := w.(type) {
+		case interface{ SetReadDeadline(time.Time) error }:
+			return t.SetReadDeadline
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
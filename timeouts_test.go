@@ -0,0 +1,103 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// tricklingReader yields one byte per read, after a delay.
+type tricklingReader struct {
+	n     int
+	delay time.Duration
+}
+
+func (t *tricklingReader) Read(b []byte) (int, error) {
+	if t.n <= 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(t.delay)
+	t.n--
+	b[0] = 'x'
+	return 1, nil
+}
+
+func TestUploadTimeouts(t *testing.T) {
+	Convey("Uploads that are too slow", t, func() {
+		h, _ := NewHandler("/", scratchDir, nil)
+
+		Convey("get aborted after UploadTimeout, and are discarded", func() {
+			h.UploadTimeout = 30 * time.Millisecond
+			tempFName := tempFileName()
+			req := httptest.NewRequest("PUT", "/"+tempFName, &tricklingReader{n: 100, delay: 5 * time.Millisecond})
+			req.ContentLength = -1
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 408)
+			So(w.Result().Header.Get("Connection"), ShouldEqual, "close")
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("get aborted once they stall for longer than IdleReadTimeout", func() {
+			h.IdleReadTimeout = 50 * time.Millisecond
+			stall := func() {
+				srv := httptest.NewServer(h)
+				defer srv.Close()
+
+				tempFName := tempFileName()
+				defer os.Remove(filepath.Join(scratchDir, tempFName))
+				pr, pw := io.Pipe()
+				defer pw.Close()
+				go func() {
+					pw.Write([]byte("DELME"))
+					// Then stall, and never close.
+				}()
+
+				req, _ := http.NewRequest("PUT", srv.URL+"/"+tempFName, pr)
+				start := time.Now()
+				resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+				So(err, ShouldBeNil)
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				So(resp.StatusCode, ShouldEqual, 408)
+				So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+				_, err = os.Stat(filepath.Join(scratchDir, tempFName))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			}
+			stall()
+
+			Convey("also if the response gets SuccessHeaders", func() {
+				h.SuccessHeaders = http.Header{"X-Uploaded": {"1"}}
+				stall()
+			})
+		})
+
+		Convey("are fine if within limits", func() {
+			h.UploadTimeout = time.Minute
+			h.IdleReadTimeout = time.Second
+			tempFName := tempFileName()
+			req := httptest.NewRequest("PUT", "/"+tempFName, &tricklingReader{n: 5, delay: time.Millisecond})
+			req.ContentLength = -1
+			defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("xxxxx"))
+		})
+	})
+}
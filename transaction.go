@@ -0,0 +1,103 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"archive/zip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transactionPath is where, below Scope, files of one MIME Multipart upload can be downloaded as ZIP archive.
+const transactionPath = "/.upload-transaction/"
+
+// transaction is the keys of all files of one upload.
+type transaction struct {
+	keys    []string
+	created time.Time
+}
+
+// transactions is a registry of transaction, by their randomized ID.
+type transactions struct {
+	sync.Mutex
+	m map[string]transaction
+}
+
+var recentTransactions = transactions{m: make(map[string]transaction)}
+
+// add registers the keys by an ID. Expired ones are removed on the occasion.
+func (t *transactions) add(id string, keys []string) {
+	t.Lock()
+	defer t.Unlock()
+	for oldID, tx := range t.m {
+		if time.Since(tx.created) > asyncJobsRetention {
+			delete(t.m, oldID)
+		}
+	}
+	t.m[id] = transaction{keys: keys, created: time.Now()}
+}
+
+func (t *transactions) get(id string) (transaction, bool) {
+	t.Lock()
+	defer t.Unlock()
+	tx, ok := t.m[id]
+	if !ok || time.Since(tx.created) > asyncJobsRetention {
+		return transaction{}, false
+	}
+	return tx, true
+}
+
+// transactionURL is the path (for header "Transaction") at which the files can be downloaded.
+func (h *Handler) transactionURL(id string) string {
+	return strings.TrimSuffix(h.Scope, "/") + transactionPath + id
+}
+
+// isTransactionRequest is true for downloads of an upload's files.
+func (h *Handler) isTransactionRequest(r *http.Request) bool {
+	if !h.EnableTransactionDownloads || r.Method != http.MethodGet {
+		return false
+	}
+	prefix := h.transactionURL("")
+	return strings.HasPrefix(r.URL.Path, prefix) && len(r.URL.Path) > len(prefix)
+}
+
+// serveTransaction streams all files of one upload as ZIP archive, in the order they have been received.
+// Files that have been deleted in the meantime are skipped.
+func (h *Handler) serveTransaction(w http.ResponseWriter, r *http.Request) (int, error) {
+	tx, ok := recentTransactions.get(r.URL.Path[len(h.transactionURL("")):])
+	if !ok || len(tx.keys) == 0 || !h.isTenantsKey(tx.keys[0]) {
+		return http.StatusNotFound, nil
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.WriteHeader(http.StatusOK)
+	zw := zip.NewWriter(w)
+	for _, key := range tx.keys {
+		attrs, err := h.Bucket.Attributes(r.Context(), key)
+		if err != nil {
+			continue
+		}
+		blob, err := h.newBlobReader(r.Context(), key)
+		if err != nil {
+			continue
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     h.tenantRelative(key),
+			Method:   zip.Store, // Most uploads, such as images, are compressed already.
+			Modified: attrs.ModTime,
+		})
+		if err == nil {
+			_, err = io.Copy(fw, blob)
+		}
+		blob.Close()
+		if err != nil {
+			return statusSent, nil // Too late for a different status code. The client will get a truncated archive.
+		}
+	}
+	zw.Close()
+	return statusSent, nil
+}
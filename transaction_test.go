@@ -0,0 +1,68 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTransactionDownloads(t *testing.T) {
+	Convey("Files of a MIME Multipart upload", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.EnableTransactionDownloads = true
+
+		names := []string{tempFileName(), tempFileName()}
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for _, name := range names {
+			p, _ := writer.CreateFormFile("A", name)
+			p.Write([]byte("DELME " + name))
+			defer os.Remove(filepath.Join(scratchDir, name))
+		}
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, 201)
+
+		Convey("can be downloaded as ZIP archive", func() {
+			url := w.Result().Header.Get("Transaction")
+			So(url, ShouldStartWith, "/.upload-transaction/")
+
+			req := httptest.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 200)
+
+			zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+			So(err, ShouldBeNil)
+			So(zr.File, ShouldHaveLength, 2)
+			for i, f := range zr.File {
+				So(f.Name, ShouldEqual, names[i])
+				fd, _ := f.Open()
+				contents, _ := ioutil.ReadAll(fd)
+				fd.Close()
+				So(string(contents), ShouldEqual, "DELME "+names[i])
+			}
+		})
+
+		Convey("are unavailable for unknown transactions", func() {
+			req := httptest.NewRequest("GET", "/.upload-transaction/nonexistent", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 404)
+		})
+	})
+}
@@ -0,0 +1,69 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Transformer rewrites files while they are being received, before they get persisted,
+// such as to sanitize them. Unlike with a PostProcessor, the original never reaches the Bucket.
+type Transformer interface {
+	// Transform writes to dst what becomes of src, the contents of the file-to-be at key.
+	// Files it's not meant for are to be copied as they are.
+	// Any error rejects the file with 422, hence return a descriptive one.
+	Transform(key string, dst io.Writer, src io.Reader) error
+}
+
+// TransformerFunc adapts a function to a Transformer.
+type TransformerFunc func(key string, dst io.Writer, src io.Reader) error
+
+// Transform implements the Transformer interface.
+func (f TransformerFunc) Transform(key string, dst io.Writer, src io.Reader) error {
+	return f(key, dst, src)
+}
+
+// transformSink returns a writer that runs what's written to it through all Transformers, in order,
+// before it reaches sink. Once everything has been written, finish returns how to respond
+// if the file must not be persisted, else 0 and nil. Call stop in any case, which is a no-op after finish.
+func (h *Handler) transformSink(key string, sink io.Writer) (io.Writer, func() (int, error), func()) {
+	var (
+		pipes   []*io.PipeWriter
+		results []chan error
+	)
+	for i := len(h.Transformers) - 1; i >= 0; i-- {
+		t, dst := h.Transformers[i], sink
+		pr, pw := io.Pipe()
+		result := make(chan error, 1)
+		go func() {
+			err := t.Transform(key, dst, pr)
+			io.Copy(ioutil.Discard, pr) // Should it have stopped early, else writes would block.
+			result <- err
+		}()
+		sink = pw
+		pipes, results = append(pipes, pw), append(results, result)
+	}
+
+	finish := func() (int, error) {
+		var failed error
+		for i := len(pipes) - 1; i >= 0; i-- { // The first Transformer's first.
+			pipes[i].Close()
+			if err := <-results[i]; err != nil && failed == nil {
+				failed = err
+			}
+		}
+		if failed != nil {
+			return http.StatusUnprocessableEntity, failed
+		}
+		return 0, nil
+	}
+	stop := func() {
+		for _, pw := range pipes {
+			pw.CloseWithError(errUploadAborted)
+		}
+	}
+	return sink, finish, stop
+}
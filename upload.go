@@ -6,14 +6,19 @@ package upload
 import (
 	"context"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
-	"golang.org/x/text/unicode/norm"
 )
 
 // Errors used in functions that resemble the core logic of this plugin.
@@ -26,8 +31,21 @@ const (
 	errLengthInvalid           coreUploadError = "Field 'length' has been set, but is invalid"
 	errFileTooLarge            coreUploadError = "The uploaded file exceeds or would exceed max_filesize"
 	errTransactionTooLarge     coreUploadError = "Upload(s) do or will exceed max_transaction_size"
+	errSymlinkInPath           coreUploadError = "Path leads through a symbolic link"
+	errUploadTimedOut          coreUploadError = "Upload has timed out"
+	errInsufficientStorage     coreUploadError = "There is no space left to store the upload"
+	errUploadToDirectory       coreUploadError = "Cannot upload to a directory"
+	errFileTooSmall            coreUploadError = "The uploaded file is empty or smaller than min_filesize"
+	errContentTypeRejected     coreUploadError = "The Content-Type is not accepted"
+	errSizeMismatch            coreUploadError = "The uploaded file is not of the declared length"
 )
 
+// finalNameHeader carries the path a file has been written to, when that's not the one it has been uploaded to.
+const finalNameHeader = "X-Final-Name"
+
+// statusSent is returned by functions that have sent the response themselves.
+const statusSent = 0
+
 // coreUploadError is returned for errors that are not in a leaf method,
 // that have no specialized error
 type coreUploadError string
@@ -38,24 +56,121 @@ func (e coreUploadError) Error() string { return string(e) }
 // ServeHTTP catches methods meant for file manipulation.
 // Anything else will be delegated to h.Next, if not nil.
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.applyContextLimits(r) // h is a copy.
+
+	// Next gets w as is: without SuccessHeaders, which are not for its responses, and with Hijacker and Pusher.
+	next := w
+	w = h.withSuccessHeaders(w, r)
 	httpCode, err := h.serveHTTP(w, r)
+	if httpCode == statusSent {
+		return
+	}
 
 	if httpCode == http.StatusMethodNotAllowed && err == nil && h.Next != nil {
-		h.Next.ServeHTTP(w, r)
+		h.Next.ServeHTTP(next, r)
 		return
 	}
+	if httpCode == http.StatusRequestEntityTooLarge {
+		h.drainOrClose(w, r)
+	}
 	if httpCode >= 400 && err != nil {
+		if acceptsProblems(r) {
+			h.writeProblem(w, httpCode, err)
+			return
+		}
 		http.Error(w, err.Error(), httpCode)
 	} else {
 		w.WriteHeader(httpCode)
 	}
 }
 
+// drainOrClose reads what's left of the request body up to DrainAllowance,
+// and if there's more, marks the connection to be closed after the response.
+// Thus exceeding a limit won't result in the rest of the body getting read anyway.
+func (h *Handler) drainOrClose(w http.ResponseWriter, r *http.Request) {
+	// Reading would trigger sending "100 Continue", for a body we don't want.
+	if h.DrainAllowance > 0 && r.Header.Get("Expect") == "" {
+		n, _ := io.CopyN(ioutil.Discard, r.Body, h.DrainAllowance+1)
+		if n <= h.DrainAllowance {
+			return
+		}
+	}
+	w.Header().Set("Connection", "close")
+}
+
+// serveHTTP dispatches by method.
+//
+// Anything that can be rejected without looking at the body must be, before reading from it:
+// Go's server sends "100 Continue" to clients that expect it only on the first read,
+// and so those clients won't transmit a body that's doomed anyway.
 func (h *Handler) serveHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if h.TenantOf != nil && h.tenant == "" {
+		confined, retval, err := h.forTenant(r)
+		if confined == nil {
+			return retval, err
+		}
+		return confined.serveHTTP(w, r)
+	}
+	if retval, err := h.checkUploadsAllowed(w, r); err != nil {
+		return retval, err
+	}
+	if retval, err := h.checkWritable(r); err != nil {
+		return retval, err
+	}
+	if h.isAsyncStatusRequest(r) {
+		return h.serveAsyncStatus(w, r)
+	}
+	if h.isFilenameCheckRequest(r) {
+		return h.serveFilenameCheck(w, r)
+	}
+	if h.EnableExistenceChecks && r.Method == http.MethodHead && r.Header.Get("Digest") != "" {
+		return h.serveExistenceCheck(w, r)
+	}
+	if h.isBlockChecksumsRequest(r) {
+		return h.serveBlockChecksums(w, r)
+	}
+	if h.isTransactionRequest(r) {
+		return h.serveTransaction(w, r)
+	}
+	if h.isSessionRequest(r) {
+		return h.serveSession(w, r)
+	}
+	if h.isVersionsRequest(r) {
+		return h.serveVersions(w, r)
+	}
+	if h.isProgressEventsRequest(r) {
+		return h.serveProgressEvents(w, r)
+	}
+	if h.isListingRequest(r) {
+		return h.serveListing(w, r)
+	}
+	if h.isMetadataRequest(r) {
+		return h.serveMetadata(w, r)
+	}
+	if h.isModerationRequest(r) {
+		return h.serveModeration(w, r)
+	}
+	if h.isScrubRequest(r) {
+		return h.serveScrub(w, r)
+	}
+	if h.isUploadFormRequest(r) {
+		return h.serveUploadForm(w, r)
+	}
+	if h.ServeDecrypted && h.isEncrypting() && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return h.serveDecrypted(w, r)
+	}
+
 	switch r.Method {
 	case http.MethodPost, http.MethodPut:
 		// nop; always permitted
-	case "COPY", "MOVE", "DELETE":
+	case http.MethodPatch:
+		// Blocks of encrypted files cannot be copied, those in quarantine are not to be,
+		// and new ones would not be transformed.
+		if h.EnableDeltaUploads && !h.isEncrypting() && !h.Quarantine && len(h.Transformers) == 0 {
+			break
+		}
+		return http.StatusMethodNotAllowed, nil
+	case "COPY", "MOVE", "DELETE", methodLink:
 		if h.EnableWebdav { // also allow any other methods
 			break
 		}
@@ -77,32 +192,114 @@ func (h *Handler) serveHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 			return http.StatusBadRequest, errNoDestination
 		}
 		return h.copy(r.Context(), destName, r.URL.Path, true)
+	case methodLink:
+		destName := r.Header.Get("Destination")
+		if len(r.URL.Path) < 2 || destName == "" {
+			return http.StatusBadRequest, errNoDestination
+		}
+		return h.link(r.Context(), destName, r.URL.Path)
 	case "DELETE":
+		if h.isBatchDelete(r) {
+			return h.serveBatchDelete(w, r)
+		}
 		if len(r.URL.Path) < 2 {
 			return http.StatusBadRequest, errNoDestination
 		}
 		return h.deleteOneFile(r.Context(), r.URL.Path)
-	case http.MethodPost:
-		ctype := r.Header.Get("Content-Type")
-		switch {
-		case strings.HasPrefix(ctype, "multipart/form-data"):
-			return h.serveMultipartUpload(w, r)
-		case ctype != "": // other envelope formats, not implemented
-			return http.StatusUnsupportedMediaType, errUnknownEnvelopeFormat
+	case http.MethodPost, http.MethodPut:
+		if slot, ok := h.slotFor(r); ok {
+			return h.serveSlotUpload(w, r, slot)
 		}
-		fallthrough
-	case http.MethodPut:
-		return h.serveOneUpload(w, r)
+		return h.serveUpload(w, r)
+	case http.MethodPatch:
+		return h.serveDeltaUpload(w, r)
 	default:
 		return http.StatusMethodNotAllowed, nil
 	}
 }
 
+// serveUpload handles HTTP POST and PUT.
+func (h *Handler) serveUpload(w http.ResponseWriter, r *http.Request) (int, error) {
+	ctype := r.Header.Get("Content-Type")
+	isEnveloped := r.Method == http.MethodPost && ctype != ""
+	if isEnveloped && !strings.HasPrefix(ctype, "multipart/form-data") {
+		// other envelope formats, not implemented
+		return http.StatusUnsupportedMediaType, errUnknownEnvelopeFormat
+	}
+	if isValidateOnly(r) {
+		return h.serveValidation(w, r, isEnveloped)
+	}
+
+	r = h.withProgressReports(w, r)
+	r, deadlines := h.withDeadlines(w, r)
+	if deadlines != nil {
+		defer deadlines.reset()
+	}
+
+	var (
+		retval int
+		err    error
+	)
+	r, finishProgress := h.trackProgress(r)
+	defer func() { finishProgress(retval) }()
+	if isEnveloped {
+		retval, err = h.serveMultipartUpload(w, r)
+	} else {
+		retval, err = h.serveOneUpload(w, r)
+	}
+	if retval == http.StatusCreated && h.SuccessStatus != 0 {
+		retval = h.SuccessStatus
+	}
+	if h.FinalNameInBody && retval >= 200 && retval <= 299 && retval != http.StatusNoContent {
+		if name := w.Header().Get(finalNameHeader); name != "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(retval)
+			io.WriteString(w, name+"\n")
+			return statusSent, nil
+		}
+	}
+
+	if deadlines != nil && deadlines.timedOut {
+		// Anything received has been discarded. The client is too slow for the rest, hence don't wait for it.
+		w.Header().Set("Connection", "close")
+		retval, err = http.StatusRequestTimeout, errUploadTimedOut
+	}
+	return retval, err
+}
+
 // serveOneUpload usually is used with HTTP PUT, and writes one file.
 func (h *Handler) serveOneUpload(w http.ResponseWriter, r *http.Request) (int, error) {
-	if len(r.URL.Path) < 2 {
+	urlPath, err := h.uploadPath(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(urlPath) < 2 {
 		return http.StatusBadRequest, errNoDestination
 	}
+	urlPath, metadata, err := h.withLanguage(urlPath, r.Header.Get("Content-Language"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	metadata = mergeMetadata(metadata, h.contentTypeMetadata(urlPath, r.Header.Get("Content-Type")))
+	storageClass, err := h.requestedStorageClass(r.Header.Get("X-Storage-Class"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	metadata = mergeMetadata(metadata, storageClass)
+	tags, err := h.requestedTags(r.Header)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	metadata = mergeMetadata(metadata, tags)
+	if strings.HasSuffix(urlPath, "/") { // Without a filename in header "Content-Disposition" either.
+		if !h.EnableWebdav || r.ContentLength != 0 {
+			return http.StatusConflict, errUploadToDirectory
+		}
+		return h.makeDirectory(urlPath)
+	}
+	if !matchesContentType(h.ContentTypes, r.Header.Get("Content-Type")) {
+		return http.StatusUnsupportedMediaType, errContentTypeRejected
+	}
 
 	// Select the limiter, transaction- or file size.
 	writeQuota, overQuotaErr := h.MaxTransactionSize, errTransactionTooLarge
@@ -120,24 +317,100 @@ func (h *Handler) serveOneUpload(w http.ResponseWriter, r *http.Request) (int, e
 		if writeQuota > 0 && expectBytes > writeQuota {
 			return http.StatusRequestEntityTooLarge, overQuotaErr // http.PayloadTooLarge
 		}
+		if h.isTooSmall(expectBytes) {
+			return http.StatusUnprocessableEntity, errFileTooSmall
+		}
+	}
+
+	r, digests := withDigestVerification(r)
+	defer digests.stop()
+
+	if h.AsyncPersist {
+		id, err := h.randomSuffix(24) // Before anything is written that needed to be discarded.
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		// The request's context ends with the response, but persisting must not.
+		bytesWritten, key, commit, retval, err := h.receiveOneHTTPBlob(context.Background(), urlPath, metadata, expectBytes, writeQuota, r.Body)
+		if writeQuota > 0 && bytesWritten > writeQuota {
+			return http.StatusRequestEntityTooLarge, overQuotaErr
+		}
+		if digests != nil && digests.err != nil {
+			return http.StatusUnprocessableEntity, digests.err
+		}
+		if commit == nil {
+			return retval, err
+		}
+		h.addFinalName(w, key)
+		return h.persistInBackground(w, r, id, key, commit)
 	}
 
-	bytesWritten, key, retval, err := h.writeOneHTTPBlob(r.Context(), r.URL.Path, expectBytes, writeQuota, r.Body)
+	body, sum := h.hashForReceipt(r.Body)
+	bytesWritten, key, retval, err := h.writeOneHTTPBlob(r.Context(), urlPath, metadata, expectBytes, writeQuota, body)
 	if writeQuota > 0 && bytesWritten > writeQuota {
 		// The partially uploaded file gets discarded by writeOneHTTPBlob.
 		return http.StatusRequestEntityTooLarge, overQuotaErr
 	}
+	if digests != nil && digests.err != nil {
+		return http.StatusUnprocessableEntity, digests.err // Has been discarded, too.
+	}
 
-	if err == nil && h.ApparentLocation != "" {
-		newApparentLocation := "/" + key
-		if h.ApparentLocation != "/" {
-			newApparentLocation = h.ApparentLocation + newApparentLocation
-		}
-		w.Header().Add("Location", newApparentLocation)
+	if err == nil {
+		h.addLocation(w, r, key)
+		h.addFinalName(w, key)
+	}
+	if err == nil && retval == http.StatusCreated {
+		h.addReceipt(w, key, bytesWritten, sum)
 	}
 	return retval, err
 }
 
+// isTooSmall is true for sizes below MinFilesize, and 0 with DenyEmptyFiles.
+func (h *Handler) isTooSmall(size int64) bool {
+	return size < h.MinFilesize || (size == 0 && h.DenyEmptyFiles)
+}
+
+// uploadPath is where a single file is to be written: the URL's path,
+// or if that ends in '/' the filename from header "Content-Disposition" in that directory.
+func (h *Handler) uploadPath(r *http.Request) (string, error) {
+	enc, err := h.filenameEncoding(r)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(r.URL.Path, "/") {
+		if name := dispositionFileName(r.Header.Get("Content-Disposition")); name != "" {
+			name, err = decodeFileName(name, enc)
+			return r.URL.Path + name, err
+		}
+	}
+
+	// The URL's percent-encoding has been undone already.
+	if enc == FilenamesInLatin1 || (enc == FilenamesAutoDetected && !utf8.ValidString(r.URL.Path)) {
+		return decodeFileName(r.URL.Path, FilenamesInLatin1)
+	}
+	return r.URL.Path, nil
+}
+
+// makeDirectory creates a directory as WebDAV's MKCOL would.
+// Buckets other than local directories have none but implicit ones, hence nothing is done for them.
+func (h *Handler) makeDirectory(urlPath string) (int, error) {
+	key, err := h.translateToKey(urlPath)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	if h.localDirectory == "" {
+		return http.StatusCreated, nil
+	}
+	err = os.MkdirAll(filepath.Join(h.localDirectory, filepath.FromSlash(key)), 0777)
+	switch {
+	case err == nil:
+		return http.StatusCreated, nil
+	case os.IsExist(err) || errors.Is(err, syscall.ENOTDIR): // A file is in the way.
+		return http.StatusConflict, errFileNameConflict
+	}
+	return http.StatusInternalServerError, errors.Wrap(err, "Creating the directory failed")
+}
+
 // serveMultipartUpload is used on HTTP POST to explode a MIME Multipart envelope
 // into one or more supplied files.
 func (h *Handler) serveMultipartUpload(w http.ResponseWriter, r *http.Request) (int, error) {
@@ -146,7 +419,34 @@ func (h *Handler) serveMultipartUpload(w http.ResponseWriter, r *http.Request) (
 		return http.StatusUnsupportedMediaType, errCannotReadMIMEMultipart
 	}
 
-	var bytesWrittenInTransaction int64
+	enc, err := h.filenameEncoding(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	requestTags, err := h.requestedTags(r.Header) // Apply to all parts.
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	var (
+		bytesWrittenInTransaction int64
+		outcomes                  []*partOutcome // In order of the parts.
+		fields                    = make(url.Values)
+	)
+
+	// Used if parts are persisted concurrently.
+	var (
+		pending     sync.WaitGroup
+		slots       chan struct{}
+		pendingKeys = make(map[string]struct{})
+	)
+	defer pending.Wait() // The request's context must outlive any writes.
+
+	// skipPart records that the part has failed, and is true if the remaining parts are to be processed still.
+	skipPart := func(partNum, retval int, err error) bool {
+		outcomes = append(outcomes, &partOutcome{partNum: partNum, retval: retval, err: err})
+		return h.skipsFailedPart(retval, err)
+	}
 
 	for partNum := 1; ; partNum++ {
 		part, err := mr.NextPart()
@@ -154,24 +454,82 @@ func (h *Handler) serveMultipartUpload(w http.ResponseWriter, r *http.Request) (
 			break
 		}
 		if err != nil {
+			pending.Wait()
 			return http.StatusBadRequest, err
 		}
 
-		fileName := part.FileName()
+		fileName := dispositionFileName(part.Header.Get("Content-Disposition"))
 		if fileName == "" {
+			if !h.isCapturingFormFields() || part.FormName() == "" {
+				continue
+			}
+			if err := readFormField(fields, part); err != nil {
+				retval := http.StatusBadRequest
+				if err == errFormFieldsTooLarge {
+					retval = http.StatusRequestEntityTooLarge
+				}
+				if skipPart(partNum, retval, err) {
+					continue
+				}
+				break
+			}
 			continue
 		}
-		// Part names are relative, and need the target directory still.
-		if h.Scope == "/" {
+		if fileName, err = decodeFileName(fileName, enc); err != nil {
+			if skipPart(partNum, http.StatusUnprocessableEntity, err) {
+				continue
+			}
+			break
+		}
+		if !matchesContentType(h.ContentTypes, part.Header.Get("Content-Type")) {
+			if skipPart(partNum, http.StatusUnsupportedMediaType, errContentTypeRejected) {
+				continue
+			}
+			break
+		}
+		fileName, metadata, err := h.withLanguage(fileName, part.Header.Get("Content-Language"))
+		if err != nil {
+			if skipPart(partNum, http.StatusBadRequest, err) {
+				continue
+			}
+			break
+		}
+		metadata = mergeMetadata(dispositionDates(part.Header.Get("Content-Disposition")), metadata)
+		metadata = mergeMetadata(metadata, h.contentTypeMetadata(fileName, part.Header.Get("Content-Type")))
+		storageClass, err := h.requestedStorageClass(part.Header.Get("X-Storage-Class"))
+		if err != nil {
+			if skipPart(partNum, http.StatusBadRequest, err) {
+				continue
+			}
+			break
+		}
+		metadata = mergeMetadata(metadata, storageClass)
+		tags, err := h.requestedTags(http.Header(part.Header))
+		if err != nil {
+			if skipPart(partNum, http.StatusBadRequest, err) {
+				continue
+			}
+			break
+		}
+		metadata = mergeMetadata(metadata, mergeMetadata(requestTags, tags))
+		// Part names are relative, and need the target directory still:
+		// the URL's path if that is one, like with single uploads.
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/"):
+			fileName = r.URL.Path + fileName
+		case h.Scope == "/":
 			fileName = h.Scope + fileName
-		} else {
+		default:
 			fileName = h.Scope + "/" + fileName
 		}
 
 		writeQuota, overQuotaErr := h.MaxFilesize, errFileTooLarge
 		if h.MaxTransactionSize > 0 {
 			if bytesWrittenInTransaction >= h.MaxTransactionSize {
-				return http.StatusRequestEntityTooLarge, errTransactionTooLarge
+				if skipPart(partNum, http.StatusRequestEntityTooLarge, errTransactionTooLarge) {
+					continue
+				}
+				break
 			}
 			if writeQuota == 0 || (h.MaxTransactionSize-bytesWrittenInTransaction) < writeQuota {
 				writeQuota, overQuotaErr = h.MaxTransactionSize-bytesWrittenInTransaction, errTransactionTooLarge
@@ -182,43 +540,119 @@ func (h *Handler) serveMultipartUpload(w http.ResponseWriter, r *http.Request) (
 		if part.Header.Get("Content-Length") != "" {
 			expectBytes, err = strconv.ParseInt(part.Header.Get("Content-Length"), 10, 64)
 			if err != nil || expectBytes < 0 {
-				return http.StatusBadRequest, errLengthInvalid
+				if skipPart(partNum, http.StatusBadRequest, errLengthInvalid) {
+					continue
+				}
+				break
 			}
 			if writeQuota > 0 && expectBytes > writeQuota {
-				return http.StatusRequestEntityTooLarge, overQuotaErr
+				if skipPart(partNum, http.StatusRequestEntityTooLarge, overQuotaErr) {
+					continue
+				}
+				break
 			}
 		}
 
-		bytesWritten, key, retval, err := h.writeOneHTTPBlob(r.Context(), fileName, expectBytes, writeQuota, part)
+		body, sum := h.hashForReceipt(part)
+		bytesWritten, key, commit, retval, err := h.receiveOneHTTPBlob(r.Context(), fileName, metadata,
+			expectBytes, writeQuota, body)
 		bytesWrittenInTransaction += bytesWritten
 		if writeQuota > 0 && bytesWritten > writeQuota {
-			return http.StatusRequestEntityTooLarge, overQuotaErr
+			if skipPart(partNum, http.StatusRequestEntityTooLarge, overQuotaErr) {
+				continue
+			}
+			break
 		}
 		if err != nil {
 			// Don't use the fileName here: it is controlled by the user.
-			return retval, errors.Wrap(err, "MIME Multipart exploding failed on part "+strconv.Itoa(partNum))
+			if skipPart(partNum, retval, err) {
+				continue
+			}
+			break
+		}
+		if commit == nil { // Has been discarded, such as for exceeding a quota.
+			continue
 		}
 
-		if h.ApparentLocation != "" {
-			newApparentLocation := "/" + key
-			if h.ApparentLocation != "/" {
-				newApparentLocation = h.ApparentLocation + newApparentLocation
+		o := &partOutcome{partNum: partNum, key: key, size: bytesWritten, sum: sum}
+		outcomes = append(outcomes, o)
+		if h.MaxConcurrentUploads > 1 {
+			if slots == nil {
+				slots = make(chan struct{}, h.MaxConcurrentUploads)
+			}
+			// Later parts overwrite earlier ones of the same name, hence must not overtake them.
+			if _, isPending := pendingKeys[key]; isPending {
+				pending.Wait()
+				pendingKeys = make(map[string]struct{})
 			}
-			w.Header().Add("Location", newApparentLocation)
-			// Yes, we send this even though the next part might throw an error.
+			pendingKeys[key] = struct{}{}
+
+			slots <- struct{}{}
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				o.retval, o.err = commit()
+				<-slots
+			}()
+			continue
 		}
+
+		if o.retval, o.err = commit(); o.err != nil && !h.skipsFailedPart(o.retval, o.err) {
+			break
+		}
+	}
+
+	pending.Wait()
+	return h.settleParts(w, r, outcomes, fields)
+}
+
+// addLocation sends a header "Location" for the given key if ApparentLocation or LocationFromRequest is set,
+// and with SendLinkHeaders headers "Link" for the file.
+func (h *Handler) addLocation(w http.ResponseWriter, r *http.Request, key string) {
+	location := h.fileLocation(r, key)
+	if location != "" {
+		w.Header().Add("Location", location)
+	}
+	if h.SendLinkHeaders {
+		h.addLinks(w, r, key, location)
 	}
+}
+
+// addFinalName sends the path the file has been written to in header "X-Final-Name",
+// if it differs from the requested one by a randomized suffix.
+func (h *Handler) addFinalName(w http.ResponseWriter, key string) {
+	if h.RandomizedSuffixLength > 0 {
+		w.Header().Set(finalNameHeader, h.urlPath(key))
+	}
+}
 
-	return http.StatusCreated, nil
+// fileLocation is where the file can be gotten back from, or "" if that's not known.
+func (h *Handler) fileLocation(r *http.Request, key string) string {
+	apparentLocation := h.ApparentLocation
+	if apparentLocation == "" {
+		if !h.LocationFromRequest {
+			return ""
+		}
+		return h.publicURL(r, h.urlPath(key)) // Where the client has uploaded it to.
+	}
+	newApparentLocation := "/" + key
+	if apparentLocation != "/" {
+		newApparentLocation = apparentLocation + newApparentLocation
+	}
+	return h.publicURL(r, newApparentLocation)
 }
 
+// reservedPrefixes are of keys in the Bucket that are kept by the Handler itself, and cannot be uploaded to.
+var reservedPrefixes = []string{corruptedPrefix, sessionPath[1:], versionsPrefix}
+
 // translateToKey derives a key suitable for use with Storage Buckets.
-func (h *Handler) translateToKey(path string) (key string, err error) {
-	if path == h.Scope {
+func (h *Handler) translateToKey(urlPath string) (key string, err error) {
+	if urlPath == h.Scope {
 		return "", os.ErrPermission
 	}
 	canary := "/" + printableSuffix(15)
-	key = filepath.Clean(canary + path) // "/var/mine/../mine/my.blob" → "/var/mine/my.blob"
+	// Keys are always separated by '/', hence no filepath.Clean which would use '\' on Windows.
+	key = path.Clean(canary + urlPath) // "/var/mine/../mine/my.blob" → "/var/mine/my.blob"
 	if !strings.HasPrefix(key, canary+h.Scope) {
 		err = os.ErrPermission
 		return
@@ -229,28 +663,96 @@ func (h *Handler) translateToKey(path string) (key string, err error) {
 		key = key[len(canary)+len(h.Scope)+1:] // "/upload/mine/my.blob" → "/mine/my.blob"
 	}
 
-	var enforceForm *norm.Form
-	if h.UnicodeForm != nil {
-		enforceForm = &h.UnicodeForm.Use
+	if err = h.checkFilenameRules(key); err != nil {
+		return
 	}
-	if !InAlphabet(key, h.RestrictFilenamesTo, enforceForm) {
-		err = errInvalidFileName
+	if h.KeyMapper != nil {
+		if key, err = h.mapKey(key); err != nil {
+			return
+		}
+	}
+	if h.Quarantine && strings.HasPrefix(key+"/", quarantinePrefix) {
+		err = os.ErrPermission
+		return
+	}
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(key+"/", prefix) {
+			err = os.ErrPermission
+			return
+		}
+	}
+	if h.tenant != "" {
+		key = h.tenant + "/" + key
+	}
+	if h.isPackingEnabled() && (key == h.packName() || key == h.packName()+".idx") {
+		err = os.ErrPermission
+		return
+	}
+	if h.localDirectory != "" {
+		err = noSymlinksBelow(h.localDirectory, key)
 	}
 	return
 }
 
-func (h *Handler) applyRandomizedSuffix(key string) string {
+// keyPrefix is translateToKey for paths of directories: it returns the prefix of all keys below it,
+// which is "" for the Scope itself unless there's a tenant.
+func (h *Handler) keyPrefix(urlPath string) (string, error) {
+	var prefix string
+	if strings.TrimSuffix(urlPath, "/") != strings.TrimSuffix(h.Scope, "/") {
+		key, err := h.translateToKey(urlPath)
+		if err != nil {
+			return "", err
+		}
+		prefix = key
+	} else if h.tenant != "" {
+		prefix = h.tenant
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix, nil
+}
+
+// noSymlinksBelow returns errSymlinkInPath if any existing component of the key,
+// interpreted relative to the directory, is a symbolic link.
+// Else an attacker could pre-create one to make us write (or copy from) outside of it.
+//
+// This leaves a window between this check and using the key,
+// and thus only closes the gap as far as the portable standard library allows.
+func noSymlinksBelow(directory, key string) error {
+	p := directory
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" {
+			continue
+		}
+		p = filepath.Join(p, segment)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil // Does not exist (yet), hence neither do any components below.
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return errSymlinkInPath
+		}
+	}
+	return nil
+}
+
+func (h *Handler) applyRandomizedSuffix(key string) (string, error) {
 	if h.RandomizedSuffixLength <= 0 {
-		return key
+		return key, nil
 	}
-	extension := filepath.Ext(key)
+	suffix, err := h.randomSuffix(h.RandomizedSuffixLength)
+	if err != nil {
+		return "", err
+	}
+	extension := path.Ext(key)
 	basename := strings.TrimSuffix(key, extension)
 	if basename == "" || strings.HasSuffix(basename, "/") {
-		key = basename + printableSuffix(h.RandomizedSuffixLength) + extension
+		key = basename + suffix + extension
 	} else {
-		key = basename + "_" + printableSuffix(h.RandomizedSuffixLength) + extension
+		key = basename + "_" + suffix + extension
 	}
-	return key
+	return key, nil
 }
 
 // copy is meant to respond to HTTP COPY by duplicating a file,
@@ -272,7 +774,13 @@ func (h *Handler) copy(ctx context.Context, newPath, oldPath string, deleteSourc
 	if srcKey == dstKey {
 		return http.StatusForbidden, nil
 	}
+	if (deleteSource && h.isProtected(srcKey)) || h.isProtected(dstKey) {
+		return http.StatusForbidden, errProtected
+	}
 
+	if err := h.keepVersion(ctx, dstKey); err != nil {
+		return http.StatusInternalServerError, err
+	}
 	if err := h.Bucket.Copy(ctx, dstKey, srcKey, nil); err != nil {
 		// Because gcerr is an internal package.
 		gcerr, _ := err.(interface{ Unwrap() error })
@@ -287,11 +795,13 @@ func (h *Handler) copy(ctx context.Context, newPath, oldPath string, deleteSourc
 		}
 	}
 	if !deleteSource {
+		h.updateChecksums(ctx, dstKey)
 		return http.StatusCreated, nil // 201, but if something gets overwritten 204
 	}
 	if err := h.Bucket.Delete(ctx, srcKey); err != nil {
 		return http.StatusInternalServerError, errors.Wrap(err, "MOVE failed")
 	}
+	h.updateChecksums(ctx, dstKey, srcKey)
 	return http.StatusCreated, nil // 201, but if something gets overwritten 204
 }
 
@@ -307,10 +817,14 @@ func (h *Handler) deleteOneFile(ctx context.Context, path string) (int, error) {
 	if key == "" || key == "/" {
 		return http.StatusForbidden, errors.Wrap(err, "DELETE has tried removing the parent directory")
 	}
+	if h.isProtected(key) {
+		return http.StatusForbidden, errProtected
+	}
 
 	err = h.Bucket.Delete(ctx, key)
 	switch err {
 	case nil:
+		h.updateChecksums(ctx, key)
 		return http.StatusNoContent, nil // 204
 	case os.ErrPermission:
 		return http.StatusForbidden, errors.Wrap(err, "DELETE failed")
@@ -322,43 +836,239 @@ func (h *Handler) deleteOneFile(ctx context.Context, path string) (int, error) {
 // writes one file to disk.
 //
 // Returns |bytesWritten|, |locationOnDisk|, |suggestHTTPResponseCode|, error.
-func (h *Handler) writeOneHTTPBlob(ctx context.Context, path string,
+func (h *Handler) writeOneHTTPBlob(ctx context.Context, path string, metadata map[string]string,
 	expectBytes, writeQuota int64, r io.Reader) (int64, string, int, error) {
+	bytesWritten, locationOnDisk, commit, retval, err := h.receiveOneHTTPBlob(ctx, path, metadata, expectBytes, writeQuota, r)
+	if commit == nil {
+		return bytesWritten, locationOnDisk, retval, err
+	}
+	retval, err = commit()
+	return bytesWritten, locationOnDisk, retval, err
+}
+
+// receiveOneHTTPBlob is the first half of writeOneHTTPBlob: it receives the file's contents.
+// If that went well, the returned function will persist the file ("commit"),
+// and it must be called exactly once. The file will have the given metadata, if any.
+//
+// Returns |bytesWritten|, |locationOnDisk|, commit, |suggestHTTPResponseCode|, error.
+func (h *Handler) receiveOneHTTPBlob(ctx context.Context, path string, metadata map[string]string,
+	expectBytes, writeQuota int64, r io.Reader) (int64, string, func() (int, error), int, error) {
 	locationOnDisk, err := h.translateToKey(path)
 	if err != nil {
-		return 0, "", http.StatusUnprocessableEntity, err // 422: unprocessable entity
+		return 0, "", nil, http.StatusUnprocessableEntity, err // 422: unprocessable entity
+	}
+	if h.isReadOnly(locationOnDisk) {
+		return 0, "", nil, http.StatusForbidden, errReadOnly
+	}
+	requestedKey := locationOnDisk
+	if locationOnDisk, err = h.applyRandomizedSuffix(locationOnDisk); err != nil {
+		return 0, "", nil, http.StatusInternalServerError, err
 	}
-	locationOnDisk = h.applyRandomizedSuffix(locationOnDisk)
 
-	ctx, cancelWrite := context.WithCancel(ctx)
-	blob, err := h.Bucket.NewWriter(ctx, locationOnDisk, nil)
-	defer cancelWrite()
+	unlock, retval, err := h.lockKey(ctx, locationOnDisk)
 	if err != nil {
-		return 0, locationOnDisk, http.StatusInternalServerError, err
+		return 0, locationOnDisk, nil, retval, err
+	}
+	bytesWritten, commit, retval, err := h.receiveIntoKey(ctx, requestedKey, locationOnDisk, metadata, expectBytes, writeQuota, r)
+	if commit == nil {
+		unlock()
+		return bytesWritten, locationOnDisk, nil, retval, err
+	}
+	// The lock is held until the file has been persisted.
+	return bytesWritten, locationOnDisk, func() (int, error) {
+		defer unlock()
+		return commit()
+	}, retval, err
+}
+
+// receiveIntoKey is receiveOneHTTPBlob for a key that has been derived and locked already.
+// requestedKey is the one before RandomizedSuffixLength has been applied, which clients know.
+func (h *Handler) receiveIntoKey(ctx context.Context, requestedKey, locationOnDisk string, metadata map[string]string,
+	expectBytes, writeQuota int64, r io.Reader) (int64, func() (int, error), int, error) {
+	var err error
+	body := &abortDetector{r: r}
+	r = body
+	verdict := func() (int, error) { return 0, nil }
+	if h.Scanner != nil {
+		var stopScanning func()
+		r, verdict, stopScanning = h.scanAlongside(ctx, locationOnDisk, r)
+		defer stopScanning()
 	}
-	bytesWritten, err := io.Copy(blob, r)
+	if len(h.RequireOpenPGPTo) > 0 {
+		var retval int
+		if r, retval, err = h.requireOpenPGP(r); err != nil {
+			return 0, nil, retval, err
+		}
+	}
+
+	if h.isAppending() {
+		return h.receiveForAppending(ctx, locationOnDisk, expectBytes, writeQuota, r, verdict)
+	}
+	if h.isPackingEnabled() {
+		small, rest, err := h.peekSmall(r)
+		if err != nil {
+			return 0, nil, http.StatusBadRequest, err
+		}
+		if rest == nil {
+			bytesWritten := int64(len(small))
+			switch {
+			case writeQuota > 0 && bytesWritten > writeQuota:
+				return bytesWritten, nil, http.StatusRequestEntityTooLarge, nil
+			case expectBytes > 0 && bytesWritten != expectBytes:
+				return bytesWritten, nil, http.StatusUnprocessableEntity, errSizeMismatch
+			case h.isTooSmall(bytesWritten):
+				return bytesWritten, nil, http.StatusUnprocessableEntity, errFileTooSmall
+			}
+			if retval, err := verdict(); err != nil {
+				return bytesWritten, nil, retval, err
+			}
+			commit := func() (int, error) { return h.appendToPack(locationOnDisk, small) }
+			return bytesWritten, commit, http.StatusCreated, nil
+		}
+		r = rest
+	}
+
+	metadata = h.withStorageClass(locationOnDisk, metadata, expectBytes)
+	sinkKey := locationOnDisk
+	if h.Quarantine {
+		sinkKey = quarantineKey(locationOnDisk)
+	}
+	sink, discard, persist, err := h.newStoredSink(ctx, sinkKey, metadata, expectBytes)
+	if err != nil {
+		return 0, nil, http.StatusInternalServerError, err
+	}
+	finishTransforms := func() (int, error) { return 0, nil }
+	if len(h.Transformers) > 0 {
+		var stopTransforms func()
+		sink, finishTransforms, stopTransforms = h.transformSink(locationOnDisk, sink)
+		defer stopTransforms()
+	}
+	var keepPartial func() error
+	if h.isKeepingPartialUploads() {
+		partial, discardPartial, keep, err := h.newPartialSink(requestedKey, locationOnDisk)
+		if err != nil {
+			discard()
+			return 0, nil, http.StatusInternalServerError, err
+		}
+		defer discardPartial()
+		r, keepPartial = io.TeeReader(r, partial), keep
+	}
+	if writeQuota > 0 { // Read no more than necessary to tell that the quota has been exceeded.
+		r = io.LimitReader(r, writeQuota+1)
+	}
+	buf := getCopyBuffer(h.copyBufferSize())
+	defer putCopyBuffer(buf)
+	// Hides blob.Writer.ReadFrom, which would copy in chunks of 1 KiB.
+	bytesWritten, err := io.CopyBuffer(struct{ io.Writer }{sink}, r, *buf)
 	if err != nil && err != io.EOF {
-		cancelWrite() // Discards the file.
-		blob.Close()
-		if bytesWritten > 0 && bytesWritten < expectBytes {
-			return bytesWritten, locationOnDisk, http.StatusInsufficientStorage, err // 507: insufficient storage
+		discard()
+		if isOutOfSpace(err) {
+			return bytesWritten, nil, http.StatusInsufficientStorage, errInsufficientStorage // 507: insufficient storage
 		}
-		return bytesWritten, locationOnDisk, http.StatusInternalServerError, err
+		if body.isAborted() {
+			if keepPartial != nil {
+				if err := keepPartial(); err != nil {
+					return bytesWritten, nil, http.StatusInternalServerError, errors.Wrap(err, "Keeping the partial upload failed")
+				}
+			}
+			return bytesWritten, nil, http.StatusBadRequest, errUploadAborted
+		}
+		return bytesWritten, nil, http.StatusInternalServerError, err
+	}
+	if writeQuota > 0 && bytesWritten > writeQuota {
+		discard()
+		return bytesWritten, nil, http.StatusRequestEntityTooLarge, nil
 	}
 	if expectBytes > 0 && bytesWritten != expectBytes {
-		cancelWrite()
-		blob.Close()
-		return bytesWritten, locationOnDisk, http.StatusUnprocessableEntity, nil
+		discard()
+		return bytesWritten, nil, http.StatusUnprocessableEntity, errSizeMismatch
+	}
+	if h.isTooSmall(bytesWritten) {
+		discard()
+		return bytesWritten, nil, http.StatusUnprocessableEntity, errFileTooSmall
+	}
+	if retval, err := finishTransforms(); err != nil {
+		discard()
+		return bytesWritten, nil, retval, err
+	}
+	if retval, err := verdict(); err != nil {
+		discard()
+		return bytesWritten, nil, retval, err
 	}
 
-	if err := blob.Close(); err != nil {
-		gcerr, _ := err.(interface{ Unwrap() error })
-		switch e := gcerr.Unwrap().(type) {
-		case *os.LinkError, *os.PathError:
-			return bytesWritten, locationOnDisk, http.StatusConflict, e
-		default:
-			return bytesWritten, locationOnDisk, http.StatusInternalServerError, err
+	commit := func() (int, error) {
+		if h.Quarantine {
+			if err := persist(); err != nil {
+				return http.StatusInternalServerError, err
+			}
+			return http.StatusAccepted, nil // 202: Awaits approval.
+		}
+		if err := h.keepVersion(ctx, locationOnDisk); err != nil {
+			discard()
+			return http.StatusInternalServerError, err
+		}
+		if err := persist(); err != nil {
+			// Because gcerr is an internal package.
+			if gcerr, ok := err.(interface{ Unwrap() error }); ok {
+				switch e := gcerr.Unwrap().(type) {
+				case *os.LinkError, *os.PathError:
+					return http.StatusConflict, e
+				}
+			}
+			return http.StatusInternalServerError, err
 		}
+		h.applyModificationDate(locationOnDisk, metadata)
+		h.postProcess(ctx, locationOnDisk)
+		h.updateChecksums(ctx, h.withDerivedFiles(ctx, locationOnDisk)...)
+		return http.StatusCreated, nil // 201: Created
+	}
+	return bytesWritten, commit, http.StatusCreated, nil
+}
+
+// newStoredSink returns a writer for a file as it's to be stored under the given key:
+// through a file in SpoolDirectory if that is set, and encrypted if isEncrypting.
+// Either discard or persist must be called exactly once.
+func (h *Handler) newStoredSink(ctx context.Context, key string, metadata map[string]string, sizeHint int64) (w io.Writer, discard, persist func() error, err error) {
+	var fileKey []byte
+	if h.isEncrypting() {
+		var keyMetadata map[string]string
+		if fileKey, keyMetadata, err = h.newFileKey(ctx); err != nil {
+			return nil, nil, nil, err
+		}
+		metadata = mergeMetadata(metadata, keyMetadata)
+	}
+	if h.SpoolDirectory != "" {
+		w, discard, persist, err = h.newSpoolSink(ctx, key, metadata)
+	} else {
+		w, discard, persist, err = h.newBlobSink(ctx, key, metadata, sizeHint)
+	}
+	if err != nil || !h.isEncrypting() {
+		return
+	}
+	if w, persist, err = h.encryptSink(fileKey, w, discard, persist); err != nil {
+		discard()
+		return nil, nil, nil, err
+	}
+	return w, discard, persist, nil
+}
+
+// newBlobSink returns a writer into the Bucket under the given key, which will have the given metadata.
+// sizeHint is the expected size, or 0 if unknown.
+// Either discard or persist must be called exactly once.
+func (h *Handler) newBlobSink(ctx context.Context, key string, metadata map[string]string, sizeHint int64) (w io.Writer, discard, persist func() error, err error) {
+	ctx, cancelWrite := context.WithCancel(ctx)
+	blob, err := h.Bucket.NewWriter(ctx, key, h.writerOptions(metadata, sizeHint))
+	if err != nil {
+		cancelWrite()
+		return nil, nil, nil, err
+	}
+	discard = func() error {
+		cancelWrite() // Discards the file.
+		return blob.Close()
+	}
+	persist = func() error {
+		defer cancelWrite()
+		return blob.Close()
 	}
-	return bytesWritten, locationOnDisk, http.StatusCreated, nil // 201: Created
+	return blob, discard, persist, nil
 }
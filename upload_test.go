@@ -6,19 +6,24 @@ package upload
 import (
 	"bytes"
 	"crypto/rand"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 	"unicode"
 
 	. "github.com/smartystreets/goconvey/convey"
+
+	"blitznote.com/src/http.upload/v5/filename"
 )
 
 var (
@@ -273,6 +278,181 @@ func TestUpload_ServeHTTP(t *testing.T) {
 		})
 	})
 
+	Convey("Filenames in header Content-Disposition", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName+"€"))
+
+		Convey("are used for PUT to a directory, decoded from filename*", func() {
+			req := httptest.NewRequest("PUT", "/", strings.NewReader("DELME"))
+			req.Header.Set("Content-Disposition", "attachment; filename*=UTF-8''"+tempFName+"%E2%82%AC")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName+"€"), []byte("DELME"))
+		})
+
+		Convey("are decoded from filename* in parts of MIME Multipart envelopes", func() {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Disposition", `form-data; name="A"; filename="x"; filename*=utf-8''`+tempFName+"%E2%82%AC")
+			p, _ := writer.CreatePart(header)
+			p.Write([]byte("DELME"))
+			writer.Close()
+
+			req := httptest.NewRequest("POST", "/", body)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName+"€"), []byte("DELME"))
+		})
+
+		Convey("are subject to the same checks as any other", func() {
+			h.RestrictFilenamesTo = []*unicode.RangeTable{unicode.Latin}
+			req := httptest.NewRequest("PUT", "/", strings.NewReader("DELME"))
+			req.Header.Set("Content-Disposition", "attachment; filename*=UTF-8''"+tempFName+"%E2%82%AC")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 422)
+		})
+	})
+
+	Convey("Filenames of legacy clients", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName+"é"))
+		put := func(path, encoding string) int {
+			req := httptest.NewRequest("PUT", path, strings.NewReader("DELME"))
+			req.Header.Set("X-Filename-Encoding", encoding)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("are decoded by header X-Filename-Encoding", func() {
+			So(put("/"+tempFName+"%E9", "latin1"), ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName+"é"), []byte("DELME"))
+		})
+
+		Convey("are decoded by FilenameEncoding", func() {
+			h.FilenameEncoding = FilenamesAutoDetected
+			So(put("/"+tempFName+"%E9", ""), ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName+"é"), []byte("DELME"))
+		})
+
+		Convey("are rejected with unknown encodings", func() {
+			So(put("/"+tempFName, "ebcdic"), ShouldEqual, 400)
+		})
+	})
+
+	Convey("PUT to a path that ends in '/'", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		put := func(body string) int {
+			req := httptest.NewRequest("PUT", "/"+tempFName+"/", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("is rejected with 409 (Conflict)", func() {
+			So(put("DELME"), ShouldEqual, 409)
+			So(put(""), ShouldEqual, 409)
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("creates a directory with WebDAV enabled", func() {
+			h.EnableWebdav = true
+			So(put(""), ShouldEqual, 201)
+			fi, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(err, ShouldBeNil)
+			So(fi.IsDir(), ShouldBeTrue)
+
+			So(put(""), ShouldEqual, 201) // Again.
+			So(put("DELME"), ShouldEqual, 409)
+		})
+
+		Convey("conflicts with a file of that name with WebDAV enabled", func() {
+			h.EnableWebdav = true
+			ioutil.WriteFile(filepath.Join(scratchDir, tempFName), []byte("DELME"), 0644)
+			So(put(""), ShouldEqual, 409)
+		})
+	})
+
+	Convey("Uploading files with names unsafe on Windows", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+
+		for _, name := range [...]string{"/nul.txt", "/LPT1/file", "/file.txt:stream", "/c:/file", "/dir\\file", "/name."} {
+			req, err := http.NewRequest("PUT", name, strings.NewReader("DELME"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Length", "5")
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+			ioutil.ReadAll(resp.Body)
+			So(resp.StatusCode, ShouldEqual, 422)
+		}
+	})
+
+	Convey("Symbolic links in the destination", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.EnableWebdav = true
+
+		outside, err := ioutil.TempDir("", "http-upload-test-outside")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(outside)
+		linkName := tempFileName()
+		if err := os.Symlink(outside, filepath.Join(scratchDir, linkName)); err != nil {
+			t.Skip("Cannot create symlinks here:", err)
+		}
+		defer os.Remove(filepath.Join(scratchDir, linkName))
+
+		Convey("are not followed on uploads", func() {
+			req, err := http.NewRequest("PUT", "/"+linkName+"/escaped", strings.NewReader("DELME"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Length", "5")
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+			ioutil.ReadAll(resp.Body)
+			So(resp.StatusCode, ShouldEqual, 422)
+
+			_, err = os.Stat(filepath.Join(outside, "escaped"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("are not followed by COPY", func() {
+			ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("DELME"), 0600)
+			copyFName := tempFileName()
+			req, _ := http.NewRequest("COPY", "/"+linkName+"/secret", nil)
+			req.Header.Set("Destination", "/"+copyFName)
+			defer func() {
+				os.Remove(filepath.Join(scratchDir, copyFName))
+			}()
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+			ioutil.ReadAll(resp.Body)
+			So(resp.StatusCode, ShouldEqual, 422)
+		})
+	})
+
 	Convey("Uploading files using POST", t, func() {
 		h := trivialConfig
 
@@ -340,19 +520,17 @@ func TestUpload_ServeHTTP(t *testing.T) {
 			body := &bytes.Buffer{}
 			writer := multipart.NewWriter(body)
 			p, _ := writer.CreateFormFile("A", tempFName)
-			p.Write([]byte("REMOVEME"))
-			p, _ = writer.CreateFormFile("B", "foo/"+tempFName) // '/' is always the separator.
 			p.Write([]byte("DELME"))
 			writer.Close()
 			// END
 
-			req, err := http.NewRequest("POST", "/", body)
+			req, err := http.NewRequest("POST", "/foo/", body)
 			req.Header.Set("Content-Type", writer.FormDataContentType())
 			if err != nil {
 				t.Fatal(err)
 			}
 			defer func() {
-				os.Remove(filepath.Join(scratchDir, tempFName))
+				os.Remove(filepath.Join(scratchDir, "foo", tempFName))
 			}()
 
 			w := httptest.NewRecorder()
@@ -365,6 +543,27 @@ func TestUpload_ServeHTTP(t *testing.T) {
 			compareContents(filepath.Join(scratchDir, "foo", tempFName), []byte("DELME"))
 		})
 
+		Convey("strips directories from filenames, as browsers do", func() {
+			tempFName := tempFileName()
+
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			p, _ := writer.CreateFormFile("A", "../bar/"+tempFName)
+			p.Write([]byte("DELME"))
+			writer.Close()
+
+			req := httptest.NewRequest("POST", "/foo/", body)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			defer os.Remove(filepath.Join(scratchDir, "foo", tempFName))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, "foo", tempFName), []byte("DELME"))
+			_, err := os.Stat(filepath.Join(scratchDir, "bar", tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
 		Convey("succeeds if two files have the same name (overwriting within the same transaction)", func() {
 			tempFName := tempFileName()
 
@@ -418,6 +617,96 @@ func TestUpload_ServeHTTP(t *testing.T) {
 		})
 	})
 
+	Convey("Persisting parts concurrently", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.ApparentLocation = "/"
+		h.MaxConcurrentUploads = 3
+
+		Convey("keeps the order of parts", func() {
+			names := make([]string, 8)
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			for i := range names {
+				names[i] = tempFileName()
+				p, _ := writer.CreateFormFile("A", names[i])
+				p.Write([]byte(names[i]))
+			}
+			// Same name again, which must overwrite the first.
+			p, _ := writer.CreateFormFile("B", names[0])
+			p.Write([]byte("DELME"))
+			writer.Close()
+
+			req, err := http.NewRequest("POST", "/", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			defer func() {
+				for _, name := range names {
+					os.Remove(filepath.Join(scratchDir, name))
+				}
+			}()
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+			ioutil.ReadAll(resp.Body)
+
+			So(resp.StatusCode, ShouldEqual, 201)
+			locations := resp.Header.Values("Location")
+			So(locations, ShouldHaveLength, len(names)+1)
+			for i, name := range names {
+				So(locations[i], ShouldEqual, "/"+name)
+			}
+			compareContents(filepath.Join(scratchDir, names[0]), []byte("DELME"))
+			compareContents(filepath.Join(scratchDir, names[7]), []byte(names[7]))
+		})
+	})
+
+	Convey("Persisting in the background", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.ApparentLocation = "/"
+		h.AsyncPersist = true
+
+		Convey("responds with 202 and a status URL that eventually reports the outcome", func() {
+			tempFName := tempFileName()
+			req, err := http.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				os.Remove(filepath.Join(scratchDir, tempFName))
+			}()
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+			So(resp.StatusCode, ShouldEqual, 202)
+			statusURL := resp.Header.Get("Location")
+			So(statusURL, ShouldStartWith, "/.upload-status/")
+
+			for i := 0; i < 100; i++ {
+				req, _ = http.NewRequest("GET", statusURL, nil)
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				if w.Code != 202 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(w.Code, ShouldEqual, 201)
+			So(w.Result().Header.Get("Location"), ShouldEqual, "/"+tempFName)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("DELME"))
+		})
+
+		Convey("answers 404 for unknown IDs", func() {
+			req, _ := http.NewRequest("GET", "/.upload-status/nonexistent", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 404)
+		})
+	})
+
 	Convey("A random suffix", t, func() {
 		h, _ := NewHandler("/", scratchDir, next)
 		h.ApparentLocation = "/"
@@ -490,6 +779,78 @@ func TestUpload_ServeHTTP(t *testing.T) {
 			So(uploadedAs, ShouldEndWith, ".ext")
 			So(len(uploadedAs), ShouldEqual, 1+3+len(".ext")) // /XXX.ext
 		})
+
+		Convey("is reproducible with a given source of randomness", func() {
+			h.Rand = bytes.NewReader([]byte{0, 1, 10})
+			req, _ := http.NewRequest("PUT", "/name.ext", strings.NewReader("REMOVEME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			defer os.Remove(filepath.Join(scratchDir, "name_01a.ext"))
+			So(w.Code, ShouldEqual, 201)
+			So(w.Header().Get("Location"), ShouldEqual, "/name_01a.ext")
+		})
+
+		Convey("fails the upload if the source of randomness does", func() {
+			h.Rand = bytes.NewReader([]byte{0})
+			req, _ := http.NewRequest("PUT", "/name.ext", strings.NewReader("REMOVEME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 500)
+			_, err := os.Stat(filepath.Join(scratchDir, "name_.ext"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("is disclosed in header X-Final-Name even without ApparentLocation", func() {
+			h.ApparentLocation = ""
+			req, _ := http.NewRequest("PUT", "/name.ext", strings.NewReader("REMOVEME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+			So(w.Header().Get("Location"), ShouldBeBlank)
+
+			finalName := w.Header().Get(finalNameHeader)
+			defer os.Remove(filepath.Join(scratchDir, finalName))
+			So(finalName, ShouldStartWith, "/name_")
+			So(finalName, ShouldEndWith, ".ext")
+			So(w.Body.String(), ShouldBeBlank)
+
+			Convey("and in the body with FinalNameInBody", func() {
+				h.FinalNameInBody = true
+				req, _ := http.NewRequest("PUT", "/name.ext", strings.NewReader("REMOVEME"))
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 201)
+				finalName := w.Header().Get(finalNameHeader)
+				defer os.Remove(filepath.Join(scratchDir, finalName))
+				So(w.Body.String(), ShouldEqual, finalName+"\n")
+			})
+		})
+	})
+
+	Convey("A FilenameProfile", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.FilenameProfile = filename.PosixPortable
+
+		Convey("rejects paths that break its rules, and tells which", func() {
+			req, _ := http.NewRequest("PUT", "/-rf", strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 422)
+			So(w.Body.String(), ShouldContainSubstring, string(filename.RuleLeadingHyphen))
+		})
+	})
+
+	Convey("RejectSpoofedFilenames", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.RejectSpoofedFilenames = true
+
+		Convey("rejects names that disguise what they are", func() {
+			req, _ := http.NewRequest("PUT", "/invoice%E2%80%AEfdp.exe", strings.NewReader("DELME"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 422)
+			So(w.Body.String(), ShouldContainSubstring, string(filename.RuleSpoofing))
+		})
 	})
 
 	Convey("Handling of conflicts includes", t, func() {
@@ -681,6 +1042,72 @@ func TestUpload_ServeHTTP(t *testing.T) {
 		})
 	})
 
+	Convey("With ContentTypes", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.ContentTypes = []string{"image/*"}
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+
+		Convey("uploads of other types are rejected with 415", func() {
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			req.Header.Set("Content-Type", "text/plain")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 415)
+
+			req = httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 415)
+		})
+
+		Convey("uploads of those types are accepted", func() {
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader("DELME"))
+			req.Header.Set("Content-Type", "image/png")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 201)
+		})
+	})
+
+	Convey("Files that are too small", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		put := func(body string, withLength bool) int {
+			req := httptest.NewRequest("PUT", "/"+tempFName, strings.NewReader(body))
+			if !withLength {
+				req.ContentLength = -1
+				req.Header.Del("Content-Length")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Convey("are rejected below MinFilesize", func() {
+			h.MinFilesize = 6
+			So(put("DELME", true), ShouldEqual, 422)
+			So(put("DELME", false), ShouldEqual, 422)
+			So(put("REMOVE", false), ShouldEqual, 201)
+		})
+
+		Convey("are rejected if empty with DenyEmptyFiles", func() {
+			So(put("", false), ShouldEqual, 201)
+			h.DenyEmptyFiles = true
+			So(put("", false), ShouldEqual, 422)
+			So(put("", true), ShouldEqual, 422)
+			So(put("DELME", false), ShouldEqual, 201)
+		})
+
+		Convey("leave nothing behind", func() {
+			h.MinFilesize = 6
+			So(put("DELME", false), ShouldEqual, 422)
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+
 	Convey("Cap", t, func() {
 		h := sizeLimited
 
@@ -733,7 +1160,7 @@ func TestUpload_ServeHTTP(t *testing.T) {
 					headerOnlyBody := `--wall
 Content-Disposition: form-data; name="fine"; filename="` + tempFName + `"
 Content-Type: application/octet-stream
-Content-Length: 1234
+Content-Length: 0017
 
 Winter is coming.
 --wall--
@@ -755,7 +1182,7 @@ Winter is coming.
 					ioutil.ReadAll(resp.Body)
 					So(resp.StatusCode, ShouldBeIn, 201, 202)
 
-					headerOnlyBody = strings.Replace(headerOnlyBody, "1234", "64001", 1)
+					headerOnlyBody = strings.Replace(headerOnlyBody, "0017", "64001", 1)
 					req, _ = http.NewRequest("POST", "/"+limitedBy+"/", strings.NewReader(headerOnlyBody))
 					req.Header.Set("Content-Type", ctype)
 					w = httptest.NewRecorder()
@@ -825,6 +1252,120 @@ Winter is coming.
 	})
 }
 
+// untouchableBody records whether anything has been read from it.
+type untouchableBody struct {
+	touched bool
+}
+
+func (b *untouchableBody) Read(p []byte) (int, error) {
+	b.touched = true
+	return 0, io.EOF
+}
+
+func (b *untouchableBody) Close() error { return nil }
+
+func TestUpload_ExpectContinue(t *testing.T) {
+	Convey("Requests that can be rejected by their headers", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.MaxFilesize = 64000
+		azOnly := unicode.RangeTable{
+			R16: []unicode.Range16{
+				{0x002f, 0x002f, 1},
+				{0x0061, 0x007a, 1},
+			},
+			LatinOffset: 1,
+		}
+		h.RestrictFilenamesTo = []*unicode.RangeTable{&azOnly}
+
+		samples := []struct {
+			method, path, ctype, length string
+			expected                    int
+		}{
+			{"PUT", "/toolarge", "", "64001", 413},
+			{"PUT", "/0invalid", "", "5", 422},
+			{"PUT", "/", "", "5", 400},
+			{"POST", "/unknownenvelope", "chunks-of/base64", "5", 415},
+			{"POST", "/", "multipart/form-data", "5", 415}, // Lacks a boundary.
+			{"DELETE", "/notenabled", "", "5", 418}, // Not enabled, hence passed on to next.
+		}
+
+		for _, sample := range samples {
+			Convey("are rejected before the body is read, such as "+sample.method+" "+sample.path, func() {
+				body := &untouchableBody{}
+				req := httptest.NewRequest(sample.method, sample.path, nil)
+				req.Body = body
+				req.Header.Set("Expect", "100-continue")
+				req.Header.Set("Content-Length", sample.length)
+				if sample.ctype != "" {
+					req.Header.Set("Content-Type", sample.ctype)
+				}
+
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, sample.expected)
+				So(body.touched, ShouldBeFalse)
+			})
+		}
+	})
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestUpload_LimitExceededMidStream(t *testing.T) {
+	Convey("Exceeding a limit while the body is being read", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.MaxFilesize = 64000
+
+		Convey("stops reading, discards the file, and closes the connection", func() {
+			tempFName := tempFileName()
+			body := &countingReader{r: strings.NewReader(strings.Repeat("\x33", 4*64000))}
+			req := httptest.NewRequest("PUT", "/"+tempFName, body)
+			req.ContentLength = -1
+			defer func() {
+				os.Remove(filepath.Join(scratchDir, tempFName))
+			}()
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+			ioutil.ReadAll(resp.Body)
+
+			So(resp.StatusCode, ShouldEqual, 413)
+			So(resp.Header.Get("Connection"), ShouldEqual, "close")
+			So(body.n, ShouldBeLessThan, 2*64000)
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("keeps the connection given a sufficient DrainAllowance", func() {
+			h.DrainAllowance = 4 * 64000
+			tempFName := tempFileName()
+			body := &countingReader{r: strings.NewReader(strings.Repeat("\x33", 64001))}
+			req := httptest.NewRequest("PUT", "/"+tempFName, body)
+			req.ContentLength = -1
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+			ioutil.ReadAll(resp.Body)
+
+			So(resp.StatusCode, ShouldEqual, 413)
+			So(resp.Header.Get("Connection"), ShouldBeBlank)
+			So(body.n, ShouldEqual, 64001)
+		})
+	})
+}
+
 // payloadWithAttachments is a helper function to test MIME multipart uploads of different sizes.
 func payloadWithAttachments(tempFName string, lengths ...int) (*bytes.Buffer, string) {
 	body := &bytes.Buffer{}
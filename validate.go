@@ -0,0 +1,87 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isValidateOnly is true for uploads with header "X-Validate-Only: 1",
+// which are to be checked, but not carried out.
+func isValidateOnly(r *http.Request) bool {
+	v := r.Header.Get("X-Validate-Only")
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// serveValidation answers an upload with the status it would get for anything that can be told
+// without its body, which is not read. That's 204 (No Content) if it would be accepted,
+// with header "Upload-Key" of the file that would be written.
+// The size can be declared in header "Upload-Length" instead of "Content-Length", to not send a body.
+//
+// Clients use this to pre-flight large transfers.
+func (h *Handler) serveValidation(w http.ResponseWriter, r *http.Request, isEnveloped bool) (int, error) {
+	var declaredSize int64
+	for _, name := range []string{"Upload-Length", "Content-Length"} {
+		if v := r.Header.Get(name); v != "" {
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || size < 0 {
+				return http.StatusBadRequest, errLengthInvalid
+			}
+			declaredSize = size
+			break
+		}
+	}
+
+	if isEnveloped { // Names of the files are in the body.
+		if h.MaxTransactionSize > 0 && declaredSize > h.MaxTransactionSize {
+			return http.StatusRequestEntityTooLarge, errTransactionTooLarge
+		}
+		return http.StatusNoContent, nil
+	}
+
+	urlPath, err := h.uploadPath(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(urlPath) < 2 {
+		return http.StatusBadRequest, errNoDestination
+	}
+	if urlPath, _, err = h.withLanguage(urlPath, r.Header.Get("Content-Language")); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if strings.HasSuffix(urlPath, "/") && (!h.EnableWebdav || declaredSize > 0) {
+		return http.StatusConflict, errUploadToDirectory
+	}
+	key, err := h.translateToKey(urlPath)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	switch {
+	case h.MaxFilesize > 0 && declaredSize > h.MaxFilesize:
+		return http.StatusRequestEntityTooLarge, errFileTooLarge
+	case h.isTooSmall(declaredSize):
+		return http.StatusUnprocessableEntity, errFileTooSmall
+	case !matchesContentType(h.ContentTypes, r.Header.Get("Content-Type")):
+		return http.StatusUnsupportedMediaType, errContentTypeRejected
+	case h.MaxTransactionSize > 0 && declaredSize > h.MaxTransactionSize:
+		return http.StatusRequestEntityTooLarge, errTransactionTooLarge
+	}
+	if h.Locker != nil && h.RejectConcurrentWrites {
+		unlock, retval, err := h.lockKey(r.Context(), key)
+		if err != nil {
+			return retval, err
+		}
+		unlock()
+	}
+
+	// With a randomized suffix, the actual upload will get a different one.
+	key, err = h.applyRandomizedSuffix(key)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Upload-Key", key)
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,53 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidateOnly(t *testing.T) {
+	Convey("Uploads that are to be validated only", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.MaxFilesize = 10
+		validate := func(method, path string, header ...string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("X-Validate-Only", "1")
+			for i := 0; i+1 < len(header); i += 2 {
+				req.Header.Set(header[i], header[i+1])
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("get 204 and the key if they would be accepted, but are not written", func() {
+			tempFName := tempFileName()
+			w := validate("PUT", "/"+tempFName, "Upload-Length", "5")
+			So(w.Code, ShouldEqual, 204)
+			So(w.Result().Header.Get("Upload-Key"), ShouldEqual, tempFName)
+			_, err := os.Stat(filepath.Join(scratchDir, tempFName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("get the status the upload would get otherwise", func() {
+			So(validate("PUT", "/"+tempFileName(), "Upload-Length", "11").Code, ShouldEqual, 413)
+			So(validate("PUT", "/"+tempFileName(), "Upload-Length", "x").Code, ShouldEqual, 400)
+			So(validate("PUT", "/../"+tempFileName()).Code, ShouldEqual, 422)
+			So(validate("POST", "/", "Content-Type", "application/json").Code, ShouldEqual, 415)
+		})
+
+		Convey("in envelopes are checked against max_transaction_size", func() {
+			h.MaxTransactionSize = 20
+			ctype := "multipart/form-data; boundary=wall"
+			So(validate("POST", "/", "Content-Type", ctype, "Upload-Length", "20").Code, ShouldEqual, 204)
+			So(validate("POST", "/", "Content-Type", ctype, "Upload-Length", "21").Code, ShouldEqual, 413)
+		})
+	})
+}
@@ -0,0 +1,153 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// versionsPrefix is where in the Bucket previous versions of files are kept,
+// as "<versionsPrefix><key>/<version>" with the version being when it's been replaced, in nanoseconds.
+const versionsPrefix = ".upload-versions/"
+
+type versionInfo struct {
+	id       int64
+	size     int64
+	replaced time.Time
+}
+
+func versionKey(key string, id int64) string {
+	return versionsPrefix + key + "/" + strconv.FormatInt(id, 10)
+}
+
+// keepVersion copies the file, if there is any, to its versions,
+// and removes the oldest beyond KeepVersions. Call it right before the file gets replaced.
+func (h *Handler) keepVersion(ctx context.Context, key string) error {
+	if h.KeepVersions <= 0 {
+		return nil
+	}
+	if err := h.copyToVersions(ctx, key); err != nil {
+		return err
+	}
+	return h.pruneVersions(ctx, key)
+}
+
+func (h *Handler) copyToVersions(ctx context.Context, key string) error {
+	err := h.Bucket.Copy(ctx, versionKey(key, time.Now().UnixNano()), key, nil)
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return errors.Wrap(err, "Keeping the previous version failed")
+	}
+	return nil
+}
+
+// pruneVersions removes the oldest versions beyond KeepVersions.
+func (h *Handler) pruneVersions(ctx context.Context, key string) error {
+	versions, err := h.listVersions(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(versions) > h.KeepVersions {
+		for _, v := range versions[h.KeepVersions:] {
+			h.Bucket.Delete(ctx, versionKey(key, v.id))
+		}
+	}
+	return nil
+}
+
+// listVersions returns the versions of a file, the most recent first.
+func (h *Handler) listVersions(ctx context.Context, key string) ([]versionInfo, error) {
+	prefix := versionsPrefix + key + "/"
+	var versions []versionInfo
+	iter := h.Bucket.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.ParseInt(obj.Key[len(prefix):], 10, 64)
+		if err != nil || obj.IsDir {
+			continue
+		}
+		versions = append(versions, versionInfo{id: id, size: obj.Size, replaced: time.Unix(0, id)})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].id > versions[j].id })
+	return versions, nil
+}
+
+// isVersionsRequest is true for GET with query "versions", and POST with "restore".
+func (h *Handler) isVersionsRequest(r *http.Request) bool {
+	if h.KeepVersions <= 0 {
+		return false
+	}
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		_, ok := query["versions"]
+		return ok
+	case http.MethodPost:
+		_, ok := query["restore"]
+		return ok
+	}
+	return false
+}
+
+// serveVersions lists previous versions of a file, one per line: "<version> <size> <when replaced>",
+// or on POST with query "restore=<version>" replaces the file with that version.
+// The file that gets replaced thereby becomes a version itself.
+func (h *Handler) serveVersions(w http.ResponseWriter, r *http.Request) (int, error) {
+	key, err := h.translateToKey(r.URL.Path)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+
+	if r.Method == http.MethodGet {
+		versions, err := h.listVersions(r.Context(), key)
+		if err != nil {
+			return http.StatusInternalServerError, errors.Wrap(err, "Listing versions failed")
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		for _, v := range versions {
+			io.WriteString(w, strconv.FormatInt(v.id, 10)+" "+strconv.FormatInt(v.size, 10)+" "+
+				v.replaced.UTC().Format(time.RFC3339)+"\n")
+		}
+		return statusSent, nil
+	}
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("restore"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+	unlock, retval, err := h.lockKey(r.Context(), key)
+	if err != nil {
+		return retval, err
+	}
+	defer unlock()
+	if exists, err := h.Bucket.Exists(r.Context(), versionKey(key, id)); err != nil || !exists {
+		return http.StatusNotFound, err
+	}
+	// Pruning comes last, because it could remove the version that's being restored.
+	if err := h.copyToVersions(r.Context(), key); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := h.Bucket.Copy(r.Context(), key, versionKey(key, id), nil); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "Restoring the version failed")
+	}
+	h.Bucket.Delete(r.Context(), versionKey(key, id))
+	h.pruneVersions(r.Context(), key)
+	h.updateChecksums(r.Context(), key)
+	return http.StatusCreated, nil
+}
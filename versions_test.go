@@ -0,0 +1,62 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVersions(t *testing.T) {
+	Convey("Files that get replaced", t, func() {
+		h, _ := NewHandler("/", scratchDir, next)
+		h.KeepVersions = 2
+		tempFName := tempFileName()
+		defer os.Remove(filepath.Join(scratchDir, tempFName))
+		defer os.RemoveAll(filepath.Join(scratchDir, versionsPrefix, tempFName))
+
+		do := func(method, path, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+		listVersions := func() []string {
+			w := do("GET", "/"+tempFName+"?versions", "")
+			So(w.Code, ShouldEqual, 200)
+			return strings.Fields(w.Body.String())
+		}
+		for _, contents := range []string{"one", "two", "three", "four"} {
+			So(do("PUT", "/"+tempFName, contents).Code, ShouldEqual, 201)
+		}
+
+		Convey("are kept up to the configured number of versions", func() {
+			fields := listVersions()
+			So(fields, ShouldHaveLength, 2*3)
+			So(fields[1], ShouldEqual, "5") // Size of "three", the most recent version.
+			So(fields[4], ShouldEqual, "3") // "two"
+		})
+
+		Convey("can be restored, which keeps what gets replaced", func() {
+			fields := listVersions()
+			So(do("POST", "/"+tempFName+"?restore="+fields[3], "").Code, ShouldEqual, 201)
+			compareContents(filepath.Join(scratchDir, tempFName), []byte("two"))
+
+			fields = listVersions()
+			So(fields, ShouldHaveLength, 2*3)
+			So(fields[1], ShouldEqual, "4") // "four"
+			So(fields[4], ShouldEqual, "5") // "three"
+		})
+
+		Convey("are not restored from versions that don't exist", func() {
+			So(do("POST", "/"+tempFName+"?restore=1", "").Code, ShouldEqual, 404)
+			So(do("POST", "/"+tempFName+"?restore=x", "").Code, ShouldEqual, 400)
+		})
+	})
+}